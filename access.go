@@ -0,0 +1,170 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// accessRule restricts the files matching glob to who: user names, groups
+// as "@<group>" or "public" for everyone.
+type accessRule struct {
+	glob string
+	who  []string
+}
+
+// accessRules are the per-directory access rules loaded with -access. The
+// first rule matching a file applies; the files not matching any rule are
+// allowed to everyone, like without -access.
+type accessRules struct {
+	groups map[string][]string
+	rules  []accessRule
+}
+
+// loadAccessRules reads the rules file at p. Each line is either a group
+// definition "@<group> = <user>..." or a rule "<glob> <who>...", e.g.:
+//
+//	@family = alice bob
+//	private alice
+//	kids public
+//	* @family
+//
+// The glob matches the file names and their directories, so "private"
+// matches all the files under private/. The users must be -user entries.
+func loadAccessRules(p string, u users) (*accessRules, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &accessRules{groups: map[string][]string{}}
+	sc := bufio.NewScanner(f)
+	for i := 1; sc.Scan(); i++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if g, ok := strings.CutPrefix(fields[0], "@"); ok {
+			if g == "" || len(fields) < 3 || fields[1] != "=" {
+				return nil, fmt.Errorf("%s:%d: a group must be in the form @<group> = <user>...", p, i)
+			}
+			if _, ok = a.groups[g]; ok {
+				return nil, fmt.Errorf("%s:%d: group @%s is defined twice", p, i, g)
+			}
+			for _, n := range fields[2:] {
+				if _, ok = u[n]; !ok {
+					return nil, fmt.Errorf("%s:%d: %q is not a -user", p, i, n)
+				}
+			}
+			a.groups[g] = fields[2:]
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: a rule must be in the form <glob> <who>...", p, i)
+		}
+		if _, err = path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", p, i, err)
+		}
+		for _, n := range fields[1:] {
+			if g, ok := strings.CutPrefix(n, "@"); ok {
+				if _, ok = a.groups[g]; !ok {
+					return nil, fmt.Errorf("%s:%d: group %s must be defined before its use", p, i, n)
+				}
+			} else if _, ok = u[n]; !ok && n != "public" {
+				return nil, fmt.Errorf("%s:%d: %q is not a -user", p, i, n)
+			}
+		}
+		a.rules = append(a.rules, accessRule{glob: strings.Trim(fields[0], "/"), who: fields[1:]})
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// allowed returns true if the user can see the file name. user is "" for
+// the anonymous accesses, only allowed by "public".
+func (a *accessRules) allowed(user, name string) bool {
+	if a == nil {
+		return true
+	}
+	for _, r := range a.rules {
+		if !r.match(name) {
+			continue
+		}
+		for _, n := range r.who {
+			if n == "public" || (user != "" && n == user) {
+				return true
+			}
+			if g, ok := strings.CutPrefix(n, "@"); ok && user != "" && slices.Contains(a.groups[g], user) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// match returns true if the glob matches the file name or one of its
+// directories.
+func (r *accessRule) match(name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(r.glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the names the user can see.
+func (a *accessRules) filter(user string, names []string) []string {
+	if a == nil {
+		return names
+	}
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if a.allowed(user, n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// visibleFiles returns the local files the user of the request can see.
+func (s *server) visibleFiles(req *http.Request) []file {
+	files := s.getFiles()
+	if s.opts.access == nil {
+		return files
+	}
+	user := userFrom(req)
+	return slices.DeleteFunc(files, func(f file) bool { return !s.opts.access.allowed(user, f.Name) })
+}
+
+// visibleKeys returns the entries of m keyed by a file name that the user can
+// see.
+func visibleKeys[V any](a *accessRules, user string, m map[string]V) map[string]V {
+	if a == nil {
+		return m
+	}
+	out := make(map[string]V, len(m))
+	for n, v := range m {
+		if a.allowed(user, n) {
+			out[n] = v
+		}
+	}
+	return out
+}
+
+// canAccess returns true if the user of the request can see the file name.
+func (s *server) canAccess(req *http.Request, name string) bool {
+	return s.opts.access.allowed(userFrom(req), name)
+}
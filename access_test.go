@@ -0,0 +1,74 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAccessRules(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob", "carol"}, "# Rules\n@family = alice bob\nprivate alice\nkids public\nfamily/* @family\n")
+	files := map[string]string{}
+	for _, name := range []string{"private/a.mp4", "kids/k.mp4", "family/f.mp4", "other.mp4"} {
+		files[name] = testMP4
+	}
+	_, ts := newTestServer(t, files, options{users: u, access: a})
+	for user, want := range map[string][]string{
+		"alice": {"family/f.mp4", "kids/k.mp4", "other.mp4", "private/a.mp4"},
+		"bob":   {"family/f.mp4", "kids/k.mp4", "other.mp4"},
+		"carol": {"kids/k.mp4", "other.mp4"},
+	} {
+		var got struct {
+			Files []fileInfo `json:"files"`
+		}
+		if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/files", user, "")), &got); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range got.Files {
+			names = append(names, f.Name)
+		}
+		if !slices.Equal(names, want) {
+			t.Fatalf("%s: got %q, want %q", user, names, want)
+		}
+		allowed := slices.Contains(want, "private/a.mp4")
+		status := http.StatusOK
+		if !allowed {
+			status = http.StatusNotFound
+		}
+		for _, p := range []string{"/raw/", "/api/checksum/", "/api/notes/", "/api/tags/", "/api/bookmarks/"} {
+			if got, _ := testGet(t, ts.URL+p+"private/a.mp4", user); got != status {
+				t.Fatalf("%s: %s: got status %d, want %d", user, p, got, status)
+			}
+		}
+		for _, p := range []string{"/api/timeline", "/api/stats", "/list", "/timeline"} {
+			if got := strings.Contains(testPage(t, ts.URL+p, user, ""), `"private`); got != allowed {
+				t.Fatalf("%s: %s: private listed: %t", user, p, got)
+			}
+		}
+	}
+}
+
+func TestLoadAccessRules(t *testing.T) {
+	u, err := parseUsers([]string{"alice:secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rules := range []string{"private bob\n", "private @family\n", "@family = bob\n", "private\n"} {
+		p := filepath.Join(t.TempDir(), "access.txt")
+		if err = os.WriteFile(p, []byte(rules), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadAccessRules(p, u); err == nil {
+			t.Errorf("%q: expected an error", rules)
+		}
+	}
+}
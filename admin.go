@@ -0,0 +1,224 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// activeStream is a file being sent.
+type activeStream struct {
+	File    string    `json:"file"`
+	Addr    string    `json:"addr"`
+	User    string    `json:"user,omitempty"`
+	Range   string    `json:"range,omitempty"`
+	Started time.Time `json:"started"`
+
+	// conn is the connection of the request, if known.
+	conn net.Conn
+}
+
+// streams are the files being sent.
+type streams struct {
+	mu     sync.Mutex
+	next   int
+	active map[int]*activeStream
+}
+
+// start records a stream as active until the returned function is called.
+func (st *streams) start(req *http.Request, name string) func() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.active == nil {
+		st.active = map[int]*activeStream{}
+	}
+	id := st.next
+	st.next++
+	c, _ := req.Context().Value(connKey{}).(net.Conn)
+	st.active[id] = &activeStream{File: name, Addr: clientAddr(req), User: userFrom(req), Range: req.Header.Get("Range"), Started: time.Now().UTC(), conn: c}
+	return func() {
+		st.mu.Lock()
+		delete(st.active, id)
+		st.mu.Unlock()
+	}
+}
+
+// list returns the active streams, oldest first.
+func (st *streams) list() []activeStream {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]activeStream, 0, len(st.active))
+	for _, a := range st.active {
+		out = append(out, *a)
+	}
+	slices.SortFunc(out, func(a, b activeStream) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// cut closes the connections of the streams, returning how many were cut.
+func (st *streams) cut() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := 0
+	for _, a := range st.active {
+		if a.conn != nil {
+			_ = a.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// watcherHealth is the state of the file system watcher.
+type watcherHealth struct {
+	// Scanned is when root was last scanned and Scan how long it took in
+	// seconds.
+	Scanned   time.Time `json:"scanned"`
+	Scan      float64   `json:"scan"`
+	Events    int       `json:"events"`
+	LastEvent time.Time `json:"last_event"`
+	// Error is the last error, cleared by a successful scan.
+	Error string `json:"error,omitempty"`
+}
+
+func (wh *watcherHealth) scanned(start time.Time) {
+	wh.Scanned = time.Now().UTC()
+	wh.Scan = time.Since(start).Seconds()
+	wh.Error = ""
+}
+
+// serverStatus describes the process.
+type serverStatus struct {
+	Version    string    `json:"version"`
+	Go         string    `json:"go"`
+	Started    time.Time `json:"started"`
+	Goroutines int       `json:"goroutines"`
+	// Memory is the bytes obtained from the OS.
+	Memory   uint64 `json:"memory"`
+	Root     string `json:"root"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+	FFmpeg   bool   `json:"ffmpeg"`
+	Sessions int    `json:"sessions"`
+}
+
+// adminStatus is what /admin shows.
+type adminStatus struct {
+	Server  serverStatus   `json:"server"`
+	Streams []activeStream `json:"streams"`
+	// Jobs are the ffmpeg and ffprobe processes running and Queued the
+	// background jobs waiting to run; Probing is true while the durations are
+	// probed in the background.
+	Jobs       []mediaJob    `json:"jobs"`
+	Queued     []job         `json:"queued"`
+	Probing    bool          `json:"probing"`
+	Duplicates bool          `json:"duplicates"`
+	Watcher    watcherHealth `json:"watcher"`
+	// Retention is set when -min-free is used.
+	Retention *retentionState `json:"retention,omitempty"`
+	Cache     cacheState      `json:"cache"`
+	// Shares are the share links not expired, of all the users.
+	Shares []share `json:"shares"`
+}
+
+func (s *server) adminStatus() adminStatus {
+	st := adminStatus{
+		Server: serverStatus{
+			Version:    "devel",
+			Go:         runtime.Version(),
+			Started:    s.started,
+			Goroutines: runtime.NumGoroutine(),
+			Root:       s.root,
+			FFmpeg:     s.media.ffmpeg != "",
+			Sessions:   len(s.sessions.list()),
+		},
+		Streams: s.streams.list(),
+		Shares:  s.shares.list(),
+		Cache:   s.media.cacheStatus(),
+	}
+	ev := s.jobEvents("")
+	st.Jobs, st.Queued = ev.Running, ev.Queued
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		st.Server.Version = bi.Main.Version
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st.Server.Memory = ms.Sys
+	s.mu.Lock()
+	st.Server.Files = len(s.files)
+	for i := range s.files {
+		st.Server.Size += s.files[i].Size
+	}
+	st.Watcher = s.watcher
+	s.mu.Unlock()
+	s.media.mu.Lock()
+	st.Probing = s.media.probing
+	s.media.mu.Unlock()
+	s.dupes.mu.Lock()
+	st.Duplicates = s.dupes.running
+	s.dupes.mu.Unlock()
+	if s.retention != nil {
+		r := s.retention.status()
+		st.Retention = &r
+	}
+	return st
+}
+
+// isAdmin returns true for the users listed with -admin or, when -user is not
+// used, the clients on the same host.
+func (s *server) isAdmin(req *http.Request) bool {
+	if len(s.opts.users) == 0 {
+		ip := net.ParseIP(clientAddr(req))
+		return ip != nil && ip.IsLoopback()
+	}
+	return slices.Contains(s.opts.admins, userFrom(req))
+}
+
+// adminHandler only allows the admins.
+func (s *server) adminHandler(h http.HandlerFunc) http.Handler {
+	return s.roleHandler(roleAdmin, h)
+}
+
+func (s *server) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, adminHTML, map[string]any{"status": s.adminStatus()})
+}
+
+func (s *server) serveAdminAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.adminStatus())
+}
+
+// requestRescan scans root again in the background, like when a file
+// changes.
+func (s *server) requestRescan() {
+	select {
+	case s.rescan <- struct{}{}:
+	default:
+		// A rescan is already pending.
+	}
+}
+
+func (s *server) serveAdminRescan(w http.ResponseWriter, req *http.Request) {
+	s.requestRescan()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveAdminPurge discards the cached probes, metadata and hashes so they
+// are computed again.
+func (s *server) serveAdminPurge(w http.ResponseWriter, req *http.Request) {
+	probes := s.media.purge()
+	hashes := s.hashes.purge()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"probes": probes, "hashes": hashes})
+}
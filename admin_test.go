@@ -0,0 +1,35 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	// Without -user, localhost is an admin.
+	testPage(t, ts.URL+"/admin", "", `"watcher":{"scanned":`)
+	testPage(t, ts.URL+"/api/admin", "", `"watcher":{"scanned":`)
+	testPost(t, ts.URL+"/api/admin/rescan", "", http.StatusAccepted)
+	resp, b := testDo(t, "POST", ts.URL+"/api/admin/purge", "", "", nil)
+	if resp.StatusCode != http.StatusOK || b != "{\"hashes\":0,\"probes\":0}\n" {
+		t.Fatalf("got status %d: %q", resp.StatusCode, b)
+	}
+}
+
+// TestAdminUsers checks that only the -admin users can use the admin API.
+func TestAdminUsers(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice", "bob"}, "")
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{users: u, admins: []string{"alice"}})
+	testPage(t, ts.URL+"/api/admin", "alice", `"watcher":{"scanned":`)
+	testPost(t, ts.URL+"/api/admin/rescan", "alice", http.StatusAccepted)
+	if status, _ := testGet(t, ts.URL+"/api/admin", "bob"); status != http.StatusForbidden {
+		t.Fatalf("got status %d", status)
+	}
+	testPost(t, ts.URL+"/api/admin/rescan", "bob", http.StatusForbidden)
+	testPost(t, ts.URL+"/api/admin/purge", "bob", http.StatusForbidden)
+}
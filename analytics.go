@@ -0,0 +1,200 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents is the number of access events kept in memory.
+const maxRecentEvents = 10000
+
+// accessEvent is a file served or played.
+type accessEvent struct {
+	Time time.Time `json:"time"`
+	// Event is "download" for a whole file, "stream" for a range of it, like
+	// players request, and "play" when the player reached the end.
+	Event  string `json:"event"`
+	File   string `json:"file"`
+	Addr   string `json:"addr"`
+	User   string `json:"user,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	// Duration is the time to serve the response, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// analytics records the access events. They are appended to p when not
+// empty, kept in memory otherwise, and sent to pushURL when not empty.
+type analytics struct {
+	p       string
+	pushURL string
+
+	mu      sync.Mutex
+	f       *os.File
+	recent  []accessEvent
+	pending []accessEvent
+}
+
+func newAnalytics(p, pushURL string) (*analytics, error) {
+	a := &analytics{p: p, pushURL: pushURL}
+	if p != "" {
+		var err error
+		if a.f, err = os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// clientAddr returns the IP address of the client.
+func clientAddr(req *http.Request) string {
+	if h, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return h
+	}
+	return req.RemoteAddr
+}
+
+// record adds an event about the file name.
+func (a *analytics) record(req *http.Request, event, name string, status int, n int64, d time.Duration) {
+	e := accessEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		File:     name,
+		Addr:     clientAddr(req),
+		User:     userFrom(req),
+		Status:   status,
+		Bytes:    n,
+		Duration: d.Seconds(),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		b, _ := json.Marshal(&e)
+		if _, err := a.f.Write(append(b, '\n')); err != nil {
+			slog.Error("analytics", "error", err)
+		}
+	} else {
+		if len(a.recent) == maxRecentEvents {
+			a.recent = a.recent[1:]
+		}
+		a.recent = append(a.recent, e)
+	}
+	if a.pushURL != "" && len(a.pending) < maxRecentEvents {
+		a.pending = append(a.pending, e)
+	}
+}
+
+// events calls fn with the events since the time, oldest first.
+func (a *analytics) events(since time.Time, fn func(e *accessEvent) error) error {
+	if a.p == "" {
+		a.mu.Lock()
+		recent := append([]accessEvent(nil), a.recent...)
+		a.mu.Unlock()
+		for i := range recent {
+			if !recent[i].Time.Before(since) {
+				if err := fn(&recent[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	f, err := os.Open(a.p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e accessEvent
+		if json.Unmarshal(sc.Bytes(), &e) != nil || e.Time.Before(since) {
+			continue
+		}
+		if err = fn(&e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// runPush sends the new events to pushURL as JSON lines every 10 seconds until
+// ctx is canceled.
+func (a *analytics) runPush(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+		a.mu.Lock()
+		batch := a.pending
+		a.pending = nil
+		a.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i := range batch {
+			_ = enc.Encode(&batch[i])
+		}
+		if err := postWithRetry(ctx, a.pushURL, http.Header{"Content-Type": {"application/x-ndjson"}}, buf.Bytes()); err != nil {
+			slog.Error("analytics", "url", a.pushURL, "events", len(batch), "error", err)
+		}
+	}
+}
+
+// serveAnalytics exports the events as JSON lines, or as CSV with
+// ?format=csv. ?since=<RFC 3339 time> skips the older events.
+func (s *server) serveAnalytics(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	var err error
+	switch q.Get("format") {
+	case "", "jsonl":
+		h.Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		err = s.analytics.events(since, func(e *accessEvent) error { return enc.Encode(e) })
+	case "csv":
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+		h.Set("Content-Disposition", `attachment; filename="analytics.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"time", "event", "file", "addr", "user", "status", "bytes", "duration"})
+		err = s.analytics.events(since, func(e *accessEvent) error {
+			return cw.Write([]string{
+				e.Time.Format(time.RFC3339Nano), e.Event, e.File, e.Addr, e.User, strconv.Itoa(e.Status),
+				strconv.FormatInt(e.Bytes, 10), strconv.FormatFloat(e.Duration, 'f', 3, 64),
+			})
+		})
+		cw.Flush()
+	default:
+		http.Error(w, "format must be jsonl or csv", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("analytics", "error", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAnalytics(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice"}, "")
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{users: u, admins: []string{"alice"}})
+	testPost(t, ts.URL+"/api/views/clip.mp4", "alice", http.StatusNoContent)
+	if status, _ := testGet(t, ts.URL+rawURL("clip.mp4"), "alice"); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if resp, _ := testDo(t, "GET", ts.URL+rawURL("clip.mp4"), "alice", "", http.Header{"Range": {"bytes=0-3"}}); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/analytics", "alice", `"event":"play","file":"clip.mp4","addr":"127.0.0.1","user":"alice",`)
+	testPage(t, ts.URL+"/api/analytics", "alice", `"event":"stream","file":"clip.mp4","addr":"127.0.0.1","user":"alice","status":206,"bytes":4,`)
+	testPage(t, ts.URL+"/api/analytics?format=csv", "alice", ",download,clip.mp4,127.0.0.1,alice,200,24,")
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if status, b := testGet(t, ts.URL+"/api/analytics?since="+future, "alice"); status != http.StatusOK || b != "" {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+	for _, q := range []string{"since=yesterday", "format=xml"} {
+		if status, _ := testGet(t, ts.URL+"/api/analytics?"+q, "alice"); status != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d", q, status)
+		}
+	}
+}
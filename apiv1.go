@@ -0,0 +1,419 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The /api/v1/ routes are the stable API for third party applications. Unlike
+// the other /api/ routes, used by the pages and free to change, their
+// responses only gain fields.
+//
+// A response is {"data": ...}, with "next_cursor" for the lists that have
+// more items, or {"error": {"status": ..., "message": ...}}. The lists accept
+// ?limit=<n> (default 100, at most 1000) and ?cursor=<next_cursor>. All
+// accept ?fields=<a,b> to only return these fields of the items.
+
+const (
+	defaultAPILimit = 100
+	maxAPILimit     = 1000
+)
+
+// apiV1Routes registers the /api/v1/ routes.
+func (s *server) apiV1Routes(m *http.ServeMux) {
+	m.HandleFunc("GET /api/v1/files", s.serveV1Files)
+	m.HandleFunc("GET /api/v1/files/{path...}", s.serveV1File)
+	m.HandleFunc("GET /api/v1/search", s.serveV1Files)
+	m.Handle("GET /api/v1/events", s.roleHandler(roleAdmin, s.serveV1Events))
+	m.HandleFunc("GET /api/v1/progress", s.serveV1Progress)
+	m.HandleFunc("PUT /api/v1/progress/{path...}", s.serveV1ProgressUpdate)
+	m.HandleFunc("DELETE /api/v1/progress/{path...}", s.serveV1ProgressUpdate)
+	m.HandleFunc("GET /api/v1/shares", s.serveV1Shares)
+	m.HandleFunc("POST /api/v1/shares", s.serveV1ShareCreate)
+	m.HandleFunc("DELETE /api/v1/shares/{id}", s.serveV1ShareRevoke)
+	m.HandleFunc("GET /api/v1/", func(w http.ResponseWriter, req *http.Request) {
+		v1Error(w, http.StatusNotFound, "unknown route")
+	})
+}
+
+// v1Error writes an error envelope.
+func v1Error(w http.ResponseWriter, status int, msg string) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"status": status, "message": msg}})
+}
+
+// v1Write writes the data envelope, keeping the fields of ?fields= only.
+func v1Write(w http.ResponseWriter, req *http.Request, status int, data any, next string) {
+	if f := req.URL.Query().Get("fields"); f != "" {
+		var err error
+		if data, err = v1Fields(data, strings.Split(f, ",")); err != nil {
+			v1Error(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	env := map[string]any{"data": data}
+	if next != "" {
+		env["next_cursor"] = next
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(env)
+}
+
+// v1Fields returns data, an object or a list of objects, with only the
+// fields listed.
+func v1Fields(data any, fields []string) (any, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	pick := func(o map[string]json.RawMessage) map[string]json.RawMessage {
+		out := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := o[strings.TrimSpace(f)]; ok {
+				out[strings.TrimSpace(f)] = v
+			}
+		}
+		return out
+	}
+	if len(b) != 0 && b[0] == '[' {
+		var l []map[string]json.RawMessage
+		if err = json.Unmarshal(b, &l); err != nil {
+			return nil, err
+		}
+		for i := range l {
+			l[i] = pick(l[i])
+		}
+		return l, nil
+	}
+	var o map[string]json.RawMessage
+	if err = json.Unmarshal(b, &o); err != nil {
+		return nil, err
+	}
+	return pick(o), nil
+}
+
+// v1Page returns the page of items after the cursor, and the cursor of the
+// next page if any. The items must be sorted by key.
+func v1Page[T any](req *http.Request, items []T, key func(*T) string) ([]T, string, error) {
+	limit, after, err := v1PageArgs(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if after != "" {
+		i, _ := slices.BinarySearchFunc(items, after, func(it T, k string) int { return strings.Compare(key(&it), k) })
+		for i < len(items) && key(&items[i]) == after {
+			i++
+		}
+		items = items[i:]
+	}
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+	return items, base64.RawURLEncoding.EncodeToString([]byte(key(&items[limit-1]))), nil
+}
+
+// v1PageArgs returns the ?limit= and the key after which the page starts,
+// decoded from ?cursor=.
+func v1PageArgs(req *http.Request) (int, string, error) {
+	q := req.URL.Query()
+	limit := defaultAPILimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAPILimit {
+			return 0, "", fmt.Errorf("limit must be between 1 and %d", maxAPILimit)
+		}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q.Get("cursor"))
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	return limit, string(b), nil
+}
+
+// v1File is a file as returned by /api/v1/.
+type v1File struct {
+	fileInfo
+	Title string `json:"title,omitempty"`
+	// Duration is in seconds, 0 until the file is probed.
+	Duration float64 `json:"duration,omitempty"`
+	// FrameRate is in frames per second, 0 until the file is probed.
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	// Chapters are known once the file is probed.
+	Chapters  []chapter `json:"chapters,omitempty"`
+	URL       string    `json:"url"`
+	Thumbnail string    `json:"thumbnail,omitempty"`
+	// Loudness is known once measured by a "loudness" job.
+	Loudness *loudness `json:"loudness,omitempty"`
+}
+
+func (s *server) v1File(fi fileInfo, titles map[string]string) v1File {
+	f := file{Name: fi.Name, Size: fi.Size, ModTime: fi.ModTime}
+	out := v1File{fileInfo: fi, Title: titles[fi.Name], URL: rawURL(fi.Name)}
+	if p := s.media.cachedProbe(f); p != nil {
+		out.Duration = p.Duration().Seconds()
+		out.FrameRate = p.FrameRate()
+		out.Chapters = p.chapters()
+	}
+	if t := mimeType(fi.Name); strings.HasPrefix(t, "video/") && t != "video/mp2t" {
+		out.Thumbnail = s.media.thumbURL(f)
+	}
+	out.Loudness = s.media.loudness.get(f)
+	return out
+}
+
+// serveV1Files lists the files sorted by name, filtered like /api/files with
+// ?dir=, ?q=, ?tag= and ?min_rating=. /api/v1/search requires ?q=.
+func (s *server) serveV1Files(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	ff := fileFilter{dir: q.Get("dir"), query: q.Get("q"), tags: q["tag"]}
+	if strings.HasSuffix(req.URL.Path, "/search") && strings.TrimSpace(ff.query) == "" {
+		v1Error(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	if v := q.Get("min_rating"); v != "" {
+		var err error
+		if ff.minRating, err = strconv.Atoi(v); err != nil {
+			v1Error(w, http.StatusBadRequest, "invalid min_rating")
+			return
+		}
+	}
+	page, next, err := v1Page(req, s.findFiles(userFrom(req), ff), func(fi *fileInfo) string { return fi.Name })
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	titles := s.titles()
+	out := make([]v1File, 0, len(page))
+	for _, fi := range page {
+		out = append(out, s.v1File(fi, titles))
+	}
+	v1Write(w, req, http.StatusOK, out, next)
+}
+
+func (s *server) serveV1File(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) {
+		v1Error(w, http.StatusNotFound, "file not found")
+		return
+	}
+	// Probe the file if needed, for its duration and streams.
+	var streams []mediaStream
+	if hasDuration(f.Name) && s.media.ffprobe != "" {
+		if p, err := s.media.probe(req.Context(), s.root, f); err == nil {
+			streams = p.mediaStreams()
+		}
+	}
+	fi := fileInfo{Name: f.Name, Size: f.Size, ModTime: f.ModTime, Tags: s.tags.get(f.Name), Rating: s.profiles.get(userFrom(req)).Ratings[f.Name], Streams: streams, viewCount: s.views.all()[f.Name]}
+	v1Write(w, req, http.StatusOK, s.v1File(fi, s.titles()), "")
+}
+
+// errPageFull stops reading the events once the page is complete.
+var errPageFull = errors.New("page full")
+
+// serveV1Events lists the access events, oldest first, to the admins.
+// ?since=<RFC 3339 time> skips the older events.
+func (s *server) serveV1Events(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if v := req.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			v1Error(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+	}
+	limit, after, err := v1PageArgs(req)
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// The events are read in order and the key sorts like the times, so only
+	// the page is kept in memory.
+	key := func(e *accessEvent) string { return fmt.Sprintf("%020d", e.Time.UnixNano()) }
+	page := []accessEvent{}
+	next := ""
+	err = s.analytics.events(since, func(e *accessEvent) error {
+		if after != "" && key(e) <= after {
+			return nil
+		}
+		if len(page) == limit {
+			next = base64.RawURLEncoding.EncodeToString([]byte(key(&page[limit-1])))
+			return errPageFull
+		}
+		page = append(page, *e)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		v1Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	v1Write(w, req, http.StatusOK, page, next)
+}
+
+// v1Progress is the playback state of a file for the user.
+type v1Progress struct {
+	File string `json:"file"`
+	// Position is the resume position in seconds.
+	Position float64 `json:"position"`
+	Watched  bool    `json:"watched"`
+}
+
+// serveV1Progress lists the files the user started or watched, sorted by
+// name.
+func (s *server) serveV1Progress(w http.ResponseWriter, req *http.Request) {
+	pr := s.profiles.get(userFrom(req))
+	var all []v1Progress
+	for f, t := range pr.Positions {
+		all = append(all, v1Progress{File: f, Position: t, Watched: pr.Watched[f]})
+	}
+	for f := range pr.Watched {
+		if _, ok := pr.Positions[f]; !ok {
+			all = append(all, v1Progress{File: f, Watched: true})
+		}
+	}
+	slices.SortFunc(all, func(a, b v1Progress) int { return strings.Compare(a.File, b.File) })
+	page, next, err := v1Page(req, all, func(p *v1Progress) string { return p.File })
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page == nil {
+		page = []v1Progress{}
+	}
+	v1Write(w, req, http.StatusOK, page, next)
+}
+
+// serveV1ProgressUpdate sets the progress of a file with a PUT of
+// {"position": <s>, "watched": <bool>}, or clears it with a DELETE.
+func (s *server) serveV1ProgressUpdate(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		v1Error(w, http.StatusNotFound, "file not found")
+		return
+	}
+	p := v1Progress{File: f}
+	if req.Method == http.MethodDelete {
+		s.profiles.update(userFrom(req), func(pr *profile) {
+			delete(pr.Positions, f)
+			delete(pr.Watched, f)
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&p); err != nil || p.Position < 0 {
+		v1Error(w, http.StatusBadRequest, "invalid progress")
+		return
+	}
+	p.File = f
+	s.profiles.update(userFrom(req), func(pr *profile) {
+		pr.Positions[f] = p.Position
+		if p.Watched {
+			pr.Watched[f] = true
+		} else {
+			delete(pr.Watched, f)
+		}
+	})
+	v1Write(w, req, http.StatusOK, p, "")
+}
+
+// v1Share is a share link as returned by /api/v1/.
+type v1Share struct {
+	share
+	URL string `json:"url"`
+	// Short is the same as URL: a short URL would be easy to guess. QR is the
+	// URL of its QR code.
+	Short string `json:"short"`
+	QR    string `json:"qr"`
+}
+
+func (s *server) v1Share(l share) v1Share {
+	u := shareURL(l.ID)
+	return v1Share{share: l, URL: u, Short: u, QR: qrURL(u)}
+}
+
+// serveV1Shares lists the user's share links, or all of them for the admins,
+// oldest first.
+func (s *server) serveV1Shares(w http.ResponseWriter, req *http.Request) {
+	user, admin := userFrom(req), s.isAdmin(req)
+	var all []v1Share
+	for _, l := range s.shares.list() {
+		if admin || l.User == user {
+			all = append(all, s.v1Share(l))
+		}
+	}
+	// The IDs are random so the key includes the creation time.
+	page, next, err := v1Page(req, all, func(l *v1Share) string { return fmt.Sprintf("%020d/%s", l.Created.UnixNano(), l.ID) })
+	if err != nil {
+		v1Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page == nil {
+		page = []v1Share{}
+	}
+	v1Write(w, req, http.StatusOK, page, next)
+}
+
+// serveV1ShareCreate creates a share link with a POST of
+// {"file": <name>, "ttl": <s>, "max_hits": <n>, "password": <password>}, or
+// {"clip": <id>, ...} to share a saved clip. The link never expires when ttl
+// is 0, else ttl is at most shareMaxTTL, and it can be downloaded any number of times when max_hits is 0; the
+// password is optional.
+func (s *server) serveV1ShareCreate(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		File     string  `json:"file"`
+		Clip     string  `json:"clip"`
+		TTL      float64 `json:"ttl"`
+		MaxHits  int     `json:"max_hits"`
+		Password string  `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&body); err != nil || body.TTL < 0 || body.TTL > shareMaxTTL.Seconds() || body.MaxHits < 0 {
+		v1Error(w, http.StatusBadRequest, "invalid share")
+		return
+	}
+	if body.Clip != "" {
+		c, ok := s.clips.get(body.Clip)
+		if !ok || (body.File != "" && body.File != c.File) {
+			v1Error(w, http.StatusNotFound, "clip not found")
+			return
+		}
+		body.File = c.File
+	}
+	if !s.hasFile(body.File) || !s.canAccess(req, body.File) {
+		v1Error(w, http.StatusNotFound, "file not found")
+		return
+	}
+	// Round up so a tiny ttl doesn't become 0, a link that never expires.
+	ttl := time.Duration(math.Ceil(body.TTL * float64(time.Second)))
+	l := s.shares.create(userFrom(req), body.File, body.Clip, ttl, body.MaxHits, body.Password)
+	v1Write(w, req, http.StatusCreated, s.v1Share(l), "")
+}
+
+// serveV1ShareRevoke deletes a share link of the user, or any for the admins.
+func (s *server) serveV1ShareRevoke(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	l, ok := s.shares.get(id)
+	if !ok || (l.User != userFrom(req) && !s.isAdmin(req)) {
+		v1Error(w, http.StatusNotFound, "share not found")
+		return
+	}
+	s.shares.revoke(id)
+	w.WriteHeader(http.StatusNoContent)
+}
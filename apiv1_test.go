@@ -0,0 +1,155 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestV1Files(t *testing.T) {
+	files := map[string]string{"movie/heat.mp4": testMP4}
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		files[n+".mp4"] = testMP4
+	}
+	_, ts := newTestServer(t, files, options{})
+	var names []string
+	for cursor := ""; ; {
+		var page struct {
+			Data []struct {
+				Name string `json:"name"`
+			} `json:"data"`
+			Next string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/v1/files?limit=3&fields=name&cursor="+url.QueryEscape(cursor), "", "")), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range page.Data {
+			names = append(names, f.Name)
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if want := []string{"a.mp4", "b.mp4", "c.mp4", "d.mp4", "e.mp4", "f.mp4", "g.mp4", "movie/heat.mp4"}; !slices.Equal(names, want) {
+		t.Fatalf("got %q, want %q", names, want)
+	}
+	testPage(t, ts.URL+"/api/v1/search?q=heat.mp4&fields=name,size", "", `{"data":[{"name":"movie/heat.mp4","size":24}]}`)
+	for _, p := range []string{"/api/v1/files?limit=0", "/api/v1/search"} {
+		if status, _ := testGet(t, ts.URL+p, ""); status != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d", p, status)
+		}
+	}
+	if status, _ := testGet(t, ts.URL+"/api/v1/bogus", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+func TestV1Progress(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	if resp, b := testDo(t, "PUT", ts.URL+"/api/v1/progress/clip.mp4", "", `{"position":12.5}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	testPage(t, ts.URL+"/api/v1/progress", "", `{"file":"clip.mp4","position":12.5,"watched":false}`)
+	if resp, _ := testDo(t, "DELETE", ts.URL+"/api/v1/progress/clip.mp4", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/v1/progress", "", `{"data":[]}`)
+}
+
+func TestV1Shares(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	resp, b := testDo(t, "POST", ts.URL+"/api/v1/shares", "", `{"file":"clip.mp4","ttl":60}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var created struct {
+		Data v1Share `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(b), &created); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{created.Data.URL, created.Data.Short} {
+		if status, got := testGet(t, ts.URL+p, ""); status != http.StatusOK || got != testMP4 {
+			t.Fatalf("%s: got status %d: %q", p, status, got)
+		}
+	}
+	testPage(t, ts.URL+"/api/v1/shares", "", `"hits":2,"url":"`+created.Data.URL+`","short":"`+created.Data.Short+`"`)
+	// The admins see all the links.
+	testPage(t, ts.URL+"/api/admin", "", `"shares":[{"id":"`+created.Data.ID+`","file":"clip.mp4",`)
+	if resp, _ = testDo(t, "DELETE", ts.URL+"/api/v1/shares/"+created.Data.ID, "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if status, _ := testGet(t, ts.URL+created.Data.URL, ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+// TestV1Events checks that only the admins list the events, a page at a
+// time.
+func TestV1Events(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice", "bob"}, "")
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{users: u, admins: []string{"alice"}})
+	now := time.Now().UTC()
+	for i, name := range []string{"a.mp4", "b.mp4", "c.mp4"} {
+		srv.analytics.recent = append(srv.analytics.recent, accessEvent{Time: now.Add(time.Duration(i) * time.Second), Event: "download", File: name})
+	}
+	if status, _ := testGet(t, ts.URL+"/api/v1/events", "bob"); status != http.StatusForbidden {
+		t.Fatalf("got status %d", status)
+	}
+	var got []string
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		status, b := testGet(t, ts.URL+"/api/v1/events?limit=2&cursor="+url.QueryEscape(cursor), "alice")
+		if status != http.StatusOK {
+			t.Fatalf("got status %d: %s", status, b)
+		}
+		var page struct {
+			Data []accessEvent `json:"data"`
+			Next string        `json:"next_cursor"`
+		}
+		if err := json.Unmarshal([]byte(b), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page.Data {
+			got = append(got, e.File)
+		}
+		if cursor = page.Next; cursor == "" {
+			break
+		}
+	}
+	if len(got) != 3 || got[0] != "a.mp4" || got[1] != "b.mp4" || got[2] != "c.mp4" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// TestV1ShareTTL checks that the ttl of a share link is bounded.
+func TestV1ShareTTL(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	for _, ttl := range []string{"-1", "1e300", "315360001"} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/v1/shares", "", `{"file": "clip.mp4", "ttl": `+ttl+`}`, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", ttl, resp.StatusCode, b)
+		}
+	}
+	for _, ttl := range []string{"0", "1e-12", "315360000"} {
+		resp, b := testDo(t, "POST", ts.URL+"/api/v1/shares", "", `{"file": "clip.mp4", "ttl": `+ttl+`}`, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: got status %d: %s", ttl, resp.StatusCode, b)
+		}
+		var l struct {
+			Data share `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(b), &l); err != nil {
+			t.Fatal(err)
+		}
+		if (ttl == "0") != (l.Data.Expires == nil) {
+			t.Fatalf("%s: got expires %v", ttl, l.Data.Expires)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// browserAudio are the audio codecs the browsers play in an MP4; the others,
+// e.g. AC-3 and DTS, are transcoded to AAC when remuxed.
+var browserAudio = []string{"aac", "mp3", "opus", "flac"}
+
+// audioFormats are the formats of /audio/. The tracks already in the codec
+// are copied as is.
+var audioFormats = map[string]struct {
+	ext, mime, encoder, bitrate string
+}{
+	"m4a":  {".m4a", "audio/mp4", "aac", "128k"},
+	"opus": {".webm", "audio/webm", "libopus", "64k"},
+}
+
+// remuxPath returns the path where the copy of f named suffix, e.g.
+// "1.mp4" for the audio track 1, is cached. It changes when the file does.
+func (m *media) remuxPath(f file, suffix string) string {
+	h := sha256.Sum256([]byte(f.Name))
+	return filepath.Join(m.remuxes, hex.EncodeToString(h[:8])+"-"+fingerprint(f)+"-"+suffix)
+}
+
+// writeRemux runs ffmpeg with args to write the copy of f at dst, unless
+// already cached. The output file is appended to args.
+func (m *media) writeRemux(ctx context.Context, kind string, f file, p *probeResult, dst string, args []string) error {
+	if _, err := os.Stat(dst); err == nil {
+		m.touched(dst)
+		return nil
+	}
+	if err := os.MkdirAll(m.remuxes, 0o755); err != nil {
+		return err
+	}
+	defer m.startJob(kind, f.Name)()
+	// A unique temporary file since two players can request the same copy.
+	tmp, err := os.CreateTemp(m.remuxes, "*.part")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	args = append(slices.Concat(args, progressArgs), "-y", tmp.Name())
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	cmd.Stdout = m.progress(kind, f.Name, p.Duration(), 0, 1)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	err = os.Rename(tmp.Name(), dst)
+	m.written()
+	return err
+}
+
+// remux returns the path of an MP4 of the first video stream of f with its
+// audio track, writing it if not cached. The video is copied as is.
+func (m *media) remux(ctx context.Context, root string, f file, track int) (string, error) {
+	p, err := m.probe(ctx, root, f)
+	if err != nil {
+		return "", err
+	}
+	tracks := p.streams("audio")
+	if track < 0 || track >= len(tracks) {
+		return "", fmt.Errorf("%s has no audio track %d", f.Name, track)
+	}
+	audio := "copy"
+	if !slices.Contains(browserAudio, tracks[track].Codec) {
+		audio = "aac"
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-v", "error", "-i", src,
+		"-map", "0:v:0?", "-map", "0:a:" + strconv.Itoa(track), "-c:v", "copy", "-c:a", audio}
+	if audio != "copy" {
+		args = append(args, "-b:a", "192k")
+	}
+	args = append(args, "-movflags", "+faststart", "-f", "mp4")
+	dst := m.remuxPath(f, strconv.Itoa(track)+".mp4")
+	return dst, m.writeRemux(ctx, "remux", f, p, dst, args)
+}
+
+// extractAudio returns the path of the audio track of f alone in the format,
+// one of audioFormats, writing it if not cached.
+func (m *media) extractAudio(ctx context.Context, root string, f file, track int, format string) (string, error) {
+	af, ok := audioFormats[format]
+	if !ok {
+		return "", fmt.Errorf("unknown audio format %q", format)
+	}
+	p, err := m.probe(ctx, root, f)
+	if err != nil {
+		return "", err
+	}
+	tracks := p.streams("audio")
+	if track < 0 || track >= len(tracks) {
+		return "", fmt.Errorf("%s has no audio track %d", f.Name, track)
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-v", "error", "-i", src,
+		"-map", "0:a:" + strconv.Itoa(track), "-vn", "-sn", "-dn"}
+	if codecOf(af.encoder) == tracks[track].Codec {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", af.encoder, "-b:a", af.bitrate)
+	}
+	if format == "m4a" {
+		args = append(args, "-movflags", "+faststart", "-f", "ipod")
+	} else {
+		args = append(args, "-f", "webm")
+	}
+	dst := m.remuxPath(f, strconv.Itoa(track)+"-audio"+af.ext)
+	return dst, m.writeRemux(ctx, "audio", f, p, dst, args)
+}
+
+// serveAudio serves the audio track ?audio=<index>, 0 by default, of a file
+// alone, in the ?format=m4a or opus, e.g. to listen to a recording over mobile
+// data without downloading the video. It is extracted on the first request,
+// so it can take a while to start.
+func (s *server) serveAudio(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) || !hasDuration(f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	q := req.URL.Query()
+	track := 0
+	if v := q.Get("audio"); v != "" {
+		var err error
+		if track, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid audio track", http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "m4a"
+	}
+	af, ok := audioFormats[format]
+	if !ok {
+		http.Error(w, "format must be m4a or opus", http.StatusBadRequest)
+		return
+	}
+	if s.media.ffmpeg == "" || s.media.ffprobe == "" {
+		http.Error(w, errNoFFmpeg.Error(), http.StatusNotImplemented)
+		return
+	}
+	p, err := s.media.extractAudio(req.Context(), s.root, f, track, format)
+	if err != nil {
+		if req.Context().Err() == nil {
+			slog.Warn("audio", "f", f.Name, "track", track, "error", err)
+		}
+		http.Error(w, "Audio track not available", 404)
+		return
+	}
+	s.serveRemuxed(w, req, f, p, af.mime)
+}
+
+// serveRemux serves a copy of a video with the audio track ?audio=<index>,
+// for the browsers that can't switch the audio track themselves. The copy is
+// made on the first request, so it can take a while to start.
+func (s *server) serveRemux(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	track, err := strconv.Atoi(req.URL.Query().Get("audio"))
+	if err != nil {
+		http.Error(w, "Invalid audio track", http.StatusBadRequest)
+		return
+	}
+	if s.media.ffmpeg == "" || s.media.ffprobe == "" {
+		http.Error(w, errNoFFmpeg.Error(), http.StatusNotImplemented)
+		return
+	}
+	p, err := s.media.remux(req.Context(), s.root, f, track)
+	if err != nil {
+		if req.Context().Err() == nil {
+			slog.Warn("remux", "f", f.Name, "track", track, "error", err)
+		}
+		http.Error(w, "Audio track not available", 404)
+		return
+	}
+	s.serveRemuxed(w, req, f, p, "video/mp4")
+}
+
+// serveRemuxed serves the cached copy at p of f.
+func (s *server) serveRemuxed(w http.ResponseWriter, req *http.Request, f file, p, contentType string) {
+	fh, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		// Purged concurrently.
+		http.Error(w, "Audio track not available", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fh.Close()
+	w.Header().Set("Content-Type", contentType)
+	setCacheControl(w.Header(), s.opts.cache.lookup(f.Name))
+	http.ServeContent(w, req, "", f.ModTime, fh)
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemuxErrors(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "private/x.mp4": testMP4}, options{users: u, access: a})
+	// The track is checked once ffmpeg is found.
+	noTrack := http.StatusNotFound
+	if srv.media.ffmpeg == "" || srv.media.ffprobe == "" {
+		noTrack = http.StatusNotImplemented
+	}
+	for p, want := range map[string]int{
+		"/remux/clip.mp4":              http.StatusBadRequest,
+		"/remux/clip.mp4?audio=x":      http.StatusBadRequest,
+		"/remux/missing.mp4?audio=1":   http.StatusNotFound,
+		"/remux/private/x.mp4?audio=1": http.StatusNotFound,
+		"/remux/clip.mp4?audio=1":      noTrack,
+	} {
+		if status, b := testGet(t, ts.URL+p, "bob"); status != want {
+			t.Errorf("%s: got status %d, want %d: %s", p, status, want, b)
+		}
+	}
+}
+
+func TestAudioErrors(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "notes.srt": "1\n", "private/x.mp4": testMP4}, options{users: u, access: a})
+	noTrack := http.StatusNotFound
+	if srv.media.ffmpeg == "" || srv.media.ffprobe == "" {
+		noTrack = http.StatusNotImplemented
+	}
+	for p, want := range map[string]int{
+		"/audio/clip.mp4?format=wav": http.StatusBadRequest,
+		"/audio/clip.mp4?audio=x":    http.StatusBadRequest,
+		"/audio/missing.mp4":         http.StatusNotFound,
+		"/audio/notes.srt":           http.StatusNotFound,
+		"/audio/private/x.mp4":       http.StatusNotFound,
+		// testMP4 has no audio track.
+		"/audio/clip.mp4?format=opus": noTrack,
+	} {
+		if status, b := testGet(t, ts.URL+p, "bob"); status != want {
+			t.Errorf("%s: got status %d, want %d: %s", p, status, want, b)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	Addr      string    `json:"addr"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Range     string    `json:"range,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// auditLog appends a line per access to the files to a file or to syslog.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAuditLog opens the destination of the -audit-log flag; see
+// openLogOutput.
+func newAuditLog(dest string, r logRotation) (*auditLog, error) {
+	w, err := openLogOutput(dest, r)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{w: w}, nil
+}
+
+func (a *auditLog) write(e *auditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		slog.Error("audit", "error", err)
+	}
+}
+
+// auditHandler logs every request served by h to the audit log, including the
+// denied ones, when -audit-log is used.
+func (s *server) auditHandler(h http.Handler) http.Handler {
+	if s.audit == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, req)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		s.audit.write(&auditEntry{
+			Time:      time.Now().UTC(),
+			User:      userFrom(req),
+			Addr:      clientAddr(req),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Range:     req.Header.Get("Range"),
+			Status:    cw.status,
+			Bytes:     cw.n,
+			UserAgent: req.UserAgent(),
+		})
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "audit.jsonl")
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "private/x.mp4": testMP4}, options{users: u, access: a, auditLog: p})
+	for _, c := range []struct {
+		p, user, rng string
+		want         int
+	}{
+		{"clip.mp4", "alice", "", http.StatusOK},
+		{"clip.mp4", "alice", "bytes=0-3", http.StatusPartialContent},
+		{"missing.mp4", "alice", "", http.StatusNotFound},
+		{"private/x.mp4", "bob", "", http.StatusNotFound},
+	} {
+		hdr := http.Header{}
+		if c.rng != "" {
+			hdr.Set("Range", c.rng)
+		}
+		if resp, _ := testDo(t, "GET", ts.URL+rawURL(c.p), c.user, "", hdr); resp.StatusCode != c.want {
+			t.Fatalf("%s: got status %d", c.p, resp.StatusCode)
+		}
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"user":"alice","addr":"127.0.0.1","method":"GET","path":"/raw/clip.mp4","status":200,"bytes":24,`,
+		`"path":"/raw/clip.mp4","range":"bytes=0-3","status":206,"bytes":4,`,
+		`"path":"/raw/missing.mp4","status":404,`,
+		`"user":"bob","addr":"127.0.0.1","method":"GET","path":"/raw/private/x.mp4","status":404,`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("missing %q in %q", want, b)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// openSyslog connects to the syslog daemon at raddr, or the local one when
+// network is empty.
+func openSyslog(network, raddr string) (io.Writer, error) {
+	return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "serve-videos")
+}
+
+// notifyReopen relays SIGUSR1, sent by logrotate to reopen the log files.
+func notifyReopen(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,20 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// openSyslog is not supported on Windows.
+func openSyslog(network, raddr string) (io.Writer, error) {
+	return nil, errors.New("-audit-log syslog is not supported on Windows")
+}
+
+// notifyReopen is a no-op since there is no SIGUSR1 on Windows.
+func notifyReopen(c chan<- os.Signal) {
+}
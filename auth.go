@@ -0,0 +1,111 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// users are the accounts allowed with HTTP basic authentication, mapping the
+// user names to the SHA-256 of their password.
+type users map[string][sha256.Size]byte
+
+// parseUsers parses -user flags in the form "<name>:<password>".
+func parseUsers(args []string) (users, error) {
+	out := users{}
+	for _, a := range args {
+		name, password, ok := strings.Cut(a, ":")
+		if !ok || name == "" || password == "" {
+			return nil, fmt.Errorf("-user %q must be in the form <name>:<password>", a)
+		}
+		if _, ok = out[name]; ok {
+			return nil, fmt.Errorf("-user %q is specified twice", name)
+		}
+		out[name] = sha256.Sum256([]byte(password))
+	}
+	return out, nil
+}
+
+// check returns true if the password of the user matches.
+func (u users) check(name, password string) bool {
+	want, ok := u[name]
+	got := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1 && ok
+}
+
+// tokens are the API tokens accepted as "Authorization: Bearer <token>",
+// mapping the SHA-256 of each token to its user.
+type tokens map[[sha256.Size]byte]string
+
+// parseTokens parses -token flags in the form "<name>:<token>", where name is
+// one of u.
+func parseTokens(args []string, u users) (tokens, error) {
+	out := tokens{}
+	for _, a := range args {
+		name, token, ok := strings.Cut(a, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("-token %q must be in the form <name>:<token> with a token of at least 16 characters", name)
+		}
+		if _, ok = u[name]; !ok {
+			return nil, fmt.Errorf("-token %q is not a -user", name)
+		}
+		out[sha256.Sum256([]byte(token))] = name
+	}
+	return out, nil
+}
+
+// check returns the user of the token in the Authorization header, if valid.
+func (t tokens) check(req *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(t) == 0 {
+		return "", false
+	}
+	// The map lookup is on the hash, so it doesn't leak the token's prefix.
+	name, ok := t[sha256.Sum256([]byte(token))]
+	return name, ok
+}
+
+type userKey struct{}
+
+// userFrom returns the authenticated user, or "" when -user is not used.
+func userFrom(req *http.Request) string {
+	u, _ := req.Context().Value(userKey{}).(string)
+	return u
+}
+
+// authHandler requires HTTP basic authentication or an API token when -user
+// is used. The requests to /raw/ with a valid signature are allowed, so a CDN
+// can fetch them, and so are the share links.
+func (s *server) authHandler(h http.Handler) http.Handler {
+	if len(s.opts.users) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, password, ok := req.BasicAuth()
+		if ok && s.opts.users.check(name, password) {
+			h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey{}, name)))
+			return
+		}
+		if name, ok = s.opts.tokens.check(req); ok {
+			h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), userKey{}, name)))
+			return
+		}
+		if s.signer != nil && strings.HasPrefix(req.URL.Path, "/raw/") && req.URL.Query().Has("md5") && s.signer.verify(req) == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/share/") {
+			h.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="serve-videos", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// isHDR returns true for the PQ and HLG transfer characteristics, as named by
+// ffprobe.
+func isHDR(transfer string) bool {
+	return transfer == "smpte2084" || transfer == "arib-std-b67"
+}
+
+// badgesOf returns the badges of a probed file, e.g. ["HEVC", "4K", "HDR",
+// "60fps", "1:02:03"]. H.264 is not shown since all browsers play it.
+func badgesOf(p *probeResult) []string {
+	var out []string
+	if v := p.streams("video"); len(v) != 0 {
+		if v[0].Codec != "h264" && v[0].Codec != "" {
+			out = append(out, strings.ToUpper(v[0].Codec))
+		}
+		// The shorter side, so the portrait videos of phones are labeled
+		// like the others.
+		if r := resolutionLabel(min(v[0].Width, v[0].Height)); r != "" {
+			out = append(out, r)
+		}
+		if v[0].HDR {
+			out = append(out, "HDR")
+		}
+		if v[0].FrameRate > 31 {
+			out = append(out, fmt.Sprintf("%.0ffps", v[0].FrameRate))
+		}
+	}
+	if d := p.Duration(); d > 0 {
+		out = append(out, fmtDuration(d))
+	}
+	return out
+}
+
+// resolutionLabel returns the label of the lines of a video, "" if unknown.
+func resolutionLabel(lines int) string {
+	switch {
+	case lines >= 4320:
+		return "8K"
+	case lines >= 2160:
+		return "4K"
+	case lines >= 1440:
+		return "1440p"
+	case lines >= 1080:
+		return "1080p"
+	case lines >= 720:
+		return "720p"
+	case lines > 0:
+		return "SD"
+	}
+	return ""
+}
+
+// fmtDuration formats d as [h:]mm:ss.
+func fmtDuration(d time.Duration) string {
+	s := int(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
+
+// badges returns the badges of the files probed among names. The files not
+// probed yet are probed in the background, for the next visit.
+func (s *server) badges(names []string) map[string][]string {
+	out := map[string][]string{}
+	var missing []file
+	for _, n := range names {
+		f, ok := s.getFile(n)
+		if !ok || !hasDuration(n) {
+			continue
+		}
+		if p := s.media.cachedProbe(f); p != nil {
+			if b := badgesOf(p); len(b) != 0 {
+				out[n] = b
+			}
+		} else {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) != 0 {
+		s.probeMissing(missing)
+	}
+	return out
+}
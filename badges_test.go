@@ -0,0 +1,57 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+// TestBadges labels an HDR video and a phone video.
+func TestBadges(t *testing.T) {
+	for _, tc := range []struct {
+		out  string
+		want []string
+	}{
+		{
+			`{"format":{"duration":"3723.4"},"streams":[{"codec_type":"video","codec_name":"hevc","width":3840,"height":2160,"avg_frame_rate":"60000/1001","color_transfer":"smpte2084"}]}`,
+			[]string{"HEVC", "4K", "HDR", "60fps", "1:02:03"},
+		},
+		{
+			`{"format":{"duration":"5.2"},"streams":[{"codec_type":"video","codec_name":"h264","width":1080,"height":1920,"avg_frame_rate":"30/1"}]}`,
+			[]string{"1080p", "00:05"},
+		},
+		{`{"streams":[]}`, nil},
+	} {
+		var p probeResult
+		if err := json.Unmarshal([]byte(tc.out), &p); err != nil {
+			t.Fatal(err)
+		}
+		if got := badgesOf(&p); !slices.Equal(got, tc.want) {
+			t.Fatalf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+// TestBadgesPages checks that the badges of the probed files are on the root
+// and list pages.
+func TestBadgesPages(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "other.mp4": testMP4}, options{})
+	f, ok := srv.getFile("clip.mp4")
+	if !ok {
+		t.Fatal("clip.mp4 not found")
+	}
+	var p probeResult
+	if err := json.Unmarshal([]byte(`{"format":{"duration":"5.2"},"streams":[{"codec_type":"video","codec_name":"h264","width":1920,"height":1080}]}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	srv.media.mu.Lock()
+	srv.media.probes[f] = &p
+	srv.media.mu.Unlock()
+	for _, u := range []string{"/", "/list"} {
+		testPage(t, ts.URL+u, "", `"badges":{"clip.mp4":["1080p","00:05"]}`)
+	}
+}
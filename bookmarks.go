@@ -0,0 +1,123 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBookmarks is the number of bookmarks of a user in a file.
+	maxBookmarks = 1000
+	// maxBookmarkName is the maximum length of the name of a bookmark.
+	maxBookmarkName = 200
+)
+
+// bookmark is a named position in a file, e.g. to find the interesting
+// moments in hours of footage.
+type bookmark struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Time is the position in seconds.
+	Time    float64   `json:"time"`
+	Created time.Time `json:"created"`
+}
+
+func (b *bookmark) valid() bool {
+	return b.ID != "" && b.Name != "" && len(b.Name) <= maxBookmarkName && b.Time >= 0
+}
+
+// addBookmark adds b to the bookmarks of the file, sorted by time. It returns
+// false when the file has too many bookmarks.
+func (pr *profile) addBookmark(f string, b bookmark) bool {
+	v := pr.Bookmarks[f]
+	if len(v) >= maxBookmarks {
+		return false
+	}
+	v = append(v, b)
+	slices.SortStableFunc(v, func(a, b bookmark) int { return cmp.Compare(a.Time, b.Time) })
+	pr.Bookmarks[f] = v
+	return true
+}
+
+// serveBookmarks lists the bookmarks of the authenticated user in a file with
+// GET, adds one with POST {"name": "...", "time": <seconds>} and deletes one
+// with DELETE ?id=<id>. They are shared as a link to the watch page with
+// #t=<seconds>.
+func (s *server) serveBookmarks(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	user := userFrom(req)
+	switch req.Method {
+	case http.MethodPost:
+		var body struct {
+			Name string   `json:"name"`
+			Time *float64 `json:"time"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		var id [8]byte
+		_, _ = rand.Read(id[:])
+		b := bookmark{ID: hex.EncodeToString(id[:]), Name: strings.TrimSpace(body.Name), Created: time.Now().UTC().Truncate(time.Second)}
+		if body.Time != nil {
+			b.Time = *body.Time
+		}
+		if body.Time == nil || !b.valid() {
+			http.Error(w, "Invalid bookmark", 400)
+			return
+		}
+		full := false
+		s.profiles.update(user, func(pr *profile) { full = !pr.addBookmark(f, b) })
+		if full {
+			http.Error(w, "Too many bookmarks", http.StatusInsufficientStorage)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(b)
+	case http.MethodDelete:
+		id := req.FormValue("id")
+		found := false
+		s.profiles.update(user, func(pr *profile) {
+			v := pr.Bookmarks[f]
+			i := slices.IndexFunc(v, func(b bookmark) bool { return b.ID == id })
+			if i == -1 {
+				return
+			}
+			found = true
+			if v = slices.Delete(v, i, i+1); len(v) == 0 {
+				delete(pr.Bookmarks, f)
+			} else {
+				pr.Bookmarks[f] = v
+			}
+		})
+		if !found {
+			http.Error(w, "Unknown bookmark", 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		v := s.profiles.get(user).Bookmarks[f]
+		if v == nil {
+			v = []bookmark{}
+		}
+		h := w.Header()
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"bookmarks": v})
+	}
+}
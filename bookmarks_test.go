@@ -0,0 +1,52 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestBookmarks adds bookmarks, lists them by time and deletes one.
+func TestBookmarks(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	u := ts.URL + "/api/bookmarks/clip.mp4"
+	for _, body := range []string{`{"name":"x"}`, `{"name":" ","time":1}`, `{"name":"x","time":-1}`} {
+		if resp, b := testDo(t, "POST", u, "", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+	}
+	if resp, b := testDo(t, "POST", ts.URL+"/api/bookmarks/missing.mp4", "", `{"name":"x","time":1}`, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var bm bookmark
+	for _, body := range []string{`{"name":"Car stops","time":2.5}`, `{"name":"Start","time":0.5}`} {
+		resp, b := testDo(t, "POST", u, "", body, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+		if bm.ID == "" {
+			if err := json.Unmarshal([]byte(b), &bm); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var got struct {
+		Bookmarks []bookmark `json:"bookmarks"`
+	}
+	_, b := testDo(t, "GET", u, "", "", nil)
+	if err := json.Unmarshal([]byte(b), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Bookmarks) != 2 || got.Bookmarks[0].Name != "Start" || got.Bookmarks[1] != bm {
+		t.Fatalf("got %+v", got.Bookmarks)
+	}
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		if resp, b2 := testDo(t, "DELETE", u+"?id="+bm.ID, "", "", nil); resp.StatusCode != want {
+			t.Fatalf("got status %d, want %d: %s", resp.StatusCode, want, b2)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cacheNoStore   = "no-store, no-cache, must-revalidate, max-age=0"
+	cacheImmutable = "public, max-age=31536000, immutable"
+	cacheDefault   = "public, max-age=86400"
+)
+
+// cacheRule is the Cache-Control value for the files matching a glob.
+type cacheRule struct {
+	pattern string
+	value   string
+}
+
+// cacheRules is the -cache flag. The first matching rule wins, the defaults are
+// applied last.
+type cacheRules []cacheRule
+
+// defaultCacheRules never caches playlists since they could be live.
+var defaultCacheRules = cacheRules{{"*.m3u8", cacheNoStore}, {"*", cacheDefault}}
+
+func (c *cacheRules) String() string {
+	var out []string
+	for _, r := range *c {
+		out = append(out, r.pattern+"="+r.value)
+	}
+	return strings.Join(out, ",")
+}
+
+// Set parses "<glob>=<policy>". The policy is "no-store", "immutable", a
+// duration like "1h" or a raw Cache-Control value.
+func (c *cacheRules) Set(v string) error {
+	pattern, value, ok := strings.Cut(v, "=")
+	if !ok || pattern == "" || value == "" {
+		return fmt.Errorf("-cache %q must be in the form <glob>=<policy>", v)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("-cache %q: %w", v, err)
+	}
+	switch value {
+	case "no-store":
+		value = cacheNoStore
+	case "immutable":
+		value = cacheImmutable
+	default:
+		if d, err := time.ParseDuration(value); err == nil {
+			if d < 0 {
+				return fmt.Errorf("-cache %q: negative duration", v)
+			}
+			value = "public, max-age=" + strconv.Itoa(int(d.Seconds()))
+		}
+	}
+	*c = append(*c, cacheRule{pattern: pattern, value: value})
+	return nil
+}
+
+// lookup returns the Cache-Control value for the file name. The glob is
+// matched against the base name and the whole path.
+func (c cacheRules) lookup(name string) string {
+	for _, rules := range []cacheRules{c, defaultCacheRules} {
+		for _, r := range rules {
+			if ok, _ := path.Match(r.pattern, path.Base(name)); ok {
+				return r.value
+			}
+			if ok, _ := path.Match(r.pattern, name); ok {
+				return r.value
+			}
+		}
+	}
+	return cacheDefault
+}
+
+// setCacheControl sets the Cache-Control header and the legacy headers when
+// the response must not be cached.
+func setCacheControl(h http.Header, value string) {
+	h.Set("Cache-Control", value)
+	if strings.Contains(value, "no-store") || strings.Contains(value, "no-cache") {
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+	}
+}
+
+// fingerprint identifies the version of a file, to make URLs derived from it
+// immutable.
+func fingerprint(f file) string {
+	return strconv.FormatInt(f.Size, 36) + "-" + strconv.FormatInt(f.ModTime.UnixNano(), 36)
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestCacheRules(t *testing.T) {
+	var c cacheRules
+	for _, v := range []string{"music/*=immutable", "*.ts=1h", "*.vtt=no-store", "*.srt=private"} {
+		if err := c.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"*.mp4", "=1h", "[=1h", "*.mp4=-1h"} {
+		if err := c.Set(v); err == nil {
+			t.Fatalf("%q: expected an error", v)
+		}
+	}
+	for name, want := range map[string]string{
+		"music/song.mp3": cacheImmutable,
+		"vod/seg0.ts":    "public, max-age=3600",
+		"a.vtt":          cacheNoStore,
+		"a.srt":          "private",
+		"vod/index.m3u8": cacheNoStore,
+		"clip.mp4":       cacheDefault,
+	} {
+		if got := c.lookup(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":       testMP4,
+		"music/song.mp3": "ID3",
+		"vod/index.m3u8": "#EXTM3U\n#EXT-X-ENDLIST\n",
+	}, options{cache: cacheRules{{"music/*", cacheImmutable}}})
+	for name, want := range map[string]string{
+		"vod/index.m3u8": cacheNoStore,
+		"clip.mp4":       cacheDefault,
+		"music/song.mp3": cacheImmutable,
+	} {
+		resp, _ := testDo(t, "GET", ts.URL+rawURL(name), "", "", nil)
+		if got := resp.Header.Get("Cache-Control"); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
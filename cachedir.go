@@ -0,0 +1,215 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheDir holds the files generated from the library: the thumbnails and
+// the copies with another audio track or of the audio alone. Their names
+// contain the fingerprint of the file they are made of, so they are never
+// stale. The least recently used are evicted above max.
+type cacheDir struct {
+	// dir is -cache-dir, or -data by default.
+	dir string
+	// max is the maximum size of the files, 0 is unlimited.
+	max  uint64
+	wake chan struct{}
+
+	mu    sync.Mutex
+	state cacheState
+}
+
+// cacheState is the outcome of the last eviction, for /admin and
+// /api/cache.
+type cacheState struct {
+	Dir     string    `json:"dir"`
+	Max     uint64    `json:"max,omitempty"`
+	Checked time.Time `json:"checked"`
+	Files   int       `json:"files"`
+	Size    uint64    `json:"size"`
+	// Evicted and Freed are the totals since startup.
+	Evicted int    `json:"evicted"`
+	Freed   uint64 `json:"freed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// partialAge is the age after which a partially written file is considered
+// left over by a crash.
+const partialAge = 24 * time.Hour
+
+// setCacheDir stores the generated files in dir, or only the copies in a
+// temporary directory when dir is empty.
+func (m *media) setCacheDir(dir string, max uint64) {
+	m.cache = &cacheDir{dir: dir, max: max, wake: make(chan struct{}, 1)}
+	if dir != "" {
+		m.thumbs = filepath.Join(dir, "thumbs")
+		m.remuxes = filepath.Join(dir, "remux")
+	} else {
+		m.thumbs = ""
+		m.remuxes = filepath.Join(os.TempDir(), "serve-videos-remux")
+	}
+}
+
+// touched marks the cached file at p as used, so it is evicted last.
+func (m *media) touched(p string) {
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+}
+
+// written is called after a file is added to the cache, to evict the oldest
+// ones if needed.
+func (m *media) written() {
+	if m.cache == nil {
+		return
+	}
+	select {
+	case m.cache.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cacheStatus returns the outcome of the last eviction.
+func (m *media) cacheStatus() cacheState {
+	c := m.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.state
+	st.Dir, st.Max = c.dir, c.max
+	if st.Dir == "" {
+		st.Dir = m.remuxes
+	}
+	return st
+}
+
+// cachedFile is a file in the cache.
+type cachedFile struct {
+	path    string
+	size    uint64
+	modTime time.Time
+}
+
+// evict deletes the least recently used files above the maximum size, or all
+// of them, and the files left partially written. It returns how many files
+// were deleted and their size.
+func (m *media) evict(all bool) (int, uint64, error) {
+	var files []cachedFile
+	var errs []error
+	deleted, freed := 0, uint64(0)
+	remove := func(f cachedFile) {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			return
+		}
+		deleted++
+		freed += f.size
+	}
+	for _, d := range []string{m.thumbs, m.remuxes} {
+		if d == "" {
+			continue
+		}
+		entries, err := os.ReadDir(d)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, e := range entries {
+			fi, err := e.Info()
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			f := cachedFile{path: filepath.Join(d, e.Name()), size: uint64(fi.Size()), modTime: fi.ModTime()}
+			if strings.HasSuffix(e.Name(), ".part") || strings.HasSuffix(e.Name(), ".tmp") {
+				// Being written, unless it's old.
+				if time.Since(f.modTime) > partialAge {
+					remove(f)
+				}
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.modTime.Compare(b.modTime) })
+	total := uint64(0)
+	for _, f := range files {
+		total += f.size
+	}
+	c := m.cache
+	kept := len(files)
+	for _, f := range files {
+		if !all && (c.max == 0 || total <= c.max) {
+			break
+		}
+		n := deleted
+		remove(f)
+		if deleted != n {
+			total -= f.size
+			kept--
+		}
+	}
+	err := errors.Join(errs...)
+	c.mu.Lock()
+	c.state.Checked = time.Now().UTC()
+	c.state.Files, c.state.Size = kept, total
+	c.state.Evicted += deleted
+	c.state.Freed += freed
+	c.state.Error = ""
+	if err != nil {
+		c.state.Error = err.Error()
+	}
+	c.mu.Unlock()
+	return deleted, freed, err
+}
+
+// runCache evicts the oldest files after each file added and every 10
+// minutes until ctx is canceled.
+func (m *media) runCache(ctx context.Context) {
+	for {
+		if n, freed, err := m.evict(false); err != nil {
+			slog.Warn("cache", "error", err)
+		} else if n != 0 {
+			slog.Info("cache", "evicted", n, "freed", freed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.cache.wake:
+		case <-time.After(10 * time.Minute):
+		}
+	}
+}
+
+// serveCache returns the size of the cache.
+func (s *server) serveCache(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.media.cacheStatus())
+}
+
+// serveCachePurge deletes all the files of the cache. They are generated
+// again when needed.
+func (s *server) serveCachePurge(w http.ResponseWriter, req *http.Request) {
+	n, freed, err := s.media.evict(true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"files": n, "freed": freed})
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCacheDir evicts the least recently used thumbnail and a partial
+// copy left over.
+func TestCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	m := newMedia()
+	m.setCacheDir(dir, 25)
+	now := time.Now()
+	for p, age := range map[string]time.Duration{
+		filepath.Join(m.thumbs, "a.jpg"):    3 * time.Hour,
+		filepath.Join(m.thumbs, "b.jpg"):    2 * time.Hour,
+		filepath.Join(m.remuxes, "c.mp4"):   time.Hour,
+		filepath.Join(m.remuxes, "d.part"):  2 * partialAge,
+		filepath.Join(m.remuxes, "e.part"):  0,
+		filepath.Join(m.remuxes, "f.m4a"):   4 * time.Hour,
+		filepath.Join(m.thumbs, "sub", "x"): 0,
+	} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("0123456789"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// f.m4a is the oldest but was just used.
+	m.touched(filepath.Join(m.remuxes, "f.m4a"))
+	if n, freed, err := m.evict(false); err != nil || n != 3 || freed != 30 {
+		t.Fatalf("got %d, %d, %v", n, freed, err)
+	}
+	for _, p := range []string{filepath.Join(m.remuxes, "c.mp4"), filepath.Join(m.remuxes, "e.part"), filepath.Join(m.remuxes, "f.m4a")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := m.cacheStatus(); st.Files != 2 || st.Size != 20 || st.Evicted != 3 || st.Max != 25 {
+		t.Fatalf("got %+v", st)
+	}
+	if n, _, err := m.evict(true); err != nil || n != 2 {
+		t.Fatalf("purge: got %d, %v", n, err)
+	}
+}
+
+// TestCacheAPI checks the status and the purge of -cache-dir.
+func TestCacheAPI(t *testing.T) {
+	dir := t.TempDir()
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{cacheDir: dir, cacheMax: 100})
+	testPage(t, ts.URL+"/api/cache", "", `"evicted":0,`)
+	p := filepath.Join(dir, "thumbs", "a.jpg")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resp, b := testDo(t, "DELETE", ts.URL+"/api/cache", "", "", nil)
+	if resp.StatusCode != http.StatusOK || b != "{\"files\":1,\"freed\":10}\n" {
+		t.Fatalf("got status %d: %q", resp.StatusCode, b)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+)
+
+// fileChange is a file added, removed or changed in root.
+type fileChange struct {
+	// Kind is "added", "removed" or "changed".
+	Kind string
+	File file
+}
+
+// diffFiles returns the changes from old to files. Both must be sorted by
+// name.
+func diffFiles(old, files []file) []fileChange {
+	var out []fileChange
+	i, j := 0, 0
+	for i < len(old) || j < len(files) {
+		switch {
+		case j == len(files) || (i < len(old) && old[i].Name < files[j].Name):
+			out = append(out, fileChange{Kind: "removed", File: old[i]})
+			i++
+		case i == len(old) || files[j].Name < old[i].Name:
+			out = append(out, fileChange{Kind: "added", File: files[j]})
+			j++
+		default:
+			if old[i] != files[j] {
+				out = append(out, fileChange{Kind: "changed", File: files[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// changes broadcasts the file changes to the subscribers.
+type changes struct {
+	mu   sync.Mutex
+	subs map[chan fileChange]struct{}
+}
+
+// subscribe returns a channel receiving the changes until cancel is called.
+// The changes are dropped when the subscriber is too slow.
+func (c *changes) subscribe() (ch <-chan fileChange, cancel func()) {
+	sub := make(chan fileChange, 256)
+	c.mu.Lock()
+	if c.subs == nil {
+		c.subs = map[chan fileChange]struct{}{}
+	}
+	c.subs[sub] = struct{}{}
+	c.mu.Unlock()
+	return sub, func() {
+		c.mu.Lock()
+		delete(c.subs, sub)
+		c.mu.Unlock()
+	}
+}
+
+func (c *changes) publish(fc []fileChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for sub := range c.subs {
+		for _, f := range fc {
+			select {
+			case sub <- f:
+			default:
+			}
+		}
+	}
+}
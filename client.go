@@ -0,0 +1,198 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// client talks to a running instance through its API.
+type client struct {
+	base string
+	// token is sent as "Authorization: Bearer <token>" when not empty.
+	token string
+}
+
+func (c *client) get(ctx context.Context, p string, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s: %s", p, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+// files returns the files listed by /api/files with the query v.
+func (c *client) files(ctx context.Context, v url.Values) ([]fileInfo, error) {
+	resp, err := c.get(ctx, "/api/files?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Files []fileInfo `json:"files"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return data.Files, nil
+}
+
+// download writes the file to the same path under dst. A file already there
+// with the same size and modification time is skipped, and a partial download
+// is resumed. It returns true if the file was downloaded.
+func (c *client) download(ctx context.Context, dst string, info fileInfo) (bool, error) {
+	if !filepath.IsLocal(filepath.FromSlash(info.Name)) {
+		return false, fmt.Errorf("%q is not a relative path", info.Name)
+	}
+	p := filepath.Join(dst, filepath.FromSlash(info.Name))
+	if fi, err := os.Stat(p); err == nil && fi.Size() == info.Size && fi.ModTime().Equal(info.ModTime) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return false, err
+	}
+	tmp := p + ".part"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	hdr := http.Header{}
+	if offset != 0 && offset < info.Size {
+		hdr.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		hdr.Set("If-Range", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.get(ctx, rawURL(info.Name), hdr)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// Not resumed, e.g. the file changed.
+		if err = f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		return false, err
+	}
+	if err = f.Close(); err != nil {
+		return false, err
+	}
+	if err = os.Chtimes(tmp, info.ModTime, info.ModTime); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, p)
+}
+
+// cmdClient runs a client command against the instance of c:
+//
+//   - "list [<dir>]" and "search <words>..." print the files as JSON lines.
+//   - "download <file or dir>..." downloads the files to the current
+//     directory.
+func cmdClient(ctx context.Context, w io.Writer, c *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("client requires list, search or download")
+	}
+	enc := json.NewEncoder(w)
+	printFiles := func(files []fileInfo) error {
+		for i := range files {
+			if err := enc.Encode(&files[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		if len(args) > 1 {
+			return errors.New("client list accepts a single directory")
+		}
+		v := url.Values{}
+		if len(args) == 1 {
+			v.Set("dir", args[0])
+		}
+		files, err := c.files(ctx, v)
+		if err != nil {
+			return err
+		}
+		return printFiles(files)
+	case "search":
+		if len(args) == 0 {
+			return errors.New("client search requires words to search")
+		}
+		files, err := c.files(ctx, url.Values{"q": {strings.Join(args, " ")}})
+		if err != nil {
+			return err
+		}
+		return printFiles(files)
+	case "download":
+		if len(args) == 0 {
+			return errors.New("client download requires files or directories")
+		}
+		all, err := c.files(ctx, nil)
+		if err != nil {
+			return err
+		}
+		var files []fileInfo
+		for _, a := range args {
+			a = strings.Trim(a, "/")
+			found := false
+			for _, f := range all {
+				if f.Name == a || strings.HasPrefix(f.Name, a+"/") {
+					files = append(files, f)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%q is not on the server", a)
+			}
+		}
+		for _, f := range files {
+			done, err := c.download(ctx, ".", f)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if done {
+				fmt.Fprintf(w, "%s\n", f.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown client command %q", cmd)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice"}, "")
+	tk, err := parseTokens([]string{"alice:0123456789abcdef"}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, n := range []string{"trip/beach.mp4", "trip/hike.mp4", "other.mp4"} {
+		files[n] = "content of " + n
+	}
+	_, ts := newTestServer(t, files, options{users: u, tokens: tk})
+	ctx := t.Context()
+	c := &client{base: ts.URL, token: "0123456789abcdef"}
+	var out bytes.Buffer
+	if err = cmdClient(ctx, &out, c, []string{"list", "trip"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out.String(), "\n"); got != 2 || !strings.HasPrefix(out.String(), `{"name":"trip/beach.mp4","size":25,`) {
+		t.Fatalf("list: got %q", out.String())
+	}
+	out.Reset()
+	if err = cmdClient(ctx, &out, c, []string{"search", "HIKE"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), `{"name":"trip/hike.mp4",`) || strings.Count(out.String(), "\n") != 1 {
+		t.Fatalf("search: got %q", out.String())
+	}
+
+	dst := t.TempDir()
+	l, err := c.files(ctx, url.Values{"dir": {"trip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an interrupted download.
+	writeTestFiles(t, dst, map[string]string{"trip/beach.mp4.part": "content"})
+	for _, f := range l {
+		if done, err2 := c.download(ctx, dst, f); err2 != nil || !done {
+			t.Fatalf("download %s: %v %v", f.Name, done, err2)
+		}
+	}
+	if b, err2 := os.ReadFile(filepath.Join(dst, "trip", "beach.mp4")); err2 != nil || string(b) != files["trip/beach.mp4"] {
+		t.Fatalf("download: got %q %v", b, err2)
+	}
+	if done, err2 := c.download(ctx, dst, l[0]); err2 != nil || done {
+		t.Fatalf("download again: %v %v", done, err2)
+	}
+
+	c.token = "wrong"
+	if err = cmdClient(ctx, &out, c, []string{"list"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected a 401, got %v", err)
+	}
+}
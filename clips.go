@@ -0,0 +1,437 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClipName is the maximum length of the name of a clip.
+	maxClipName = 200
+	// maxClipLength is the maximum duration of a clip.
+	maxClipLength = time.Hour
+)
+
+// clip is a part of a file saved to be found, tagged and shared apart from
+// the raw recordings.
+type clip struct {
+	ID   string `json:"id"`
+	File string `json:"file"`
+	Name string `json:"name,omitempty"`
+	// Start and End are the in and out points in seconds.
+	Start   float64   `json:"start"`
+	End     float64   `json:"end"`
+	Tags    []string  `json:"tags"`
+	User    string    `json:"user,omitempty"`
+	Created time.Time `json:"created"`
+	// Rendered is set once the "clip" job wrote it to its own file. Until
+	// then, it is cut from the file when downloaded.
+	Rendered bool `json:"rendered,omitempty"`
+}
+
+// validate returns an error if the clip's values can't be used.
+func (c *clip) validate() error {
+	if len(c.Name) > maxClipName {
+		return errors.New("name too long")
+	}
+	if c.Start < 0 || c.End <= c.Start || c.End-c.Start > maxClipLength.Seconds() {
+		return errors.New("invalid in and out points")
+	}
+	for _, t := range c.Tags {
+		if err := validTag(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clips are the clips saved by the users, by ID.
+//
+// They are saved to p when not empty; the rendered clips are written in dir.
+type clips struct {
+	p   string
+	dir string
+
+	mu    sync.Mutex
+	byID  map[string]*clip
+	dirty bool
+}
+
+// newClips loads the clips saved in p, if any.
+func newClips(p, dir string) (*clips, error) {
+	c := &clips{p: p, dir: dir, byID: map[string]*clip{}}
+	if err := readJSON(p, &c.byID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// path returns the path of the rendered clip id.
+func (c *clips) path(id string) string {
+	return filepath.Join(c.dir, id+".mp4")
+}
+
+// open opens the rendered clip id, without following the links out of dir.
+func (c *clips) open(id string) (*os.File, error) {
+	r, err := os.OpenRoot(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return r.Open(id + ".mp4")
+}
+
+// add saves a new clip like t and returns it.
+func (c *clips) add(t clip) clip {
+	var b [9]byte
+	_, _ = rand.Read(b[:])
+	t.ID = base64.RawURLEncoding.EncodeToString(b[:])
+	t.Created = time.Now().UTC().Truncate(time.Second)
+	t.Rendered = false
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byID[t.ID] = &t
+	c.dirty = true
+	return t
+}
+
+// get returns the clip id.
+func (c *clips) get(id string) (clip, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.byID[id]
+	if v == nil {
+		return clip{}, false
+	}
+	out := *v
+	out.Tags = slices.Clone(v.Tags)
+	return out, true
+}
+
+// list returns the clips, most recent first.
+func (c *clips) list() []clip {
+	c.mu.Lock()
+	out := make([]clip, 0, len(c.byID))
+	for _, v := range c.byID {
+		cp := *v
+		cp.Tags = slices.Clone(v.Tags)
+		out = append(out, cp)
+	}
+	c.mu.Unlock()
+	slices.SortFunc(out, func(a, b clip) int {
+		return cmp.Or(b.Created.Compare(a.Created), strings.Compare(a.ID, b.ID))
+	})
+	return out
+}
+
+// update modifies the clip id, returning false if it doesn't exist.
+func (c *clips) update(id string, f func(v *clip)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.byID[id]
+	if v == nil {
+		return false
+	}
+	f(v)
+	c.dirty = true
+	return true
+}
+
+// remove deletes the clip id and its rendered file.
+func (c *clips) remove(id string) error {
+	c.mu.Lock()
+	v := c.byID[id]
+	delete(c.byID, id)
+	c.dirty = true
+	c.mu.Unlock()
+	if v == nil || !v.Rendered {
+		return nil
+	}
+	if err := os.Remove(c.path(id)); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// save writes the clips to disk if they changed.
+func (c *clips) save() error {
+	c.mu.Lock()
+	if c.p == "" || !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(c.byID)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.p, b)
+}
+
+// cutArgs returns the ffmpeg arguments reading the clip from its file.
+func cutArgs(root string, c clip) ([]string, error) {
+	src, err := mediaPath(root, c.File)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-ss", strconv.FormatFloat(c.Start, 'f', -1, 64), "-i", src,
+		"-t", strconv.FormatFloat(c.End-c.Start, 'f', -1, 64), "-map", "0:v:0?", "-map", "0:a:0?", "-sn", "-dn"}, nil
+}
+
+// renderClip re-encodes the clip to dst, so it starts exactly at its in point
+// and is seekable when shared.
+func (m *media) renderClip(ctx context.Context, root string, c clip, dst string) error {
+	if m.ffmpeg == "" {
+		return errNoFFmpeg
+	}
+	in, err := cutArgs(root, c)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	defer m.startJob("clip", c.File)()
+	tmp := dst + ".part"
+	args := append([]string{"-v", "error"}, in...)
+	args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p", "-c:a", "aac",
+		"-movflags", "+faststart", "-f", "mp4", "-y", tmp)
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return os.Rename(tmp, dst)
+}
+
+// cutMP4 streams the clip cut from its file with stream copy, starting at the
+// keyframe before its in point, as a fragmented MP4 to w.
+func (m *media) cutMP4(ctx context.Context, root string, c clip, w io.Writer) error {
+	if m.ffmpeg == "" {
+		return errNoFFmpeg
+	}
+	in, err := cutArgs(root, c)
+	if err != nil {
+		return err
+	}
+	// The output is not seekable, so the moov atom must be written first.
+	args := append([]string{"-v", "error"}, in...)
+	args = append(args, "-c", "copy", "-movflags", "frag_keyframe+empty_moov", "-f", "mp4", "pipe:1")
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	cmd.Stdout = w
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// clipsOf returns the clips of the files the user can access, only the ones
+// tagged with all tags.
+func (s *server) clipsOf(req *http.Request, tags []string) []clip {
+	out := []clip{}
+	for _, c := range s.clips.list() {
+		if s.hasFile(c.File) && s.canAccess(req, c.File) && !slices.ContainsFunc(tags, func(t string) bool { return !slices.Contains(c.Tags, t) }) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// clipFor returns the clip {id} if the user can access its file.
+func (s *server) clipFor(req *http.Request) (clip, bool) {
+	c, ok := s.clips.get(req.PathValue("id"))
+	if !ok || !s.hasFile(c.File) || !s.canAccess(req, c.File) {
+		return clip{}, false
+	}
+	return c, true
+}
+
+// serveClips shows the saved clips, filtered by ?tag=.
+func (s *server) serveClips(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, clipsHTML, map[string]any{"clips": s.clipsOf(req, req.URL.Query()["tag"]), "titles": visibleKeys(s.opts.access, userFrom(req), s.titles()), "user": userFrom(req), "admin": s.isAdmin(req), "render": s.clips.dir != "" && s.media.ffmpeg != ""})
+}
+
+// serveClipsAPI lists the clips tagged with all the ?tag=, most recent first.
+func (s *server) serveClipsAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"clips": s.clipsOf(req, req.URL.Query()["tag"])})
+}
+
+// serveClipAdd saves a clip with a POST of {"file": <name>, "name": ...,
+// "start": <seconds>, "end": <seconds>, "tags": [...]}.
+func (s *server) serveClipAdd(w http.ResponseWriter, req *http.Request) {
+	var body clip
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if !s.hasFile(body.File) || !s.canAccess(req, body.File) || !hasDuration(body.File) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Tags == nil {
+		body.Tags = []string{}
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	body.User = userFrom(req)
+	c := s.clips.add(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+// serveClip returns the clip {id}, renames and retags it with a POST of
+// {"name": ..., "tags": [...]} or deletes it with DELETE. Only its author or
+// an admin can modify it.
+func (s *server) serveClip(w http.ResponseWriter, req *http.Request) {
+	c, ok := s.clipFor(req)
+	if !ok {
+		http.Error(w, "Unknown clip", 404)
+		return
+	}
+	if req.Method != http.MethodGet && c.User != userFrom(req) && !s.isAdmin(req) {
+		http.Error(w, "Not the author of the clip", http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		var body struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		c.Name = strings.TrimSpace(body.Name)
+		c.Tags = slices.Compact(slices.Sorted(slices.Values(body.Tags)))
+		if c.Tags == nil {
+			c.Tags = []string{}
+		}
+		if err := c.validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		s.clips.update(c.ID, func(v *clip) { v.Name, v.Tags = c.Name, c.Tags })
+	case http.MethodDelete:
+		if err := s.clips.remove(c.ID); err != nil {
+			slog.Error("clip", "id", c.ID, "error", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+// serveClipRender queues a "clip" job rendering the clip {id} to its own file,
+// in the clips directory of -data.
+func (s *server) serveClipRender(w http.ResponseWriter, req *http.Request) {
+	c, ok := s.clipFor(req)
+	if !ok {
+		http.Error(w, "Unknown clip", 404)
+		return
+	}
+	if c.User != userFrom(req) && !s.isAdmin(req) {
+		http.Error(w, "Not the author of the clip", http.StatusForbidden)
+		return
+	}
+	if s.clips.dir == "" {
+		http.Error(w, "The clips are only rendered with -data", http.StatusNotImplemented)
+		return
+	}
+	jobs, err := s.addJobs(job{Kind: "clip", Clip: c.ID}, []string{c.File})
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(jobs[0])
+}
+
+// clipURL returns the escaped URL path to download a clip.
+func clipURL(id string) string {
+	return "/clips/" + id + ".mp4"
+}
+
+// serveClipFile downloads the clip {name}.mp4.
+func (s *server) serveClipFile(w http.ResponseWriter, req *http.Request) {
+	id, ok := strings.CutSuffix(req.PathValue("name"), ".mp4")
+	if !ok {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	req.SetPathValue("id", id)
+	c, ok := s.clipFor(req)
+	if !ok {
+		http.Error(w, "Unknown clip", 404)
+		return
+	}
+	s.serveClipMedia(w, req, c)
+}
+
+// serveClipMedia serves the rendered clip, or cuts it from its file.
+func (s *server) serveClipMedia(w http.ResponseWriter, req *http.Request, c clip) {
+	name := strings.ReplaceAll(cmp.Or(c.Name, strings.TrimSuffix(c.File, filepath.Ext(c.File))), "/", "_") + ".mp4"
+	h := w.Header()
+	h.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	defer s.streams.start(req, c.File)()
+	if c.Rendered {
+		if f, err := s.clips.open(c.ID); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil {
+				h.Set("Content-Type", "video/mp4")
+				http.ServeContent(w, req, "", fi.ModTime(), f)
+				return
+			}
+		}
+	}
+	if s.media.ffmpeg == "" {
+		http.Error(w, errNoFFmpeg.Error(), http.StatusNotImplemented)
+		return
+	}
+	h.Set("Content-Type", "video/mp4")
+	defer s.media.startJob("export", c.File)()
+	if err := s.media.cutMP4(req.Context(), s.root, c, w); err != nil {
+		// Headers are already sent, only log.
+		slog.Error("clip", "id", c.ID, "error", err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestClips saves a clip, retags it, shares it and deletes it.
+func TestClips(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	for body, want := range map[string]int{
+		`{"file":"clip.mp4","start":2,"end":1}`:                      http.StatusBadRequest,
+		`{"file":"clip.mp4","start":-1,"end":1}`:                     http.StatusBadRequest,
+		`{"file":"clip.mp4","start":0,"end":1,"tags":["a,b"]}`:       http.StatusBadRequest,
+		`{"file":"missing.mp4","start":0,"end":1}`:                   http.StatusNotFound,
+		`{"file":"clip.mp4","name":"Car stops","start":1.5,"end":4}`: http.StatusCreated,
+	} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/clips", "", body, nil); resp.StatusCode != want {
+			t.Fatalf("%s: got status %d, want %d: %s", body, resp.StatusCode, want, b)
+		}
+	}
+	var list struct {
+		Clips []clip `json:"clips"`
+	}
+	if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/clips", "", `"clips":[`)), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Clips) != 1 {
+		t.Fatalf("got %+v", list.Clips)
+	}
+	c := list.Clips[0]
+	u := ts.URL + "/api/clips/" + c.ID
+	if resp, b := testDo(t, "POST", u, "", `{"name":"Car stops","tags":["keep","incident","keep"]}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	testPage(t, ts.URL+"/api/clips?tag=incident", "", `{"clips":[{"id":"`+c.ID+`","file":"clip.mp4","name":"Car stops","start":1.5,"end":4,"tags":["incident","keep"],`)
+	testPage(t, ts.URL+"/api/clips?tag=other", "", `{"clips":[]}`)
+	testPage(t, ts.URL+"/clips", "", `"name":"Car stops"`)
+	testPage(t, ts.URL+"/", "", `"clips":1`)
+	// Rendering requires -data.
+	testPost(t, u+"/render", "", http.StatusNotImplemented)
+	if resp, b := testDo(t, "POST", ts.URL+"/api/jobs", "", `{"kind":"clip","files":["clip.mp4"]}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	resp, b := testDo(t, "POST", ts.URL+"/api/v1/shares", "", `{"clip":"`+c.ID+`"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var created struct {
+		Data v1Share `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(b), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Data.Clip != c.ID || created.Data.File != "clip.mp4" {
+		t.Fatalf("got %+v", created.Data)
+	}
+	if resp, b = testDo(t, "DELETE", u, "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	// The link stops working with the clip.
+	if status, _ := testGet(t, ts.URL+created.Data.URL, ""); status != http.StatusNotFound {
+		t.Fatalf("share: got status %d", status)
+	}
+	if resp, b = testDo(t, "DELETE", ts.URL+"/api/v1/shares/"+created.Data.ID, "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	if status, _ := testGet(t, u, ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+// TestClipFile serves a rendered clip and refuses one linking out of the
+// clips directory.
+func TestClipFile(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"a.mp4": "source"}, options{dataDir: t.TempDir()})
+	rendered := func() clip {
+		c := srv.clips.add(clip{File: "a.mp4", Start: 0, End: 1})
+		srv.clips.update(c.ID, func(v *clip) { v.Rendered = true })
+		return c
+	}
+	c := rendered()
+	if err := os.MkdirAll(filepath.Dir(srv.clips.path(c.ID)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srv.clips.path(c.ID), []byte("rendered"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if status, b := testGet(t, ts.URL+"/clips/"+c.ID+".mp4", ""); status != http.StatusOK || b != "rendered" {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+	secret := filepath.Join(t.TempDir(), "secret.mp4")
+	if err := os.WriteFile(secret, []byte("outside"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	escape := rendered()
+	if err := os.Symlink(secret, srv.clips.path(escape.ID)); err != nil {
+		t.Skip(err)
+	}
+	if _, b := testGet(t, ts.URL+"/clips/"+escape.ID+".mp4", ""); strings.Contains(b, "outside") {
+		t.Fatal("the clip escaped its directory")
+	}
+}
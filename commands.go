@@ -0,0 +1,312 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selectFiles returns the files in root, or only those named in args when not
+// empty. args are files or directories, relative to root or absolute.
+func selectFiles(root string, exts, args []string) ([]file, error) {
+	files := walk(root, exts, nil)
+	if len(args) == 0 {
+		return files, nil
+	}
+	var out []file
+	for _, a := range args {
+		if filepath.IsAbs(a) {
+			rel, err := filepath.Rel(root, a)
+			if err != nil {
+				return nil, err
+			}
+			a = rel
+		}
+		if !filepath.IsLocal(a) {
+			return nil, fmt.Errorf("%q is outside -root", a)
+		}
+		name := filepath.ToSlash(filepath.Clean(a))
+		found := false
+		for _, f := range files {
+			if name == "." || f.Name == name || strings.HasPrefix(f.Name, name+"/") {
+				out = append(out, f)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%q is not in -root", a)
+		}
+	}
+	return out, nil
+}
+
+// indexEntry is a line printed by the scan command.
+type indexEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Duration is in seconds, when ffprobe is available.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// cmdScan prints the index of the files as JSON lines, with their duration
+// when ffprobe is available.
+func cmdScan(ctx context.Context, w io.Writer, m *media, root string, exts []string) error {
+	enc := json.NewEncoder(w)
+	for _, f := range walk(root, exts, nil) {
+		e := indexEntry{Name: f.Name, Size: f.Size, ModTime: f.ModTime}
+		if m.ffprobe != "" && hasDuration(f.Name) {
+			if p, err := m.probe(ctx, root, f); err != nil {
+				slog.Warn("scan", "f", f.Name, "error", err)
+			} else {
+				e.Duration = p.Duration().Seconds()
+			}
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmdThumbs generates the thumbnails missing in m.thumbs.
+func cmdThumbs(ctx context.Context, w io.Writer, m *media, root string, files []file) error {
+	if m.ffmpeg == "" {
+		return errNoFFmpeg
+	}
+	failed := 0
+	for _, f := range files {
+		if t := mimeType(f.Name); !strings.HasPrefix(t, "video/") || t == "video/mp2t" {
+			continue
+		}
+		if _, err := os.Stat(m.thumbPath(f)); err == nil {
+			continue
+		}
+		if _, err := m.thumbnail(ctx, root, f); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", f.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "%s\n", f.Name)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d thumbnails failed", failed)
+	}
+	return ctx.Err()
+}
+
+// cmdTranscode writes a copy of the files with the transcode profile tp, by
+// default one that browsers can play: H.264 and AAC in an MP4 next to the
+// source. The streams already compatible are copied as is.
+func cmdTranscode(ctx context.Context, w io.Writer, m *media, root string, files []file, tp transcodeProfile) error {
+	if m.ffmpeg == "" || m.ffprobe == "" {
+		return errNoFFmpeg
+	}
+	failed := 0
+	for _, f := range files {
+		if !hasDuration(f.Name) || strings.HasSuffix(f.Name, ".m3u8") {
+			continue
+		}
+		dst, err := m.transcode(ctx, root, f, tp)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", f.Name, err)
+			failed++
+			continue
+		}
+		if dst != "" {
+			fmt.Fprintf(w, "%s\n", dst)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d files failed to transcode", failed)
+	}
+	return ctx.Err()
+}
+
+// transcode writes an MP4 of f with the profile tp and returns its name, or ""
+// if f is already compatible or was already transcoded. The default profile
+// writes <name>.mp4 and the others <name>.<profile>.mp4.
+func (m *media) transcode(ctx context.Context, root string, f file, tp transcodeProfile) (string, error) {
+	p, err := m.probe(ctx, root, f)
+	if err != nil {
+		return "", err
+	}
+	video, audio, scale, toneMap := "copy", "copy", false, false
+	// The decoder rotates the video upright, so the browsers ignoring the
+	// rotation metadata play the copy upright too.
+	v := p.streams("video")
+	rotated := len(v) != 0 && v[0].Rotation != 0
+	for _, s := range p.Streams {
+		switch {
+		case s.CodecType == "video":
+			scale = scale || (tp.Height != 0 && s.Height > tp.Height)
+			toneMap = toneMap || (tp.ToneMap != "off" && isHDR(s.ColorTransfer))
+			if s.CodecName != codecOf(tp.Video) || tp.Bitrate != "" || scale || toneMap || rotated {
+				video = tp.Video
+			}
+		case s.CodecType == "audio" && (s.CodecName != codecOf(tp.Audio) || tp.Loudnorm != 0):
+			audio = tp.Audio
+		}
+	}
+	base := strings.TrimSuffix(f.Name, path.Ext(f.Name))
+	dst := base + ".mp4"
+	if tp.Name != defaultProfile.Name {
+		dst = base + "." + tp.Name + ".mp4"
+	} else if path.Ext(f.Name) == ".mp4" && video == "copy" && audio == "copy" {
+		return "", nil
+	}
+	if dst == f.Name {
+		dst = strings.TrimSuffix(f.Name, ".mp4") + ".h264.mp4"
+	}
+	abs := filepath.Join(root, filepath.FromSlash(dst))
+	if _, err = os.Stat(abs); err == nil {
+		return "", nil
+	}
+	defer m.startJob("transcode", f.Name)()
+	args := append([]string{"-v", "error"}, m.decodeArgs(tp.HWAccel)...)
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, "-i", src, "-map", "0:v:0?", "-map", "0:a:0?", "-c:v", video)
+	if video != "copy" {
+		if tp.Preset != "" {
+			args = append(args, "-preset", tp.Preset)
+		}
+		if tp.CRF != 0 {
+			args = append(args, "-crf", strconv.Itoa(tp.CRF))
+		}
+		if tp.Bitrate != "" {
+			args = append(args, "-b:v", tp.Bitrate)
+		}
+		var filters []string
+		if scale {
+			filters = append(filters, "scale=-2:"+strconv.Itoa(tp.Height))
+		}
+		if toneMap {
+			filters = append(filters, toneMapFilter(tp.ToneMap))
+			args = append(args, toneMapArgs...)
+		}
+		if len(filters) != 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		if strings.HasPrefix(tp.Video, "lib") {
+			// The hardware encoders choose their own pixel format.
+			args = append(args, "-pix_fmt", "yuv420p")
+		}
+		args = append(args, m.encodeArgs()...)
+	}
+	args = append(args, "-c:a", audio)
+	if audio != "copy" {
+		if tp.AudioBitrate != "" {
+			args = append(args, "-b:a", tp.AudioBitrate)
+		}
+		if tp.Channels != 0 {
+			args = append(args, "-ac", strconv.Itoa(tp.Channels))
+		}
+		if tp.Loudnorm != 0 {
+			// loudnorm resamples to 192kHz.
+			args = append(args, "-af", loudnormFilter(tp.Loudnorm, m.loudness.get(f)), "-ar", "48000")
+		}
+	}
+	// Write to a temporary file so a partial output is never in the library.
+	tmp := abs + ".part"
+	args = append(args, progressArgs...)
+	args = append(args, "-movflags", "+faststart", "-f", "mp4", tmp)
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	cmd.Stdout = m.progress("transcode", f.Name, p.Duration(), 0, 1)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return dst, os.Rename(tmp, abs)
+}
+
+// cmdVerify checks that the playlists' segments exist and, when ffmpeg is
+// available, that the media files decode without error.
+func cmdVerify(ctx context.Context, w io.Writer, m *media, root string, files []file) error {
+	if m.ffmpeg == "" {
+		slog.Warn("verify", "msg", "ffmpeg not found; only the playlists are verified")
+	}
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	failed := 0
+	for _, f := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if strings.HasSuffix(f.Name, ".m3u8") {
+			err = verifyPlaylist(r, f.Name)
+		} else if m.ffmpeg != "" && hasDuration(f.Name) {
+			err = m.verify(ctx, root, f)
+		} else {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", f.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "ok %s\n", f.Name)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d files failed verification", failed)
+	}
+	return nil
+}
+
+// verifyPlaylist returns an error if a segment of the playlist is missing.
+func verifyPlaylist(root *os.Root, name string) error {
+	segs, err := playlistSegments(root, name)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if _, err = os.Stat(s); err != nil {
+			return fmt.Errorf("segment %q is missing", filepath.Base(s))
+		}
+	}
+	return nil
+}
+
+// verify decodes f entirely and returns the errors reported by ffmpeg.
+func (m *media) verify(ctx context.Context, root string, f file) error {
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return err
+	}
+	defer m.startJob("verify", f.Name)()
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, "-v", "error", "-i", src, "-f", "null", "-")
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	err = m.run(ctx, cmd)
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return errors.New(strings.SplitN(msg, "\n", 2)[0])
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	return nil
+}
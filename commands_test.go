@@ -0,0 +1,38 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"cam/live.m3u8": "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n"})
+	m := newMedia()
+	var out bytes.Buffer
+	if err := cmdScan(t.Context(), &out, m, root, defaultExts); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"cam/live.m3u8","size":44,`; !strings.HasPrefix(out.String(), want) {
+		t.Fatalf("scan: got %q, want %q", out.String(), want)
+	}
+	files, err := selectFiles(root, defaultExts, []string{"cam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err = cmdVerify(t.Context(), &out, m, root, files); err == nil {
+		t.Fatal("verify: expected an error")
+	}
+	if want := "FAIL cam/live.m3u8: segment \"seg0.ts\" is missing\n"; out.String() != want {
+		t.Fatalf("verify: got %q, want %q", out.String(), want)
+	}
+	if _, err = selectFiles(root, defaultExts, []string{"../etc"}); err == nil {
+		t.Fatal("selectFiles: expected an error outside of root")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// playback are the codecs of a video and its variants, for the watch page to
+// play a variant when the browser can't play the original.
+type playback struct {
+	// Video and Audio are the codecs of the first video and audio streams, as
+	// named by ffprobe.
+	Video string `json:"video,omitempty"`
+	Audio string `json:"audio,omitempty"`
+	// HDR is set for the PQ and HLG videos, which look washed out on the SDR
+	// screens.
+	HDR bool `json:"hdr,omitempty"`
+	// Rotation, Width and Height are the ones of the first video stream, to
+	// rotate it when the browser ignores the rotation metadata.
+	Rotation int `json:"rotation,omitempty"`
+	Width    int `json:"width,omitempty"`
+	Height   int `json:"height,omitempty"`
+	// Fallbacks are the variants in the library, the preferred first.
+	Fallbacks []fallback `json:"fallbacks,omitempty"`
+}
+
+// fallback is a variant of a video.
+type fallback struct {
+	// Kind is "hls" for a ladder or "transcode" for a transcoded copy.
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Video is the codec of the variant.
+	Video string `json:"video"`
+	// HDR is set when the variant wasn't tone mapped to SDR.
+	HDR bool `json:"hdr,omitempty"`
+}
+
+// playbackOf returns the codecs of f and the variants the user can access.
+func (s *server) playbackOf(req *http.Request, f file, p *probeResult) *playback {
+	out := &playback{}
+	if v := p.streams("video"); len(v) != 0 {
+		out.Video = v[0].Codec
+		out.HDR = v[0].HDR
+		out.Rotation, out.Width, out.Height = v[0].Rotation, v[0].Width, v[0].Height
+	}
+	if a := p.streams("audio"); len(a) != 0 {
+		out.Audio = a[0].Codec
+	}
+	add := func(kind, name, video string, hdr bool) {
+		if name != f.Name && s.hasFile(name) && s.canAccess(req, name) {
+			out.Fallbacks = append(out.Fallbacks, fallback{Kind: kind, Name: name, Video: video, HDR: hdr})
+		}
+	}
+	// The ladders adapt to the bandwidth and are always SDR; see m.ladder.
+	add("hls", ladderDir(f.Name)+".m3u8", "h264", false)
+	// The names written by m.transcode.
+	base := strings.TrimSuffix(f.Name, path.Ext(f.Name))
+	for _, tp := range s.media.profiles.list() {
+		hdr := out.HDR && tp.ToneMap == "off"
+		if tp.Name == defaultProfile.Name {
+			add("transcode", base+".mp4", codecOf(tp.Video), hdr)
+			add("transcode", base+".h264.mp4", codecOf(tp.Video), hdr)
+		} else {
+			add("transcode", base+"."+tp.Name+".mp4", codecOf(tp.Video), hdr)
+		}
+	}
+	return out
+}
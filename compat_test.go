@@ -0,0 +1,61 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// testUserRequest returns a request authenticated as user.
+func testUserRequest(user string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+func TestPlaybackFallbacks(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "movie/heat.h264.mp4 alice\n")
+	var tp transcodeProfiles
+	if err := tp.Set("small=height=720"); err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := newTestServer(t, map[string]string{
+		"movie/heat.mkv":       testMP4,
+		"movie/heat.mp4":       testMP4,
+		"movie/heat.h264.mp4":  testMP4,
+		"movie/heat.small.mp4": testMP4,
+		"movie/heat.abr.m3u8":  "#EXTM3U\n",
+		"other.mkv":            testMP4,
+	}, options{users: u, access: a, profiles: tp})
+	var p probeResult
+	if err := json.Unmarshal([]byte(`{"streams":[{"codec_type":"video","codec_name":"hevc"},{"codec_type":"audio","codec_name":"eac3"}]}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string][]fallback{
+		"alice": {
+			{Kind: "hls", Name: "movie/heat.abr.m3u8", Video: "h264"},
+			{Kind: "transcode", Name: "movie/heat.mp4", Video: "h264"},
+			{Kind: "transcode", Name: "movie/heat.h264.mp4", Video: "h264"},
+			{Kind: "transcode", Name: "movie/heat.small.mp4", Video: "h264"},
+		},
+		"bob": {
+			{Kind: "hls", Name: "movie/heat.abr.m3u8", Video: "h264"},
+			{Kind: "transcode", Name: "movie/heat.mp4", Video: "h264"},
+			{Kind: "transcode", Name: "movie/heat.small.mp4", Video: "h264"},
+		},
+	} {
+		got := srv.playbackOf(testUserRequest(user), file{Name: "movie/heat.mkv"}, &p)
+		if got.Video != "hevc" || got.Audio != "eac3" || !slices.Equal(got.Fallbacks, want) {
+			t.Fatalf("%s: got %+v, want %+v", user, got, want)
+		}
+	}
+	if got := srv.playbackOf(testUserRequest("bob"), file{Name: "other.mkv"}, &p); len(got.Fallbacks) != 0 {
+		t.Fatalf("got %+v", got.Fallbacks)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize is the minimum Content-Length worth compressing.
+const compressMinSize = 1024
+
+var gzipPool = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+var zstdPool = sync.Pool{
+	New: func() any {
+		// Browsers limit the window size to 8MiB.
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	},
+}
+
+// isCompressible returns true for the text Content-Types: pages, playlists,
+// feeds and JSON.
+func isCompressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch t {
+	case "application/json", "application/vnd.apple.mpegurl", "application/dash+xml",
+		"application/atom+xml", "application/rss+xml", "application/xml", "application/x-subrip",
+		"image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(t, "text/")
+}
+
+// acceptEncoding returns the preferred supported encoding, "zstd", "gzip" or
+// "".
+func acceptEncoding(req *http.Request) string {
+	gz := false
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "zstd":
+			return "zstd"
+		case "gzip":
+			gz = true
+		}
+	}
+	if gz {
+		return "gzip"
+	}
+	return ""
+}
+
+// compressHandler compresses the text responses with zstd or gzip based on
+// Accept-Encoding. Media files are passed through, keeping sendfile.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		enc := acceptEncoding(req)
+		// WebSocket connections hijack the ResponseWriter.
+		if enc == "" || req.Method == http.MethodHead || req.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: enc}
+		defer cw.close()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// compressWriter decides whether to compress when the headers are written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	// w is the encoder, nil when the response is not compressed.
+	w io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	if h.Get("Vary") == "" {
+		h.Set("Vary", "Accept-Encoding")
+	}
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || !isCompressible(h.Get("Content-Type")) {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if l, err := strconv.Atoi(h.Get("Content-Length")); err == nil && l < compressMinSize {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	// The compressed representation is different, a range of it doesn't make
+	// sense.
+	h.Del("Accept-Ranges")
+	if e := h.Get("ETag"); e != "" && !strings.HasPrefix(e, "W/") {
+		h.Set("ETag", "W/"+e)
+	}
+	switch c.encoding {
+	case "zstd":
+		z := zstdPool.Get().(*zstd.Encoder)
+		z.Reset(c.ResponseWriter)
+		c.w = z
+	case "gzip":
+		g := gzipPool.Get().(*gzip.Writer)
+		g.Reset(c.ResponseWriter)
+		c.w = g
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.w != nil {
+		return c.w.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile for the responses that are not compressed.
+func (c *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.w != nil {
+		return io.Copy(c.w, r)
+	}
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.ResponseWriter}, r)
+}
+
+func (c *compressWriter) Flush() {
+	switch w := c.w.(type) {
+	case *zstd.Encoder:
+		_ = w.Flush()
+	case *gzip.Writer:
+		_ = w.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressWriter) close() {
+	switch w := c.w.(type) {
+	case *zstd.Encoder:
+		_ = w.Close()
+		w.Reset(nil)
+		zstdPool.Put(w)
+	case *gzip.Writer:
+		_ = w.Close()
+		w.Reset(nil)
+		gzipPool.Put(w)
+	}
+	c.w = nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompress(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"front/20241015_140200.mp4": testMP4}, options{})
+	for _, c := range []struct {
+		path, encoding, want string
+	}{
+		{"/", "zstd", "const data = "},
+		{"/api/timeline", "gzip", `"recordings":[`},
+	} {
+		resp, b := testDo(t, "GET", ts.URL+c.path, "", "", http.Header{"Accept-Encoding": {c.encoding}})
+		if e := resp.Header.Get("Content-Encoding"); e != c.encoding {
+			t.Fatalf("%s: got Content-Encoding %q", c.path, e)
+		}
+		var r io.Reader
+		var err error
+		if c.encoding == "zstd" {
+			var d *zstd.Decoder
+			if d, err = zstd.NewReader(strings.NewReader(b)); err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			r = d
+		} else if r, err = gzip.NewReader(strings.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		d, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(d), c.want) {
+			t.Fatalf("%s: missing %q", c.path, c.want)
+		}
+	}
+	// The media are not compressed.
+	if resp, _ := testDo(t, "GET", ts.URL+rawURL("front/20241015_140200.mp4"), "", "", http.Header{"Accept-Encoding": {"gzip"}}); resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal("the video was compressed")
+	}
+}
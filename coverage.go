@@ -0,0 +1,236 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span is a byte range [Start, End) of a file.
+type span struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// fileCoverage is which parts of a file were sent to clients.
+type fileCoverage struct {
+	Size     int64     `json:"size"`
+	Spans    []span    `json:"spans"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// covered returns the number of bytes sent at least once.
+func (f *fileCoverage) covered() int64 {
+	n := int64(0)
+	for _, s := range f.Spans {
+		n += s.End - s.Start
+	}
+	return n
+}
+
+// add merges the span into the sorted and non-overlapping spans.
+func (f *fileCoverage) add(s span) {
+	out := make([]span, 0, len(f.Spans)+1)
+	for _, x := range f.Spans {
+		if x.End < s.Start || x.Start > s.End {
+			out = append(out, x)
+			continue
+		}
+		s.Start = min(s.Start, x.Start)
+		s.End = max(s.End, x.End)
+	}
+	out = append(out, s)
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	f.Spans = out
+}
+
+// coverage records the byte ranges of each file sent by /raw/, to tell if a
+// recording was watched and how far.
+//
+// It is saved to p when not empty.
+type coverage struct {
+	p string
+
+	mu    sync.Mutex
+	files map[string]*fileCoverage
+	dirty bool
+}
+
+// newCoverage loads the coverage saved in p, if any.
+func newCoverage(p string) (*coverage, error) {
+	c := &coverage{p: p, files: map[string]*fileCoverage{}}
+	if err := readJSON(p, &c.files); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// add records that the span of the file name of size bytes was sent.
+func (c *coverage) add(name string, size int64, s span) {
+	if s.End <= s.Start {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[name]
+	if f == nil || f.Size != size {
+		// New or rewritten file.
+		f = &fileCoverage{Size: size}
+		c.files[name] = f
+	}
+	f.add(s)
+	f.LastSeen = time.Now().UTC().Truncate(time.Second)
+	c.dirty = true
+}
+
+// get returns a copy of the coverage of the file name, if any.
+func (c *coverage) get(name string) (fileCoverage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[name]
+	if f == nil {
+		return fileCoverage{}, false
+	}
+	return *f, true
+}
+
+// save writes the coverage to disk if it changed.
+func (c *coverage) save() error {
+	c.mu.Lock()
+	if c.p == "" || !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(c.files)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.p, b)
+}
+
+// countingWriter counts the bytes of the body actually sent. ReadFrom is
+// forwarded so sendfile is still used.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.ResponseWriter}, r)
+	}
+	c.n += n
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// sentSpan returns the span of the file sent in the response, based on its
+// status and Content-Range. Multipart responses are ignored.
+func (c *countingWriter) sentSpan() span {
+	start := int64(0)
+	if c.status == http.StatusPartialContent {
+		var end, size int64
+		cr := c.Header().Get("Content-Range")
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return span{}
+		}
+	} else if c.status != http.StatusOK {
+		return span{}
+	}
+	return span{Start: start, End: start + c.n}
+}
+
+// coverageStat is the coverage of a file, or of a playlist's segments, as
+// returned by /api/coverage.
+type coverageStat struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Covered  int64     `json:"covered"`
+	Percent  float64   `json:"percent"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// coverageStats returns the coverage of each watched file the user of the
+// request can see. HLS segments are summed up in their playlist.
+func (s *server) coverageStats(req *http.Request) []coverageStat {
+	out := []coverageStat{}
+	for _, f := range s.visibleFiles(req) {
+		st := coverageStat{Name: f.Name}
+		if strings.HasSuffix(f.Name, ".m3u8") {
+			segs, _ := playlistSegments(s.rootDir, f.Name)
+			for _, p := range segs {
+				rel, err := filepath.Rel(s.root, p)
+				if err != nil {
+					continue
+				}
+				sf, ok := s.getFile(filepath.ToSlash(rel))
+				if !ok {
+					continue
+				}
+				st.Size += sf.Size
+				if c, ok := s.coverage.get(sf.Name); ok && c.Size == sf.Size {
+					st.Covered += c.covered()
+					if c.LastSeen.After(st.LastSeen) {
+						st.LastSeen = c.LastSeen
+					}
+				}
+			}
+		} else if c, ok := s.coverage.get(f.Name); ok && c.Size == f.Size {
+			st.Size = f.Size
+			st.Covered = c.covered()
+			st.LastSeen = c.LastSeen
+		}
+		if st.Covered == 0 {
+			continue
+		}
+		st.Percent = float64(int(1000*float64(st.Covered)/float64(st.Size))) / 10
+		out = append(out, st)
+	}
+	return out
+}
+
+func (s *server) serveCoverageAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"coverage": s.coverageStats(req)})
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestFileCoverage(t *testing.T) {
+	var f fileCoverage
+	for _, s := range []span{{10, 20}, {30, 40}, {15, 25}, {0, 5}, {25, 30}} {
+		f.add(s)
+	}
+	if want := []span{{0, 5}, {10, 40}}; !slices.Equal(f.Spans, want) {
+		t.Fatalf("got %v, want %v", f.Spans, want)
+	}
+	if n := f.covered(); n != 35 {
+		t.Fatalf("got %d", n)
+	}
+}
+
+// TestCoverageAPI checks that the segments' coverage is summed up in their
+// playlist.
+func TestCoverageAPI(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{
+		"clip.mp4":       testMP4,
+		"vod/index.m3u8": "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n#EXTINF:2.0,\nseg1.ts\n#EXT-X-ENDLIST\n",
+		"vod/seg0.ts":    "0123456789",
+		"vod/seg1.ts":    "0123456789",
+	}, options{})
+	srv.coverage.add("clip.mp4", int64(len(testMP4)), span{0, int64(len(testMP4))})
+	srv.coverage.add("vod/seg0.ts", 10, span{0, 10})
+	var data struct {
+		Coverage []coverageStat `json:"coverage"`
+	}
+	if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/coverage", "", `"name":"clip.mp4","size":24,"covered":24,"percent":100,`)), &data); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range data.Coverage {
+		got = append(got, c.Name)
+		if c.Name == "vod/index.m3u8" && (c.Size != 20 || c.Percent != 50) {
+			t.Fatalf("got %+v", c)
+		}
+	}
+	if want := []string{"clip.mp4", "vod/index.m3u8", "vod/seg0.ts"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
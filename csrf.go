@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// csrfHandler rejects the cross site requests modifying the state, so a page
+// of another site open in the same browser can't use the credentials the
+// browser remembers for this one.
+//
+// Browsers send Sec-Fetch-Site; the older ones only send Origin. The requests
+// with neither come from other HTTP clients. The requests with an API token
+// are allowed since browsers never add one by themselves.
+func csrfHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isCrossSite(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		http.Error(w, "Cross site request rejected", http.StatusForbidden)
+	})
+}
+
+// isCrossSite returns true for an unsafe request sent by a browser from
+// another site.
+func isCrossSite(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return false
+	}
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		// "none" is a navigation typed by the user.
+		return site != "same-origin" && site != "none"
+	}
+	o := req.Header.Get("Origin")
+	if o == "" {
+		return false
+	}
+	u, err := url.Parse(o)
+	return err != nil || u.Host != req.Host
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	for _, tc := range []struct {
+		key, value string
+		want       int
+	}{
+		{"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		{"Sec-Fetch-Site", "same-origin", http.StatusNoContent},
+		{"Sec-Fetch-Site", "none", http.StatusNoContent},
+		{"Origin", "http://evil.example", http.StatusForbidden},
+		{"Origin", ts.URL, http.StatusNoContent},
+		{"Authorization", "Bearer x", http.StatusNoContent},
+		{"", "", http.StatusNoContent},
+	} {
+		hdr := http.Header{}
+		if tc.key != "" {
+			hdr.Set(tc.key, tc.value)
+			if tc.key == "Authorization" {
+				hdr.Set("Sec-Fetch-Site", "cross-site")
+			}
+		}
+		if resp, _ := testDo(t, "POST", ts.URL+"/api/profile/favorite/clip.mp4", "", "", hdr); resp.StatusCode != tc.want {
+			t.Fatalf("%s: %s: got status %d, want %d", tc.key, tc.value, resp.StatusCode, tc.want)
+		}
+	}
+	// The safe methods are always allowed.
+	if resp, _ := testDo(t, "GET", ts.URL+"/api/profile", "", "", http.Header{"Sec-Fetch-Site": {"cross-site"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to the user and the total size of the
+// volume containing p.
+func diskSpace(p string) (free, total uint64, err error) {
+	var s unix.Statfs_t
+	if err = unix.Statfs(p, &s); err != nil {
+		return 0, 0, err
+	}
+	return uint64(s.Bavail) * uint64(s.Bsize), uint64(s.Blocks) * uint64(s.Bsize), nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the bytes available to the user and the total size of the
+// volume containing p.
+func diskSpace(p string) (free, total uint64, err error) {
+	s, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = windows.GetDiskFreeSpaceEx(s, &free, &total, nil)
+	return free, total, err
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partialHashSize is how much of the start and the end of the files is hashed
+// to rule out most of the files of the same size before hashing them fully.
+const partialHashSize = 64 << 10
+
+// duplicateGroup is a set of files with the same content.
+type duplicateGroup struct {
+	Size  int64           `json:"size"`
+	Hash  string          `json:"hash"`
+	Files []duplicateFile `json:"files"`
+}
+
+type duplicateFile struct {
+	Name    string    `json:"name"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// wasted returns the bytes that would be freed by keeping a single copy.
+func (g *duplicateGroup) wasted() int64 {
+	return g.Size * int64(len(g.Files)-1)
+}
+
+// duplicates is the last duplicates report.
+type duplicates struct {
+	// scan requests a new scan.
+	scan chan struct{}
+
+	mu      sync.Mutex
+	groups  []duplicateGroup
+	updated time.Time
+	running bool
+}
+
+func newDuplicates() *duplicates {
+	return &duplicates{scan: make(chan struct{}, 1)}
+}
+
+// canHaveDuplicates returns false for the files that are expected to be
+// identical or only make sense in their directory, like HLS playlists and
+// segments.
+func canHaveDuplicates(f file) bool {
+	ext := path.Ext(f.Name)
+	return f.Size != 0 && ext != ".m3u8" && ext != ".ts"
+}
+
+// partialHash hashes the start and the end of the file.
+func partialHash(root *os.Root, f file) (string, error) {
+	h, err := root.Open(filepath.FromSlash(f.Name))
+	if err != nil {
+		return "", err
+	}
+	defer h.Close()
+	d := sha256.New()
+	if _, err = io.Copy(d, io.LimitReader(h, partialHashSize)); err != nil {
+		return "", err
+	}
+	if f.Size > 2*partialHashSize {
+		if _, err = io.Copy(d, io.NewSectionReader(h, f.Size-partialHashSize, partialHashSize)); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(d.Sum(nil)), nil
+}
+
+// groupBy splits the files by key, keeping only the groups with more than one
+// file. The files whose key can't be computed are skipped.
+func groupBy(ctx context.Context, files []file, key func(f file) (string, error)) [][]file {
+	m := map[string][]file{}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return nil
+		}
+		k, err := key(f)
+		if err != nil {
+			slog.Warn("duplicates", "f", f.Name, "error", err)
+			continue
+		}
+		m[k] = append(m[k], f)
+	}
+	var out [][]file
+	for _, l := range m {
+		if len(l) > 1 {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// findDuplicates returns the files with the same content, the ones wasting the
+// most space first. Only the files with the same size are compared, first by
+// their partial hash then by their full hash.
+func findDuplicates(ctx context.Context, root *os.Root, files []file, hashes *contentHashes) []duplicateGroup {
+	var candidates []file
+	for _, f := range files {
+		if canHaveDuplicates(f) {
+			candidates = append(candidates, f)
+		}
+	}
+	var out []duplicateGroup
+	for _, same := range groupBy(ctx, candidates, func(f file) (string, error) { return fmt.Sprint(f.Size), nil }) {
+		for _, partial := range groupBy(ctx, same, func(f file) (string, error) { return partialHash(root, f) }) {
+			full := map[string]string{}
+			for _, l := range groupBy(ctx, partial, func(f file) (string, error) {
+				h, err := hashes.sum(f)
+				full[f.Name] = h
+				return h, err
+			}) {
+				g := duplicateGroup{Size: l[0].Size, Hash: full[l[0].Name]}
+				for _, f := range l {
+					g.Files = append(g.Files, duplicateFile{Name: f.Name, ModTime: f.ModTime})
+				}
+				slices.SortFunc(g.Files, func(a, b duplicateFile) int { return strings.Compare(a.Name, b.Name) })
+				out = append(out, g)
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b duplicateGroup) int {
+		return cmp.Or(cmp.Compare(b.wasted(), a.wasted()), strings.Compare(a.Files[0].Name, b.Files[0].Name))
+	})
+	return out
+}
+
+// runDuplicates looks for duplicates at startup, then every day or when
+// requested, until ctx is canceled.
+func (s *server) runDuplicates(ctx context.Context) {
+	for {
+		s.dupes.mu.Lock()
+		s.dupes.running = true
+		s.dupes.mu.Unlock()
+		start := time.Now()
+		groups := findDuplicates(ctx, s.rootDir, s.getFiles(), s.hashes)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Info("duplicates", "groups", len(groups), "duration", time.Since(start).Round(time.Millisecond))
+		s.dupes.mu.Lock()
+		s.dupes.groups = groups
+		s.dupes.updated = time.Now()
+		s.dupes.running = false
+		s.dupes.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.dupes.scan:
+		case <-time.After(24 * time.Hour):
+		}
+	}
+}
+
+// duplicatesReport is the response of /api/duplicates.
+type duplicatesReport struct {
+	Groups []duplicateGroup `json:"groups"`
+	// Wasted is the bytes freed by keeping one copy of each file.
+	Wasted  int64     `json:"wasted"`
+	Updated time.Time `json:"updated"`
+	Running bool      `json:"running"`
+}
+
+// duplicatesReport returns the duplicates the user of the request can see. A
+// group with a single visible copy is skipped.
+func (s *server) duplicatesReport(req *http.Request) duplicatesReport {
+	s.dupes.mu.Lock()
+	defer s.dupes.mu.Unlock()
+	r := duplicatesReport{Groups: []duplicateGroup{}, Updated: s.dupes.updated, Running: s.dupes.running}
+	for _, g := range s.dupes.groups {
+		g.Files = slices.DeleteFunc(slices.Clone(g.Files), func(f duplicateFile) bool { return !s.canAccess(req, f.Name) })
+		if len(g.Files) < 2 {
+			continue
+		}
+		r.Groups = append(r.Groups, g)
+		r.Wasted += g.wasted()
+	}
+	return r
+}
+
+func (s *server) serveDuplicates(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, duplicatesHTML, map[string]any{"report": s.duplicatesReport(req), "admin": s.roleOf(req) == roleAdmin})
+}
+
+func (s *server) serveDuplicatesAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.duplicatesReport(req))
+}
+
+// serveDuplicatesScan requests a new scan.
+func (s *server) serveDuplicatesScan(w http.ResponseWriter, req *http.Request) {
+	select {
+	case s.dupes.scan <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveDuplicatesDelete deletes the files {"files": [...]} listed in the
+// report. It refuses to delete every copy of a file or a file modified since
+// it was hashed.
+func (s *server) serveDuplicatesDelete(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Files []string `json:"files"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || len(body.Files) == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	s.dupes.mu.Lock()
+	defer s.dupes.mu.Unlock()
+	remove := map[string]bool{}
+	for _, f := range body.Files {
+		if !s.canAccess(req, f) {
+			http.Error(w, fmt.Sprintf("%q is not a duplicate", f), http.StatusNotFound)
+			return
+		}
+		remove[f] = true
+	}
+	type target struct {
+		duplicateFile
+		size int64
+	}
+	var todo []target
+	for _, g := range s.dupes.groups {
+		kept := 0
+		for _, f := range g.Files {
+			if !remove[f.Name] {
+				kept++
+				continue
+			}
+			delete(remove, f.Name)
+			todo = append(todo, target{f, g.Size})
+		}
+		if kept == 0 {
+			http.Error(w, fmt.Sprintf("Refusing to delete every copy of %q", g.Files[0].Name), http.StatusConflict)
+			return
+		}
+	}
+	for f := range remove {
+		http.Error(w, fmt.Sprintf("%q is not a duplicate", f), http.StatusNotFound)
+		return
+	}
+	for _, f := range todo {
+		fi, err := s.rootDir.Stat(filepath.FromSlash(f.Name))
+		if err != nil || !fi.ModTime().Equal(f.ModTime) {
+			http.Error(w, fmt.Sprintf("%q changed since the scan; scan again", f.Name), http.StatusConflict)
+			return
+		}
+	}
+	var deleted []string
+	var freed int64
+	for _, f := range todo {
+		if err := s.rootDir.Remove(filepath.FromSlash(f.Name)); err != nil {
+			slog.Error("duplicates", "f", f.Name, "error", err)
+			continue
+		}
+		slog.Warn("duplicates", "deleted", f.Name, "user", userFrom(req))
+		removeEmptyDirs(s.rootDir, path.Dir(f.Name), s.opts.dropDir)
+		deleted = append(deleted, f.Name)
+		freed += f.size
+	}
+	// Update the report right away instead of waiting for the next scan.
+	var groups []duplicateGroup
+	for _, g := range s.dupes.groups {
+		var left []duplicateFile
+		for _, f := range g.Files {
+			if !slices.Contains(deleted, f.Name) {
+				left = append(left, f)
+			}
+		}
+		if g.Files = left; len(g.Files) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	s.dupes.groups = groups
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"deleted": deleted, "freed": freed})
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	// The files have the same size. b.mp4 differs at the end, so its partial
+	// hash differs, and c.mp4 differs in the middle, so only its full hash
+	// does.
+	content := strings.Repeat("0123456789abcdef", 3*partialHashSize/16)
+	other := content[:len(content)-1] + "x"
+	middle := content[:len(content)/2] + "x" + content[len(content)/2+1:]
+	srv, ts := newTestServer(t, map[string]string{"a.mp4": content, "copy/a.mp4": content, "b.mp4": other, "c.mp4": middle}, options{})
+	var r duplicatesReport
+	for start := time.Now(); r.Updated.IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the scan")
+		}
+		r = srv.duplicatesReport(&http.Request{})
+	}
+	if len(r.Groups) != 1 || len(r.Groups[0].Files) != 2 || r.Groups[0].Files[1].Name != "copy/a.mp4" || r.Wasted != int64(len(content)) {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	testPage(t, ts.URL+"/duplicates", "", `"hash":"`+r.Groups[0].Hash+`"`)
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		// Deleting every copy.
+		{`{"files":["a.mp4","copy/a.mp4"]}`, http.StatusConflict},
+		// Deleting a unique file.
+		{`{"files":["b.mp4"]}`, http.StatusNotFound},
+		{`{"files":["copy/a.mp4"]}`, http.StatusOK},
+	} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/duplicates/delete", "", c.body, nil); resp.StatusCode != c.want {
+			t.Fatalf("%s: got status %d, want %d: %s", c.body, resp.StatusCode, c.want, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.rootDir.Name(), "copy")); !os.IsNotExist(err) {
+		t.Fatalf("copy/ should be deleted: %v", err)
+	}
+	testPage(t, ts.URL+"/api/duplicates", "", `{"groups":[],"wasted":0,`)
+}
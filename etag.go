@@ -0,0 +1,228 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contentHashes computes the SHA-256 of the files, e.g. in the background so
+// they can be used as ETags. The cache is keyed by the file name, size and
+// modification time so a rewritten file is hashed again.
+type contentHashes struct {
+	root *os.Root
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	sums    map[file]string
+	pending map[file]bool
+}
+
+func newContentHashes(root *os.Root) *contentHashes {
+	return &contentHashes{
+		root:    root,
+		sem:     make(chan struct{}, 1),
+		sums:    map[file]string{},
+		pending: map[file]bool{},
+	}
+}
+
+// get returns the hash of f, or "" if it is not known yet. In that case, it is
+// computed in the background.
+func (c *contentHashes) get(f file) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h, ok := c.sums[f]; ok {
+		return h
+	}
+	if !c.pending[f] {
+		c.pending[f] = true
+		go c.compute(f)
+	}
+	return ""
+}
+
+// cached returns the hash of f if it is known.
+func (c *contentHashes) cached(f file) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sums[f]
+}
+
+// purge discards the known hashes and returns how many there were.
+func (c *contentHashes) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.sums)
+	c.sums = map[file]string{}
+	return n
+}
+
+func (c *contentHashes) compute(f file) {
+	sum, err := c.sum(f)
+	if err != nil {
+		slog.Warn("etag", "f", f.Name, "error", err)
+	}
+	c.mu.Lock()
+	delete(c.pending, f)
+	if sum != "" {
+		c.sums[f] = sum
+	}
+	c.mu.Unlock()
+}
+
+// sum returns the hash of f, hashing it now if it is not known yet.
+func (c *contentHashes) sum(f file) (string, error) {
+	c.mu.Lock()
+	h, ok := c.sums[f]
+	c.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+	// Hash one file at a time to not starve the streams.
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+	r, err := c.root.Open(filepath.FromSlash(f.Name))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	d := sha256.New()
+	if _, err = io.Copy(d, r); err != nil {
+		return "", err
+	}
+	h = hex.EncodeToString(d.Sum(nil))
+	c.mu.Lock()
+	c.sums[f] = h
+	c.mu.Unlock()
+	return h, nil
+}
+
+// etag returns a strong ETag for the content of f. It is the content hash when
+// -etag-hash is used and the hash is known, otherwise it is derived from the
+// size and modification time.
+func (s *server) etag(f file) string {
+	if s.opts.etagHash {
+		if h := s.hashes.get(f); h != "" {
+			return `"` + h + `"`
+		}
+	}
+	return `"` + strconv.FormatInt(f.Size, 16) + "-" + strconv.FormatInt(f.ModTime.UnixNano(), 16) + `"`
+}
+
+// setDigest sets the Repr-Digest (RFC 9530) and the legacy Digest (RFC 3230)
+// headers when the hash of f is known. Whole downloads start hashing the file
+// in the background so the next download has them; range requests, like the
+// ones of players, don't to not read the whole file for a seek.
+func (s *server) setDigest(h http.Header, req *http.Request, f file) {
+	if strings.HasSuffix(f.Name, ".m3u8") {
+		// Playlists can be live.
+		return
+	}
+	var sum string
+	if req.Header.Get("Range") == "" {
+		sum = s.hashes.get(f)
+	} else {
+		sum = s.hashes.cached(f)
+	}
+	if sum == "" {
+		return
+	}
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(b)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	h.Set("Digest", "SHA-256="+b64)
+}
+
+// serveChecksum returns the SHA-256 of a file, hashing it if needed.
+func (s *server) serveChecksum(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("path")
+	if !s.hasFile(name) || !s.canAccess(req, name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	fi, err := s.rootDir.Stat(filepath.FromSlash(name))
+	if err != nil || fi.IsDir() {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	f := file{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}
+	sum, err := s.hashes.sum(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": name, "size": f.Size, "mod_time": f.ModTime, "sha256": sum})
+}
+
+// serveContent serves the file name relative to root with an ETag, so
+// If-None-Match and If-Range are honored. The bytes sent are recorded in the
+// coverage.
+//
+// The ETag is derived from the opened file, so a client resuming a download
+// with If-Range after the file was rewritten gets the whole new file instead
+// of a range of it.
+func (s *server) serveContent(w http.ResponseWriter, req *http.Request, name string) {
+	h, err := s.open(name)
+	if err != nil {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	defer h.Close()
+	fi, err := h.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	f := file{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}
+	defer s.streams.start(req, name)()
+	w.Header().Set("ETag", s.etag(f))
+	s.setDigest(w.Header(), req, f)
+	if s.opts.readAhead > 0 {
+		readAhead(h, rangeStart(req), s.opts.readAhead)
+	}
+	// http.ServeContent uses sendfile when given an *os.File for whole files
+	// and single ranges; countingWriter forwards ReadFrom to keep it.
+	var content io.ReadSeeker = h
+	method := "sendfile"
+	if s.opts.readBuffer > 0 {
+		content = newBufferedFile(h, s.opts.readBuffer)
+		method = "buffered"
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	start := time.Now()
+	http.ServeContent(cw, req, name, fi.ModTime(), content)
+	d := time.Since(start)
+	s.metrics.sent(method, cw.n, d)
+	if req.Method == http.MethodGet && !strings.HasSuffix(name, ".m3u8") {
+		s.coverage.add(name, fi.Size(), cw.sentSpan())
+		// A whole download, as opposed to a player fetching ranges. The HLS
+		// segments are counted as plays of their playlist.
+		event := "stream"
+		if cw.status == http.StatusOK && cw.n == fi.Size() && !strings.HasSuffix(name, ".ts") {
+			s.views.add(name, 0, 1)
+			event = "download"
+		}
+		s.analytics.record(req, event, name, cw.status, cw.n, d)
+	}
+}
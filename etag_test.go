@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestConditional checks the If-None-Match and If-Range requests.
+func TestConditional(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	u := ts.URL + rawURL("clip.mp4")
+	resp, _ := testDo(t, "GET", u, "", "", nil)
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("got ETag %q", etag)
+	}
+	if resp, _ = testDo(t, "GET", u, "", "", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("If-None-Match: got status %d", resp.StatusCode)
+	}
+	resp, b := testDo(t, "GET", u, "", "", http.Header{"Range": {"bytes=2-5"}, "If-Range": {etag}})
+	if resp.StatusCode != http.StatusPartialContent || b != testMP4[2:6] {
+		t.Fatalf("If-Range: got status %d: %q", resp.StatusCode, b)
+	}
+	// A stale ETag means the file was rewritten, the whole file must be sent.
+	resp, b = testDo(t, "GET", u, "", "", http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"stale"`}})
+	if resp.StatusCode != http.StatusOK || b != testMP4 {
+		t.Fatalf("stale If-Range: got status %d with %d bytes", resp.StatusCode, len(b))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	sum := sha256.Sum256([]byte(testMP4))
+	testPage(t, ts.URL+"/api/checksum/clip.mp4", "", `"sha256":"`+hex.EncodeToString(sum[:])+`"`)
+	if status, _ := testGet(t, ts.URL+"/api/checksum/missing.mp4", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+	resp, _ := testDo(t, "GET", ts.URL+rawURL("clip.mp4"), "", "", nil)
+	if got, want := resp.Header.Get("Repr-Digest"), "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":"; got != want {
+		t.Fatalf("got Repr-Digest %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNoEXIF = errors.New("no EXIF date")
+
+// jpegEXIFDate returns the date the photo was taken from the EXIF metadata of
+// a JPEG.
+func jpegEXIFDate(r io.Reader) (time.Time, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return time.Time{}, errNoEXIF
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil || hdr[0] != 0xFF {
+			return time.Time{}, errNoEXIF
+		}
+		marker := hdr[1]
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if size < 0 || marker == 0xDA {
+			// Start of scan, no more metadata.
+			return time.Time{}, errNoEXIF
+		}
+		seg := make([]byte, size)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return time.Time{}, errNoEXIF
+		}
+		if marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffDate(seg[6:])
+		}
+	}
+}
+
+// tiffDate returns DateTimeOriginal, or DateTime, from a TIFF structure.
+func tiffDate(b []byte) (time.Time, error) {
+	if len(b) < 8 {
+		return time.Time{}, errNoEXIF
+	}
+	var bo binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return time.Time{}, errNoEXIF
+	}
+	// readIFD returns the ASCII value or the offset of the requested tags.
+	readIFD := func(off uint32, tag uint16) (string, uint32) {
+		if int(off)+2 > len(b) {
+			return "", 0
+		}
+		n := int(bo.Uint16(b[off:]))
+		for i := 0; i < n; i++ {
+			e := int(off) + 2 + 12*i
+			if e+12 > len(b) {
+				return "", 0
+			}
+			if bo.Uint16(b[e:]) != tag {
+				continue
+			}
+			count := bo.Uint32(b[e+4:])
+			val := bo.Uint32(b[e+8:])
+			if bo.Uint16(b[e+2:]) == 2 && count > 4 && int(val)+int(count) <= len(b) {
+				return strings.TrimRight(string(b[val:val+count]), "\x00 "), 0
+			}
+			return "", val
+		}
+		return "", 0
+	}
+	ifd0 := bo.Uint32(b[4:])
+	const (
+		tagDateTime         = 0x0132
+		tagExifIFD          = 0x8769
+		tagDateTimeOriginal = 0x9003
+	)
+	s := ""
+	if _, exif := readIFD(ifd0, tagExifIFD); exif != 0 {
+		s, _ = readIFD(exif, tagDateTimeOriginal)
+	}
+	if s == "" {
+		s, _ = readIFD(ifd0, tagDateTime)
+	}
+	if s == "" {
+		return time.Time{}, errNoEXIF
+	}
+	// EXIF dates have no time zone, they are in the camera's local time.
+	return time.ParseInLocation("2006:01:02 15:04:05", s, time.Local)
+}
+
+// photoDate returns when a photo was taken, from its EXIF metadata when
+// available, otherwise its modification time. The result is cached.
+func (m *media) photoDate(root *os.Root, f file) time.Time {
+	m.mu.Lock()
+	t, ok := m.dates[f]
+	m.mu.Unlock()
+	if ok {
+		return t
+	}
+	t = f.ModTime
+	if ext := strings.ToLower(filepath.Ext(f.Name)); ext == ".jpg" || ext == ".jpeg" {
+		if h, err := root.Open(filepath.FromSlash(f.Name)); err == nil {
+			if d, err2 := jpegEXIFDate(h); err2 == nil {
+				t = d
+			}
+			_ = h.Close()
+		}
+	}
+	m.mu.Lock()
+	m.dates[f] = t
+	m.mu.Unlock()
+	return t
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// playlistSegments returns the absolute path of the local segments referenced
+// by the playlist name, relative to root. The segments are passed to ffmpeg
+// as is, so the ones leading outside of root, e.g. via a symlink, are
+// rejected.
+func playlistSegments(root *os.Root, name string) ([]string, error) {
+	b, err := root.ReadFile(filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, s := range parsePlaylist(b).segments {
+		if strings.Contains(s, "://") {
+			return nil, fmt.Errorf("%s: remote segment %q is not supported", name, s)
+		}
+		rel := filepath.FromSlash(path.Join(path.Dir(name), s))
+		if !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("%s: segment %q is outside the root", name, s)
+		}
+		// A missing segment is reported when read.
+		if _, err = root.Stat(rel); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%s: segment %q: %w", name, s, err)
+		}
+		out = append(out, filepath.Join(root.Name(), rel))
+	}
+	return out, nil
+}
+
+// exportSegments returns the segments to export for target, which is either
+// a playlist or a directory of playlists. The playlists and the segments
+// whose name ok rejects are skipped.
+func (s *server) exportSegments(target string, ok func(name string) bool) ([]string, error) {
+	var playlists []string
+	if strings.HasSuffix(target, ".m3u8") {
+		if !s.hasFile(target) {
+			return nil, os.ErrNotExist
+		}
+		playlists = []string{target}
+	} else {
+		if target == "" {
+			target = "."
+		}
+		if !filepath.IsLocal(filepath.FromSlash(target)) {
+			return nil, os.ErrNotExist
+		}
+		for _, f := range s.getFiles() {
+			if path.Dir(f.Name) == target && strings.HasSuffix(f.Name, ".m3u8") && ok(f.Name) {
+				playlists = append(playlists, f.Name)
+			}
+		}
+		if len(playlists) == 0 {
+			return nil, os.ErrNotExist
+		}
+		sort.Strings(playlists)
+	}
+	var out []string
+	seen := map[string]bool{}
+	for _, p := range playlists {
+		segs, err := playlistSegments(s.rootDir, p)
+		if err != nil {
+			return nil, err
+		}
+		for _, seg := range segs {
+			// A repaired playlist may overlap with the original.
+			if seen[seg] {
+				continue
+			}
+			seen[seg] = true
+			// seg is joined to the root by playlistSegments.
+			if rel, _ := filepath.Rel(s.rootDir.Name(), seg); !ok(filepath.ToSlash(rel)) {
+				continue
+			}
+			out = append(out, seg)
+		}
+	}
+	return out, nil
+}
+
+// concatMP4 streams the segments concatenated with stream copy as a
+// fragmented MP4 to w.
+func (m *media) concatMP4(ctx context.Context, segs []string, w io.Writer) error {
+	if m.ffmpeg == "" {
+		return errNoFFmpeg
+	}
+	list, err := os.CreateTemp("", "serve-videos-concat-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	for _, s := range segs {
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(s, "'", `'\''`))
+	}
+	if err = list.Close(); err != nil {
+		return err
+	}
+	// The output is not seekable, so the moov atom must be written first.
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, "-v", "error", "-f", "concat", "-safe", "0", "-i", list.Name(),
+		"-c", "copy", "-bsf:a", "aac_adtstoasc", "-movflags", "frag_keyframe+empty_moov", "-f", "mp4", "pipe:1")
+	cmd.Stdout = w
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// serveExport serves a playlist, or all the playlists in a directory, as a
+// single MP4 file.
+func (s *server) serveExport(w http.ResponseWriter, req *http.Request) {
+	target, ok := strings.CutSuffix(req.PathValue("path"), ".mp4")
+	if !ok {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	target = strings.Trim(target, "/")
+	if !s.canAccess(req, target) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	segs, err := s.exportSegments(target, func(name string) bool {
+		return s.canAccess(req, name)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Invalid path", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(segs) == 0 {
+		http.Error(w, "No segment to export", 404)
+		return
+	}
+	if s.media.ffmpeg == "" {
+		http.Error(w, errNoFFmpeg.Error(), http.StatusNotImplemented)
+		return
+	}
+	name := strings.ReplaceAll(strings.TrimSuffix(target, ".m3u8"), "/", "_")
+	if name == "" {
+		name = "export"
+	}
+	h := w.Header()
+	h.Set("Content-Type", "video/mp4")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".mp4"}))
+	defer s.media.startJob("export", target)()
+	if err = s.media.concatMP4(req.Context(), segs, w); err != nil {
+		// Headers are already sent, only log.
+		slog.Error("export", "target", target, "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestExportAccess checks that a directory export skips the playlists and the
+// segments denied by -access.
+func TestExportAccess(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "cam/private* alice\nprivate alice\n")
+	srv, ts := newTestServer(t, map[string]string{
+		"cam/a.m3u8":       "#EXTM3U\n#EXTINF:2.0,\na.ts\n#EXTINF:2.0,\n../private/x.ts\n#EXT-X-ENDLIST\n",
+		"cam/a.ts":         "ts",
+		"cam/denied.m3u8":  "#EXTM3U\n#EXTINF:2.0,\n../private/x.ts\n#EXT-X-ENDLIST\n",
+		"cam/private.m3u8": "#EXTM3U\n#EXTINF:2.0,\nprivate.ts\n#EXT-X-ENDLIST\n",
+		"cam/private.ts":   "ts",
+		"private/x.ts":     "ts",
+	}, options{users: u, access: a})
+	segs := func(user, target string) []string {
+		out, err := srv.exportSegments(target, func(name string) bool {
+			return a.allowed(user, name)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range out {
+			rel, _ := filepath.Rel(srv.rootDir.Name(), out[i])
+			out[i] = filepath.ToSlash(rel)
+		}
+		return out
+	}
+	if got, want := segs("bob", "cam"), []string{"cam/a.ts"}; !slices.Equal(got, want) {
+		t.Fatalf("bob got %q, want %q", got, want)
+	}
+	if got, want := segs("alice", "cam"), []string{"cam/a.ts", "private/x.ts", "cam/private.ts"}; !slices.Equal(got, want) {
+		t.Fatalf("alice got %q, want %q", got, want)
+	}
+	// The segments of a playlist denied to bob are not exported to them.
+	if status, _ := testGet(t, ts.URL+"/export/cam/denied.m3u8.mp4", "bob"); status != 404 {
+		t.Fatalf("got status %d", status)
+	}
+}
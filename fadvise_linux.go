@@ -0,0 +1,24 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readAhead tells the kernel the file is read sequentially from offset and to
+// start reading n bytes in the background.
+func readAhead(f *os.File, offset, n int64) {
+	c, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = c.Control(func(fd uintptr) {
+		_ = unix.Fadvise(int(fd), 0, 0, unix.FADV_SEQUENTIAL)
+		_ = unix.Fadvise(int(fd), offset, n, unix.FADV_WILLNEED)
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// feedSize is the number of entries in the feed.
+const feedSize = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// baseURL returns the URL the client used to reach the server, without the
+// trailing slash.
+func baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+// recentFiles returns up to n files, most recently modified first.
+func recentFiles(files []file, n int) []file {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// serveFeed serves an Atom feed of the most recently added files.
+func (s *server) serveFeed(w http.ResponseWriter, req *http.Request) {
+	base := baseURL(req)
+	files := recentFiles(s.visibleFiles(req), feedSize)
+	f := atomFeed{
+		Title:  "serve-videos",
+		ID:     base + "/",
+		Link:   []atomLink{{Href: base + "/"}, {Href: base + "/feed.xml", Rel: "self", Type: "application/atom+xml"}},
+		Author: "serve-videos",
+	}
+	updated := time.Time{}
+	for _, e := range files {
+		u := base + rawURL(e.Name)
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   e.Name,
+			ID:      u,
+			Link:    atomLink{Href: base + s.linkURL(e.Name)},
+			Updated: e.ModTime.UTC().Format(time.RFC3339),
+		})
+		if e.ModTime.After(updated) {
+			updated = e.ModTime
+		}
+	}
+	f.Updated = updated.UTC().Format(time.RFC3339)
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Type", "application/atom+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	e := xml.NewEncoder(w)
+	e.Indent("", " ")
+	_ = e.Encode(&f)
+}
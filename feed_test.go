@@ -0,0 +1,21 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"sub dir/clip.mp4": testMP4}, options{})
+	var f atomFeed
+	if err := xml.Unmarshal([]byte(testPage(t, ts.URL+"/feed.xml", "", "<entry>")), &f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 || f.Entries[0].Title != "sub dir/clip.mp4" || f.Entries[0].ID != ts.URL+rawURL("sub dir/clip.mp4") {
+		t.Fatalf("unexpected entries %+v", f.Entries)
+	}
+}
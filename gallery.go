@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// imageExts are the photo extensions shown in the gallery instead of the
+// players.
+var imageExts = []string{".heic", ".jpeg", ".jpg", ".png"}
+
+// isImage returns true if the file name is a photo.
+func isImage(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range imageExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// photo is a photo as listed in the gallery.
+type photo struct {
+	Name string `json:"name"`
+	// Taken is the EXIF date in Unix seconds, or the modification time.
+	Taken int64 `json:"taken"`
+	// Version versions the thumbnail URL.
+	Version string `json:"v"`
+}
+
+// photos returns the photos the user of the request can see, most recent
+// first.
+func (s *server) photos(req *http.Request) []photo {
+	var out []photo
+	for _, f := range s.visibleFiles(req) {
+		if isImage(f.Name) && !isSidecarArt(f.Name) {
+			out = append(out, photo{Name: f.Name, Taken: s.media.photoDate(s.rootDir, f).Unix(), Version: s.media.thumbVersion(f)})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Taken > out[j].Taken })
+	return out
+}
+
+func (s *server) serveGallery(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, galleryHTML, map[string]any{"photos": s.photos(req)})
+}
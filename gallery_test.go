@@ -0,0 +1,48 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEXIFJPEG returns a JPEG with only an EXIF DateTimeOriginal.
+func testEXIFJPEG(date string) string {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = append(tiff, "\x01\x00\x69\x87\x04\x00\x01\x00\x00\x00\x1A\x00\x00\x00\x00\x00\x00\x00"...)
+	tiff = append(tiff, "\x01\x00\x03\x90\x02\x00\x14\x00\x00\x00\x2C\x00\x00\x00\x00\x00\x00\x00"...)
+	tiff = append(tiff, date+"\x00"...)
+	jpg := binary.BigEndian.AppendUint16([]byte("\xFF\xD8\xFF\xE1"), uint16(2+6+len(tiff)))
+	jpg = append(append(append(jpg, "Exif\x00\x00"...), tiff...), 0xFF, 0xD9)
+	return string(jpg)
+}
+
+func TestJPEGEXIFDate(t *testing.T) {
+	got, err := jpegEXIFDate(bytes.NewReader([]byte(testEXIFJPEG("2020:01:02 03:04:05"))))
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local); err != nil || !got.Equal(want) {
+		t.Fatalf("got %s, %v", got, err)
+	}
+	if _, err = jpegEXIFDate(bytes.NewReader([]byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"))); err == nil {
+		t.Fatal("expected an error without EXIF")
+	}
+}
+
+func TestGallery(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"photos/snap.jpg":  testEXIFJPEG("2020:01:02 03:04:05"),
+		"photos/still.png": "\x89PNG\r\n\x1a\n",
+		"clip.mp4":         testMP4,
+	}, options{})
+	taken := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local).Unix()
+	b := testPage(t, ts.URL+"/gallery", "", fmt.Sprintf(`{"name":"photos/snap.jpg","taken":%d,`, taken))
+	if !strings.Contains(b, `"name":"photos/still.png"`) || strings.Contains(b, `"name":"clip.mp4"`) {
+		t.Fatalf("unexpected gallery %q", b)
+	}
+}
@@ -1,15 +1,18 @@
 module github.com/maruel/serve-videos
 
-go 1.23.0
+go 1.25.0
 
 require (
+	github.com/klauspost/compress v1.17.11
 	github.com/lmittmann/tint v1.0.5
 	github.com/mattn/go-colorable v0.1.13
 	github.com/mattn/go-isatty v0.0.20
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
 	gopkg.in/fsnotify.v1 v1.4.7
 )
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
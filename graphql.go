@@ -0,0 +1,685 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// graphqlSchema is the schema served by /graphql, returned by a GET without a
+// query. Only queries are supported; there are no mutations, fragments,
+// directives or introspection.
+const graphqlSchema = `type Query {
+  # files returns the files in dir, with all the tags, containing all the
+  # words of query in their name or title, modified in [after, before).
+  # after and before are RFC 3339 times or dates like "2024-10-31".
+  files(dir: String, tags: [String!], query: String, after: String, before: String, first: Int): [File!]!
+  # file returns a file, or null if it is not in the library.
+  file(name: String!): File
+  # tags returns the tags in use.
+  tags: [Tag!]!
+}
+
+type File {
+  name: String!
+  # size is in bytes; it's a Float as it can exceed 32 bits.
+  size: Float!
+  modTime: String!
+  title: String!
+  tags: [String!]!
+  rating: Int!
+  plays: Int!
+  downloads: Int!
+  # The media information is null until the file was probed by ffprobe.
+  duration: Float
+  width: Int
+  height: Int
+  videoCodec: String
+  audioCodec: String
+  # The metadata from the .nfo sidecar, if any.
+  year: Int
+  plot: String
+  show: String
+  season: Int
+  episode: Int
+  # url, watchUrl and thumbnail are paths relative to the server.
+  url: String!
+  watchUrl: String!
+  thumbnail: String
+}
+
+type Tag {
+  name: String!
+  count: Int!
+}
+`
+
+// gqlField is a field selected in a query.
+type gqlField struct {
+	alias string
+	name  string
+	args  map[string]any
+	sel   []*gqlField
+}
+
+// gqlObject is a JSON object keeping the order of the fields selected.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlParser parses the subset of the GraphQL query language that is
+// supported.
+type gqlParser struct {
+	src  string
+	pos  int
+	vars map[string]any
+	// tok is the current token; kind is one of "name", "punct", "string",
+	// "number" or "" at the end.
+	tok, kind string
+}
+
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if strings.HasPrefix(p.src[p.pos:], "\uFEFF") {
+			// Byte order mark.
+			p.pos += 3
+		} else {
+			break
+		}
+	}
+	if p.pos == len(p.src) {
+		p.tok, p.kind = "", ""
+		return nil
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for p.pos < len(p.src) && isGQLNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind = "name"
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) != -1 {
+			p.pos++
+		}
+		p.kind = "number"
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			return p.errorf("block strings are not supported")
+		}
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' && p.src[p.pos] != '\n' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+			return p.errorf("unterminated string")
+		}
+		p.pos++
+		s, err := strconv.Unquote(p.src[start:p.pos])
+		if err != nil {
+			return p.errorf("invalid string %s", p.src[start:p.pos])
+		}
+		p.tok, p.kind = s, "string"
+		return nil
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = "punct"
+	case strings.IndexByte("!$():=@[]{|}", c) != -1:
+		p.pos++
+		p.kind = "punct"
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return p.errorf("unexpected character %q", r)
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+func isGQLNameChar(c byte) bool {
+	return c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z') || (c >= '0' && c <= '9')
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// expect consumes the punctuator tok.
+func (p *gqlParser) expect(tok string) error {
+	if p.kind != "punct" || p.tok != tok {
+		return p.errorf("expected %q, got %q", tok, p.tok)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.kind != "name" {
+		return "", p.errorf("expected a name, got %q", p.tok)
+	}
+	n := p.tok
+	return n, p.next()
+}
+
+// document parses the operations and returns the selection of the one named
+// op, or of the only one if op is empty.
+func (p *gqlParser) document(op string) ([]*gqlField, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var found []*gqlField
+	count := 0
+	for p.kind != "" {
+		name := ""
+		if p.kind == "name" {
+			switch p.tok {
+			case "query":
+			case "mutation", "subscription":
+				return nil, p.errorf("%s is not supported", p.tok)
+			case "fragment":
+				return nil, p.errorf("fragments are not supported")
+			default:
+				return nil, p.errorf("unexpected %q", p.tok)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.kind == "name" {
+				name = p.tok
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+			}
+			if p.kind == "punct" && p.tok == "(" {
+				if err := p.skipVariables(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		sel, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		count++
+		if op == "" || name == op {
+			found = sel
+		}
+	}
+	if count == 0 {
+		return nil, errors.New("no operation")
+	}
+	if op == "" && count > 1 {
+		return nil, errors.New("operationName is required with multiple operations")
+	}
+	if found == nil {
+		return nil, fmt.Errorf("operation %q not found", op)
+	}
+	return found, nil
+}
+
+// skipVariables skips the variable definitions. Their values come from the
+// "variables" of the request; the types are not checked.
+func (p *gqlParser) skipVariables() error {
+	depth := 0
+	for {
+		if p.kind == "" {
+			return p.errorf("unterminated variable definitions")
+		}
+		if p.kind == "punct" && p.tok == "(" {
+			depth++
+		} else if p.kind == "punct" && p.tok == ")" {
+			if depth--; depth == 0 {
+				return p.next()
+			}
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var out []*gqlField
+	for p.kind != "punct" || p.tok != "}" {
+		if p.kind == "punct" && p.tok == "..." {
+			return nil, p.errorf("fragments are not supported")
+		}
+		f := &gqlField{}
+		var err error
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		f.alias = f.name
+		if p.kind == "punct" && p.tok == ":" {
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+			if f.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.kind == "punct" && p.tok == "(" {
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+			f.args = map[string]any{}
+			for p.kind != "punct" || p.tok != ")" {
+				n, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expect(":"); err != nil {
+					return nil, err
+				}
+				if f.args[n], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			if err = p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.kind == "punct" && p.tok == "@" {
+			return nil, p.errorf("directives are not supported")
+		}
+		if p.kind == "punct" && p.tok == "{" {
+			if f.sel, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, f)
+	}
+	if len(out) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return out, p.next()
+}
+
+// value parses a value, replacing the variables.
+func (p *gqlParser) value() (any, error) {
+	tok, kind := p.tok, p.kind
+	switch {
+	case kind == "punct" && tok == "$":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return p.vars[n], nil
+	case kind == "punct" && tok == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		l := []any{}
+		for p.kind != "punct" || p.tok != "]" {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, p.next()
+	case kind == "punct" && tok == "{":
+		return nil, p.errorf("input objects are not supported")
+	case kind == "string":
+		return tok, p.next()
+	case kind == "number":
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok)
+		}
+		return f, p.next()
+	case kind == "name":
+		var v any = tok
+		switch tok {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("expected a value, got %q", tok)
+}
+
+// gqlString returns the string argument name, or "" if missing.
+func gqlString(args map[string]any, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("argument %q must be a String", name)
+	}
+}
+
+// gqlTime parses the time argument name, either RFC 3339 or a date.
+func gqlTime(args map[string]any, name string) (time.Time, error) {
+	v, err := gqlString(args, name)
+	if err != nil || v == "" {
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("argument %q must be an RFC 3339 time or a date", name)
+}
+
+// graphql runs the query selection for the user.
+func (s *server) graphql(user string, sel []*gqlField) (gqlObject, error) {
+	var out gqlObject
+	for _, f := range sel {
+		var v any
+		switch f.name {
+		case "__typename":
+			v = "Query"
+		case "files":
+			ff := fileFilter{}
+			var err error
+			if ff.dir, err = gqlString(f.args, "dir"); err != nil {
+				return nil, err
+			}
+			if ff.query, err = gqlString(f.args, "query"); err != nil {
+				return nil, err
+			}
+			switch t := f.args["tags"].(type) {
+			case nil:
+			case string:
+				ff.tags = []string{t}
+			case []any:
+				for _, x := range t {
+					tag, ok := x.(string)
+					if !ok {
+						return nil, errors.New("argument \"tags\" must be a list of String")
+					}
+					ff.tags = append(ff.tags, tag)
+				}
+			default:
+				return nil, errors.New("argument \"tags\" must be a list of String")
+			}
+			after, err := gqlTime(f.args, "after")
+			if err != nil {
+				return nil, err
+			}
+			before, err := gqlTime(f.args, "before")
+			if err != nil {
+				return nil, err
+			}
+			first := -1
+			switch n := f.args["first"].(type) {
+			case nil:
+			case float64:
+				if n < 0 || n != float64(int(n)) {
+					return nil, errors.New("argument \"first\" must be a positive Int")
+				}
+				first = int(n)
+			default:
+				return nil, errors.New("argument \"first\" must be an Int")
+			}
+			l := []gqlObject{}
+			r := s.gqlResolver()
+			for _, fi := range s.findFiles(user, ff) {
+				if len(l) == first {
+					break
+				}
+				if (!after.IsZero() && fi.ModTime.Before(after)) || (!before.IsZero() && !fi.ModTime.Before(before)) {
+					continue
+				}
+				o, err := r.file(fi, f)
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, o)
+			}
+			v = l
+		case "file":
+			name, err := gqlString(f.args, "name")
+			if err != nil {
+				return nil, err
+			}
+			if fl, ok := s.getFile(name); ok && s.opts.access.allowed(user, fl.Name) {
+				fi := fileInfo{Name: fl.Name, Size: fl.Size, ModTime: fl.ModTime, Tags: s.tags.get(fl.Name), Rating: s.profiles.get(user).Ratings[fl.Name], viewCount: s.views.all()[fl.Name]}
+				o, err := s.gqlResolver().file(fi, f)
+				if err != nil {
+					return nil, err
+				}
+				v = o
+			}
+		case "tags":
+			if f.sel == nil {
+				return nil, errors.New("field \"tags\" requires a selection")
+			}
+			counts := s.tags.counts(func(n string) bool { return s.opts.access.allowed(user, n) })
+			l := []gqlObject{}
+			for _, name := range slices.Sorted(maps.Keys(counts)) {
+				var o gqlObject
+				for _, sf := range f.sel {
+					switch sf.name {
+					case "__typename":
+						o = append(o, gqlEntry{sf.alias, "Tag"})
+					case "name":
+						o = append(o, gqlEntry{sf.alias, name})
+					case "count":
+						o = append(o, gqlEntry{sf.alias, counts[name]})
+					default:
+						return nil, fmt.Errorf("cannot query field %q on type \"Tag\"", sf.name)
+					}
+				}
+				l = append(l, o)
+			}
+			v = l
+		default:
+			return nil, fmt.Errorf("cannot query field %q on type \"Query\"", f.name)
+		}
+		out = append(out, gqlEntry{f.alias, v})
+	}
+	return out, nil
+}
+
+// gqlResolver resolves the fields of the files.
+type gqlResolver struct {
+	s      *server
+	titles map[string]string
+	meta   map[string]*sidecar
+}
+
+func (s *server) gqlResolver() *gqlResolver {
+	return &gqlResolver{s: s, titles: s.titles(), meta: s.sidecars()}
+}
+
+// file returns the fields of fi selected by f.
+func (r *gqlResolver) file(fi fileInfo, f *gqlField) (gqlObject, error) {
+	if f.sel == nil {
+		return nil, fmt.Errorf("field %q requires a selection", f.name)
+	}
+	fl := file{Name: fi.Name, Size: fi.Size, ModTime: fi.ModTime}
+	p := r.s.media.cachedProbe(fl)
+	sc := r.meta[fi.Name]
+	if sc == nil {
+		sc = &sidecar{}
+	}
+	stream := func(kind string, fn func(codec string, w, h int) any) any {
+		if p != nil {
+			for _, st := range p.Streams {
+				if st.CodecType == kind {
+					return fn(st.CodecName, st.Width, st.Height)
+				}
+			}
+		}
+		return nil
+	}
+	// orNil returns nil for the zero value so missing metadata is null.
+	orNil := func(v any, zero bool) any {
+		if zero {
+			return nil
+		}
+		return v
+	}
+	var o gqlObject
+	for _, sf := range f.sel {
+		var v any
+		switch sf.name {
+		case "__typename":
+			v = "File"
+		case "name":
+			v = fi.Name
+		case "size":
+			v = fi.Size
+		case "modTime":
+			v = fi.ModTime.Format(time.RFC3339)
+		case "title":
+			v = cmp.Or(r.titles[fi.Name], fi.Name)
+		case "tags":
+			v = fi.Tags
+			if fi.Tags == nil {
+				v = []string{}
+			}
+		case "rating":
+			v = fi.Rating
+		case "plays":
+			v = fi.Plays
+		case "downloads":
+			v = fi.Downloads
+		case "duration":
+			if p != nil {
+				v = p.Duration().Seconds()
+			}
+		case "width":
+			v = stream("video", func(_ string, w, _ int) any { return w })
+		case "height":
+			v = stream("video", func(_ string, _, h int) any { return h })
+		case "videoCodec":
+			v = stream("video", func(c string, _, _ int) any { return c })
+		case "audioCodec":
+			v = stream("audio", func(c string, _, _ int) any { return c })
+		case "year":
+			v = orNil(sc.Year, sc.Year == 0)
+		case "plot":
+			v = orNil(sc.Plot, sc.Plot == "")
+		case "show":
+			v = orNil(sc.Show, sc.Show == "")
+		case "season":
+			v = orNil(sc.Season, sc.Show == "")
+		case "episode":
+			v = orNil(sc.Episode, sc.Show == "")
+		case "url":
+			v = rawURL(fi.Name)
+		case "watchUrl":
+			v = watchURL(fi.Name)
+		case "thumbnail":
+			if t := mimeType(fi.Name); strings.HasPrefix(t, "video/") && t != "video/mp2t" {
+				v = r.s.media.thumbURL(fl)
+			}
+		default:
+			return nil, fmt.Errorf("cannot query field %q on type \"File\"", sf.name)
+		}
+		if sf.sel != nil {
+			return nil, fmt.Errorf("field %q of type \"File\" has no selection", sf.name)
+		}
+		o = append(o, gqlEntry{sf.alias, v})
+	}
+	return o, nil
+}
+
+// serveGraphQL runs a query sent as JSON with a POST, or with ?query= and
+// ?variables= with a GET. A GET without a query returns the schema.
+func (s *server) serveGraphQL(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if req.Method == http.MethodPost {
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		q := req.URL.Query()
+		body.Query = q.Get("query")
+		body.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &body.Variables); err != nil {
+				http.Error(w, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+		if body.Query == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(graphqlSchema))
+			return
+		}
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	p := gqlParser{src: body.Query, vars: body.Variables}
+	sel, err := p.document(body.OperationName)
+	if err == nil {
+		var data gqlObject
+		if data, err = s.graphql(userFrom(req), sel); err == nil {
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": []map[string]string{{"message": err.Error()}}})
+}
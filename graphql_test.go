@@ -0,0 +1,34 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestGraphQL(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":       testMP4,
+		"movie/heat.mp4": testMP4,
+		"movie/heat.nfo": "<movie><title>Heat</title><year>1995</year></movie>\n",
+		"private/x.mp4":  testMP4,
+	}, options{users: u, access: a})
+	q := `{ files(dir: "movie", query: "heat.mp4", after: "2000-01-01") { name heat: year thumbnail } }`
+	testPage(t, ts.URL+"/graphql?query="+url.QueryEscape(q), "bob", `{"data":{"files":[{"name":"movie/heat.mp4","heat":1995,"thumbnail":"/thumb/movie/heat.mp4?v=`)
+	q = `query Q($d: String) { files(dir: $d) { name } }`
+	v := `{"d":"private"}`
+	testPage(t, ts.URL+"/graphql?query="+url.QueryEscape(q)+"&variables="+url.QueryEscape(v), "bob", `{"data":{"files":[]}}`)
+	testPage(t, ts.URL+"/graphql?query="+url.QueryEscape(q)+"&variables="+url.QueryEscape(v), "alice", `{"data":{"files":[{"name":"private/x.mp4"}]}}`)
+	// Without a query, the schema is returned.
+	testPage(t, ts.URL+"/graphql", "bob", "type Query {")
+	for _, body := range []string{`{"query":"{ files { bogus } }"}`, `{"query":"{ files(first: -1) { name } }"}`, `{"query":"{"}`, `{`} {
+		if resp, b := testDo(t, "POST", ts.URL+"/graphql", "bob", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// groupModes are the ways the listing can be split in sections:
+//   - "dir" by top-level directory;
+//   - "show" by show and season, for the videos with metadata;
+//   - "date" by calendar day, from the timestamp in the name or the
+//     modification time.
+var groupModes = []string{"dir", "show", "date"}
+
+// groupOf returns the section of the file name in the grouping mode. It
+// returns "" when the file doesn't belong to a section, e.g. the files at the
+// root or a movie when grouping by show.
+func groupOf(mode, name string, modTime time.Time, sc *sidecar) string {
+	switch mode {
+	case "dir":
+		if d, _, ok := strings.Cut(name, "/"); ok {
+			return d
+		}
+	case "show":
+		if sc != nil && sc.Show != "" {
+			if sc.Season == 0 {
+				return sc.Show + " / Specials"
+			}
+			return fmt.Sprintf("%s / Season %d", sc.Show, sc.Season)
+		}
+	case "date":
+		if t, ok := parseTimestamp(name); ok {
+			return t.Format("2006-01-02")
+		}
+		if !modTime.IsZero() {
+			return modTime.Local().Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// reTrailingNumber splits "Season 10" so it sorts after "Season 2".
+var reTrailingNumber = regexp.MustCompile(`^(.*?)(\d+)$`)
+
+// compareGroups sorts the sections: newest first by date, by name otherwise.
+// The files without a section come last.
+func compareGroups(mode, a, b string) int {
+	if (a == "") != (b == "") {
+		if a == "" {
+			return 1
+		}
+		return -1
+	}
+	if mode == "date" {
+		return strings.Compare(b, a)
+	}
+	ma, mb := reTrailingNumber.FindStringSubmatch(a), reTrailingNumber.FindStringSubmatch(b)
+	if ma != nil && mb != nil && strings.EqualFold(ma[1], mb[1]) {
+		na, _ := strconv.Atoi(ma[2])
+		nb, _ := strconv.Atoi(mb[2])
+		return cmp.Compare(na, nb)
+	}
+	return cmp.Or(strings.Compare(strings.ToLower(a), strings.ToLower(b)), strings.Compare(a, b))
+}
+
+// groups returns the section of each file of the library having one, for each
+// grouping mode.
+func (s *server) groups(names []string) map[string]map[string]string {
+	modTimes := map[string]time.Time{}
+	for _, f := range s.getFiles() {
+		modTimes[f.Name] = f.ModTime
+	}
+	meta := s.sidecars()
+	out := map[string]map[string]string{}
+	for _, mode := range groupModes {
+		g := map[string]string{}
+		for _, n := range names {
+			if v := groupOf(mode, n, modTimes[n], meta[n]); v != "" {
+				g[n] = v
+			}
+		}
+		out[mode] = g
+	}
+	return out
+}
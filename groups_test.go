@@ -0,0 +1,66 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGroupOf(t *testing.T) {
+	mod := time.Date(2024, 10, 15, 12, 0, 0, 0, time.Local)
+	show := &sidecar{Show: "The Office", Season: 2}
+	for _, c := range []struct {
+		mode, name string
+		sc         *sidecar
+		want       string
+	}{
+		{"dir", "movie/heat.mp4", nil, "movie"},
+		{"dir", "clip.mp4", nil, ""},
+		{"show", "S02E01.mkv", show, "The Office / Season 2"},
+		{"show", "S00E01.mkv", &sidecar{Show: "The Office"}, "The Office / Specials"},
+		{"show", "movie/heat.mp4", &sidecar{Title: "Heat"}, ""},
+		{"date", "cam/2020-01-02_03-04-05.mp4", nil, "2020-01-02"},
+		{"date", "clip.mp4", nil, "2024-10-15"},
+	} {
+		if got := groupOf(c.mode, c.name, mod, c.sc); got != c.want {
+			t.Errorf("%s %s: got %q, want %q", c.mode, c.name, got, c.want)
+		}
+	}
+}
+
+func TestCompareGroups(t *testing.T) {
+	for _, g := range [][2]string{{"Season 2", "Season 10"}, {"cam1", "front"}, {"a", ""}} {
+		if compareGroups("show", g[0], g[1]) >= 0 {
+			t.Errorf("%q must sort before %q", g[0], g[1])
+		}
+	}
+	if compareGroups("date", "2024-10-15", "2024-10-14") >= 0 {
+		t.Error("the dates must be newest first")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":                             testMP4,
+		"movie/heat.mp4":                       testMP4,
+		"shows/The Office/Season 2/S02E01.mkv": testMP4,
+	}, options{})
+	testPage(t, ts.URL+"/list", "", `"show":{"shows/The Office/Season 2/S02E01.mkv":"The Office / Season 2"}`)
+	var got struct {
+		Files []fileInfo `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/files?group=dir", "", "")), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Files) != 3 || got.Files[0].Group != "movie" || got.Files[1].Group != "shows" || got.Files[2].Name != "clip.mp4" || got.Files[2].Group != "" {
+		t.Fatalf("files at the root must be last: %+v", got.Files)
+	}
+	if status, _ := testGet(t, ts.URL+"/api/files?group=size", ""); status != http.StatusBadRequest {
+		t.Fatalf("got status %d", status)
+	}
+}
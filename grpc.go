@@ -0,0 +1,312 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The Library service of servevideos.proto is served over HTTP/2 on the same
+// port, distinguished by its Content-Type. The few messages are encoded by
+// hand to not depend on the protobuf and gRPC modules.
+
+// gRPC status codes.
+const (
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+)
+
+// grpcError is an error with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// Protocol Buffers wire types.
+const (
+	pbVarint = 0
+	pbI64    = 1
+	pbLen    = 2
+	pbI32    = 5
+)
+
+func pbTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num<<3|typ))
+}
+
+func pbString(b []byte, num int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = binary.AppendUvarint(pbTag(b, num, pbLen), uint64(len(v)))
+	return append(b, v...)
+}
+
+func pbInt(b []byte, num int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(pbTag(b, num, pbVarint), uint64(v))
+}
+
+func pbDouble(b []byte, num int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.LittleEndian.AppendUint64(pbTag(b, num, pbI64), math.Float64bits(v))
+}
+
+// pbMessage appends the embedded message m, even if empty.
+func pbMessage(b []byte, num int, m []byte) []byte {
+	b = binary.AppendUvarint(pbTag(b, num, pbLen), uint64(len(m)))
+	return append(b, m...)
+}
+
+// pbFields calls fn with each field of the message b. data is set for the
+// length delimited fields and v for the others.
+func pbFields(b []byte, fn func(num, typ int, v uint64, data []byte)) error {
+	for len(b) != 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid tag")
+		}
+		b = b[n:]
+		num, typ := int(tag>>3), int(tag&7)
+		var v uint64
+		var data []byte
+		switch typ {
+		case pbVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			b = b[n:]
+		case pbI64, pbI32:
+			l := 8
+			if typ == pbI32 {
+				l = 4
+			}
+			if len(b) < l {
+				return errors.New("truncated field")
+			}
+			b = b[l:]
+		case pbLen:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("truncated field")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", typ)
+		}
+		fn(num, typ, v, data)
+	}
+	return nil
+}
+
+// maxGRPCMessage is the largest request accepted.
+const maxGRPCMessage = 1 << 20
+
+// readGRPCMessage reads a length prefixed message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compression is not supported"}
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return nil, &grpcError{grpcInvalidArgument, "request message is too large"}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	return b, nil
+}
+
+// writeGRPCMessage writes a length prefixed message and flushes it.
+func writeGRPCMessage(w http.ResponseWriter, b []byte) error {
+	hdr := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(b)))
+	if _, err := w.Write(append(hdr, b...)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// grpcEscape percent-encodes the status message as required by gRPC.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isGRPC returns true for the gRPC requests.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveGRPC serves a call of the Library service. The status is sent in the
+// trailers.
+func (s *server) serveGRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires an HTTP/2 POST", http.StatusBadRequest)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	code := 0
+	if err := s.grpcCall(w, req); err != nil {
+		var ge *grpcError
+		if !errors.As(err, &ge) {
+			ge = &grpcError{grpcInternal, err.Error()}
+		}
+		code = ge.code
+		h.Set("Grpc-Message", grpcEscape(ge.msg))
+	}
+	h.Set("Grpc-Status", strconv.Itoa(code))
+}
+
+func (s *server) grpcCall(w http.ResponseWriter, req *http.Request) error {
+	in, err := readGRPCMessage(req.Body)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	switch req.URL.Path {
+	case "/servevideos.v1.Library/ListFiles":
+		var ff fileFilter
+		err = pbFields(in, func(num, typ int, v uint64, data []byte) {
+			switch num {
+			case 1:
+				ff.dir = string(data)
+			case 2:
+				ff.query = string(data)
+			case 3:
+				ff.tags = append(ff.tags, string(data))
+			}
+		})
+		if err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		titles := s.titles()
+		for _, fi := range s.findFiles(userFrom(req), ff) {
+			out = pbMessage(out, 1, s.pbFile(fi, titles))
+		}
+	case "/servevideos.v1.Library/GetFile":
+		var name string
+		if err = pbFields(in, func(num, typ int, v uint64, data []byte) {
+			if num == 1 {
+				name = string(data)
+			}
+		}); err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		f, ok := s.getFile(name)
+		if !ok || !s.canAccess(req, f.Name) {
+			return &grpcError{grpcNotFound, "file not found"}
+		}
+		fi := fileInfo{Name: f.Name, Size: f.Size, ModTime: f.ModTime, Tags: s.tags.get(f.Name), viewCount: s.views.all()[f.Name]}
+		out = s.pbFile(fi, s.titles())
+	case "/servevideos.v1.Library/Watch":
+		var dir string
+		if err = pbFields(in, func(num, typ int, v uint64, data []byte) {
+			if num == 1 {
+				dir = strings.Trim(string(data), "/")
+			}
+		}); err != nil {
+			return &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		return s.grpcWatch(w, req, dir)
+	case "/servevideos.v1.Library/Rescan":
+		if !s.isAdmin(req) {
+			return &grpcError{grpcPermissionDenied, "requires an -admin"}
+		}
+		s.requestRescan()
+	case "/servevideos.v1.Library/PurgeCaches":
+		if !s.isAdmin(req) {
+			return &grpcError{grpcPermissionDenied, "requires an -admin"}
+		}
+		out = pbInt(out, 1, int64(s.media.purge()))
+		out = pbInt(out, 2, int64(s.hashes.purge()))
+	default:
+		return &grpcError{grpcUnimplemented, "unknown method " + req.URL.Path}
+	}
+	return writeGRPCMessage(w, out)
+}
+
+// grpcWatch streams the changes of the files in dir the user can access until
+// the client cancels.
+func (s *server) grpcWatch(w http.ResponseWriter, req *http.Request, dir string) error {
+	ch, cancel := s.changes.subscribe()
+	defer cancel()
+	// Send the headers so the client knows it is subscribed.
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return err
+	}
+	kinds := map[string]int64{"added": 1, "removed": 2, "changed": 3}
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case c := <-ch:
+			if dir != "" && !strings.HasPrefix(c.File.Name, dir+"/") {
+				continue
+			}
+			if !s.canAccess(req, c.File.Name) {
+				continue
+			}
+			fi := fileInfo{Name: c.File.Name, Size: c.File.Size, ModTime: c.File.ModTime}
+			if c.Kind != "removed" {
+				fi.Tags = s.tags.get(fi.Name)
+			}
+			e := pbInt(nil, 1, kinds[c.Kind])
+			e = pbMessage(e, 2, s.pbFile(fi, nil))
+			if err := writeGRPCMessage(w, e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pbFile encodes a File message.
+func (s *server) pbFile(fi fileInfo, titles map[string]string) []byte {
+	b := pbString(nil, 1, fi.Name)
+	b = pbInt(b, 2, fi.Size)
+	b = pbInt(b, 3, fi.ModTime.UnixNano())
+	b = pbString(b, 4, titles[fi.Name])
+	for _, t := range fi.Tags {
+		b = pbString(b, 5, t)
+	}
+	if p := s.media.cachedProbe(file{Name: fi.Name, Size: fi.Size, ModTime: fi.ModTime}); p != nil {
+		b = pbDouble(b, 6, p.Duration().Seconds())
+	}
+	b = pbInt(b, 7, int64(fi.Plays))
+	return pbInt(b, 8, int64(fi.Downloads))
+}
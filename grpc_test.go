@@ -0,0 +1,138 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// testGRPCCall starts a gRPC call as user with the message in.
+func testGRPCCall(t testing.TB, base, user, method string, in []byte) *http.Response {
+	t.Helper()
+	// Talk HTTP/2 without TLS, like gRPC clients do with insecure credentials.
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	body := append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(in))), in...)
+	req, err := http.NewRequestWithContext(t.Context(), "POST", base+"/servevideos.v1.Library/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// testGRPCWatched returns the kind and the name of the next file streamed by
+// Watch.
+func testGRPCWatched(t testing.TB, r io.Reader) (uint64, string) {
+	t.Helper()
+	b, err := readGRPCMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind, name := uint64(0), ""
+	if err = pbFields(b, func(num, typ int, v uint64, data []byte) {
+		if num == 1 {
+			kind = v
+		} else if num == 2 {
+			_ = pbFields(data, func(num, typ int, v uint64, data []byte) {
+				if num == 1 {
+					name = string(data)
+				}
+			})
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return kind, name
+}
+
+// testGRPCUnary calls a method and returns the response message and the
+// gRPC status.
+func testGRPCUnary(t testing.TB, base, method string, in []byte) ([]byte, string) {
+	t.Helper()
+	resp := testGRPCCall(t, base, "", method, in)
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= 5 {
+		b = b[5:]
+	}
+	return b, resp.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPC(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"beach.mp4": "beach.mp4", "hike.mp4": "hike.mp4"}, options{})
+	out, status := testGRPCUnary(t, ts.URL, "ListFiles", pbString(nil, 2, "HIKE"))
+	var names []string
+	if err := pbFields(out, func(num, typ int, v uint64, data []byte) {
+		_ = pbFields(data, func(num, typ int, v uint64, data []byte) {
+			if num == 1 {
+				names = append(names, string(data))
+			}
+		})
+	}); err != nil || status != "0" || !slices.Equal(names, []string{"hike.mp4"}) {
+		t.Fatalf("ListFiles: got %q, status %q, %v", names, status, err)
+	}
+	out, status = testGRPCUnary(t, ts.URL, "GetFile", pbString(nil, 1, "beach.mp4"))
+	if want := pbInt(pbString(nil, 1, "beach.mp4"), 2, 9); status != "0" || !bytes.HasPrefix(out, want) {
+		t.Fatalf("GetFile: got %x, status %q", out, status)
+	}
+	if _, status = testGRPCUnary(t, ts.URL, "GetFile", pbString(nil, 1, "missing.mp4")); status != "5" {
+		t.Fatalf("GetFile missing: got status %q", status)
+	}
+	if _, status = testGRPCUnary(t, ts.URL, "Nope", nil); status != "12" {
+		t.Fatalf("unknown method: got status %q", status)
+	}
+
+	resp := testGRPCCall(t, ts.URL, "", "Watch", nil)
+	writeTestFiles(t, srv.rootDir.Name(), map[string]string{"new.mp4": "new"})
+	srv.requestRescan()
+	if kind, name := testGRPCWatched(t, resp.Body); kind != 1 || name != "new.mp4" {
+		t.Fatalf("Watch: got kind %d name %q", kind, name)
+	}
+}
+
+// TestGRPCWatchAccess checks that Watch only streams the changes of the files
+// the user can access.
+func TestGRPCWatchAccess(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	srv, ts := newTestServer(t, nil, options{users: u, access: a})
+	alice := testGRPCCall(t, ts.URL, "alice", "Watch", nil)
+	bob := testGRPCCall(t, ts.URL, "bob", "Watch", nil)
+	srv.changes.publish([]fileChange{
+		{Kind: "added", File: file{Name: "private/a.mp4"}},
+		{Kind: "added", File: file{Name: "b.mp4"}},
+	})
+	if _, got := testGRPCWatched(t, bob.Body); got != "b.mp4" {
+		t.Fatalf("bob got %q", got)
+	}
+	if _, got := testGRPCWatched(t, alice.Body); got != "private/a.mp4" {
+		t.Fatalf("alice got %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// permissionsPolicy disables the browser features the pages don't use.
+// Fullscreen and picture-in-picture stay allowed for the player.
+const permissionsPolicy = "camera=(), microphone=(), geolocation=(), payment=(), usb=()"
+
+// securityHandler sets the security headers on all the responses, including
+// the HTML pages and the errors. Strict-Transport-Security is only set with
+// -hsts, as it breaks the plain HTTP access for its whole duration.
+func (s *server) securityHandler(h http.Handler) http.Handler {
+	hsts := ""
+	if s.opts.hsts > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(s.opts.hsts/time.Second), 10)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hdr := w.Header()
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		hdr.Set("Referrer-Policy", "same-origin")
+		hdr.Set("Permissions-Policy", permissionsPolicy)
+		if hsts != "" {
+			hdr.Set("Strict-Transport-Security", hsts)
+		}
+		h.ServeHTTP(w, req)
+	})
+}
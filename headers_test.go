@@ -0,0 +1,36 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		hsts time.Duration
+		want string
+	}{
+		{0, ""},
+		{24 * time.Hour, "max-age=86400"},
+	} {
+		_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{hsts: tc.hsts})
+		// The errors have the headers too.
+		for _, p := range []string{"/", "/missing"} {
+			resp, _ := testDo(t, "GET", ts.URL+p, "", "", nil)
+			for k, v := range map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"Referrer-Policy":           "same-origin",
+				"Permissions-Policy":        permissionsPolicy,
+				"Strict-Transport-Security": tc.want,
+			} {
+				if got := resp.Header.Get(k); got != v {
+					t.Fatalf("%s: %s: got %q, want %q", p, k, got, v)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// profileExportVersion is the version of the export format.
+const profileExportVersion = 1
+
+// profileExport is a profile as exported, to be imported in another instance
+// or after the data directory was lost.
+type profileExport struct {
+	Version  int       `json:"version"`
+	User     string    `json:"user,omitempty"`
+	Exported time.Time `json:"exported"`
+	Profile  profile   `json:"profile"`
+}
+
+// merge adds the state of other to the profile. The values of other win,
+// except for the history and the synced values where the most recent are
+// kept, and the bookmarks which are added. The invalid values are skipped.
+func (pr *profile) merge(other *profile) {
+	for f, t := range other.Positions {
+		if t >= 0 {
+			pr.Positions[f] = t
+		}
+	}
+	for f, ok := range other.Watched {
+		if ok {
+			pr.Watched[f] = true
+		}
+	}
+	for f, ok := range other.Favorites {
+		if ok {
+			pr.Favorites[f] = true
+		}
+	}
+	for f, stars := range other.Ratings {
+		if stars >= 1 && stars <= 5 {
+			pr.Ratings[f] = stars
+		}
+	}
+	latest := map[string]time.Time{}
+	for _, e := range slices.Concat(pr.History, other.History) {
+		if t, ok := latest[e.File]; e.File != "" && (!ok || e.Time.After(t)) {
+			latest[e.File] = e.Time
+		}
+	}
+	pr.History = pr.History[:0]
+	for f, t := range latest {
+		pr.History = append(pr.History, historyEntry{File: f, Time: t})
+	}
+	slices.SortFunc(pr.History, func(a, b historyEntry) int {
+		return cmp.Or(b.Time.Compare(a.Time), cmp.Compare(a.File, b.File))
+	})
+	if len(pr.History) > maxHistory {
+		pr.History = pr.History[:maxHistory]
+	}
+	p := other.Player
+	if p.Volume != nil && *p.Volume >= 0 && *p.Volume <= 1 {
+		pr.Player.Volume = p.Volume
+	}
+	if p.Speed != nil && *p.Speed >= 0.5 && *p.Speed <= 4 {
+		pr.Player.Speed = p.Speed
+	}
+	pr.Player.Muted = cmp.Or(p.Muted, pr.Player.Muted)
+	pr.Player.Autoplay = cmp.Or(p.Autoplay, pr.Player.Autoplay)
+	pr.Player.PiP = cmp.Or(p.PiP, pr.Player.PiP)
+	for k, e := range other.State {
+		cur, ok := pr.State[k]
+		if !ok && len(pr.State) >= maxSyncKeys {
+			continue
+		}
+		if validSyncKey(k) && json.Valid(e.Value) && (!ok || e.Updated.After(cur.Updated)) {
+			pr.State[k] = e
+		}
+	}
+	for f, v := range other.Bookmarks {
+		for _, b := range v {
+			if b.valid() && !slices.ContainsFunc(pr.Bookmarks[f], func(x bookmark) bool { return x.ID == b.ID }) {
+				pr.addBookmark(f, b)
+			}
+		}
+	}
+}
+
+// serveHistory shows the files the user opened, most recent first, with
+// their resume position.
+func (s *server) serveHistory(w http.ResponseWriter, req *http.Request) {
+	pr := s.profiles.get(userFrom(req))
+	// The files deleted or not accessible anymore are shown without a link.
+	available := map[string]bool{}
+	for _, e := range pr.History {
+		available[e.File] = s.inLibrary(e.File) && s.canAccess(req, e.File)
+	}
+	s.serveHTML(w, historyHTML, map[string]any{"profile": pr, "available": available, "titles": visibleKeys(s.opts.access, userFrom(req), s.titles())})
+}
+
+// serveProfileExport downloads the profile of the authenticated user as JSON.
+func (s *server) serveProfileExport(w http.ResponseWriter, req *http.Request) {
+	user := userFrom(req)
+	out := profileExport{Version: profileExportVersion, User: user, Exported: time.Now().UTC().Truncate(time.Second), Profile: s.profiles.get(user)}
+	name := "profile"
+	if user != "" {
+		name = user
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "serve-videos-"+name+"-"+out.Exported.Format("2006-01-02")+".json"))
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// serveProfileImport merges a profile exported by serveProfileExport, maybe
+// of another user or instance, in the profile of the authenticated user, or
+// replaces it with ?replace=1.
+func (s *server) serveProfileImport(w http.ResponseWriter, req *http.Request) {
+	var in profileExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 16<<20)).Decode(&in); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if in.Version != profileExportVersion {
+		http.Error(w, fmt.Sprintf("Unsupported version %d", in.Version), 400)
+		return
+	}
+	in.Profile.init()
+	replace := req.FormValue("replace") == "1"
+	s.profiles.update(userFrom(req), func(pr *profile) {
+		if replace {
+			*pr = *newProfile()
+		}
+		pr.merge(&in.Profile)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
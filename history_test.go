@@ -0,0 +1,66 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestProfileMerge merges an imported profile.
+func TestProfileMerge(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pr := newProfile()
+	pr.Positions["a.mp4"] = 10
+	pr.History = []historyEntry{{"b.mp4", t0.Add(time.Hour)}, {"a.mp4", t0}}
+	other := newProfile()
+	other.Positions["a.mp4"] = 20
+	other.Positions["c.mp4"] = -1
+	other.Ratings["a.mp4"] = 9
+	other.History = []historyEntry{{"a.mp4", t0.Add(2 * time.Hour)}, {"b.mp4", t0}}
+	pr.merge(other)
+	want := []historyEntry{{"a.mp4", t0.Add(2 * time.Hour)}, {"b.mp4", t0.Add(time.Hour)}}
+	if !slices.Equal(pr.History, want) || !maps.Equal(pr.Positions, map[string]float64{"a.mp4": 20}) || len(pr.Ratings) != 0 {
+		t.Fatalf("got %+v", pr)
+	}
+}
+
+// TestHistory exports the profile, imports it back with another file in the
+// history and removes it.
+func TestHistory(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "other.mp4": testMP4}, options{})
+	testPost(t, ts.URL+"/api/profile/history/clip.mp4", "", http.StatusNoContent)
+	testPage(t, ts.URL+"/api/profile", "", `"history":[{"file":"clip.mp4",`)
+	resp, b := testDo(t, "GET", ts.URL+"/api/profile/export", "", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var exp profileExport
+	if err := json.Unmarshal([]byte(b), &exp); err != nil {
+		t.Fatal(err)
+	}
+	if exp.Version != profileExportVersion || len(exp.Profile.History) != 1 || exp.Profile.History[0].File != "clip.mp4" {
+		t.Fatalf("got %+v", exp)
+	}
+	exp.Profile.History = []historyEntry{{File: "other.mp4", Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	imp, err := json.Marshal(exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, want := range map[string]int{`{"version":2}`: http.StatusBadRequest, string(imp): http.StatusNoContent} {
+		if resp, b = testDo(t, "POST", ts.URL+"/api/profile/import", "", body, nil); resp.StatusCode != want {
+			t.Fatalf("got status %d, want %d: %s", resp.StatusCode, want, b)
+		}
+	}
+	testPage(t, ts.URL+"/history", "", `{"file":"other.mp4","time":"2020-01-02T03:04:05Z"}]`)
+	if resp, b = testDo(t, "DELETE", ts.URL+"/api/profile/history/other.mp4", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	testPage(t, ts.URL+"/history", "", `"available":{"clip.mp4":true}`)
+}
@@ -0,0 +1,372 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playlist is a parsed HLS media playlist.
+type playlist struct {
+	// segments are the URIs of the segments, in order.
+	segments []string
+	// ended is true if the playlist has an #EXT-X-ENDLIST tag.
+	ended bool
+	// mediaSequence is the media sequence number of the first segment.
+	mediaSequence int
+	// targetDuration is the maximum segment duration.
+	targetDuration time.Duration
+	// parts is the number of LL-HLS partial segments after the last segment.
+	parts int
+	// preloadHints are the URIs of the LL-HLS #EXT-X-PRELOAD-HINT tags.
+	preloadHints []string
+}
+
+// parsePlaylist parses the subset of a HLS media playlist needed to find the
+// segments.
+func parsePlaylist(b []byte) *playlist {
+	p := &playlist{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		switch {
+		case l == "":
+		case l == "#EXT-X-ENDLIST":
+			p.ended = true
+		case strings.HasPrefix(l, "#EXT-X-MEDIA-SEQUENCE:"):
+			p.mediaSequence, _ = strconv.Atoi(l[len("#EXT-X-MEDIA-SEQUENCE:"):])
+		case strings.HasPrefix(l, "#EXT-X-TARGETDURATION:"):
+			d, _ := strconv.Atoi(l[len("#EXT-X-TARGETDURATION:"):])
+			p.targetDuration = time.Duration(d) * time.Second
+		case strings.HasPrefix(l, "#EXT-X-PART:"):
+			p.parts++
+		case strings.HasPrefix(l, "#EXT-X-PRELOAD-HINT:"):
+			if u := attrValue(l, "URI"); u != "" {
+				p.preloadHints = append(p.preloadHints, u)
+			}
+		case strings.HasPrefix(l, "#"):
+		default:
+			p.segments = append(p.segments, l)
+			p.parts = 0
+		}
+	}
+	return p
+}
+
+// attrValue returns the value of an attribute in a tag line, e.g. the URI in
+// `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="a.mp4"`.
+func attrValue(l, key string) string {
+	_, attrs, _ := strings.Cut(l, ":")
+	for attrs != "" {
+		var k, v string
+		k, attrs, _ = strings.Cut(attrs, "=")
+		if strings.HasPrefix(attrs, `"`) {
+			v, attrs, _ = strings.Cut(attrs[1:], `"`)
+			attrs = strings.TrimPrefix(attrs, ",")
+		} else {
+			v, attrs, _ = strings.Cut(attrs, ",")
+		}
+		if k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// lastMSN returns the media sequence number of the last complete segment.
+func (p *playlist) lastMSN() int {
+	return p.mediaSequence + len(p.segments) - 1
+}
+
+// has returns true if the playlist contains the segment msn, or its partial
+// segment part when part is not negative.
+func (p *playlist) has(msn, part int) bool {
+	last := p.lastMSN()
+	if msn <= last {
+		return true
+	}
+	return msn == last+1 && part >= 0 && part < p.parts
+}
+
+// errTooFarAhead is returned when a client requests a segment that will not
+// be available soon.
+var errTooFarAhead = errors.New("requested media sequence is too far ahead")
+
+// waitPlaylist implements LL-HLS blocking playlist reload. It blocks until the
+// playlist name in root contains the segment msn, or its partial segment
+// part, the playlist ended or 3 target durations elapsed.
+func waitPlaylist(ctx context.Context, root *os.Root, name string, msn, part int) error {
+	p := filepath.FromSlash(name)
+	var mod time.Time
+	var deadline time.Time
+	for {
+		fi, err := root.Stat(p)
+		if err != nil {
+			return err
+		}
+		if !fi.ModTime().Equal(mod) {
+			mod = fi.ModTime()
+			b, err := root.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			pl := parsePlaylist(b)
+			if pl.ended || pl.has(msn, part) {
+				return nil
+			}
+			if msn > pl.lastMSN()+2 {
+				return errTooFarAhead
+			}
+			if deadline.IsZero() {
+				td := pl.targetDuration
+				if td == 0 {
+					td = 6 * time.Second
+				}
+				deadline = time.Now().Add(3 * td)
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// waitPreload blocks until the file name, referenced by an
+// #EXT-X-PRELOAD-HINT of a live playlist in the same directory, is in the
+// index. It returns false if the file is not hinted or didn't appear in time.
+func (s *server) waitPreload(ctx context.Context, name string) bool {
+	dir := path.Dir(name)
+	hinted := false
+	timeout := 6 * time.Second
+	for _, f := range s.getFiles() {
+		if path.Dir(f.Name) != dir || !strings.HasSuffix(f.Name, ".m3u8") || !isLive(s.rootDir, f) {
+			continue
+		}
+		b, err := s.readFile(f.Name)
+		if err != nil {
+			continue
+		}
+		pl := parsePlaylist(b)
+		for _, h := range pl.preloadHints {
+			if path.Join(dir, h) == name {
+				hinted = true
+				if pl.targetDuration != 0 {
+					timeout = 3 * pl.targetDuration
+				}
+			}
+		}
+	}
+	if !hinted {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for !s.hasFile(name) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// segmentStem returns the name of a segment without its extension and
+// sequence number, e.g. "091717_00012.ts" returns "091717_".
+func segmentStem(name string) string {
+	return strings.TrimRight(strings.TrimSuffix(name, path.Ext(name)), "0123456789")
+}
+
+// repairDir writes a VOD playlist for the .ts segments in dir that are not
+// referenced by a complete or live playlist. The segments are grouped by stem
+// and written to <stem>.m3u8, overwriting a playlist that was left truncated
+// by a recorder that crashed.
+//
+// It returns the playlists written, relative to root.
+func (m *media) repairDir(ctx context.Context, root, dir string) ([]string, error) {
+	if m.ffprobe == "" {
+		return nil, errNoFFmpeg
+	}
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	defer m.startJob("repair", dir)()
+	rel := filepath.FromSlash(dir)
+	d, err := r.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := d.ReadDir(-1)
+	_ = d.Close()
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	referenced := map[string]bool{}
+	broken := map[string]bool{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch path.Ext(e.Name()) {
+		case ".ts":
+			segments = append(segments, e.Name())
+		case ".m3u8":
+			fi, err2 := e.Info()
+			if err2 != nil {
+				continue
+			}
+			b, err2 := r.ReadFile(filepath.Join(rel, e.Name()))
+			if err2 != nil {
+				return nil, err2
+			}
+			p := parsePlaylist(b)
+			if !p.ended && time.Since(fi.ModTime()) > liveMaxAge {
+				// Truncated; its segments are orphans.
+				broken[e.Name()] = true
+				continue
+			}
+			for _, s := range p.segments {
+				referenced[s] = true
+			}
+		}
+	}
+	groups := map[string][]string{}
+	for _, s := range segments {
+		if !referenced[s] {
+			stem := segmentStem(s)
+			groups[stem] = append(groups[stem], s)
+		}
+	}
+	var out []string
+	for stem, segs := range groups {
+		sort.Strings(segs)
+		name := strings.TrimRight(stem, "_-. ")
+		if name == "" {
+			name = "index"
+		}
+		name += ".m3u8"
+		if _, err = r.Stat(filepath.Join(rel, name)); err == nil && !broken[name] {
+			name = strings.TrimSuffix(name, ".m3u8") + "-repaired.m3u8"
+		}
+		if err = m.writePlaylist(ctx, root, r, dir, name, segs); err != nil {
+			return out, err
+		}
+		slog.Info("repair", "dir", dir, "playlist", name, "segments", len(segs))
+		out = append(out, path.Join(dir, name))
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// writePlaylist writes a VOD playlist of segs in dir, probing each segment for
+// its duration. r is root opened.
+func (m *media) writePlaylist(ctx context.Context, root string, r *os.Root, dir, name string, segs []string) error {
+	rel := filepath.FromSlash(dir)
+	var body bytes.Buffer
+	maxDur := 0.
+	for _, s := range segs {
+		fi, err := r.Stat(filepath.Join(rel, s))
+		if err != nil {
+			return err
+		}
+		f := file{Name: path.Join(dir, s), Size: fi.Size(), ModTime: fi.ModTime()}
+		p, err := m.probe(ctx, root, f)
+		if err != nil {
+			// Skip segments that can't be decoded, they were likely being written
+			// when the recorder crashed.
+			slog.Warn("repair", "segment", s, "error", err)
+			continue
+		}
+		d := p.Duration().Seconds()
+		if d <= 0 {
+			continue
+		}
+		maxDur = math.Max(maxDur, d)
+		fmt.Fprintf(&body, "#EXTINF:%.3f,\n%s\n", d, s)
+	}
+	if body.Len() == 0 {
+		return fmt.Errorf("no usable segment for %s", name)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", int(math.Ceil(maxDur)))
+	b.Write(body.Bytes())
+	b.WriteString("#EXT-X-ENDLIST\n")
+	// Write atomically so a player never sees a partial playlist.
+	tmp := filepath.Join(rel, "."+name+".tmp")
+	if err := r.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return r.Rename(tmp, filepath.Join(rel, name))
+}
+
+// repairAll repairs the playlists in every directory under root.
+func (m *media) repairAll(ctx context.Context, root string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			rel, _ := filepath.Rel(root, p)
+			dirs = append(dirs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, d := range dirs {
+		written, err2 := m.repairDir(ctx, root, d)
+		out = append(out, written...)
+		if err2 != nil {
+			slog.Error("repair", "dir", d, "error", err2)
+		}
+	}
+	return out, nil
+}
+
+// serveRepair repairs the playlists of a directory.
+func (s *server) serveRepair(w http.ResponseWriter, req *http.Request) {
+	dir := strings.Trim(req.PathValue("dir"), "/")
+	if dir == "" {
+		dir = "."
+	}
+	if !filepath.IsLocal(filepath.FromSlash(dir)) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	written, err := s.media.repairDir(req.Context(), s.root, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if written == nil {
+		written = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"playlists": written})
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// camera is an RTSP source recorded with ffmpeg.
+type camera struct {
+	name string
+	url  string
+}
+
+// parseCameras parses -rtsp flags in the form "<name>=<url>".
+func parseCameras(args []string) ([]camera, error) {
+	var out []camera
+	for _, a := range args {
+		name, u, ok := strings.Cut(a, "=")
+		if !ok || name == "" || !strings.HasPrefix(u, "rtsp") {
+			return nil, fmt.Errorf("-rtsp %q must be in the form <name>=rtsp://...", a)
+		}
+		if strings.ContainsAny(name, `/\.`) {
+			return nil, fmt.Errorf("-rtsp %q: name must be a simple directory name", a)
+		}
+		out = append(out, camera{name: name, url: u})
+	}
+	return out, nil
+}
+
+// record records the camera into root/<name>/<YYYY-MM-DD>/ until ctx is
+// canceled. A new recording is started every day at midnight and whenever
+// ffmpeg exits, e.g. when the camera drops out.
+//
+// format is either "hls" for a playlist with hlsTime segments, which is
+// playable while it is recorded, or "mp4" for 5 minutes files. Shorter
+// segments reduce the latency of the live view but the camera's keyframe
+// interval must be at most hlsTime since the stream is not re-encoded.
+func (m *media) record(ctx context.Context, root string, c camera, format string, hlsTime time.Duration) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := m.recordOnce(ctx, root, c, format, hlsTime, start)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("rtsp", "camera", c.name, "error", err)
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// recordOnce runs ffmpeg until midnight, ctx is canceled or the stream ends.
+func (m *media) recordOnce(ctx context.Context, root string, c camera, format string, hlsTime time.Duration, now time.Time) error {
+	dir := filepath.Join(root, c.name, now.Format("2006-01-02"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	y, mo, d := now.Date()
+	midnight := time.Date(y, mo, d+1, 0, 0, 0, 0, now.Location())
+	ctx, cancel := context.WithDeadline(ctx, midnight)
+	defer cancel()
+	base := filepath.Join(dir, now.Format("150405"))
+	args := []string{"-v", "error", "-rtsp_transport", "tcp", "-i", c.url, "-c", "copy"}
+	switch format {
+	case "hls":
+		args = append(args, "-f", "hls", "-hls_time", strconv.FormatFloat(hlsTime.Seconds(), 'f', -1, 64),
+			"-hls_list_size", "0", "-hls_playlist_type", "event", "-hls_flags", "independent_segments",
+			"-hls_segment_filename", base+"_%05d.ts", base+".m3u8")
+	case "mp4":
+		args = append(args, "-f", "segment", "-segment_time", "300", "-reset_timestamps", "1", "-strftime", "1",
+			"-segment_format_options", "movflags=+faststart", filepath.Join(dir, "%H%M%S.mp4"))
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	slog.Info("rtsp", "camera", c.name, "dir", dir)
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	// Ask ffmpeg to stop gracefully so the files are finalized.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 10 * time.Second
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		// Stopped on purpose.
+		return nil
+	}
+	if err == nil {
+		return errors.New("stream ended")
+	}
+	return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+}
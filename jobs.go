@@ -0,0 +1,579 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxJobAttempts is how many times a failing job is run before giving up.
+const maxJobAttempts = 3
+
+// maxFinishedJobs is how many finished jobs are kept to be inspected.
+const maxFinishedJobs = 1000
+
+// jobKind is a kind of job that can be queued.
+type jobKind struct {
+	// accept returns true for the files the job applies to.
+	accept func(name string) bool
+	// ffmpeg is true when the job requires ffmpeg and ffprobe.
+	ffmpeg bool
+	// run does the job j on f and returns its result, e.g. the file written.
+	run func(ctx context.Context, s *server, j *job, f file) (string, error)
+}
+
+// isVideoFile returns true for the videos in a single file, excluding the HLS
+// segments and playlists.
+func isVideoFile(name string) bool {
+	t := mimeType(name)
+	return strings.HasPrefix(t, "video/") && t != "video/mp2t"
+}
+
+// jobKinds are the kinds of jobs, by name.
+var jobKinds = map[string]jobKind{
+	"thumbnail": {
+		accept: isVideoFile,
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			if s.media.thumbs == "" {
+				return "", errors.New("the thumbnails are only saved with -data or -cache-dir")
+			}
+			_, err := s.media.thumbnail(ctx, s.root, f)
+			return "", err
+		},
+	},
+	"transcode": {
+		accept: func(name string) bool { return hasDuration(name) && !strings.HasSuffix(name, ".m3u8") },
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			tp, ok := s.media.profiles.lookup(j.Profile)
+			if !ok {
+				return "", errUnknownProfile
+			}
+			return s.media.transcode(ctx, s.root, f, tp)
+		},
+	},
+	"ladder": {
+		accept: func(name string) bool { return isVideoFile(name) && !isLadderRendition(name) },
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			return s.media.ladder(ctx, s.root, f)
+		},
+	},
+	"export": {
+		accept: func(name string) bool { return strings.HasSuffix(name, ".m3u8") },
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			return s.media.exportFile(ctx, s.rootDir, f)
+		},
+	},
+	"loudness": {
+		accept: func(name string) bool { return hasDuration(name) && !strings.HasSuffix(name, ".m3u8") },
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			l, err := s.media.measureLoudness(ctx, s.root, f)
+			if err != nil {
+				return "", err
+			}
+			s.media.loudness.set(f.Name, l)
+			return strconv.FormatFloat(l.Integrated, 'f', 1, 64) + " LUFS", nil
+		},
+	},
+	"clip": {
+		accept: hasDuration,
+		ffmpeg: true,
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			c, ok := s.clips.get(j.Clip)
+			if !ok || c.File != f.Name {
+				return "", errUnknownClip
+			}
+			dst := s.clips.path(c.ID)
+			if err := s.media.renderClip(ctx, s.root, c, dst); err != nil {
+				return "", err
+			}
+			if !s.clips.update(c.ID, func(v *clip) { v.Rendered = true }) {
+				// Deleted while rendering.
+				_ = os.Remove(dst)
+				return "", errUnknownClip
+			}
+			return clipURL(c.ID), nil
+		},
+	},
+	"hash": {
+		accept: func(string) bool { return true },
+		run: func(ctx context.Context, s *server, j *job, f file) (string, error) {
+			return s.hashes.sum(f)
+		},
+	},
+}
+
+// job is a job queued, running or finished.
+type job struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind"`
+	File string `json:"file"`
+	// Profile is the transcode profile of the transcode jobs, "" for the
+	// default.
+	Profile string `json:"profile,omitempty"`
+	// Clip is the ID of the clip of File rendered by the clip jobs.
+	Clip string `json:"clip,omitempty"`
+	// Priority orders the jobs queued, highest first, then oldest first.
+	Priority int `json:"priority"`
+	// State is "queued", "running", "done", "failed" or "canceled".
+	State string `json:"state"`
+	// Attempts counts the runs. A failed run is retried after a minute per
+	// attempt, up to maxJobAttempts.
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	Result   string     `json:"result,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// notBefore delays the retries.
+	notBefore time.Time
+}
+
+func (j *job) finished() bool {
+	return j.State == "done" || j.State == "failed" || j.State == "canceled"
+}
+
+// jobQueue is the persistent queue of the background jobs.
+//
+// It is saved to p when not empty; the jobs interrupted by a restart are
+// queued again.
+type jobQueue struct {
+	p string
+	// wake signals the workers that a job was queued.
+	wake chan struct{}
+
+	mu      sync.Mutex
+	jobs    map[int]*job
+	nextID  int
+	cancels map[int]context.CancelFunc
+	dirty   bool
+}
+
+// newJobQueue loads the jobs saved in p, if any.
+func newJobQueue(p string) (*jobQueue, error) {
+	q := &jobQueue{p: p, wake: make(chan struct{}, 1), jobs: map[int]*job{}, nextID: 1, cancels: map[int]context.CancelFunc{}}
+	var jobs []*job
+	if err := readJSON(p, &jobs); err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if j.State == "running" {
+			j.State = "queued"
+			j.Started = nil
+		}
+		q.jobs[j.ID] = j
+		q.nextID = max(q.nextID, j.ID+1)
+	}
+	return q, nil
+}
+
+// add queues a job like t, unless the same one is already queued or running.
+func (q *jobQueue) add(t job) job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.Kind == t.Kind && j.File == t.File && j.Profile == t.Profile && j.Clip == t.Clip && !j.finished() {
+			return *j
+		}
+	}
+	j := &job{ID: q.nextID, Kind: t.Kind, File: t.File, Profile: t.Profile, Clip: t.Clip, Priority: t.Priority, State: "queued", Created: time.Now().UTC().Truncate(time.Second)}
+	q.nextID++
+	q.jobs[j.ID] = j
+	q.dirty = true
+	q.signal()
+	return *j
+}
+
+// signal wakes up a worker.
+func (q *jobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// list returns the jobs, the ones not finished first in the order they will
+// run, then the most recently finished.
+func (q *jobQueue) list() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		out = append(out, *j)
+	}
+	slices.SortFunc(out, compareJobs)
+	return out
+}
+
+func compareJobs(a, b job) int {
+	if a.finished() != b.finished() {
+		if a.finished() {
+			return 1
+		}
+		return -1
+	}
+	if a.finished() {
+		return cmp.Or(b.Finished.Compare(*a.Finished), cmp.Compare(b.ID, a.ID))
+	}
+	if (a.State == "running") != (b.State == "running") {
+		if a.State == "running" {
+			return -1
+		}
+		return 1
+	}
+	return cmp.Or(cmp.Compare(b.Priority, a.Priority), cmp.Compare(a.ID, b.ID))
+}
+
+// get returns the job id.
+func (q *jobQueue) get(id int) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// cancel cancels the job id if it is queued or running.
+func (q *jobQueue) cancel(id int) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	if !j.finished() {
+		if c := q.cancels[id]; c != nil {
+			c()
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		j.State = "canceled"
+		j.Finished = &now
+		q.dirty = true
+	}
+	return *j, true
+}
+
+// next marks the next job due as running and returns it with its context.
+// Otherwise it returns how long until a retry is due, 0 if none.
+func (q *jobQueue) next(ctx context.Context) (*job, context.Context, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	var best *job
+	var wait time.Duration
+	for _, j := range q.jobs {
+		if j.State != "queued" {
+			continue
+		}
+		if d := j.notBefore.Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		if best == nil || compareJobs(*j, *best) < 0 {
+			best = j
+		}
+	}
+	if best == nil {
+		return nil, nil, wait
+	}
+	t := now.UTC().Truncate(time.Second)
+	best.State = "running"
+	best.Started = &t
+	best.Attempts++
+	q.dirty = true
+	ctx, q.cancels[best.ID] = context.WithCancel(ctx)
+	// Wake up another worker for the next job, if any.
+	q.signal()
+	c := *best
+	return &c, ctx, 0
+}
+
+// finish records the outcome of a run of the job id. A failed job is retried
+// unless it was canceled.
+func (q *jobQueue) finish(id int, result string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if c := q.cancels[id]; c != nil {
+		c()
+		delete(q.cancels, id)
+	}
+	j := q.jobs[id]
+	if j == nil || j.State != "running" {
+		// Canceled.
+		return
+	}
+	q.dirty = true
+	now := time.Now().UTC().Truncate(time.Second)
+	j.Result = result
+	if err == nil {
+		j.State = "done"
+		j.Error = ""
+	} else {
+		j.Error = err.Error()
+		j.State = "failed"
+		if j.Attempts < maxJobAttempts {
+			j.State = "queued"
+			j.notBefore = time.Now().Add(time.Duration(j.Attempts) * time.Minute)
+			return
+		}
+	}
+	j.Finished = &now
+	q.prune()
+}
+
+// requeue puts back the job id interrupted by a shutdown, to run it again on
+// the next start.
+func (q *jobQueue) requeue(id int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.cancels, id)
+	if j := q.jobs[id]; j != nil && j.State == "running" {
+		j.State = "queued"
+		j.Started = nil
+		j.Attempts--
+		q.dirty = true
+	}
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs.
+func (q *jobQueue) prune() {
+	var done []*job
+	for _, j := range q.jobs {
+		if j.finished() {
+			done = append(done, j)
+		}
+	}
+	if len(done) <= maxFinishedJobs {
+		return
+	}
+	slices.SortFunc(done, func(a, b *job) int { return compareJobs(*a, *b) })
+	for _, j := range done[maxFinishedJobs:] {
+		delete(q.jobs, j.ID)
+	}
+}
+
+// save writes the jobs to disk if they changed.
+func (q *jobQueue) save() error {
+	q.mu.Lock()
+	if q.p == "" || !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	jobs := make([]*job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, j)
+	}
+	b, err := json.Marshal(jobs)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.p, b)
+}
+
+// runJobs runs the jobs queued with -job-workers workers until ctx is
+// canceled.
+func (s *server) runJobs(ctx context.Context) {
+	for range max(s.opts.jobWorkers, 1) {
+		go s.runJobWorker(ctx)
+	}
+}
+
+func (s *server) runJobWorker(ctx context.Context) {
+	for {
+		j, jctx, wait := s.jobs.next(ctx)
+		if j == nil {
+			var retry <-chan time.Time
+			if wait != 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.jobs.wake:
+			case <-retry:
+			}
+			continue
+		}
+		start := time.Now()
+		result, err := s.runJob(jctx, j)
+		if ctx.Err() != nil {
+			s.jobs.requeue(j.ID)
+			return
+		}
+		if err != nil {
+			slog.Error("job", "id", j.ID, "kind", j.Kind, "file", j.File, "attempt", j.Attempts, "error", err)
+		} else {
+			slog.Info("job", "id", j.ID, "kind", j.Kind, "file", j.File, "result", result, "duration", time.Since(start).Round(time.Millisecond))
+		}
+		s.jobs.finish(j.ID, result, err)
+	}
+}
+
+// runJob runs the job on its file as it is now.
+func (s *server) runJob(ctx context.Context, j *job) (string, error) {
+	f, ok := s.getFile(j.File)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return jobKinds[j.Kind].run(ctx, s, j, f)
+}
+
+// serveJobs lists the jobs, filtered by ?state= if specified.
+func (s *server) serveJobs(w http.ResponseWriter, req *http.Request) {
+	jobs := s.jobs.list()
+	if st := req.URL.Query().Get("state"); st != "" {
+		jobs = slices.DeleteFunc(jobs, func(j job) bool { return j.State != st })
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"jobs": jobs})
+}
+
+// serveJobsAdd queues a job for each file of {"kind": ..., "files": [...],
+// "priority": ..., "profile": ...}. The files must all be valid for the kind
+// of job.
+func (s *server) serveJobsAdd(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Kind     string   `json:"kind"`
+		Files    []string `json:"files"`
+		Priority int      `json:"priority"`
+		Profile  string   `json:"profile"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || len(body.Files) == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	jobs, err := s.addJobs(job{Kind: body.Kind, Profile: body.Profile, Priority: body.Priority}, body.Files)
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{"jobs": jobs})
+}
+
+var (
+	errUnknownJob     = errors.New("unknown kind of job")
+	errUnknownProfile = errors.New("unknown transcode profile")
+	errUnknownClip    = errors.New("unknown clip")
+)
+
+// jobErrorStatus returns the HTTP status of an error of addJobs.
+func jobErrorStatus(err error) int {
+	if errors.Is(err, errNoFFmpeg) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
+
+// addJobs queues a job like t for each file.
+func (s *server) addJobs(t job, files []string) ([]job, error) {
+	k, ok := jobKinds[t.Kind]
+	if !ok {
+		return nil, errUnknownJob
+	}
+	if t.Profile != "" {
+		if _, ok = s.media.profiles.lookup(t.Profile); !ok || t.Kind != "transcode" {
+			return nil, errUnknownProfile
+		}
+	}
+	// The clips are rendered with /api/clips/{id}/render.
+	if (t.Kind == "clip") != (t.Clip != "") {
+		return nil, errUnknownClip
+	}
+	if k.ffmpeg && (s.media.ffmpeg == "" || s.media.ffprobe == "") {
+		return nil, errNoFFmpeg
+	}
+	for _, n := range files {
+		if !s.hasFile(n) || !k.accept(n) {
+			return nil, errors.New("invalid file " + n)
+		}
+	}
+	jobs := make([]job, 0, len(files))
+	for _, n := range files {
+		t.File = n
+		jobs = append(jobs, s.jobs.add(t))
+	}
+	return jobs, nil
+}
+
+// serveJob returns the job {id}, or cancels it with DELETE.
+func (s *server) serveJob(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid id", 404)
+		return
+	}
+	var j job
+	var ok bool
+	if req.Method == http.MethodDelete {
+		j, ok = s.jobs.cancel(id)
+	} else {
+		j, ok = s.jobs.get(id)
+	}
+	if !ok {
+		http.Error(w, "Invalid id", 404)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(j)
+}
+
+// exportFile writes the segments of the playlist f as an MP4 next to it and
+// returns its name, or "" if it already exists.
+func (m *media) exportFile(ctx context.Context, root *os.Root, f file) (string, error) {
+	dst := strings.TrimSuffix(f.Name, ".m3u8") + ".mp4"
+	rel := filepath.FromSlash(dst)
+	if _, err := root.Stat(rel); err == nil {
+		return "", nil
+	}
+	segs, err := playlistSegments(root, f.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(segs) == 0 {
+		return "", errors.New("no segment to export")
+	}
+	defer m.startJob("export", f.Name)()
+	tmp := rel + ".part"
+	out, err := root.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	err = m.concatMP4(ctx, segs, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = root.Remove(tmp)
+		return "", err
+	}
+	return dst, root.Rename(tmp, rel)
+}
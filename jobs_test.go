@@ -0,0 +1,68 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testJob returns the job at u after checking the status.
+func testJob(t testing.TB, method, u string, want int) job {
+	t.Helper()
+	resp, b := testDo(t, method, u, "", "", nil)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, u, resp.StatusCode, want, b)
+	}
+	var j job
+	if want == http.StatusOK {
+		if err := json.Unmarshal([]byte(b), &j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return j
+}
+
+func TestJobs(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	for _, body := range []string{`{"kind":"unknown","files":["clip.mp4"]}`, `{"kind":"hash","files":["missing.mp4"]}`} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/jobs", "", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+	}
+	resp, b := testDo(t, "POST", ts.URL+"/api/jobs", "", `{"kind":"hash","files":["clip.mp4"],"priority":1}`, nil)
+	var added struct {
+		Jobs []job `json:"jobs"`
+	}
+	if err := json.Unmarshal([]byte(b), &added); err != nil || resp.StatusCode != http.StatusAccepted || len(added.Jobs) != 1 {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	u := ts.URL + "/api/jobs/" + strconv.Itoa(added.Jobs[0].ID)
+	var j job
+	for start := time.Now(); j.State != "done"; time.Sleep(10 * time.Millisecond) {
+		if j = testJob(t, "GET", u, http.StatusOK); j.State == "failed" || j.State == "canceled" {
+			t.Fatalf("job %s: %s", j.State, j.Error)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out with the job %s", j.State)
+		}
+	}
+	sum := sha256.Sum256([]byte(testMP4))
+	if want := hex.EncodeToString(sum[:]); j.Result != want {
+		t.Fatalf("got result %q, want %q", j.Result, want)
+	}
+	// Canceling a finished job is a no-op.
+	if j = testJob(t, "DELETE", u, http.StatusOK); j.State != "done" {
+		t.Fatalf("got state %q, want done", j.State)
+	}
+	testJob(t, "DELETE", ts.URL+"/api/jobs/0", http.StatusNotFound)
+	testPage(t, ts.URL+"/api/jobs?state=done", "", fmt.Sprintf(`"id":%d,"kind":"hash","file":"clip.mp4"`, j.ID))
+}
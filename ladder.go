@@ -0,0 +1,197 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ladderRungs are the renditions of the HLS ladders, best first. The rungs
+// taller than the source are skipped.
+var ladderRungs = []struct {
+	height int
+	// kbps is the video bitrate.
+	kbps int
+}{
+	{1080, 5000},
+	{720, 2800},
+	{480, 1400},
+	{360, 800},
+}
+
+// ladderAudioKbps is the bitrate of the AAC audio of every rung.
+const ladderAudioKbps = 128
+
+// ladderDir returns the directory of the renditions of the ladder of name.
+// The master playlist is next to it, with the same name plus ".m3u8".
+func ladderDir(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".abr"
+}
+
+// isLadderRendition returns true for the playlists and segments of the
+// renditions of a ladder, only played through its master playlist.
+func isLadderRendition(name string) bool {
+	return strings.HasSuffix(path.Dir(name), ".abr")
+}
+
+// ladder writes an HLS ladder of f: a rendition for each of ladderRungs no
+// taller than f and a master playlist for the players to switch between them
+// according to the bandwidth. It returns the master playlist, or "" if it
+// already exists. The master playlist is written last so the ladder is only
+// listed once complete.
+func (m *media) ladder(ctx context.Context, root string, f file) (string, error) {
+	if m.ffmpeg == "" || m.ffprobe == "" {
+		return "", errNoFFmpeg
+	}
+	dir := ladderDir(f.Name)
+	master := dir + ".m3u8"
+	absMaster := filepath.Join(root, filepath.FromSlash(master))
+	if _, err := os.Stat(absMaster); err == nil {
+		return "", nil
+	}
+	p, err := m.probe(ctx, root, f)
+	if err != nil {
+		return "", err
+	}
+	width, height, audio, hdr := 0, 0, false, false
+	for _, s := range p.Streams {
+		switch {
+		case s.CodecType == "video" && height == 0:
+			width, height, hdr = s.Width, s.Height, isHDR(s.ColorTransfer)
+		case s.CodecType == "audio":
+			audio = true
+		}
+	}
+	if height == 0 {
+		return "", fmt.Errorf("%s has no video", f.Name)
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return "", err
+	}
+	absDir := filepath.Join(root, filepath.FromSlash(dir))
+	if err = os.MkdirAll(absDir, 0o755); err != nil {
+		return "", err
+	}
+	defer m.startJob("ladder", f.Name)()
+	parts := 0
+	for i, r := range ladderRungs {
+		if r.height <= height || i == len(ladderRungs)-1 {
+			parts++
+		}
+	}
+	part := 0
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for i, r := range ladderRungs {
+		// Always keep the smallest rung.
+		if r.height > height && i != len(ladderRungs)-1 {
+			continue
+		}
+		h := min(r.height, height)
+		w := (width*h/height + 1) &^ 1
+		name := strconv.Itoa(h) + "p"
+		vf := "scale=-2:" + strconv.Itoa(h)
+		if hdr {
+			// The ladders are played by the browsers, mostly on SDR screens.
+			vf += "," + toneMapFilter(defaultProfile.ToneMap)
+		}
+		args := append([]string{"-v", "error"}, m.decodeArgs("")...)
+		args = append(args,
+			"-i", src, "-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", vf, "-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+			"-b:v", strconv.Itoa(r.kbps)+"k", "-maxrate", strconv.Itoa(r.kbps*107/100)+"k", "-bufsize", strconv.Itoa(r.kbps*3/2)+"k",
+			// Align the keyframes of the renditions so the players can switch
+			// at every segment.
+			"-force_key_frames", "expr:gte(t,n_forced*2)", "-sc_threshold", "0",
+			"-c:a", "aac", "-b:a", strconv.Itoa(ladderAudioKbps)+"k", "-ac", "2",
+			"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+		)
+		if hdr {
+			args = append(args, toneMapArgs...)
+		}
+		args = append(args, m.encodeArgs()...)
+		args = append(args, progressArgs...)
+		args = append(args, "-hls_segment_filename", filepath.Join(absDir, name+"_%05d.ts"), filepath.Join(absDir, name+".m3u8"))
+		// #nosec G204
+		cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+		cmd.Stdout = m.progress("ladder", f.Name, p.Duration(), part, parts)
+		stderr := bytes.Buffer{}
+		cmd.Stderr = &stderr
+		if err = m.run(ctx, cmd); err != nil {
+			return "", fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		part++
+		bw := r.kbps * 1000
+		if audio {
+			bw += ladderAudioKbps * 1000
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n%s/%s.m3u8\n", bw*11/10, w, h, url.PathEscape(path.Base(dir)), name)
+	}
+	tmp := absMaster + ".part"
+	if err = os.WriteFile(tmp, b.Bytes(), 0o644); err != nil {
+		return "", err
+	}
+	return master, os.Rename(tmp, absMaster)
+}
+
+// cmdLadder writes an HLS ladder of the videos, to stream them over slow
+// connections.
+func cmdLadder(ctx context.Context, w io.Writer, m *media, root string, files []file) error {
+	if m.ffmpeg == "" || m.ffprobe == "" {
+		return errNoFFmpeg
+	}
+	failed := 0
+	for _, f := range files {
+		if !jobKinds["ladder"].accept(f.Name) {
+			continue
+		}
+		master, err := m.ladder(ctx, root, f)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", f.Name, err)
+			failed++
+			continue
+		}
+		if master != "" {
+			fmt.Fprintf(w, "%s\n", master)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d ladders failed", failed)
+	}
+	return ctx.Err()
+}
+
+// serveLadder queues the videos {"files": [...]} to write their HLS ladder as
+// "ladder" jobs; see /api/jobs.
+func (s *server) serveLadder(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Files []string `json:"files"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || len(body.Files) == 0 {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	jobs, err := s.addJobs(job{Kind: "ladder"}, body.Files)
+	if err != nil {
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{"jobs": jobs})
+}
@@ -0,0 +1,54 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLadder(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a b.mp4": testVideo(t)})
+	fi, err := os.Stat(filepath.Join(root, "a b.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := newMedia().ladder(t.Context(), root, file{Name: "a b.mp4", Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if master != "a b.abr.m3u8" {
+		t.Fatalf("got master %q", master)
+	}
+	b, err := os.ReadFile(filepath.Join(root, master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 160x120 video only gets the smallest rung, at its size.
+	if !strings.Contains(string(b), "RESOLUTION=160x120\na%20b.abr/120p.m3u8\n") {
+		t.Fatalf("unexpected master playlist %q", b)
+	}
+	if _, err = os.Stat(filepath.Join(root, "a b.abr", "120p_00000.ts")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLadderAPI(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	// The file is checked once ffmpeg is found.
+	want := http.StatusBadRequest
+	if srv.media.ffmpeg == "" {
+		want = http.StatusNotImplemented
+	}
+	for body, status := range map[string]int{`{"files":[]}`: http.StatusBadRequest, `{`: http.StatusBadRequest, `{"files":["missing.mp4"]}`: want} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/ladder", "", body, nil); resp.StatusCode != status {
+			t.Fatalf("%s: got status %d, want %d: %s", body, resp.StatusCode, status, b)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// liveMaxAge is how long a playlist without an end marker is considered live
+// after its last modification. Older ones are leftovers from a recorder that
+// crashed.
+const liveMaxAge = 2 * time.Minute
+
+// isLive returns true if the HLS playlist f is still being recorded.
+func isLive(root *os.Root, f file) bool {
+	if !strings.HasSuffix(f.Name, ".m3u8") || time.Since(f.ModTime) > liveMaxAge {
+		return false
+	}
+	h, err := root.Open(filepath.FromSlash(f.Name))
+	if err != nil {
+		return false
+	}
+	defer h.Close()
+	// The end marker is at the end of the file, only read the tail.
+	const tail = 256
+	if f.Size > tail {
+		if _, err = h.Seek(f.Size-tail, io.SeekStart); err != nil {
+			return false
+		}
+	}
+	b, err := io.ReadAll(io.LimitReader(h, tail))
+	if err != nil {
+		return false
+	}
+	return !bytes.Contains(b, []byte("#EXT-X-ENDLIST"))
+}
+
+// liveStreams returns the names of the playlists being recorded that the user
+// of the request can see.
+func (s *server) liveStreams(req *http.Request) []string {
+	out := []string{}
+	for _, f := range s.visibleFiles(req) {
+		if isLive(s.rootDir, f) {
+			out = append(out, f.Name)
+		}
+	}
+	return out
+}
+
+func (s *server) serveLiveAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"streams": s.liveStreams(req)})
+}
+
+func (s *server) serveLive(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, liveHTML, map[string]any{"streams": s.liveStreams(req)})
+}
@@ -0,0 +1,20 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// TestLive checks that only the playlists without an end marker are listed.
+func TestLive(t *testing.T) {
+	const live = "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nseg0.ts\n"
+	_, ts := newTestServer(t, map[string]string{
+		"live/index.m3u8": live,
+		"live/seg0.ts":    "ts",
+		"vod/index.m3u8":  live + "#EXT-X-ENDLIST\n",
+		"vod/seg0.ts":     "ts",
+	}, options{})
+	testPage(t, ts.URL+"/live", "", "const data = ")
+	testPage(t, ts.URL+"/api/live", "", `{"streams":["live/index.m3u8"]}`)
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRotation is when to rotate the log files and how many to keep.
+type logRotation struct {
+	// maxSize and maxAge trigger a rotation when not 0.
+	maxSize int64
+	maxAge  time.Duration
+	// keep is the number of rotated files kept; 0 keeps them all.
+	keep int
+}
+
+// logFile is a log file rotated by size or age. The rotated files are named
+// "<p>.<timestamp>.gz" and are compressed in the background.
+type logFile struct {
+	p string
+	r logRotation
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(p string, r logRotation) (*logFile, error) {
+	l := &logFile{p: p, r: r}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size != 0 && ((l.r.maxSize != 0 && l.size+int64(len(b)) > l.r.maxSize) || (l.r.maxAge != 0 && time.Since(l.opened) > l.r.maxAge)) {
+		if err := l.rotate(); err != nil {
+			slog.Error("log", "p", l.p, "error", err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file, opens a new one and compresses the old one.
+func (l *logFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	old := l.p + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(l.p, old); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	go l.compress(old)
+	return nil
+}
+
+// compress gzips the rotated file then deletes the oldest ones beyond keep.
+func (l *logFile) compress(old string) {
+	err := gzipFile(old)
+	if err == nil {
+		err = os.Remove(old)
+	}
+	if err != nil {
+		slog.Error("log", "p", old, "error", err)
+	}
+	if l.r.keep == 0 {
+		return
+	}
+	rotated, _ := filepath.Glob(l.p + ".*.gz")
+	// The timestamp sorts chronologically.
+	slices.Sort(rotated)
+	for len(rotated) > l.r.keep {
+		if err = os.Remove(rotated[0]); err != nil {
+			slog.Error("log", "p", rotated[0], "error", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// gzipFile writes p compressed to p+".gz".
+func gzipFile(p string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(p+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err2 := zw.Close(); err == nil {
+		err = err2
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	return os.Rename(dst.Name(), strings.TrimSuffix(dst.Name(), ".tmp"))
+}
+
+// reopen closes and opens the file again, after an external tool like
+// logrotate renamed it.
+func (l *logFile) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	return l.open()
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogRotation rotates a log file by size and reopens it.
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "audit.log")
+	l, err := openLogFile(p, logRotation{maxSize: 100, keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 29) + "\n")
+	for range 10 {
+		if _, err = l.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		all, _ := filepath.Glob(p + ".*")
+		gz, _ := filepath.Glob(p + ".*.gz")
+		if len(all) == 2 && len(gz) == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("got rotated files %v", all)
+		}
+	}
+	if fi, err2 := os.Stat(p); err2 != nil || fi.Size() > 100 {
+		t.Fatalf("the log file wasn't rotated: %v", err2)
+	}
+	if err = os.Rename(p, p+".logrotate"); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Write(line); err != nil {
+		t.Fatal(err)
+	}
+	if b, err2 := os.ReadFile(p); err2 != nil || !bytes.Equal(b, line) {
+		t.Fatalf("the log file wasn't reopened: %v", err2)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lmittmann/tint"
+	"github.com/mattn/go-colorable"
+	"github.com/mattn/go-isatty"
+)
+
+// openLogOutput opens a log destination: "syslog" for the local syslog daemon,
+// "syslog://host:port" or "syslog+tcp://host:port" for a remote one,
+// "eventlog" for the Windows event log, or a file path, opened in append mode
+// and rotated per r.
+func openLogOutput(dest string, r logRotation) (io.Writer, error) {
+	switch {
+	case dest == "eventlog":
+		return openEventLog()
+	case dest == "syslog":
+		return openSyslog("", "")
+	case strings.HasPrefix(dest, "syslog://"):
+		return openSyslog("udp", strings.TrimPrefix(dest, "syslog://"))
+	case strings.HasPrefix(dest, "syslog+tcp://"):
+		return openSyslog("tcp", strings.TrimPrefix(dest, "syslog+tcp://"))
+	default:
+		return openLogFile(dest, r)
+	}
+}
+
+// newLogger returns the logger for the -log-level, -log-format and -log-output
+// flags and the writer it logs to.
+//
+// The format is "pretty", colored on a terminal, or "json". The output is
+// "stderr", "journald" or a destination supported by openLogOutput. With
+// journald, the lines are written to stderr prefixed with their priority, as
+// understood by journald for services. The event log uses the same prefix to
+// set the type of the events.
+func newLogger(level slog.Level, format, output string, r logRotation) (*slog.Logger, io.Writer, error) {
+	var out io.Writer = os.Stderr
+	if output != "stderr" && output != "journald" {
+		var err error
+		if out, err = openLogOutput(output, r); err != nil {
+			return nil, nil, err
+		}
+	}
+	w := out
+	// syslog, journald and the event log add their own timestamp.
+	noTime := output == "journald" || output == "eventlog" || strings.HasPrefix(output, "syslog")
+	var jw *journalWriter
+	if output == "journald" || output == "eventlog" {
+		jw = &journalWriter{w: w}
+		w = jw
+	}
+	var h slog.Handler
+	switch format {
+	case "pretty":
+		color := output == "stderr" && isatty.IsTerminal(os.Stderr.Fd())
+		if color {
+			w = colorable.NewColorable(os.Stderr)
+		}
+		timeFormat := time.TimeOnly
+		if output != "stderr" {
+			timeFormat = time.DateTime
+		}
+		o := &tint.Options{Level: level, TimeFormat: timeFormat, NoColor: !color}
+		if noTime {
+			o.ReplaceAttr = dropTime
+		}
+		h = tint.NewHandler(w, o)
+	case "json":
+		o := &slog.HandlerOptions{Level: level}
+		if noTime {
+			o.ReplaceAttr = dropTime
+		}
+		h = slog.NewJSONHandler(w, o)
+	default:
+		return nil, nil, errors.New("-log-format must be \"pretty\" or \"json\"")
+	}
+	if jw != nil {
+		h = &journalHandler{Handler: h, w: jw}
+	}
+	return slog.New(h), out, nil
+}
+
+// dropTime removes the time of the log records.
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// journalWriter prefixes the lines with their priority, e.g. "<6>" for info,
+// as defined by sd-daemon(3).
+type journalWriter struct {
+	w io.Writer
+
+	// mu is held by journalHandler while a record is written.
+	mu     sync.Mutex
+	prefix string
+}
+
+// Write writes the line with its prefix in a single call.
+func (j *journalWriter) Write(b []byte) (int, error) {
+	if _, err := j.w.Write(append([]byte(j.prefix), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// journalHandler sets the priority of each record written to journalWriter.
+type journalHandler struct {
+	slog.Handler
+	w *journalWriter
+}
+
+func (j *journalHandler) Handle(ctx context.Context, r slog.Record) error {
+	j.w.mu.Lock()
+	defer j.w.mu.Unlock()
+	switch {
+	case r.Level >= slog.LevelError:
+		j.w.prefix = "<3>"
+	case r.Level >= slog.LevelWarn:
+		j.w.prefix = "<4>"
+	case r.Level >= slog.LevelInfo:
+		j.w.prefix = "<6>"
+	default:
+		j.w.prefix = "<7>"
+	}
+	return j.Handler.Handle(ctx, r)
+}
+
+func (j *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journalHandler{Handler: j.Handler.WithAttrs(attrs), w: j.w}
+}
+
+func (j *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{Handler: j.Handler.WithGroup(name), w: j.w}
+}
+
+// reopenLogs reopens the log files among the writers on SIGUSR1, for
+// logrotate, until ctx is canceled.
+func reopenLogs(ctx context.Context, writers ...io.Writer) {
+	c := make(chan os.Signal, 1)
+	notifyReopen(c)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			for _, w := range writers {
+				if l, ok := w.(*logFile); ok {
+					if err := l.reopen(); err != nil {
+						slog.Error("log", "p", l.p, "error", err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLogOutput logs as JSON to a file and with the journald priorities.
+func TestLogOutput(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "serve-videos.log")
+	l, _, err := newLogger(slog.LevelWarn, "json", p, logRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("filtered")
+	l.Warn("selftest", "n", 1)
+	if b, err2 := os.ReadFile(p); err2 != nil || !bytes.Contains(b, []byte(`"level":"WARN","msg":"selftest","n":1}`)) || bytes.Contains(b, []byte("filtered")) {
+		t.Fatalf("unexpected log %q: %v", b, err2)
+	}
+	var buf bytes.Buffer
+	jw := &journalWriter{w: &buf}
+	j := slog.New(&journalHandler{Handler: slog.NewTextHandler(jw, &slog.HandlerOptions{ReplaceAttr: dropTime}), w: jw})
+	j.With("a", 1).Error("failed")
+	j.Info("started")
+	if want := "<3>level=ERROR msg=failed a=1\n<6>level=INFO msg=started\n"; buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+	if _, _, err = newLogger(slog.LevelInfo, "xml", "stderr", logRotation{}); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
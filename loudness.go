@@ -0,0 +1,173 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// loudness is the EBU R128 loudness of the first audio track of a file, as
+// measured by ffmpeg's loudnorm filter.
+type loudness struct {
+	// Integrated is in LUFS, TruePeak in dBTP, Range in LU and Threshold in
+	// LUFS.
+	Integrated float64 `json:"integrated"`
+	TruePeak   float64 `json:"true_peak"`
+	Range      float64 `json:"range"`
+	Threshold  float64 `json:"threshold"`
+	// Version is the fingerprint of the file measured.
+	Version string `json:"v"`
+}
+
+// parseLoudness parses the JSON printed by loudnorm=print_format=json at the
+// end of ffmpeg's stderr.
+func parseLoudness(b []byte) (*loudness, error) {
+	i := bytes.LastIndexByte(b, '{')
+	j := bytes.LastIndexByte(b, '}')
+	if i < 0 || j < i {
+		return nil, errors.New("no loudness measured")
+	}
+	var raw struct {
+		I      string `json:"input_i"`
+		TP     string `json:"input_tp"`
+		LRA    string `json:"input_lra"`
+		Thresh string `json:"input_thresh"`
+	}
+	if err := json.Unmarshal(b[i:j+1], &raw); err != nil {
+		return nil, err
+	}
+	out := &loudness{}
+	for _, v := range []struct {
+		s   string
+		dst *float64
+	}{{raw.I, &out.Integrated}, {raw.TP, &out.TruePeak}, {raw.LRA, &out.Range}, {raw.Thresh, &out.Threshold}} {
+		f, err := strconv.ParseFloat(v.s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudness %q", v.s)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, errors.New("the audio is silent")
+		}
+		*v.dst = f
+	}
+	return out, nil
+}
+
+// measureLoudness measures the loudness of the first audio track of f. The
+// whole track is decoded, so it takes a while.
+func (m *media) measureLoudness(ctx context.Context, root string, f file) (*loudness, error) {
+	if m.ffmpeg == "" {
+		return nil, errNoFFmpeg
+	}
+	p, err := m.probe(ctx, root, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.streams("audio")) == 0 {
+		return nil, fmt.Errorf("%s has no audio track", f.Name)
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer m.startJob("loudness", f.Name)()
+	// loudnorm prints its measurement at the info level.
+	args := []string{"-hide_banner", "-v", "info", "-i", src,
+		"-map", "0:a:0", "-vn", "-sn", "-dn", "-af", "loudnorm=print_format=json"}
+	args = append(args, progressArgs...)
+	args = append(args, "-f", "null", "-")
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	cmd.Stdout = m.progress("loudness", f.Name, p.Duration(), 0, 1)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	if err = m.run(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	l, err := parseLoudness(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg %q: %w", f.Name, err)
+	}
+	l.Version = fingerprint(f)
+	return l, nil
+}
+
+// loudnormFilter returns the ffmpeg audio filter normalizing the loudness to
+// target LUFS. With the measured loudness, it is a single linear gain instead
+// of a dynamic compression.
+func loudnormFilter(target float64, measured *loudness) string {
+	s := "loudnorm=I=" + strconv.FormatFloat(target, 'f', -1, 64) + ":TP=-1.5:LRA=11"
+	if measured != nil {
+		s += fmt.Sprintf(":measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:linear=true",
+			measured.Integrated, measured.TruePeak, measured.Range, measured.Threshold)
+	}
+	return s
+}
+
+// loudnesses are the loudness measured by the "loudness" jobs.
+//
+// They are saved to p when not empty.
+type loudnesses struct {
+	p string
+
+	mu     sync.Mutex
+	byName map[string]loudness
+	dirty  bool
+}
+
+// newLoudnesses loads the loudness saved in p, if any.
+func newLoudnesses(p string) (*loudnesses, error) {
+	l := &loudnesses{p: p, byName: map[string]loudness{}}
+	if err := readJSON(p, &l.byName); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// get returns the loudness of f if measured since it last changed.
+func (l *loudnesses) get(f file) *loudness {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v, ok := l.byName[f.Name]
+	if !ok || v.Version != fingerprint(f) {
+		return nil
+	}
+	return &v
+}
+
+// set records the loudness of the file.
+func (l *loudnesses) set(name string, v *loudness) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.byName[name] = *v
+	l.dirty = true
+}
+
+// save writes the loudness to disk if it changed.
+func (l *loudnesses) save() error {
+	l.mu.Lock()
+	if l.p == "" || !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(l.byName)
+	l.dirty = false
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.p, b)
+}
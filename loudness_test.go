@@ -0,0 +1,52 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestLoudness parses the measurement of loudnorm and the profiles
+// normalizing the loudness.
+func TestLoudness(t *testing.T) {
+	const stderr = `[Parsed_loudnorm_0 @ 0x5581] 
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-16.58",
+	"output_tp" : "-1.50",
+	"output_lra" : "14.78",
+	"output_thresh" : "-27.71",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.58"
+}
+`
+	l, err := parseLoudness([]byte(stderr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (loudness{Integrated: -27.61, TruePeak: -4.47, Range: 18.06, Threshold: -39.2}); *l != want {
+		t.Fatalf("got %+v", l)
+	}
+	if got, want := loudnormFilter(-16, l), "loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=-27.61:measured_TP=-4.47:measured_LRA=18.06:measured_thresh=-39.2:linear=true"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if _, err = parseLoudness([]byte(strings.ReplaceAll(stderr, "-27.61", "-inf"))); err == nil {
+		t.Fatal("expected the silence to fail")
+	}
+	var profiles transcodeProfiles
+	if err = profiles.Set("night=loudnorm=-16"); err != nil {
+		t.Fatal(err)
+	}
+	if tp, _ := profiles.lookup("night"); tp.Loudnorm != -16 {
+		t.Fatalf("got %+v", tp)
+	}
+	if err = profiles.Set("loud=loudnorm=0"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -6,28 +6,36 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/lmittmann/tint"
-	"github.com/mattn/go-colorable"
-	"github.com/mattn/go-isatty"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"gopkg.in/fsnotify.v1"
 )
 
@@ -37,18 +45,131 @@ var rootHTML []byte
 //go:embed html/list.html
 var listHTML []byte
 
+//go:embed html/watch.html
+var watchHTML []byte
+
+//go:embed html/live.html
+var liveHTML []byte
+
+//go:embed html/timeline.html
+var timelineHTML []byte
+
+//go:embed html/gallery.html
+var galleryHTML []byte
+
+//go:embed html/party.html
+var partyHTML []byte
+
+//go:embed html/shows.html
+var showsHTML []byte
+
+//go:embed html/duplicates.html
+var duplicatesHTML []byte
+
+//go:embed html/stats.html
+var statsHTML []byte
+
+//go:embed html/admin.html
+var adminHTML []byte
+
+//go:embed html/clips.html
+var clipsHTML []byte
+
+//go:embed html/share.html
+var shareHTML []byte
+
+//go:embed html/history.html
+var historyHTML []byte
+
+// mimeTypes overrides the Content-Type guessed by http.ServeFile, which
+// depends on the OS configuration. AirPlay and hls.js are picky about it.
+//
+// It can be amended with -mime.
+var mimeTypes = map[string]string{
+	".aac":  "audio/aac",
+	".avi":  "video/x-msvideo",
+	".flac": "audio/flac",
+	".heic": "image/heic",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".m4s":  "video/iso.segment",
+	".m4v":  "video/x-m4v",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".png":  "image/png",
+	".srt":  "application/x-subrip",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+	".webp": "image/webp",
+}
+
+// mimeType returns the Content-Type to use for a file name.
+func mimeType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t := mimeTypes[ext]; t != "" {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// setMIMETypes amends mimeTypes with -mime flags in the form "<ext>=<type>".
+func setMIMETypes(args []string) error {
+	for _, a := range args {
+		ext, t, ok := strings.Cut(a, "=")
+		if !ok || ext == "" || t == "" {
+			return fmt.Errorf("-mime %q must be in the form <ext>=<type>", a)
+		}
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("-mime %q: %w", a, err)
+		}
+		mimeTypes["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = t
+	}
+	return nil
+}
+
 // Injected data to speed up page load, versus having to do an API call.
 var dataTmpl = template.Must(template.New("").Parse("<script>'use strict';const data = {{.}};</script>"))
 
-func getFiles(root string, exts []string) (*fsnotify.Watcher, []string, error) {
+// file is a file in the index.
+type file struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// scan walks root to find the files with one of the extensions exts and
+// returns a watcher for all the directories found.
+func scan(root string, exts []string) (*fsnotify.Watcher, []file, error) {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create a watcher for %q: %w", root, err)
 	}
-	var files []string
+	return w, walk(root, exts, w), nil
+}
+
+// walk returns the files in root with one of the extensions exts, adding the
+// directories found to w if not nil.
+func walk(root string, exts []string, w *fsnotify.Watcher) []file {
+	var files []file
 	offset := len(root) + 1
 	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Ignore, e.g. a file deleted while walking.
+			return nil
+		}
 		if d.IsDir() {
+			if w == nil {
+				return nil
+			}
 			if err2 := w.Add(path); err2 != nil {
 				// Ignore, it's not a big deal.
 				slog.Error("watcher", "path", path, "error", err2)
@@ -56,16 +177,18 @@ func getFiles(root string, exts []string) (*fsnotify.Watcher, []string, error) {
 		} else {
 			for _, ext := range exts {
 				if strings.HasSuffix(path, ext) {
-					files = append(files, path[offset:])
+					if fi, err2 := d.Info(); err2 == nil {
+						files = append(files, file{Name: filepath.ToSlash(path[offset:]), Size: fi.Size(), ModTime: fi.ModTime()})
+					}
 					break
 				}
 			}
 		}
 		return nil
 	})
-	sort.Strings(files)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
 	slog.Info("done parsing", "num_files", len(files))
-	return w, files, nil
+	return files
 }
 
 type stringsFlag []string
@@ -79,138 +202,1203 @@ func (s *stringsFlag) Set(value string) error {
 	return nil
 }
 
-func mainImpl() error {
-	logger := slog.New(tint.NewHandler(colorable.NewColorable(os.Stderr), &tint.Options{
-		Level:      slog.LevelDebug,
-		TimeFormat: time.TimeOnly,
-		NoColor:    !isatty.IsTerminal(os.Stderr.Fd()),
-	}))
-	slog.SetDefault(logger)
-	addr := flag.String("addr", ":8010", "address and port to listen to")
-	var extsArg stringsFlag
-	flag.Var(&extsArg, "e", "extensions")
-	root := flag.String("root", ".", "root directory")
-	flag.Parse()
+// options are the server settings specified on the command line.
+type options struct {
+	// allowRemote enables AirPlay and other remote playback in the player.
+	allowRemote bool
+	// speed is the default playback rate of the videos on the root page.
+	speed float64
+	// autoplay starts the videos of the root page once autoplayThreshold of
+	// them is within autoplayMargin of the viewport for autoplayDelay; muted
+	// starts them muted.
+	autoplay          bool
+	autoplayDelay     time.Duration
+	autoplayThreshold float64
+	autoplayMargin    string
+	muted             bool
+	// preloadMargin is how far from the viewport the players of the root page
+	// are created, as a CSS margin.
+	preloadMargin string
+	// pip allows picture-in-picture on the root page.
+	pip bool
+	// publicURL is the URL used in links sent outside of HTTP responses, e.g.
+	// "https://videos.example.com".
+	publicURL string
+	// webhooks are URLs to POST to when a new file appears.
+	webhooks []string
+	// ntfy, gotify and pushover are push notification services to notify when
+	// a new file appears in one of notifyDirs.
+	ntfy       string
+	gotify     string
+	pushover   string
+	notifyDirs []string
+	// gapThreshold is the minimum period without recording reported as a gap.
+	gapThreshold time.Duration
+	// minFree enables deleting the oldest files in the recordings directories
+	// when the free space is lower; the files matching keep are never
+	// deleted.
+	minFree    freeSpace
+	recordings []string
+	keep       []string
+	// jobWorkers is how many background jobs run concurrently.
+	jobWorkers int
+	// pregenerate generates the missing thumbnails when idle.
+	pregenerate bool
+	// ffmpeg limits the ffmpeg and ffprobe processes.
+	ffmpeg ffmpegLimits
+	// profiles are the transcode profiles usable with /api/jobs.
+	profiles transcodeProfiles
+	// etagHash uses the SHA-256 of the content as the ETag of /raw/.
+	etagHash bool
+	// readBuffer, when not 0, reads the files in chunks of this size instead
+	// of using sendfile.
+	readBuffer int
+	// readAhead, when not 0, asks the OS to read this many bytes ahead of the
+	// requested offset.
+	readAhead int64
+	// cache is the Cache-Control policy of the files.
+	cache cacheRules
+	// signSecret enables signed URLs; see signer.
+	signSecret   string
+	signTTL      time.Duration
+	signRequired bool
+	// peers are other instances merged in the library; their files are
+	// proxied instead of redirected to when peerProxy is set.
+	peers     []*peer
+	peerProxy bool
+	// mirror is the URL of a source to proxy and cache in root.
+	mirror string
+	// dataDir is where the state is saved, e.g. the watched coverage. It is
+	// kept in memory when empty.
+	dataDir string
+	// cacheDir is where the thumbnails and the copies are kept, up to
+	// cacheMax bytes when not 0; see setCacheDir.
+	cacheDir string
+	cacheMax uint64
+	// thumbTimes are the times of the thumbnails set with -thumb-time.
+	thumbTimes thumbTimes
+	// users enables HTTP basic authentication and per-user profiles.
+	users users
+	// admins are the users allowed to use /admin and to delete files;
+	// uploaders can upload files into dropDir. See role.
+	admins    []string
+	uploaders []string
+	dropDir   string
+	// tokens authenticate users for scripts, e.g. the client command.
+	tokens tokens
+	// access restricts the files each user can see; nil allows everything.
+	access *accessRules
+	// tmdbKey enables looking up the movies and shows on TheMovieDB.
+	tmdbKey string
+	// titleRules override the display titles of the files.
+	titleRules titleRules
+	// analyticsURL is where to POST the access events.
+	analyticsURL string
+	// auditLog is the file or syslog destination to log the accesses to
+	// /raw/ to.
+	auditLog string
+	// logRotation applies to the log files.
+	logRotation logRotation
+	// hsts is the max-age of Strict-Transport-Security, not sent when 0.
+	hsts time.Duration
+	// shutdownGrace is how long to wait for the requests in flight when
+	// shutting down; drainStreams includes the files being streamed.
+	shutdownGrace time.Duration
+	drainStreams  bool
+	// readTimeout and writeTimeout limit the requests to the pages and the
+	// API; streamTimeout limits the media streams and stallTimeout how long
+	// their client can stop reading. 0 means no limit.
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	streamTimeout time.Duration
+	stallTimeout  time.Duration
+}
 
-	if flag.NArg() != 0 {
-		return errors.New("unexpected argument")
+// server serves the files found in root.
+type server struct {
+	root string
+	// rootDir is root opened, so the files served can't be outside of it.
+	rootDir  *os.Root
+	exts     []string
+	opts     options
+	media    *media
+	hashes   *contentHashes
+	dupes    *duplicates
+	coverage *coverage
+	profiles *profiles
+	tags     *tags
+	notes    *notes
+	clips    *clips
+	views    *views
+	shares   *shares
+	slugs    *slugs
+	// analytics records the downloads and plays.
+	analytics *analytics
+	// audit is set when -audit-log is used.
+	audit *auditLog
+	// tmdb is set when -tmdb-key is used.
+	tmdb    *tmdb
+	metrics *metrics
+	// signer is set when -sign-secret is used.
+	signer *signer
+	peers  []*peer
+	mirror *mirror
+	// retention is set when -min-free is used.
+	retention *retention
+
+	parties  parties
+	sessions sessions
+	streams  streams
+	changes  changes
+	started  time.Time
+	// draining is set while shutting down.
+	draining atomic.Bool
+	// rescan triggers a scan of root.
+	rescan chan struct{}
+	// pregenerate is set with -pregenerate; it is signaled when files are
+	// added.
+	pregenerate chan struct{}
+	// jobs are the background jobs, e.g. the HLS ladders to write.
+	jobs *jobQueue
+
+	mu      sync.Mutex
+	files   []file
+	watcher watcherHealth
+}
+
+// newServer scans root and starts watching it for changes until ctx is
+// canceled.
+func newServer(ctx context.Context, root string, exts []string, opts options) (*server, error) {
+	rootDir, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
 	}
-	if len(extsArg) == 0 {
-		extsArg = []string{"m3u8", "mkv", "mp4", "ts"}
+	s := &server{root: root, rootDir: rootDir, exts: exts, opts: opts, media: newMedia(), hashes: newContentHashes(rootDir), dupes: newDuplicates(), metrics: newMetrics(), started: time.Now().UTC(), rescan: make(chan struct{}, 1)}
+	s.media.setLimits(opts.ffmpeg)
+	s.media.profiles = opts.profiles
+	s.media.thumbTimes = opts.thumbTimes
+	cp, pp, tp, np, vp, sp, lp, ap, jp, op, up, kp, kd := "", "", "", "", "", "", "", "", "", "", "", "", ""
+	if opts.dataDir != "" {
+		cp = filepath.Join(opts.dataDir, "coverage.json")
+		pp = filepath.Join(opts.dataDir, "profiles.json")
+		tp = filepath.Join(opts.dataDir, "tags.json")
+		np = filepath.Join(opts.dataDir, "notes.json")
+		vp = filepath.Join(opts.dataDir, "views.json")
+		sp = filepath.Join(opts.dataDir, "shares.json")
+		lp = filepath.Join(opts.dataDir, "slugs.json")
+		ap = filepath.Join(opts.dataDir, "analytics.jsonl")
+		jp = filepath.Join(opts.dataDir, "jobs.json")
+		op = filepath.Join(opts.dataDir, "posters.json")
+		up = filepath.Join(opts.dataDir, "loudness.json")
+		kp = filepath.Join(opts.dataDir, "clips.json")
+		kd = filepath.Join(opts.dataDir, "clips")
 	}
-	var err error
-	if *root, err = filepath.Abs(filepath.Clean(*root)); err != nil {
-		return err
+	s.media.setCacheDir(cmp.Or(opts.cacheDir, opts.dataDir), opts.cacheMax)
+	if s.coverage, err = newCoverage(cp); err != nil {
+		return nil, err
 	}
-	if fi, err2 := os.Stat(*root); err2 != nil {
-		return fmt.Errorf("-root %q is unusable: %w", *root, err2)
-	} else if !fi.IsDir() {
-		return fmt.Errorf("-root %q is not a directory", *root)
+	if s.profiles, err = newProfiles(pp); err != nil {
+		return nil, err
 	}
-	slog.Info("looking for files", "root", *root, "ext", strings.Join(extsArg, ","))
-	mu := sync.Mutex{}
-	wat, files, err := getFiles(*root, extsArg)
+	if s.tags, err = newTags(tp); err != nil {
+		return nil, err
+	}
+	if s.notes, err = newNotes(np); err != nil {
+		return nil, err
+	}
+	if s.clips, err = newClips(kp, kd); err != nil {
+		return nil, err
+	}
+	if s.views, err = newViews(vp); err != nil {
+		return nil, err
+	}
+	if s.shares, err = newShares(sp); err != nil {
+		return nil, err
+	}
+	if s.slugs, err = newSlugs(lp); err != nil {
+		return nil, err
+	}
+	if s.jobs, err = newJobQueue(jp); err != nil {
+		return nil, err
+	}
+	if s.media.posters, err = newPosters(op); err != nil {
+		return nil, err
+	}
+	if s.media.loudness, err = newLoudnesses(up); err != nil {
+		return nil, err
+	}
+	if s.analytics, err = newAnalytics(ap, opts.analyticsURL); err != nil {
+		return nil, err
+	}
+	if opts.analyticsURL != "" {
+		go s.analytics.runPush(ctx)
+	}
+	if opts.auditLog != "" {
+		if s.audit, err = newAuditLog(opts.auditLog, opts.logRotation); err != nil {
+			return nil, fmt.Errorf("-audit-log: %w", err)
+		}
+	}
+	if opts.tmdbKey != "" {
+		if s.tmdb, err = newTMDB(opts.tmdbKey, filepath.Join(opts.dataDir, "tmdb")); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	wat, files, err := scan(root, exts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s.files = files
+	s.watcher.scanned(start)
+	go s.runSaveState(ctx)
+	if s.tmdb != nil {
+		go s.runTMDB(ctx)
+	}
+	if opts.mirror != "" {
+		if s.mirror, err = newMirror(opts.mirror, rootDir, exts); err != nil {
+			return nil, err
+		}
+		go s.mirror.run(ctx)
 	}
+	if s.peers = opts.peers; len(s.peers) != 0 {
+		go s.runPeers(ctx)
+	}
+	if opts.signSecret != "" {
+		s.signer = &signer{secret: opts.signSecret, ttl: opts.signTTL, required: opts.signRequired}
+	}
+	go s.watch(ctx, wat)
+	go s.runDuplicates(ctx)
+	go s.runJobs(ctx)
+	go s.media.runCache(ctx)
+	if opts.pregenerate && s.media.ffmpeg != "" {
+		s.pregenerate = make(chan struct{}, 1)
+		go s.runPregenerate(ctx)
+	}
+	if opts.minFree != (freeSpace{}) {
+		s.retention = &retention{minFree: opts.minFree, dirs: opts.recordings, keep: opts.keep, dropDir: opts.dropDir}
+		go s.retention.run(ctx, s)
+	}
+	return s, nil
+}
 
-	go func() {
-		for {
-			e := <-wat.Events
-			slog.Info("event", "op", e.Op, "name", e.Name)
-			wat2, files2, _ := getFiles(*root, extsArg)
+func (s *server) watch(ctx context.Context, wat *fsnotify.Watcher) {
+	for {
+		select {
+		case <-ctx.Done():
+			// rootDir is closed by shutdown, once the streams are drained.
 			_ = wat.Close()
-			wat = wat2
-			mu.Lock()
-			files = files2
-			mu.Unlock()
+			return
+		case e := <-wat.Events:
+			slog.Debug("event", "op", e.Op, "name", e.Name)
+			s.mu.Lock()
+			s.watcher.Events++
+			s.watcher.LastEvent = time.Now().UTC()
+			s.mu.Unlock()
+		case err := <-wat.Errors:
+			slog.Error("watcher", "error", err)
+			s.mu.Lock()
+			s.watcher.Error = err.Error()
+			s.mu.Unlock()
+			continue
+		case <-s.rescan:
+			slog.Info("watcher", "msg", "rescan requested")
+		}
+		start := time.Now()
+		wat2, files, err := scan(s.root, s.exts)
+		if err != nil {
+			slog.Error("watcher", "error", err)
+			s.mu.Lock()
+			s.watcher.Error = err.Error()
+			s.mu.Unlock()
+			continue
 		}
-	}()
+		_ = wat.Close()
+		wat = wat2
+		s.mu.Lock()
+		added := addedFiles(s.files, files)
+		diff := diffFiles(s.files, files)
+		s.files = files
+		s.watcher.scanned(start)
+		s.mu.Unlock()
+		s.media.resetMetadata()
+		s.changes.publish(diff)
+		if len(added) != 0 {
+			s.onNewFiles(ctx, added)
+		}
+	}
+}
+
+// addedFiles returns the files in files that are not in old.
+func addedFiles(old, files []file) []file {
+	seen := make(map[string]struct{}, len(old))
+	for i := range old {
+		seen[old[i].Name] = struct{}{}
+	}
+	var out []file
+	for _, f := range files {
+		if _, ok := seen[f.Name]; !ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// getFiles returns a copy of the current list of files.
+func (s *server) getFiles() []file {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := make([]file, len(s.files))
+	copy(tmp, s.files)
+	return tmp
+}
 
-	m := http.ServeMux{}
+// getNames returns the current list of file names.
+func (s *server) getNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, len(s.files))
+	for i := range s.files {
+		names[i] = s.files[i].Name
+	}
+	return names
+}
+
+// hasFile returns true if f is in the list of files.
+func (s *server) hasFile(f string) bool {
+	_, ok := s.getFile(f)
+	return ok
+}
+
+// getFile returns the file named name if it is in the list of files.
+func (s *server) getFile(name string) (file, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].Name >= name })
+	if i < len(s.files) && s.files[i].Name == name {
+		return s.files[i], true
+	}
+	return file{}, false
+}
+
+func (s *server) handler() http.Handler {
+	m := &http.ServeMux{}
 	// Videos
-	m.HandleFunc("GET /raw/", func(w http.ResponseWriter, req *http.Request) {
-		path, err2 := url.QueryUnescape(req.URL.Path)
-		if err2 != nil {
+	m.Handle("GET /raw/", s.auditHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// req.URL.Path is already unescaped.
+		f := req.URL.Path[len("/raw/"):]
+		if !validPath(f) {
 			http.Error(w, "Invalid path", 404)
 			return
 		}
-		f := path[len("/raw/"):]
-		mu.Lock()
-		// Only allow files in the list we have.
-		i := sort.SearchStrings(files, f)
-		found := i < len(files) && files[i] == f
-		mu.Unlock()
-		if !found {
+		// A signed URL fetched without logging in, e.g. by a CDN, is anonymous
+		// so it only grants access to the public files.
+		if !s.canAccess(req, f) {
+			http.Error(w, "Invalid path", 404)
+			return
+		}
+		if s.signer != nil {
+			if err := s.signer.verify(req); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		// Only allow files in the list we have. A LL-HLS partial segment may be
+		// requested before it is written.
+		if p, name := s.findPeer(f); p != nil && !s.hasFile(f) {
+			s.servePeerFile(w, req, p, name)
+			return
+		}
+		if s.mirror != nil && !s.hasFile(f) && s.mirror.hasFile(f) {
+			s.serveMirrorFile(w, req, f)
+			return
+		}
+		if !s.hasFile(f) && !s.waitPreload(req.Context(), f) {
 			slog.Info("http", "f", f)
 			http.Error(w, "Invalid path", 404)
 			return
 		}
-		// Cache for a long time, the exception is m3u8 since it could be a live
-		// playlist.
-		if h := w.Header(); strings.HasSuffix(f, ".m3u8") {
-			h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			h.Set("Pragma", "no-cache")
-			h.Set("Expires", "0")
-		} else {
-			h.Set("Cache-Control", "public, max-age=86400")
+		if q := req.URL.Query(); strings.HasSuffix(f, ".m3u8") && q.Has("_HLS_msn") {
+			// LL-HLS blocking playlist reload.
+			msn, err := strconv.Atoi(q.Get("_HLS_msn"))
+			part := -1
+			if err == nil && q.Has("_HLS_part") {
+				part, err = strconv.Atoi(q.Get("_HLS_part"))
+			}
+			if err != nil {
+				http.Error(w, "Invalid _HLS_msn or _HLS_part", http.StatusBadRequest)
+				return
+			}
+			if err = waitPlaylist(req.Context(), s.rootDir, f, msn, part); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
-		http.ServeFile(w, req, filepath.Join(*root, f))
-	})
+		setCacheControl(w.Header(), s.opts.cache.lookup(f))
+		if s.signer != nil && strings.HasSuffix(f, ".m3u8") && req.URL.Query().Has("md5") {
+			s.serveSignedPlaylist(w, req, f)
+			return
+		}
+		if t := mimeType(f); t != "" {
+			w.Header().Set("Content-Type", t)
+		}
+		s.serveContent(w, req, f)
+	})))
+	m.HandleFunc("GET /thumb/{path...}", s.serveThumb)
+	m.HandleFunc("GET /api/scenes/{path...}", s.serveScenes)
+	m.HandleFunc("GET /art/{path...}", s.serveArt)
+	m.HandleFunc("GET /export/{path...}", s.serveExport)
+	m.HandleFunc("GET /remux/{path...}", s.serveRemux)
+	m.HandleFunc("GET /audio/{path...}", s.serveAudio)
+	m.HandleFunc("GET /share/{id}", s.serveShare)
+	m.HandleFunc("POST /share/{id}", s.serveShare)
+	m.HandleFunc("GET /s/{slug}", s.serveSlug)
+	m.HandleFunc("GET /qr", s.serveQR)
+
+	// API
+	m.HandleFunc("GET /api/live", s.serveLiveAPI)
+	m.HandleFunc("GET /api/timeline", s.serveTimelineAPI)
+	m.HandleFunc("GET /api/gaps", s.serveGapsAPI)
+	m.HandleFunc("GET /api/coverage", s.serveCoverageAPI)
+	m.HandleFunc("GET /api/files", s.serveFilesAPI)
+	m.HandleFunc("GET /graphql", s.serveGraphQL)
+	m.HandleFunc("POST /graphql", s.serveGraphQL)
+	s.apiV1Routes(m)
+	m.HandleFunc("GET /metrics", s.metrics.serve)
+	m.Handle("POST /api/repair/{dir...}", s.roleHandler(roleAdmin, s.serveRepair))
+	m.Handle("POST /api/ladder", s.roleHandler(roleAdmin, s.serveLadder))
+	m.Handle("GET /api/jobs", s.roleHandler(roleAdmin, s.serveJobs))
+	m.Handle("POST /api/jobs", s.roleHandler(roleAdmin, s.serveJobsAdd))
+	m.Handle("GET /api/transcode/profiles", s.roleHandler(roleAdmin, s.serveTranscodeProfiles))
+	m.Handle("GET /api/jobs/events", s.roleHandler(roleAdmin, s.serveJobEvents))
+	m.Handle("GET /api/jobs/{id}", s.roleHandler(roleAdmin, s.serveJob))
+	m.Handle("DELETE /api/jobs/{id}", s.roleHandler(roleAdmin, s.serveJob))
+	m.Handle("PUT /api/upload/{name}", s.roleHandler(roleUploader, s.serveUpload))
+	m.HandleFunc("GET /api/profile", s.serveProfileAPI)
+	m.HandleFunc("GET /api/profile/export", s.serveProfileExport)
+	m.HandleFunc("POST /api/profile/import", s.serveProfileImport)
+	m.HandleFunc("GET /api/sync", s.serveSyncList)
+	m.HandleFunc("GET /api/sync/{key}", s.serveSync)
+	m.HandleFunc("PUT /api/sync/{key}", s.serveSync)
+	m.HandleFunc("DELETE /api/sync/{key}", s.serveSync)
+	m.HandleFunc("POST /api/profile/player", s.serveProfilePlayer)
+	m.HandleFunc("POST /api/profile/{kind}/{path...}", s.serveProfileUpdate)
+	m.HandleFunc("DELETE /api/profile/{kind}/{path...}", s.serveProfileUpdate)
+	m.HandleFunc("GET /api/tags", s.serveTagsAPI)
+	m.Handle("POST /api/tags", s.roleHandler(roleUploader, s.serveTagsEdit))
+	m.HandleFunc("GET /api/tags/{path...}", s.serveFileTagsAPI)
+	m.HandleFunc("GET /api/bookmarks/{path...}", s.serveBookmarks)
+	m.HandleFunc("POST /api/bookmarks/{path...}", s.serveBookmarks)
+	m.HandleFunc("DELETE /api/bookmarks/{path...}", s.serveBookmarks)
+	m.HandleFunc("GET /api/clips", s.serveClipsAPI)
+	m.HandleFunc("POST /api/clips", s.serveClipAdd)
+	m.HandleFunc("GET /api/clips/{id}", s.serveClip)
+	m.HandleFunc("POST /api/clips/{id}", s.serveClip)
+	m.HandleFunc("DELETE /api/clips/{id}", s.serveClip)
+	m.HandleFunc("POST /api/clips/{id}/render", s.serveClipRender)
+	m.HandleFunc("GET /api/notes", s.serveNotesSearch)
+	m.HandleFunc("GET /api/notes/{path...}", s.serveNotes)
+	m.HandleFunc("POST /api/notes/{path...}", s.serveNotes)
+	m.HandleFunc("DELETE /api/notes/{path...}", s.serveNotes)
+	m.HandleFunc("GET /api/checksum/{path...}", s.serveChecksum)
+	m.HandleFunc("GET /api/progress/{path...}", s.serveProgress)
+	m.HandleFunc("GET /api/duplicates", s.serveDuplicatesAPI)
+	m.HandleFunc("GET /api/stats", s.serveStatsAPI)
+	m.HandleFunc("GET /api/views", s.serveViewsAPI)
+	m.Handle("GET /api/analytics", s.roleHandler(roleAdmin, s.serveAnalytics))
+	m.HandleFunc("POST /api/views/{path...}", s.servePlayed)
+	m.HandleFunc("POST /api/short/{path...}", s.serveSlugCreate)
+	m.Handle("POST /api/duplicates/scan", s.roleHandler(roleAdmin, s.serveDuplicatesScan))
+	m.Handle("POST /api/duplicates/delete", s.roleHandler(roleAdmin, s.serveDuplicatesDelete))
+	m.Handle("GET /api/admin", s.adminHandler(s.serveAdminAPI))
+	m.Handle("POST /api/admin/rescan", s.adminHandler(s.serveAdminRescan))
+	m.Handle("POST /api/admin/purge", s.adminHandler(s.serveAdminPurge))
+	m.Handle("GET /api/cache", s.adminHandler(s.serveCache))
+	m.Handle("DELETE /api/cache", s.adminHandler(s.serveCachePurge))
+	m.Handle("POST /api/poster/{path...}", s.adminHandler(s.servePoster))
+	m.Handle("DELETE /api/poster/{path...}", s.adminHandler(s.servePoster))
+	m.HandleFunc("GET /api/sessions", s.serveSessionsAPI)
+	m.HandleFunc("GET /api/sessions/ws", s.serveSessionWS)
+	m.HandleFunc("POST /api/sessions/{id}/{command}", s.serveSessionCommand)
+
+	// Feeds
+	m.HandleFunc("GET /feed.xml", s.serveFeed)
+	m.HandleFunc("GET /podcast/{dir...}", s.servePodcast)
 
-	// HTML
 	m.HandleFunc("GET /list", func(w http.ResponseWriter, req *http.Request) {
-		mu.Lock()
-		tmp := make([]string, len(files))
-		copy(tmp, files)
-		mu.Unlock()
-		h := w.Header()
-		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-		h.Set("Pragma", "no-cache")
-		h.Set("Expires", "0")
-		h.Set("Content-Type", "text/html; charset=utf-8")
-		if _, err2 := w.Write(listHTML); err2 != nil {
+		watched := map[string]float64{}
+		for _, c := range s.coverageStats(req) {
+			watched[c.Name] = c.Percent
+		}
+		user := userFrom(req)
+		pr := s.profiles.get(user)
+		names := s.libraryNames(user)
+		a := s.opts.access
+		s.serveHTML(w, listHTML, map[string]any{"files": names, "watched": watched, "profile": pr, "tags": visibleKeys(a, user, s.tags.all()), "meta": visibleKeys(a, user, s.sidecars()), "titles": visibleKeys(a, user, s.titles()), "groups": s.groups(names), "views": visibleKeys(a, user, s.views.all()), "badges": s.badges(names)})
+	})
+	m.HandleFunc("GET /live", s.serveLive)
+	m.HandleFunc("GET /timeline", s.serveTimeline)
+	m.HandleFunc("GET /gallery", s.serveGallery)
+	m.HandleFunc("GET /shows", s.serveShows)
+	m.HandleFunc("GET /duplicates", s.serveDuplicates)
+	m.HandleFunc("GET /stats", s.serveStats)
+	m.HandleFunc("GET /history", s.serveHistory)
+	m.HandleFunc("GET /clips", s.serveClips)
+	m.HandleFunc("GET /clips/{name}", s.serveClipFile)
+	m.Handle("GET /admin", s.adminHandler(s.serveAdmin))
+	m.HandleFunc("GET /party/{id}", s.servePartyPage)
+	m.HandleFunc("GET /party/{id}/ws", s.servePartyWS)
+	m.HandleFunc("GET /watch/{path...}", func(w http.ResponseWriter, req *http.Request) {
+		f := req.PathValue("path")
+		if !s.inLibrary(f) || !s.canAccess(req, f) {
+			http.Error(w, "Invalid path", 404)
 			return
 		}
-		_ = dataTmpl.Execute(w, map[string]any{"files": tmp})
+		pr := s.profiles.get(userFrom(req))
+		// The frame rate is used to step frame by frame; the audio tracks are
+		// listed when there are several, to pick the language; the codecs
+		// pick a variant when the browser can't play them.
+		fps := 0.
+		var audio []mediaStream
+		var chapters []chapter
+		var pb *playback
+		if fl, ok := s.getFile(f); ok && strings.HasPrefix(mimeType(f), "video/") {
+			if p, err := s.media.probe(req.Context(), s.root, fl); err == nil {
+				fps = p.FrameRate()
+				chapters = p.chapters()
+				pb = s.playbackOf(req, fl, p)
+				if audio = p.streams("audio"); len(audio) < 2 {
+					audio = nil
+				}
+			}
+		}
+		// The admins can transcode the file.
+		var profiles []string
+		if s.roleOf(req) == roleAdmin && s.media.ffmpeg != "" && jobKinds["transcode"].accept(f) {
+			for _, p := range s.media.profiles.list() {
+				profiles = append(profiles, p.Name)
+			}
+		}
+		// The admins can pick the frame used as the thumbnail.
+		setPoster := s.roleOf(req) == roleAdmin && s.media.ffmpeg != "" && s.hasFile(f) && hasDuration(f)
+		// The short URL is only created when the user asks for it.
+		short := ""
+		if slug := s.slugs.lookup(watchURL(f)); slug != "" {
+			short = "/s/" + slug
+		}
+		s.serveHTML(w, watchHTML, map[string]any{"file": f, "short": short, "position": pr.Positions[f], "favorite": pr.Favorites[f], "rating": pr.Ratings[f], "tags": s.tags.get(f), "meta": visibleKeys(s.opts.access, userFrom(req), s.sidecars()), "titles": visibleKeys(s.opts.access, userFrom(req), s.titles()), "fps": fps, "jobs": s.jobEvents(f), "profiles": profiles, "setPoster": setPoster, "sync": pr.syncValues(), "audio": audio, "chapters": chapters, "playback": pb, "renditions": renditions(s.libraryNames(userFrom(req)))[f]})
 	})
 	m.HandleFunc("GET /", func(w http.ResponseWriter, req *http.Request) {
-		mu.Lock()
-		tmp := make([]string, len(files))
-		copy(tmp, files)
-		mu.Unlock()
-		h := w.Header()
-		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-		h.Set("Pragma", "no-cache")
-		h.Set("Expires", "0")
-		h.Set("Content-Type", "text/html; charset=utf-8")
-		if _, err2 := w.Write(rootHTML); err2 != nil {
+		names := s.libraryNames(userFrom(req))
+		r := renditions(names)
+		listed := listedNames(names, r)
+		s.serveHTML(w, rootHTML, map[string]any{"files": listed, "renditions": r, "badges": s.badges(listed), "meta": visibleKeys(s.opts.access, userFrom(req), s.sidecars()), "titles": visibleKeys(s.opts.access, userFrom(req), s.titles()), "player": s.profiles.get(userFrom(req)).Player, "previews": s.media.ffmpeg != "", "clips": len(s.clipsOf(req, nil))})
+	})
+	h := s.drainHandler(s.timeoutHandler(compressHandler(s.securityHandler(s.authHandler(csrfHandler(m))))))
+	g := s.drainHandler(s.timeoutHandler(s.authHandler(http.HandlerFunc(s.serveGRPC))))
+	// h2c serves HTTP/2 without TLS, as gRPC requires.
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isGRPC(req) {
+			g.ServeHTTP(w, req)
 			return
 		}
-		_ = dataTmpl.Execute(w, map[string]any{"files": tmp})
-	})
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
-	s := &http.Server{
-		Handler:      &m,
-		BaseContext:  func(net.Listener) context.Context { return ctx },
-		ReadTimeout:  10. * time.Second,
-		WriteTimeout: time.Hour,
+		h.ServeHTTP(w, req)
+	}), &http2.Server{})
+}
+
+// escapePath escapes each element of a slash separated path.
+func escapePath(name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// rawURL returns the escaped URL path to fetch a file.
+func rawURL(name string) string {
+	return "/raw/" + escapePath(name)
+}
+
+// watchURL returns the escaped URL path to the page to watch a file.
+func watchURL(name string) string {
+	return "/watch/" + escapePath(name)
+}
+
+// serveHTML serves a page with data injected. The player settings are added
+// to data.
+func (s *server) serveHTML(w http.ResponseWriter, page []byte, data map[string]any) {
+	data["allowRemote"] = s.opts.allowRemote
+	data["speed"] = s.opts.speed
+	data["autoplay"] = s.opts.autoplay
+	data["autoplayDelay"] = s.opts.autoplayDelay.Milliseconds()
+	data["autoplayThreshold"] = s.opts.autoplayThreshold
+	data["autoplayMargin"] = s.opts.autoplayMargin
+	data["preloadMargin"] = s.opts.preloadMargin
+	data["muted"] = s.opts.muted
+	data["pip"] = s.opts.pip
+	h := w.Header()
+	h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(page); err != nil {
+		return
+	}
+	_ = dataTmpl.Execute(w, data)
+}
+
+// reMargin matches the margins accepted by IntersectionObserver's rootMargin.
+var reMargin = regexp.MustCompile(`^-?\d+(\.\d+)?(px|%)( -?\d+(\.\d+)?(px|%)){0,3}$`)
+
+// commands are the subcommands; they share the flags.
+var commands = []string{"serve", "scan", "thumbs", "transcode", "ladder", "verify", "repair", "sign", "client", "service", "selftest"}
+
+// defaultExts is used when -e is not specified.
+var defaultExts = []string{"flac", "heic", "jpeg", "jpg", "m3u8", "m4a", "mkv", "mp3", "mp4", "ogg", "png", "ts"}
+
+func mainImpl(ctx context.Context) error {
+	logger, _, _ := newLogger(slog.LevelInfo, "pretty", "stderr", logRotation{})
+	slog.SetDefault(logger)
+	addr := flag.String("addr", ":8010", "address and port to listen to")
+	serverURL := flag.String("url", "http://localhost:8010", "URL of the instance used by the client command")
+	var extsArg stringsFlag
+	flag.Var(&extsArg, "e", "extensions")
+	root := flag.String("root", ".", "root directory")
+	mdnsName := flag.String("mdns", "", "advertise the server over mDNS as <name>.local, e.g. \"videos\"")
+	allowRemote := flag.Bool("allow-remote", false, "allow AirPlay and other remote playback from the player")
+	speed := flag.Float64("speed", 2, "default playback rate of the videos on the root page, between 0.5 and 4")
+	autoplay := flag.Bool("autoplay", true, "start the videos of the root page when they are scrolled into view")
+	autoplayDelay := flag.Duration("autoplay-delay", time.Second, "how long a video must be visible before it starts, to reduce the load when scrolling fast")
+	autoplayThreshold := flag.Float64("autoplay-threshold", 0, "fraction of a video that must be visible to start it, from 0 to 1")
+	autoplayMargin := flag.String("autoplay-margin", "0px", "CSS margin around the viewport where the videos start, e.g. \"-20%\" to start them only once well inside")
+	preloadMargin := flag.String("preload-margin", "200%", "CSS margin around the viewport where the players are created; lower it for low-power devices")
+	muted := flag.Bool("muted", true, "start the videos of the root page muted; browsers may block the autoplay otherwise")
+	pip := flag.Bool("pip", false, "allow picture-in-picture on the root page, e.g. to keep an eye on a camera")
+	hsts := flag.Duration("hsts", 0, "send Strict-Transport-Security with this max-age, e.g. \"8760h\"; only use when served over HTTPS, e.g. behind a reverse proxy")
+	shutdownGrace := flag.Duration("shutdown-grace", 10*time.Second, "how long to wait for the requests in flight when shutting down")
+	shutdownStreams := flag.String("shutdown-streams", "cut", "what to do with the files being streamed when shutting down: \"cut\" them immediately or let them \"drain\" during -shutdown-grace")
+	readTimeout := flag.Duration("read-timeout", time.Minute, "maximum duration to receive a request to the pages or the API; 0 for no limit")
+	writeTimeout := flag.Duration("write-timeout", time.Minute, "maximum duration to send a page or an API response; 0 for no limit")
+	streamTimeout := flag.Duration("stream-timeout", time.Hour, "maximum duration to send a media stream or a gRPC response; players resume the videos with a new request; 0 for no limit")
+	stallTimeout := flag.Duration("stall-timeout", time.Minute, "abort the media streams and gRPC responses whose client hasn't read anything for this long, e.g. a phone gone to sleep; 0 to disable")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long to keep the idle connections open")
+	runAs := flag.String("run-as", "", "switch to this \"<user>[:<group>]\" after listening, e.g. when started as root to use port 80")
+	sandboxArg := flag.Bool("sandbox", false, "restrict the file system access to -root, -data, the temporary directory and the system directories with Landlock; Linux only")
+	publicURL := flag.String("public-url", "", "URL of the server to use in notifications, e.g. \"https://videos.example.com\"")
+	var webhooks stringsFlag
+	flag.Var(&webhooks, "webhook", "URL to POST a JSON payload to when a new file appears; can be repeated")
+	ntfy := flag.String("ntfy", "", "ntfy topic URL to notify when a new file appears, e.g. \"https://ntfy.sh/mytopic\"")
+	gotify := flag.String("gotify", "", "Gotify message URL including the app token, e.g. \"https://gotify.example.com/message?token=XXX\"")
+	pushover := flag.String("pushover", "", "Pushover \"<app token>:<user key>\" to notify when a new file appears")
+	var rtsp stringsFlag
+	flag.Var(&rtsp, "rtsp", "record an RTSP camera into <root>/<name>/, in the form \"<name>=rtsp://...\"; can be repeated")
+	rtspFormat := flag.String("rtsp-format", "hls", "format of the RTSP recordings, \"hls\" or \"mp4\"")
+	rtspHLSTime := flag.Duration("rtsp-hls-time", 4*time.Second, "target duration of the HLS segments of RTSP recordings; lower reduces the live latency")
+	gapThreshold := flag.Duration("gap-threshold", 2*time.Minute, "minimum period without recording in a directory reported as a gap")
+	var minFree freeSpace
+	flag.Var(&minFree, "min-free", "delete the oldest -recordings when the free space is below this, e.g. \"50GB\" or \"10%\"")
+	var recordings stringsFlag
+	flag.Var(&recordings, "recordings", "directory under -root holding the recordings -min-free deletes; can be repeated; defaults to the -rtsp cameras")
+	var keep stringsFlag
+	flag.Var(&keep, "keep", "glob of files or directories never deleted by -min-free, e.g. \"incidents\" or \"*/keep-*\"; can be repeated")
+	dataDir := flag.String("data", "", "directory to save the state, e.g. which parts of the files were watched")
+	cacheDirArg := flag.String("cache-dir", "", "directory to keep the thumbnails and the copies with another audio track; defaults to -data")
+	cacheMaxArg := flag.String("cache-max", "", "maximum size of -cache-dir, e.g. \"20GB\"; the least recently used files are evicted")
+	var thumbTimesArg thumbTimes
+	flag.Var(&thumbTimesArg, "thumb-time", "time of the frame used as the thumbnail, in the form \"<duration>\" or \"<glob>=<duration>\" for the files or directories matching the glob, e.g. \"cam1=5s\"; defaults to 1s; can be repeated")
+	readBuffer := flag.String("read-buffer", "", "read files in chunks of this size, e.g. \"1MiB\", instead of using sendfile; may help with slow disks")
+	readAheadArg := flag.String("readahead", "", "ask the OS to read this much ahead of the requested offset, e.g. \"8MiB\"")
+	var cache cacheRules
+	flag.Var(&cache, "cache", "Cache-Control of the files matching a glob, in the form \"<glob>=<policy>\" where policy is \"no-store\", \"immutable\", a duration or a raw value, e.g. \"*.mp4=168h\"; can be repeated")
+	signSecret := flag.String("sign-secret", "", "shared secret to verify /raw/ URLs signed like nginx secure_link_md5 \"$secure_link_expires$uri <secret>\"")
+	signTTL := flag.Duration("sign-ttl", 24*time.Hour, "validity of the URLs signed with -sign-secret")
+	signRequired := flag.Bool("sign-required", false, "reject unsigned /raw/ requests; requires -sign-secret")
+	tmdbKey := flag.String("tmdb-key", "", "TheMovieDB API key or read access token to look up the titles, posters and episodes of the movies and shows; requires -data")
+	var userArgs stringsFlag
+	flag.Var(&userArgs, "user", "require HTTP basic authentication with this account, in the form \"<name>:<password>\"; each user has their own resume positions, watched markers, favorites and history; can be repeated")
+	var tokenArgs stringsFlag
+	flag.Var(&tokenArgs, "token", "accept this API token as \"Authorization: Bearer <token>\" for a -user, in the form \"<name>:<token>\"; can be repeated")
+	accessFile := flag.String("access", "", "file of the per-directory access rules, restricting the files each -user sees; see the README")
+	var adminArgs stringsFlag
+	flag.Var(&adminArgs, "admin", "allow this -user to use /admin to see the server status and trigger rescans, and to delete files; without -user, only localhost is allowed; can be repeated")
+	var uploaderArgs stringsFlag
+	flag.Var(&uploaderArgs, "uploader", "allow this -user to upload files into -drop; can be repeated")
+	dropDir := flag.String("drop", "", "directory under -root where the -uploader users and the admins can upload files, e.g. \"incoming\"")
+	var peerArgs stringsFlag
+	flag.Var(&peerArgs, "peer", "merge the library of another serve-videos instance under @<name>/, in the form \"<name>=<url>\"; can be repeated")
+	peerProxy := flag.Bool("peer-proxy", false, "proxy the files of the -peer instances instead of redirecting to them")
+	mirrorURL := flag.String("mirror", "", "proxy the files of another serve-videos instance or HTTP directory listing and cache them in -root")
+	ffmpegMax := flag.Int("ffmpeg-max", 0, "maximum number of ffmpeg and ffprobe processes running concurrently, e.g. for thumbnails, probes and transcodes; 0 is unlimited; the -rtsp recordings are not limited")
+	ffmpegNice := flag.Int("ffmpeg-nice", 0, "niceness of the ffmpeg and ffprobe processes, 0 to 19, so they don't starve the streams; linux only")
+	ffmpegIONice := flag.String("ffmpeg-ionice", "", "I/O scheduling class of the ffmpeg and ffprobe processes, \"idle\" or \"best-effort\"; linux only")
+	ffmpegThreads := flag.Int("ffmpeg-threads", 0, "number of threads of each ffmpeg encoder; 0 lets ffmpeg decide")
+	ffmpegHWAccel := flag.String("ffmpeg-hwaccel", "", "hardware decoder used by ffmpeg for the thumbnails, transcodes and ladders, e.g. \"auto\", \"vaapi\" or \"cuda\"")
+	var profiles transcodeProfiles
+	flag.Var(&profiles, "transcode-profile", "define a transcode profile usable by the transcode command and /api/jobs, in the form \"<name>=<key>=<value>,...\" with the keys video, preset, crf, bitrate, height, audio, audio_bitrate, channels, hwaccel, tonemap and loudnorm, e.g. \"small=video=libx265,crf=28,height=720,audio=libopus,audio_bitrate=96k\"; unset keys use the H.264/AAC default; can be repeated")
+	useProfile := flag.String("use-profile", "default", "transcode profile used by the transcode command")
+	jobWorkers := flag.Int("job-workers", 1, "number of background jobs, e.g. transcodes and thumbnails queued with /api/jobs, run concurrently")
+	pregenerate := flag.Bool("pregenerate", false, "generate the missing thumbnails of the library and of the new files in the background when no file is streamed, at the lowest priority; requires -data or -cache-dir")
+	etagHash := flag.Bool("etag-hash", false, "use the SHA-256 of the files as ETag, computed in the background")
+	analyticsURL := flag.String("analytics-url", "", "URL to POST the downloads and plays to every 10s, as JSON lines")
+	auditLogArg := flag.String("audit-log", "", "append a JSON line per request to /raw/ to this file, or to syslog with \"syslog\", \"syslog://<host>:<port>\" or \"syslog+tcp://<host>:<port>\"")
+	logLevel := flag.String("log-level", "info", "minimum level of the logs: \"debug\", \"info\", \"warn\" or \"error\"; debug includes every file system event")
+	logFormat := flag.String("log-format", "pretty", "format of the logs, \"pretty\" or \"json\"")
+	logOutput := flag.String("log-output", "stderr", "where to write the logs: \"stderr\", \"journald\", \"syslog\", \"syslog://<host>:<port>\", \"syslog+tcp://<host>:<port>\", \"eventlog\" on Windows, the default for a service, or a file path")
+	logMaxSize := flag.String("log-max-size", "", "rotate the log files when they reach this size, e.g. \"100MB\"; the rotated files are gzipped")
+	logMaxAge := flag.Duration("log-max-age", 0, "rotate the log files when they are older than this, e.g. \"24h\"")
+	logKeep := flag.Int("log-keep", 10, "number of rotated log files to keep; 0 keeps them all")
+	var titleRuleArgs titleRules
+	flag.Var(&titleRuleArgs, "title-rule", "display the files whose path matches a regexp with this title, in the form \"<regexp>=<replacement>\" where the replacement can use $1, e.g. \"^cam(\\d)/.*/(\\d\\d)(\\d\\d)\\d\\d\\.m3u8$=Camera $1 at $2:$3\"; can be repeated")
+	var mimeArgs stringsFlag
+	flag.Var(&mimeArgs, "mime", "override the Content-Type of an extension, in the form \"<ext>=<type>\", e.g. \"mkv=video/webm\"; can be repeated")
+	var notifyDirs stringsFlag
+	flag.Var(&notifyDirs, "notify-dir", "only send push notifications for new files in this directory; can be repeated")
+	flag.Usage = func() {
+		o := flag.CommandLine.Output()
+		fmt.Fprintf(o, "usage: serve-videos [<command>] [flags] [<file>...]\n\n")
+		fmt.Fprintf(o, "The commands share the flags below. The command can also follow the flags.\n\n")
+		fmt.Fprintf(o, "serve (the default) serves -root over HTTP.\n")
+		fmt.Fprintf(o, "scan prints the files under -root as JSON lines, with their duration when ffprobe is available.\n")
+		fmt.Fprintf(o, "thumbs generates the thumbnails missing in -data of the files, or of all of them.\n")
+		fmt.Fprintf(o, "transcode writes an H.264/AAC MP4 copy next to the files browsers can't play.\n")
+		fmt.Fprintf(o, "ladder writes an HLS ladder of the videos, streamed at the quality the bandwidth allows.\n")
+		fmt.Fprintf(o, "verify checks that the playlists' segments exist and that the files decode, or all of them.\n")
+		fmt.Fprintf(o, "repair writes playlists for the HLS segments under -root not referenced by one.\n")
+		fmt.Fprintf(o, "sign prints URLs to the files signed with -sign-secret, valid for -sign-ttl.\n")
+		fmt.Fprintf(o, "client list [<dir>], client search <words>... and client download <file>... use the API of\n")
+		fmt.Fprintf(o, "  the instance at -url, with the token in $SERVE_VIDEOS_TOKEN if set.\n")
+		fmt.Fprintf(o, "service install and service uninstall register serve with the flags given as a Windows service.\n")
+		fmt.Fprintf(o, "selftest runs the server against a generated library and reports problems.\n\n")
+		flag.PrintDefaults()
+	}
+	cmd, args := "", os.Args[1:]
+	if len(args) != 0 && slices.Contains(commands, args[0]) {
+		cmd, args = args[0], args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+	args = flag.Args()
+	if cmd == "" && len(args) != 0 && slices.Contains(commands, args[0]) {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd == "" {
+		cmd = "serve"
+	}
+
+	switch {
+	case cmd == "selftest" && len(args) == 0:
+		return selftest(ctx)
+	case cmd == "sign" && len(args) != 0:
+		if *signSecret == "" {
+			return errors.New("sign requires -sign-secret")
+		}
+		sg := signer{secret: *signSecret, ttl: *signTTL}
+		for _, f := range args {
+			fmt.Printf("%s%s\n", strings.TrimSuffix(*publicURL, "/"), sg.rawURL(filepath.ToSlash(f)))
+		}
+		return nil
+	case cmd == "client":
+		return cmdClient(ctx, os.Stdout, &client{base: strings.TrimSuffix(*serverURL, "/"), token: os.Getenv("SERVE_VIDEOS_TOKEN")}, args)
+	case cmd == "sign" || cmd == "transcode" || cmd == "ladder":
+		if len(args) == 0 {
+			return fmt.Errorf("%s requires files", cmd)
+		}
+	case cmd == "thumbs" || cmd == "verify":
+	case cmd == "service":
+		if len(args) != 1 || (args[0] != "install" && args[0] != "uninstall") {
+			return errors.New("service requires install or uninstall")
+		}
+	case len(args) != 0:
+		return errors.New("unexpected argument")
+	}
+	if *shutdownStreams != "cut" && *shutdownStreams != "drain" {
+		return errors.New("-shutdown-streams must be \"cut\" or \"drain\"")
+	}
+	if *speed < 0.5 || *speed > 4 {
+		return errors.New("-speed must be between 0.5 and 4")
+	}
+	if *ffmpegMax < 0 {
+		return errors.New("-ffmpeg-max must not be negative")
+	}
+	if *ffmpegNice < 0 || *ffmpegNice > 19 {
+		return errors.New("-ffmpeg-nice must be between 0 and 19")
+	}
+	if *ffmpegIONice != "" && *ffmpegIONice != "idle" && *ffmpegIONice != "best-effort" {
+		return errors.New("-ffmpeg-ionice must be \"idle\" or \"best-effort\"")
+	}
+	if (*ffmpegNice != 0 || *ffmpegIONice != "") && runtime.GOOS != "linux" {
+		return errors.New("-ffmpeg-nice and -ffmpeg-ionice are only supported on linux")
+	}
+	if *ffmpegThreads < 0 {
+		return errors.New("-ffmpeg-threads must not be negative")
+	}
+	tp, ok := profiles.lookup(*useProfile)
+	if !ok {
+		return fmt.Errorf("-use-profile: unknown profile %q", *useProfile)
+	}
+	limits := ffmpegLimits{max: *ffmpegMax, nice: *ffmpegNice, ionice: *ffmpegIONice, threads: *ffmpegThreads, hwaccel: *ffmpegHWAccel}
+	if *jobWorkers < 1 {
+		return errors.New("-job-workers must be at least 1")
+	}
+	if *pregenerate && *dataDir == "" && *cacheDirArg == "" {
+		return errors.New("-pregenerate requires -data or -cache-dir")
+	}
+	if *autoplayDelay < 0 {
+		return errors.New("-autoplay-delay must not be negative")
+	}
+	if *autoplayThreshold < 0 || *autoplayThreshold > 1 {
+		return errors.New("-autoplay-threshold must be between 0 and 1")
+	}
+	if !reMargin.MatchString(*autoplayMargin) || !reMargin.MatchString(*preloadMargin) {
+		return errors.New("-autoplay-margin and -preload-margin must be CSS margins in px or %, e.g. \"100px 0px\"")
+	}
+	if *shutdownGrace <= 0 {
+		return errors.New("-shutdown-grace must be positive")
+	}
+	if *readTimeout < 0 || *writeTimeout < 0 || *streamTimeout < 0 || *stallTimeout < 0 || *idleTimeout <= 0 {
+		return errors.New("-read-timeout, -write-timeout, -stream-timeout and -stall-timeout must not be negative and -idle-timeout must be positive")
+	}
+	if *signRequired && *signSecret == "" {
+		return errors.New("-sign-required requires -sign-secret")
+	}
+	if *tmdbKey != "" && *dataDir == "" {
+		return errors.New("-tmdb-key requires -data")
+	}
+	if *pushover != "" && !strings.Contains(*pushover, ":") {
+		return errors.New("-pushover must be \"<app token>:<user key>\"")
+	}
+	cameras, err := parseCameras(rtsp)
+	if err != nil {
+		return err
+	}
+	if len(recordings) == 0 {
+		for _, c := range cameras {
+			recordings = append(recordings, c.name)
+		}
+	}
+	for i, d := range recordings {
+		recordings[i] = strings.Trim(filepath.ToSlash(d), "/")
+		if !filepath.IsLocal(filepath.FromSlash(recordings[i])) {
+			return fmt.Errorf("-recordings %q must be a directory under -root", d)
+		}
+	}
+	if minFree != (freeSpace{}) && len(recordings) == 0 {
+		return errors.New("-min-free requires -recordings or -rtsp")
+	}
+	if err = setMIMETypes(mimeArgs); err != nil {
+		return err
+	}
+	peers, err := parsePeers(peerArgs)
+	if err != nil {
+		return err
+	}
+	usersList, err := parseUsers(userArgs)
+	if err != nil {
+		return err
+	}
+	tokensList, err := parseTokens(tokenArgs, usersList)
+	if err != nil {
+		return err
+	}
+	for _, a := range adminArgs {
+		if _, ok := usersList[a]; !ok {
+			return fmt.Errorf("-admin %q is not a -user", a)
+		}
+	}
+	for _, a := range uploaderArgs {
+		if _, ok := usersList[a]; !ok {
+			return fmt.Errorf("-uploader %q is not a -user", a)
+		}
+	}
+	if len(uploaderArgs) != 0 && *dropDir == "" {
+		return errors.New("-uploader requires -drop")
+	}
+	*dropDir = strings.Trim(filepath.ToSlash(*dropDir), "/")
+	if *dropDir != "" && !filepath.IsLocal(filepath.FromSlash(*dropDir)) {
+		return errors.New("-drop must be a directory under -root")
+	}
+	var access *accessRules
+	if *accessFile != "" {
+		if access, err = loadAccessRules(*accessFile, usersList); err != nil {
+			return fmt.Errorf("-access: %w", err)
+		}
+	}
+	readBufferSize, readAheadSize := uint64(0), uint64(0)
+	if *readBuffer != "" {
+		if readBufferSize, err = parseSize(*readBuffer); err != nil || readBufferSize > 1<<30 {
+			return fmt.Errorf("-read-buffer %q is invalid", *readBuffer)
+		}
+	}
+	if *readAheadArg != "" {
+		if readAheadSize, err = parseSize(*readAheadArg); err != nil || readAheadSize > 1<<30 {
+			return fmt.Errorf("-readahead %q is invalid", *readAheadArg)
+		}
+	}
+	var cacheMax uint64
+	if *cacheMaxArg != "" {
+		if cacheMax, err = parseSize(*cacheMaxArg); err != nil || cacheMax == 0 {
+			return fmt.Errorf("-cache-max %q is invalid", *cacheMaxArg)
+		}
+	}
+	rotation := logRotation{maxAge: *logMaxAge, keep: *logKeep}
+	if *logMaxSize != "" {
+		v, err2 := parseSize(*logMaxSize)
+		if err2 != nil || v == 0 || v > 1<<40 {
+			return fmt.Errorf("-log-max-size %q is invalid", *logMaxSize)
+		}
+		rotation.maxSize = int64(v)
+	}
+	if *logMaxAge < 0 || *logKeep < 0 {
+		return errors.New("-log-max-age and -log-keep must not be negative")
+	}
+	var level slog.Level
+	if err = level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return errors.New("-log-level must be \"debug\", \"info\", \"warn\" or \"error\"")
+	}
+	if runningAsService && *logOutput == "stderr" {
+		// A service has no console.
+		*logOutput = "eventlog"
+	}
+	logger, logOut, err := newLogger(level, *logFormat, *logOutput, rotation)
+	if err != nil {
+		return fmt.Errorf("-log-output: %w", err)
+	}
+	slog.SetDefault(logger)
+	if *rtspFormat != "hls" && *rtspFormat != "mp4" {
+		return errors.New("-rtsp-format must be \"hls\" or \"mp4\"")
+	}
+	if len(extsArg) == 0 {
+		extsArg = defaultExts
+	}
+	if *root, err = filepath.Abs(filepath.Clean(*root)); err != nil {
+		return err
+	}
+	if fi, err2 := os.Stat(*root); err2 != nil {
+		return fmt.Errorf("-root %q is unusable: %w", *root, err2)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("-root %q is not a directory", *root)
+	}
+	if cmd == "thumbs" && *dataDir == "" && *cacheDirArg == "" {
+		return errors.New("thumbs requires -data or -cache-dir")
+	}
+	if cmd == "service" {
+		if args[0] == "uninstall" {
+			return uninstallService()
+		}
+		// The service starts in the system directory.
+		svcArgs := serviceArgs(os.Args[1:])
+		svcArgs = append(svcArgs, "-root="+*root)
+		if *dataDir != "" {
+			d, err2 := filepath.Abs(*dataDir)
+			if err2 != nil {
+				return err2
+			}
+			svcArgs = append(svcArgs, "-data="+d)
+		}
+		if *cacheDirArg != "" {
+			d, err2 := filepath.Abs(*cacheDirArg)
+			if err2 != nil {
+				return err2
+			}
+			svcArgs = append(svcArgs, "-cache-dir="+d)
+		}
+		return installService(svcArgs)
+	}
+	if cmd != "serve" && (*runAs != "" || *sandboxArg) {
+		return errors.New("-run-as and -sandbox only apply to serve")
+	}
+	var l net.Listener
+	if cmd == "serve" {
+		// Listen before dropping the privileges, to be able to use port 80.
+		if l, err = net.Listen("tcp", *addr); err != nil {
+			return err
+		}
+		defer l.Close()
+		if *runAs != "" {
+			if err = dropPrivileges(*runAs); err != nil {
+				return fmt.Errorf("-run-as: %w", err)
+			}
+		}
 	}
-	l, err := net.Listen("tcp", *addr)
+	if *dataDir != "" {
+		if err = os.MkdirAll(*dataDir, 0o755); err != nil {
+			return fmt.Errorf("-data: %w", err)
+		}
+	}
+	if *cacheDirArg != "" {
+		if err = os.MkdirAll(*cacheDirArg, 0o755); err != nil {
+			return fmt.Errorf("-cache-dir: %w", err)
+		}
+	}
+	if *dropDir != "" {
+		if err = os.MkdirAll(filepath.Join(*root, filepath.FromSlash(*dropDir)), 0o755); err != nil {
+			return fmt.Errorf("-drop: %w", err)
+		}
+	}
+	if cmd != "serve" {
+		m := newMedia()
+		m.setLimits(limits)
+		m.profiles = profiles
+		m.setCacheDir(cmp.Or(*cacheDirArg, *dataDir), 0)
+		m.thumbTimes = thumbTimesArg
+		if *dataDir != "" {
+			// Use the posters picked from the watch pages and the loudness
+			// measured by the jobs.
+			if m.posters, err = newPosters(filepath.Join(*dataDir, "posters.json")); err != nil {
+				return err
+			}
+			if m.loudness, err = newLoudnesses(filepath.Join(*dataDir, "loudness.json")); err != nil {
+				return err
+			}
+		}
+		if cmd == "scan" {
+			return cmdScan(ctx, os.Stdout, m, *root, extsArg)
+		}
+		if cmd == "repair" {
+			written, err2 := m.repairAll(ctx, *root)
+			for _, w := range written {
+				fmt.Printf("%s\n", w)
+			}
+			return err2
+		}
+		files, err2 := selectFiles(*root, extsArg, args)
+		if err2 != nil {
+			return err2
+		}
+		switch cmd {
+		case "thumbs":
+			return cmdThumbs(ctx, os.Stdout, m, *root, files)
+		case "transcode":
+			return cmdTranscode(ctx, os.Stdout, m, *root, files, tp)
+		case "ladder":
+			return cmdLadder(ctx, os.Stdout, m, *root, files)
+		default:
+			return cmdVerify(ctx, os.Stdout, m, *root, files)
+		}
+	}
+	slog.Info("looking for files", "root", *root, "ext", strings.Join(extsArg, ","))
+	opts := options{
+		allowRemote:       *allowRemote,
+		speed:             *speed,
+		autoplay:          *autoplay,
+		autoplayDelay:     *autoplayDelay,
+		autoplayThreshold: *autoplayThreshold,
+		autoplayMargin:    *autoplayMargin,
+		preloadMargin:     *preloadMargin,
+		muted:             *muted,
+		pip:               *pip,
+		hsts:              *hsts,
+		shutdownGrace:     *shutdownGrace,
+		drainStreams:      *shutdownStreams == "drain",
+		readTimeout:       *readTimeout,
+		writeTimeout:      *writeTimeout,
+		streamTimeout:     *streamTimeout,
+		stallTimeout:      *stallTimeout,
+		publicURL:         strings.TrimSuffix(*publicURL, "/"),
+		webhooks:          webhooks,
+		ntfy:              *ntfy,
+		gotify:            *gotify,
+		pushover:          *pushover,
+		notifyDirs:        notifyDirs,
+		gapThreshold:      *gapThreshold,
+		minFree:           minFree,
+		recordings:        recordings,
+		keep:              keep,
+		etagHash:          *etagHash,
+		jobWorkers:        *jobWorkers,
+		pregenerate:       *pregenerate,
+		ffmpeg:            limits,
+		profiles:          profiles,
+		dataDir:           *dataDir,
+		cacheDir:          *cacheDirArg,
+		cacheMax:          cacheMax,
+		thumbTimes:        thumbTimesArg,
+		cache:             cache,
+		signSecret:        *signSecret,
+		signTTL:           *signTTL,
+		signRequired:      *signRequired,
+		peers:             peers,
+		peerProxy:         *peerProxy,
+		mirror:            *mirrorURL,
+		users:             usersList,
+		admins:            adminArgs,
+		uploaders:         uploaderArgs,
+		dropDir:           *dropDir,
+		tokens:            tokensList,
+		access:            access,
+		tmdbKey:           *tmdbKey,
+		titleRules:        titleRuleArgs,
+		analyticsURL:      *analyticsURL,
+		auditLog:          *auditLogArg,
+		logRotation:       rotation,
+		readBuffer:        int(readBufferSize),
+		readAhead:         int64(readAheadSize),
+	}
+	srv, err := newServer(ctx, *root, extsArg, opts)
 	if err != nil {
 		return err
 	}
+	if len(cameras) != 0 && srv.media.ffmpeg == "" {
+		return errors.New("-rtsp requires ffmpeg")
+	}
+	if *sandboxArg {
+		if err = sandbox(sandboxPaths(srv, *logOutput)); err != nil {
+			return fmt.Errorf("-sandbox: %w", err)
+		}
+	}
+	for _, c := range cameras {
+		go srv.media.record(ctx, *root, c, *rtspFormat, *rtspHLSTime)
+	}
+	// The read and write deadlines depend on the route; see timeoutHandler.
+	s := &http.Server{
+		Handler:           srv.handler(),
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		ConnContext:       connContext,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       *idleTimeout,
+	}
 	slog.Info("serving", "addr", l.Addr())
+	if *mdnsName != "" {
+		if err = mdnsAdvertise(ctx, *mdnsName, l.Addr().(*net.TCPAddr)); err != nil {
+			_ = l.Close()
+			return fmt.Errorf("-mdns: %w", err)
+		}
+	}
 	go s.Serve(l)
+	go srv.runSystemd(ctx)
+	logs := []io.Writer{logOut}
+	if srv.audit != nil {
+		logs = append(logs, srv.audit.w)
+	}
+	go reopenLogs(ctx, logs...)
 	<-ctx.Done()
-	_ = s.Shutdown(context.Background())
-	return nil
+	err = srv.shutdown(s)
+	return errors.Join(err, srv.saveState())
 }
 
 func main() {
-	if err := mainImpl(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), stopSignals...)
+	ok, err := runService(ctx, mainImpl)
+	if !ok {
+		err = mainImpl(ctx)
+	}
+	stop()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "serve-videos: %s\n", err)
 		os.Exit(1)
 	}
 }
+
+// serviceArgs returns the arguments of "service install" to start the
+// service with.
+func serviceArgs(args []string) []string {
+	var out []string
+	skipped := 0
+	for _, a := range args {
+		if skipped < 2 && (a == "service" || a == "install") {
+			skipped++
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testMP4 is the smallest valid looking MP4: a single ftyp box.
+const testMP4 = "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41"
+
+// writeTestFiles writes the files, by their slash separated names, in root.
+func writeTestFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testVideo returns a decodable 2s video made with ffmpeg, skipping the test
+// when ffmpeg is not installed.
+func testVideo(t testing.TB) string {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip(err)
+	}
+	p := filepath.Join(t.TempDir(), "testsrc.mp4")
+	// #nosec G204
+	cmd := exec.CommandContext(t.Context(), ffmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=2:size=160x120:rate=10",
+		"-pix_fmt", "yuv420p", p)
+	if out, err2 := cmd.CombinedOutput(); err2 != nil {
+		t.Fatalf("failed to generate a video: %v: %s", err2, out)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// newTestServer serves a library made of files with opts until the test
+// ends.
+func newTestServer(t testing.TB, files map[string]string, opts options) (*server, *httptest.Server) {
+	t.Helper()
+	root := t.TempDir()
+	writeTestFiles(t, root, files)
+	srv, err := newServer(t.Context(), root, defaultExts, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.rootDir.Close()
+	})
+	return srv, ts
+}
+
+// testUsers returns the users, all with the password "secret", and the
+// access rules if not empty.
+func testUsers(t testing.TB, names []string, rules string) (users, *accessRules) {
+	t.Helper()
+	var args []string
+	for _, n := range names {
+		args = append(args, n+":secret")
+	}
+	u, err := parseUsers(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules == "" {
+		return u, nil
+	}
+	p := filepath.Join(t.TempDir(), "access.txt")
+	if err = os.WriteFile(p, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadAccessRules(p, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, a
+}
+
+// testDo sends the request as user, with the password "secret" if not empty,
+// and returns the response with its body.
+func testDo(t testing.TB, method, u, user, body string, hdr http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// testWebSocket connects to the WebSocket at p as user, with the password
+// "secret" if not empty, until the test ends.
+func testWebSocket(t testing.TB, base, p, user string) *websocket.Conn {
+	t.Helper()
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(base, "http")+p, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		req, _ := http.NewRequest("GET", base, nil)
+		req.SetBasicAuth(user, "secret")
+		cfg.Header = req.Header
+	}
+	c, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// testGet returns the status and the body of the page fetched as user.
+func testGet(t testing.TB, u, user string) (int, string) {
+	t.Helper()
+	resp, b := testDo(t, "GET", u, user, "", nil)
+	return resp.StatusCode, b
+}
+
+// testPage returns the page fetched as user, failing the test unless it is
+// served and contains want.
+func testPage(t testing.TB, u, user, want string) string {
+	t.Helper()
+	status, b := testGet(t, u, user)
+	if status != http.StatusOK {
+		t.Fatalf("%s: got status %d: %s", u, status, b)
+	}
+	if !strings.Contains(b, want) {
+		t.Fatalf("%s: missing %q in %q", u, want, b)
+	}
+	return b
+}
+
+func TestSpeed(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{speed: 1.5})
+	testPage(t, ts.URL+"/", "", `"speed":1.5`)
+}
+
+func TestAutoplay(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{
+		autoplay:          true,
+		autoplayDelay:     500 * time.Millisecond,
+		autoplayMargin:    "-10%",
+		autoplayThreshold: 0.5,
+		muted:             true,
+	})
+	testPage(t, ts.URL+"/", "", `"autoplay":true,"autoplayDelay":500,"autoplayMargin":"-10%","autoplayThreshold":0.5,`)
+	testPage(t, ts.URL+"/", "", `"muted":true`)
+	for m, want := range map[string]bool{
+		"0px":                 true,
+		"-10%":                true,
+		"100px 0px":           true,
+		"1px 2% 3px 4%":       true,
+		"1.5px":               true,
+		"":                    false,
+		"10":                  false,
+		"1em":                 false,
+		"1px 2px 3px 4px 5px": false,
+		"1px;":                false,
+	} {
+		if got := reMargin.MatchString(m); got != want {
+			t.Errorf("%q: got %t", m, got)
+		}
+	}
+}
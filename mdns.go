@@ -0,0 +1,202 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// cacheFlush is the mDNS bit set on the class of unique records.
+const cacheFlush = 0x8000
+
+// mdnsResponder advertises the HTTP server as <name>.local and as an
+// <name>._http._tcp.local DNS-SD service.
+type mdnsResponder struct {
+	host     dnsmessage.Name
+	instance dnsmessage.Name
+	service  dnsmessage.Name
+	services dnsmessage.Name
+	port     uint16
+	// ip is the address the server listens on. When unspecified, all the
+	// interfaces' addresses are advertised.
+	ip net.IP
+}
+
+// mdnsAdvertise answers mDNS queries until ctx is canceled.
+func mdnsAdvertise(ctx context.Context, name string, addr *net.TCPAddr) error {
+	r := &mdnsResponder{
+		host:     dnsmessage.MustNewName(name + ".local."),
+		instance: dnsmessage.MustNewName(name + "._http._tcp.local."),
+		service:  dnsmessage.MustNewName("_http._tcp.local."),
+		services: dnsmessage.MustNewName("_services._dns-sd._udp.local."),
+		port:     uint16(addr.Port),
+		ip:       addr.IP,
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	slog.Info("mdns", "host", r.host.String(), "service", r.instance.String())
+	go func() {
+		// Announce twice as recommended by RFC 6762 section 8.3.
+		for i := 0; i < 2; i++ {
+			r.send(conn, mdnsGroup, 0, nil, r.all(), nil, 120)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		// Goodbye packet.
+		r.send(conn, mdnsGroup, 0, nil, r.all(), nil, 0)
+		_ = conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("mdns", "error", err)
+				}
+				return
+			}
+			r.handle(conn, src, buf[:n])
+		}
+	}()
+	return nil
+}
+
+// recordKind identifies a set of resource records to return.
+type recordKind int
+
+const (
+	recServices recordKind = iota
+	recPTR
+	recSRV
+	recTXT
+	recA
+)
+
+func (r *mdnsResponder) all() []recordKind {
+	return []recordKind{recPTR, recSRV, recTXT, recA}
+}
+
+func (r *mdnsResponder) handle(conn *net.UDPConn, src *net.UDPAddr, b []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || h.Response {
+		return
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	var answers, extra []recordKind
+	for _, q := range qs {
+		n := q.Name.String()
+		all := q.Type == dnsmessage.TypeALL
+		switch {
+		case strings.EqualFold(n, r.services.String()) && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, recServices)
+		case strings.EqualFold(n, r.service.String()) && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, recPTR)
+			extra = append(extra, recSRV, recTXT, recA)
+		case strings.EqualFold(n, r.instance.String()) && (all || q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT):
+			answers = append(answers, recSRV, recTXT)
+			extra = append(extra, recA)
+		case strings.EqualFold(n, r.host.String()) && (all || q.Type == dnsmessage.TypeA):
+			answers = append(answers, recA)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	if src.Port != mdnsGroup.Port {
+		// Legacy unicast query, RFC 6762 section 6.7.
+		r.send(conn, src, h.ID, qs, answers, extra, 10)
+		return
+	}
+	r.send(conn, mdnsGroup, 0, nil, answers, extra, 120)
+}
+
+func (r *mdnsResponder) send(conn *net.UDPConn, dst *net.UDPAddr, id uint16, qs []dnsmessage.Question, answers, extra []recordKind, ttl uint32) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: qs,
+	}
+	for _, k := range answers {
+		msg.Answers = append(msg.Answers, r.resources(k, ttl)...)
+	}
+	for _, k := range extra {
+		msg.Additionals = append(msg.Additionals, r.resources(k, ttl)...)
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		slog.Error("mdns", "error", err)
+		return
+	}
+	if _, err = conn.WriteToUDP(b, dst); err != nil {
+		slog.Warn("mdns", "error", err)
+	}
+}
+
+func (r *mdnsResponder) resources(k recordKind, ttl uint32) []dnsmessage.Resource {
+	hdr := func(name dnsmessage.Name, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	}
+	unique := dnsmessage.ClassINET | cacheFlush
+	switch k {
+	case recServices:
+		return []dnsmessage.Resource{{Header: hdr(r.services, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: r.service}}}
+	case recPTR:
+		return []dnsmessage.Resource{{Header: hdr(r.service, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: r.instance}}}
+	case recSRV:
+		return []dnsmessage.Resource{{Header: hdr(r.instance, unique), Body: &dnsmessage.SRVResource{Target: r.host, Port: r.port}}}
+	case recTXT:
+		return []dnsmessage.Resource{{Header: hdr(r.instance, unique), Body: &dnsmessage.TXTResource{TXT: []string{"path=/"}}}}
+	case recA:
+		var out []dnsmessage.Resource
+		for _, ip := range r.ips() {
+			a := dnsmessage.AResource{}
+			copy(a.A[:], ip)
+			out = append(out, dnsmessage.Resource{Header: hdr(r.host, unique), Body: &a})
+		}
+		return out
+	}
+	return nil
+}
+
+// ips returns the IPv4 addresses to advertise.
+func (r *mdnsResponder) ips() []net.IP {
+	if ip := r.ip.To4(); ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var out []net.IP
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			if ip := n.IP.To4(); ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+				out = append(out, ip)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,521 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// media runs ffprobe and ffmpeg to extract information from the files.
+//
+// Both are optional, the features relying on them are disabled when they are
+// not in PATH.
+type media struct {
+	ffmpeg  string
+	ffprobe string
+	// thumbs is the directory where the thumbnails are saved, if not empty.
+	thumbs string
+	// limits apply to the processes started with run; slots holds a value
+	// per process running when limits.max is set.
+	limits ffmpegLimits
+	slots  chan struct{}
+	// profiles are the transcode profiles defined with -transcode-profile.
+	profiles transcodeProfiles
+	// remuxes is the directory where the copies of the videos with another
+	// audio track and the audio tracks alone are cached.
+	remuxes string
+	// cache evicts the thumbnails and the copies; see setCacheDir.
+	cache *cacheDir
+	// thumbTimes and posters set the time of the thumbnails; see thumbTime.
+	thumbTimes thumbTimes
+	posters    *posters
+	// loudness is the loudness measured by the "loudness" jobs, used by the
+	// transcodes normalizing it.
+	loudness *loudnesses
+
+	mu     sync.Mutex
+	probes map[file]*probeResult
+	dates  map[file]time.Time
+	// sceneCache are the scenes detected for the hover previews.
+	sceneCache map[file]*scenes
+	// probing is true while probeMissing runs.
+	probing bool
+	// sidecars and titles are reset when a file changes.
+	sidecars map[string]*sidecar
+	titles   map[string]string
+	// jobs are the ffmpeg and ffprobe processes running.
+	jobs    map[int]*mediaJob
+	nextJob int
+}
+
+// mediaJob is an ffmpeg or ffprobe process running.
+type mediaJob struct {
+	// Kind is "probe", "thumbnail", "export", "repair", "transcode",
+	// "ladder", "remux", "audio", "scenes", "loudness" or "verify".
+	Kind    string    `json:"kind"`
+	File    string    `json:"file"`
+	Started time.Time `json:"started"`
+	// Percent, Speed and ETA, in seconds, are the progress of the
+	// transcodes and ladders; see progressWriter.
+	Percent float64 `json:"percent,omitempty"`
+	Speed   float64 `json:"speed,omitempty"`
+	ETA     float64 `json:"eta,omitempty"`
+}
+
+// startJob records a job as running until the returned function is called.
+func (m *media) startJob(kind, name string) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs == nil {
+		m.jobs = map[int]*mediaJob{}
+	}
+	id := m.nextJob
+	m.nextJob++
+	m.jobs[id] = &mediaJob{Kind: kind, File: name, Started: time.Now().UTC()}
+	return func() {
+		m.mu.Lock()
+		delete(m.jobs, id)
+		m.mu.Unlock()
+	}
+}
+
+// runningJobs returns the jobs running, oldest first.
+func (m *media) runningJobs() []mediaJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]mediaJob, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		out = append(out, *j)
+	}
+	slices.SortFunc(out, func(a, b mediaJob) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// purge discards all the cached probes and metadata and returns how many
+// probes were discarded.
+func (m *media) purge() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.probes)
+	m.probes = map[file]*probeResult{}
+	m.dates = map[file]time.Time{}
+	m.sceneCache = map[file]*scenes{}
+	m.sidecars = nil
+	m.titles = nil
+	return n
+}
+
+// resetMetadata discards the cached metadata so it is read again.
+func (m *media) resetMetadata() {
+	m.mu.Lock()
+	m.sidecars = nil
+	m.titles = nil
+	m.mu.Unlock()
+}
+
+func newMedia() *media {
+	m := &media{probes: map[file]*probeResult{}, dates: map[file]time.Time{}, sceneCache: map[file]*scenes{}}
+	m.ffmpeg, _ = exec.LookPath("ffmpeg")
+	m.ffprobe, _ = exec.LookPath("ffprobe")
+	m.setCacheDir("", 0)
+	if m.ffmpeg == "" || m.ffprobe == "" {
+		slog.Info("media", "msg", "ffmpeg or ffprobe not found; durations and thumbnails are disabled")
+	}
+	return m
+}
+
+// probeResult is the subset of ffprobe's output that is used.
+type probeResult struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		// AvgFrameRate is a fraction, e.g. "30000/1001".
+		AvgFrameRate string `json:"avg_frame_rate"`
+		// ColorTransfer is e.g. "smpte2084" for PQ HDR; see isHDR.
+		ColorTransfer string `json:"color_transfer"`
+		Channels      int    `json:"channels"`
+		Tags          struct {
+			// Language is an ISO 639-2 code, e.g. "eng".
+			Language string `json:"language"`
+			Title    string `json:"title"`
+			// Rotate is the clockwise rotation written by the older ffmpeg.
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			// Rotation is the counterclockwise rotation of the display
+			// matrix, e.g. of the videos shot in portrait by the phones.
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+		Disposition struct {
+			Default int `json:"default"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Chapters []struct {
+		// StartTime and EndTime are in seconds.
+		StartTime string `json:"start_time"`
+		EndTime   string `json:"end_time"`
+		Tags      struct {
+			Title string `json:"title"`
+		} `json:"tags"`
+	} `json:"chapters"`
+}
+
+// chapter is a chapter of an MKV or MP4 file.
+type chapter struct {
+	Title string `json:"title,omitempty"`
+	// Start and End are in seconds.
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// chapters returns the chapters in order, skipping the invalid ones. It
+// returns nil if p is nil.
+func (p *probeResult) chapters() []chapter {
+	if p == nil {
+		return nil
+	}
+	var out []chapter
+	for _, c := range p.Chapters {
+		start, err1 := strconv.ParseFloat(c.StartTime, 64)
+		end, err2 := strconv.ParseFloat(c.EndTime, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			continue
+		}
+		out = append(out, chapter{Title: c.Tags.Title, Start: start, End: end})
+	}
+	slices.SortStableFunc(out, func(a, b chapter) int { return cmp.Compare(a.Start, b.Start) })
+	return out
+}
+
+// mediaStream is a video, audio or subtitle stream of a file.
+type mediaStream struct {
+	// Type is "video", "audio" or "subtitle".
+	Type string `json:"type"`
+	// Index is the position among the streams of the same type, as in
+	// "-map 0:a:<index>".
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	// Default is set for the stream played when none is picked.
+	Default   bool    `json:"default,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	FrameRate float64 `json:"frame_rate,omitempty"`
+	// HDR is set for the PQ and HLG videos.
+	HDR bool `json:"hdr,omitempty"`
+	// Rotation is the clockwise rotation in degrees to display the video
+	// upright: 0, 90, 180 or 270. Width and Height are before the rotation.
+	Rotation int `json:"rotation,omitempty"`
+	Channels int `json:"channels,omitempty"`
+}
+
+// mediaStreams returns the video, audio and subtitle streams, in the order
+// of the file. It returns nil if p is nil.
+func (p *probeResult) mediaStreams() []mediaStream {
+	if p == nil {
+		return nil
+	}
+	var out []mediaStream
+	counts := map[string]int{}
+	for _, s := range p.Streams {
+		if s.CodecType != "video" && s.CodecType != "audio" && s.CodecType != "subtitle" {
+			continue
+		}
+		ms := mediaStream{
+			Type:     s.CodecType,
+			Index:    counts[s.CodecType],
+			Codec:    s.CodecName,
+			Language: s.Tags.Language,
+			Title:    s.Tags.Title,
+			Default:  s.Disposition.Default != 0,
+			Width:    s.Width,
+			Height:   s.Height,
+			Channels: s.Channels,
+		}
+		if s.CodecType == "video" {
+			ms.FrameRate = parseRate(s.AvgFrameRate)
+			ms.HDR = isHDR(s.ColorTransfer)
+			deg, _ := strconv.ParseFloat(s.Tags.Rotate, 64)
+			for _, sd := range s.SideDataList {
+				if sd.Rotation != 0 {
+					deg = -sd.Rotation
+				}
+			}
+			ms.Rotation = (int(math.Round(deg/90))%4 + 4) % 4 * 90
+		}
+		counts[s.CodecType]++
+		out = append(out, ms)
+	}
+	return out
+}
+
+// streams returns the streams of the type, e.g. "audio".
+func (p *probeResult) streams(typ string) []mediaStream {
+	return slices.DeleteFunc(p.mediaStreams(), func(s mediaStream) bool { return s.Type != typ })
+}
+
+// FrameRate returns the frames per second of the first video stream, 0 if
+// unknown.
+func (p *probeResult) FrameRate() float64 {
+	for _, st := range p.Streams {
+		if st.CodecType == "video" {
+			return parseRate(st.AvgFrameRate)
+		}
+	}
+	return 0
+}
+
+// parseRate parses a frame rate fraction, e.g. "30000/1001", 0 if invalid.
+func parseRate(r string) float64 {
+	n, d, _ := strings.Cut(r, "/")
+	num, err1 := strconv.ParseFloat(n, 64)
+	den, err2 := strconv.ParseFloat(d, 64)
+	if err1 != nil || err2 != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// Duration returns the duration of the media, 0 if unknown.
+func (p *probeResult) Duration() time.Duration {
+	f, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
+// probe returns the ffprobe information about f. The result is cached as long
+// as the file size and modification time do not change.
+func (m *media) probe(ctx context.Context, root string, f file) (*probeResult, error) {
+	if m.ffprobe == "" {
+		return nil, errNoFFmpeg
+	}
+	m.mu.Lock()
+	p := m.probes[f]
+	m.mu.Unlock()
+	if p != nil {
+		return p, nil
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer m.startJob("probe", f.Name)()
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffprobe, "-v", "error", "-show_format", "-show_streams", "-show_chapters", "-of", "json", src)
+	out, err := m.output(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe %q: %w", f.Name, err)
+	}
+	p = &probeResult{}
+	if err = json.Unmarshal(out, p); err != nil {
+		return nil, fmt.Errorf("ffprobe %q: %w", f.Name, err)
+	}
+	m.mu.Lock()
+	m.probes[f] = p
+	m.mu.Unlock()
+	return p, nil
+}
+
+// cachedProbe returns the ffprobe information about f if it is known.
+func (m *media) cachedProbe(f file) *probeResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.probes[f]
+}
+
+// thumbPath returns the path where the thumbnail of f is saved. It changes
+// when the file or the time of the thumbnail does.
+func (m *media) thumbPath(f file) string {
+	h := sha256.Sum256([]byte(f.Name))
+	return filepath.Join(m.thumbs, hex.EncodeToString(h[:8])+"-"+m.thumbVersion(f)+".jpg")
+}
+
+// framePath returns the path where the frame of f at t is saved.
+func (m *media) framePath(f file, t time.Duration) string {
+	h := sha256.Sum256([]byte(f.Name))
+	return filepath.Join(m.thumbs, hex.EncodeToString(h[:8])+"-"+fingerprint(f)+"-"+strconv.FormatInt(t.Milliseconds(), 36)+".jpg")
+}
+
+// thumbnail returns a JPEG of the frame of f used as its thumbnail; see
+// thumbTime and posterTime.
+func (m *media) thumbnail(ctx context.Context, root string, f file) ([]byte, error) {
+	return m.frame(ctx, root, f, m.thumbPath(f), func() time.Duration {
+		if t, ok := m.thumbTime(f.Name); ok {
+			return t
+		}
+		return m.posterTime(ctx, root, f)
+	})
+}
+
+// preview returns a JPEG of the frame of f at t, e.g. a scene of the hover
+// previews.
+func (m *media) preview(ctx context.Context, root string, f file, t time.Duration) ([]byte, error) {
+	return m.frame(ctx, root, f, m.framePath(f, t), func() time.Duration { return t })
+}
+
+// frame returns a JPEG of the frame of f at the time returned by at. It is
+// saved at p when thumbs is set.
+func (m *media) frame(ctx context.Context, root string, f file, p string, at func() time.Duration) ([]byte, error) {
+	if m.thumbs != "" {
+		if b, err := os.ReadFile(p); err == nil {
+			m.touched(p)
+			return b, nil
+		}
+	}
+	if m.ffmpeg == "" {
+		return nil, errNoFFmpeg
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	ss := strconv.FormatFloat(at().Seconds(), 'f', -1, 64)
+	defer m.startJob("thumbnail", f.Name)()
+	// #nosec G204
+	args := append(append([]string{"-v", "error", "-ss", ss}, m.decodeArgs("")...), "-i", src,
+		"-frames:v", "1", "-vf", "scale=320:-2", "-f", "image2", "-c:v", "mjpeg", "-")
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	out, err := m.output(ctx, cmd)
+	if err == nil && len(out) == 0 {
+		// The video is shorter than the thumbnail time; use the first frame,
+		// removing "-ss <time>".
+		// #nosec G204
+		cmd = exec.CommandContext(ctx, m.ffmpeg, slices.Delete(args, 2, 4)...)
+		out, err = m.output(ctx, cmd)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg %q: %w", f.Name, err)
+	}
+	if !bytes.HasPrefix(out, []byte{0xFF, 0xD8}) {
+		return nil, fmt.Errorf("ffmpeg %q: no frame", f.Name)
+	}
+	if m.thumbs != "" {
+		if err = os.MkdirAll(m.thumbs, 0o755); err == nil {
+			err = writeFileAtomic(p, out)
+		}
+		m.written()
+		if err != nil {
+			slog.Warn("thumb", "f", f.Name, "error", err)
+		}
+	}
+	return out, nil
+}
+
+var errNoFFmpeg = errors.New("ffmpeg is not available")
+
+// serveThumb serves a thumbnail of a file, or its frame at ?t=<seconds> for
+// the hover previews. It is immutable when the URL is versioned with thumbURL
+// or previewURL.
+func (s *server) serveThumb(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	q := req.URL.Query()
+	var b []byte
+	var err error
+	version := s.media.thumbVersion(f)
+	if v := q.Get("t"); v != "" {
+		t, err2 := strconv.ParseFloat(v, 64)
+		if err2 != nil || t < 0 || math.IsInf(t, 0) || math.IsNaN(t) || !hasDuration(f.Name) {
+			http.Error(w, "Invalid time", 400)
+			return
+		}
+		b, err = s.media.preview(req.Context(), s.root, f, time.Duration(t*float64(time.Second)))
+		version = fingerprint(f)
+	} else {
+		b, err = s.media.thumbnail(req.Context(), s.root, f)
+	}
+	if err != nil {
+		slog.Warn("thumb", "f", f.Name, "error", err)
+		http.Error(w, "Thumbnail not available", 404)
+		return
+	}
+	h := w.Header()
+	if q.Get("v") == version {
+		h.Set("Cache-Control", cacheImmutable)
+	} else {
+		h.Set("Cache-Control", cacheDefault)
+	}
+	h.Set("Content-Type", "image/jpeg")
+	_, _ = w.Write(b)
+}
+
+// artNames are the album art file names looked up next to an audio file, after
+// "<name>.jpg" and "<name>.png".
+var artNames = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png", "AlbumArt.jpg"}
+
+// findArt returns the path of the sidecar image for the file name, relative
+// to root.
+func findArt(root *os.Root, name string) string {
+	return findSidecar(root, name, []string{".jpg", ".png"}, artNames)
+}
+
+// serveArt serves the album art or poster next to a file, or the fanart with
+// ?kind=fanart.
+func (s *server) serveArt(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	a := ""
+	if req.URL.Query().Get("kind") == "fanart" {
+		a = findFanart(s.rootDir, f.Name)
+	} else {
+		a = findPoster(s.rootDir, f.Name)
+	}
+	if a == "" && s.tmdb != nil {
+		if p := s.tmdb.poster(parseVideoName(f.Name)); p != "" {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			http.ServeFile(w, req, p)
+			return
+		}
+	}
+	if a == "" {
+		http.Error(w, "No art", 404)
+		return
+	}
+	h, err := s.open(a)
+	if err != nil {
+		http.Error(w, "No art", 404)
+		return
+	}
+	defer h.Close()
+	fi, err := h.Stat()
+	if err != nil {
+		http.Error(w, "No art", 404)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeContent(w, req, a, fi.ModTime(), h)
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// TestMediaStreams lists the streams of a dual-language video.
+func TestMediaStreams(t *testing.T) {
+	var p probeResult
+	const out = `{"streams":[{"codec_type":"video","codec_name":"h264","width":1920,"height":1080,"avg_frame_rate":"25/1"},` +
+		`{"codec_type":"audio","codec_name":"ac3","channels":6,"tags":{"language":"fre"},"disposition":{"default":1}},` +
+		`{"codec_type":"subtitle","codec_name":"subrip","tags":{"language":"eng"}},` +
+		`{"codec_type":"data","codec_name":"bin_data"},` +
+		`{"codec_type":"audio","codec_name":"aac","channels":2,"tags":{"language":"eng","title":"Commentary"}}]}`
+	if err := json.Unmarshal([]byte(out), &p); err != nil {
+		t.Fatal(err)
+	}
+	got := p.mediaStreams()
+	want := []mediaStream{
+		{Type: "video", Codec: "h264", Width: 1920, Height: 1080, FrameRate: 25},
+		{Type: "audio", Codec: "ac3", Language: "fre", Default: true, Channels: 6},
+		{Type: "subtitle", Codec: "subrip", Language: "eng"},
+		{Type: "audio", Index: 1, Codec: "aac", Language: "eng", Title: "Commentary", Channels: 2},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if a := p.streams("audio"); len(a) != 2 || a[1] != want[3] {
+		t.Fatalf("got audio %+v", a)
+	}
+}
+
+// TestChapters reads the chapters, out of order and with an invalid one.
+func TestChapters(t *testing.T) {
+	var p probeResult
+	const out = `{"chapters":[{"start_time":"600.5","end_time":"1200.000000","tags":{"title":"The heist"}},` +
+		`{"start_time":"0.000000","end_time":"600.5","tags":{"title":"Opening"}},` +
+		`{"start_time":"1200","end_time":"1200"}]}`
+	if err := json.Unmarshal([]byte(out), &p); err != nil {
+		t.Fatal(err)
+	}
+	want := []chapter{{Title: "Opening", End: 600.5}, {Title: "The heist", Start: 600.5, End: 1200}}
+	if got := p.chapters(); !slices.Equal(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if (*probeResult)(nil).chapters() != nil {
+		t.Fatal("expected no chapters")
+	}
+}
+
+// TestRotation reads the rotation of the phone videos, from the display
+// matrix or the older tag.
+func TestRotation(t *testing.T) {
+	for out, want := range map[string]int{
+		`{"streams":[{"codec_type":"video","side_data_list":[{"side_data_type":"Display Matrix","rotation":-90}]}]}`: 90,
+		`{"streams":[{"codec_type":"video","side_data_list":[{"rotation":180}]}]}`:                                   180,
+		`{"streams":[{"codec_type":"video","tags":{"rotate":"270"}}]}`:                                               270,
+		`{"streams":[{"codec_type":"video"}]}`:                                                                       0,
+	} {
+		var p probeResult
+		if err := json.Unmarshal([]byte(out), &p); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.streams("video")[0].Rotation; got != want {
+			t.Fatalf("%s: got %d, want %d", out, got, want)
+		}
+	}
+}
+
+func TestFrameRate(t *testing.T) {
+	for out, want := range map[string]float64{
+		`{"streams":[{"codec_type":"audio","avg_frame_rate":"0/0"},{"codec_type":"video","avg_frame_rate":"30000/1001"}]}`: 30000. / 1001,
+		`{"streams":[{"codec_type":"video","avg_frame_rate":"25/1"}]}`:                                                     25,
+		`{"streams":[{"codec_type":"video","avg_frame_rate":"0/0"}]}`:                                                      0,
+		`{"streams":[{"codec_type":"audio"}]}`:                                                                             0,
+	} {
+		var p probeResult
+		if err := json.Unmarshal([]byte(out), &p); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.FrameRate(); got != want {
+			t.Errorf("%s: got %g, want %g", out, got, want)
+		}
+	}
+}
+
+// TestWatchFrameRate checks that the watch page knows the frame rate to step
+// frame by frame.
+func TestWatchFrameRate(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"testsrc.mp4": testVideo(t)}, options{})
+	testPage(t, ts.URL+"/watch/testsrc.mp4", "", `"fps":10`)
+}
+
+func TestThumb(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"testsrc.mp4": testVideo(t)}, options{})
+	resp, b := testDo(t, "GET", ts.URL+"/thumb/testsrc.mp4", "", "", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" || len(b) == 0 {
+		t.Fatalf("got status %d with %d bytes of %q", resp.StatusCode, len(b), resp.Header.Get("Content-Type"))
+	}
+}
+
+// TestAlbumArt checks that the art of a song is the image named after it, or
+// else the album cover in its directory.
+func TestAlbumArt(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"music/a.mp3":     "ID3",
+		"music/b.mp3":     "ID3",
+		"music/b.png":     "\x89PNG\r\n\x1a\nb",
+		"music/cover.jpg": "\xFF\xD8\xFF\xE0cover",
+		"other/c.mp3":     "ID3",
+	}, options{})
+	for name, want := range map[string]string{"music/a.mp3": "\xFF\xD8\xFF\xE0cover", "music/b.mp3": "\x89PNG\r\n\x1a\nb"} {
+		if status, b := testGet(t, ts.URL+"/art/"+name, ""); status != http.StatusOK || b != want {
+			t.Fatalf("%s: got status %d: %q", name, status, b)
+		}
+	}
+	if status, _ := testGet(t, ts.URL+"/art/other/c.mp3", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
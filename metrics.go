@@ -0,0 +1,124 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transfer is the counters for one way of sending files.
+type transfer struct {
+	responses uint64
+	bytes     uint64
+	duration  time.Duration
+}
+
+// metrics are the server counters exported at /metrics in the Prometheus text
+// format.
+type metrics struct {
+	mu        sync.Mutex
+	transfers map[string]*transfer
+	// stalls is the streams aborted because the client stopped reading.
+	stalls uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{transfers: map[string]*transfer{}}
+}
+
+// sent records a file response sent via method, either "sendfile" or
+// "buffered".
+func (m *metrics) sent(method string, n int64, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.transfers[method]
+	if t == nil {
+		t = &transfer{}
+		m.transfers[method] = t
+	}
+	t.responses++
+	t.bytes += uint64(n)
+	t.duration += d
+}
+
+// stall records a stream aborted because the client stopped reading.
+func (m *metrics) stall() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stalls++
+}
+
+func (m *metrics) serve(w http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	keys := slices.Sorted(maps.Keys(m.transfers))
+	fmt.Fprintf(w, "# HELP serve_videos_file_responses_total Responses of /raw/ files.\n")
+	fmt.Fprintf(w, "# TYPE serve_videos_file_responses_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "serve_videos_file_responses_total{method=%q} %d\n", k, m.transfers[k].responses)
+	}
+	fmt.Fprintf(w, "# HELP serve_videos_file_sent_bytes_total Bytes of /raw/ files sent.\n")
+	fmt.Fprintf(w, "# TYPE serve_videos_file_sent_bytes_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "serve_videos_file_sent_bytes_total{method=%q} %d\n", k, m.transfers[k].bytes)
+	}
+	fmt.Fprintf(w, "# HELP serve_videos_file_send_seconds_total Time spent sending /raw/ files; the throughput is the bytes divided by this.\n")
+	fmt.Fprintf(w, "# TYPE serve_videos_file_send_seconds_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "serve_videos_file_send_seconds_total{method=%q} %g\n", k, m.transfers[k].duration.Seconds())
+	}
+	fmt.Fprintf(w, "# HELP serve_videos_streams_stalled_total Streams aborted because the client stopped reading.\n")
+	fmt.Fprintf(w, "# TYPE serve_videos_streams_stalled_total counter\n")
+	fmt.Fprintf(w, "serve_videos_streams_stalled_total %d\n", m.stalls)
+}
+
+// bufferedFile reads a file in large chunks instead of letting the kernel
+// send it with sendfile, which can be faster on slow spinning disks.
+type bufferedFile struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+func newBufferedFile(f *os.File, size int) *bufferedFile {
+	return &bufferedFile{f: f, r: bufio.NewReaderSize(f, size)}
+}
+
+func (b *bufferedFile) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferedFile) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(b.r.Buffered())
+	}
+	n, err := b.f.Seek(offset, whence)
+	b.r.Reset(b.f)
+	return n, err
+}
+
+// rangeStart returns the offset of the first range requested, 0 if none.
+func rangeStart(req *http.Request) int64 {
+	r, ok := strings.CutPrefix(req.Header.Get("Range"), "bytes=")
+	if !ok {
+		return 0
+	}
+	r, _, _ = strings.Cut(r, "-")
+	n, err := strconv.ParseInt(strings.TrimSpace(r), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
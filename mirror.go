@@ -0,0 +1,285 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirror proxies the files of a source, either another serve-videos instance
+// or a plain HTTP directory listing, and caches the files it served in root
+// so they are served locally afterward.
+type mirror struct {
+	url  *url.URL
+	root *os.Root
+	exts []string
+	sem  chan struct{}
+
+	mu sync.Mutex
+	// api is true when the source is a serve-videos instance.
+	api      bool
+	files    map[string]bool
+	fetching map[string]bool
+}
+
+func newMirror(u string, root *os.Root, exts []string) (*mirror, error) {
+	mu, err := url.Parse(strings.TrimSuffix(u, "/"))
+	if err != nil || (mu.Scheme != "http" && mu.Scheme != "https") || mu.Host == "" {
+		return nil, fmt.Errorf("-mirror %q: invalid URL", u)
+	}
+	return &mirror{
+		url:      mu,
+		root:     root,
+		exts:     exts,
+		sem:      make(chan struct{}, 2),
+		files:    map[string]bool{},
+		fetching: map[string]bool{},
+	}, nil
+}
+
+// fileURL returns the URL of the file name on the source.
+func (m *mirror) fileURL(name string) *url.URL {
+	m.mu.Lock()
+	api := m.api
+	m.mu.Unlock()
+	p := "/" + escapePath(name)
+	if api {
+		p = rawURL(name)
+	}
+	u, _ := url.Parse(m.url.String() + p)
+	return u
+}
+
+// refresh lists the files of the source.
+func (m *mirror) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	files, err := m.listAPI(ctx)
+	api := err == nil
+	if !api {
+		files = map[string]bool{}
+		if err = m.crawl(ctx, "", files, 0); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.api = api
+	m.files = files
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mirror) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: got status %d", u, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// listAPI lists the files of a serve-videos source.
+func (m *mirror) listAPI(ctx context.Context) (map[string]bool, error) {
+	resp, err := m.get(ctx, m.url.String()+"/api/files")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Files []fileInfo `json:"files"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(data.Files))
+	for _, f := range data.Files {
+		files[f.Name] = true
+	}
+	return files, nil
+}
+
+var reHref = regexp.MustCompile(`href="([^"?#]+)"`)
+
+// crawl lists the files of a directory listing, like the ones of nginx's
+// autoindex or Apache.
+func (m *mirror) crawl(ctx context.Context, dir string, files map[string]bool, depth int) error {
+	if depth > 16 {
+		return nil
+	}
+	u := m.url.String() + "/" + strings.TrimPrefix(escapePath(dir), "/")
+	if dir != "" {
+		u += "/"
+	}
+	resp, err := m.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, match := range reHref.FindAllSubmatch(b, -1) {
+		href, err := url.PathUnescape(string(match[1]))
+		if err != nil || strings.Contains(href, "://") || strings.HasPrefix(href, "/") || strings.HasPrefix(href, ".") {
+			continue
+		}
+		name := path.Join(dir, href)
+		if strings.HasSuffix(href, "/") {
+			if err = m.crawl(ctx, name, files, depth+1); err != nil {
+				slog.Warn("mirror", "dir", name, "error", err)
+			}
+			continue
+		}
+		for _, e := range m.exts {
+			if strings.HasSuffix(name, "."+e) {
+				files[name] = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mirror) hasFile(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files[name]
+}
+
+// names returns the files of the source.
+func (m *mirror) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]string, 0, len(m.files))
+	for n := range m.files {
+		out = append(out, n)
+	}
+	return out
+}
+
+// run refreshes the list of files every minute until ctx is canceled.
+func (m *mirror) run(ctx context.Context) {
+	for {
+		if err := m.refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("mirror", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// cache downloads the file in root in the background, unless it is already
+// being downloaded.
+func (m *mirror) cache(ctx context.Context, name string) {
+	m.mu.Lock()
+	if m.fetching[name] {
+		m.mu.Unlock()
+		return
+	}
+	m.fetching[name] = true
+	m.mu.Unlock()
+	go func() {
+		m.sem <- struct{}{}
+		defer func() {
+			<-m.sem
+			m.mu.Lock()
+			delete(m.fetching, name)
+			m.mu.Unlock()
+		}()
+		if err := m.download(ctx, name); err != nil {
+			slog.Warn("mirror", "f", name, "error", err)
+		}
+	}()
+}
+
+// download fetches the file into root. Playlists still being recorded are not
+// cached since they would not be updated anymore.
+func (m *mirror) download(ctx context.Context, name string) error {
+	dst := filepath.FromSlash(name)
+	if !filepath.IsLocal(dst) {
+		return fmt.Errorf("%q is outside the root", name)
+	}
+	if _, err := m.root.Stat(dst); err == nil {
+		return nil
+	}
+	resp, err := m.get(ctx, m.fileURL(name).String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if strings.HasSuffix(name, ".m3u8") {
+		b, err2 := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		if err2 != nil {
+			return err2
+		}
+		if !parsePlaylist(b).ended {
+			return nil
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	if err = m.root.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	// The temporary file is ignored by scan since its extension differs.
+	tmp := dst + ".part"
+	f, err := m.root.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = m.root.Remove(tmp)
+		return err
+	}
+	slog.Info("mirror", "cached", name)
+	return m.root.Rename(tmp, dst)
+}
+
+// serveMirrorFile proxies the file from the source, with the credentials of
+// -mirror instead of the client's, and caches it for the next requests.
+func (s *server) serveMirrorFile(w http.ResponseWriter, req *http.Request, name string) {
+	m := s.mirror
+	// The download outlives the request.
+	m.cache(context.WithoutCancel(req.Context()), name)
+	u := m.fileURL(name)
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.Out.URL.Path = u.Path
+			r.Out.URL.RawPath = u.RawPath
+			proxyAuth(r, u)
+		},
+	}
+	rp.ServeHTTP(w, req)
+}
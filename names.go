@@ -0,0 +1,186 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// videoName is what the file name of a video tells about it.
+type videoName struct {
+	// Title is the movie or show title.
+	Title string
+	Year  int
+	// Season and Episode are set for TV episodes.
+	Season  int
+	Episode int
+}
+
+var (
+	// reEpisode matches "Show.Name.S01E02" and "Show Name - 1x02".
+	reEpisode = regexp.MustCompile(`(?i)^(.*?)[ ._-]*\b(?:s(\d{1,2})[ ._-]?e(\d{1,3})|(\d{1,2})x(\d{2,3}))\b`)
+	// reYear matches "Title (2010)" and "Title.2010.1080p".
+	reYear = regexp.MustCompile(`^(.+?)[ ._\[(-]+((?:19|20)\d{2})(?:[ ._\])-]|$)`)
+	// reSeasonDir matches the directory of a season, e.g. "Season 1".
+	reSeasonDir = regexp.MustCompile(`(?i)^(?:season|saison|staffel)[ ._-]*\d+$`)
+)
+
+// parseVideoName parses the naming conventions of movies and TV episodes. For
+// an episode named only "S01E02.mkv", the show is the directory name.
+func parseVideoName(name string) videoName {
+	base := path.Base(name)
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	var v videoName
+	if m := reEpisode.FindStringSubmatch(stem); m != nil {
+		if m[2] != "" {
+			v.Season, _ = strconv.Atoi(m[2])
+			v.Episode, _ = strconv.Atoi(m[3])
+		} else {
+			v.Season, _ = strconv.Atoi(m[4])
+			v.Episode, _ = strconv.Atoi(m[5])
+		}
+		v.Title = cleanTitle(m[1])
+		if y := reYear.FindStringSubmatch(v.Title + " "); y != nil {
+			// "Show (2005) S01E02".
+			v.Title = cleanTitle(y[1])
+			v.Year, _ = strconv.Atoi(y[2])
+		}
+		for dir := path.Dir(name); v.Title == "" && dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if d := path.Base(dir); !reSeasonDir.MatchString(d) {
+				v.Title = cleanTitle(d)
+			}
+		}
+		return v
+	}
+	if m := reYear.FindStringSubmatch(stem); m != nil {
+		v.Title = cleanTitle(m[1])
+		v.Year, _ = strconv.Atoi(m[2])
+	}
+	return v
+}
+
+// cleanTitle replaces the dots and underscores used as separators.
+func cleanTitle(s string) string {
+	if !strings.Contains(s, " ") {
+		s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	}
+	return strings.Trim(s, " -")
+}
+
+var (
+	// reJunk matches the release tags after the title, e.g. "1080p.BluRay.x264-GROUP".
+	reJunk = regexp.MustCompile(`(?i)[ ._\[(-]+(?:\d{3,4}[pi]|\d{3,4}x\d{3,4}|4k|uhd|[xh][ .]?26[45]|hevc|avc|av1|xvid|divx|blu-?ray|brrip|bdrip|web-?dl|webrip|hdtv|dvdrip|remux|hdr(?:10)?|dv|10bit|aac|ac3|e?ac-?3|dts|ddp?[ .]?\d\.\d|atmos|proper|repack|extended|unrated)\b.*$`)
+	// reCameraPrefix matches the prefix cameras and phones put before the
+	// timestamp, e.g. "VID_" or "PXL_".
+	reCameraPrefix = regexp.MustCompile(`(?i)(?:^|/)(?:vid|img|pxl|mvi|mov|dji|gopr|rec|video|screen[ _-]?recording)[ _-]*$`)
+)
+
+// titleRule rewrites the names matching a regexp into a display title.
+type titleRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// titleRules is the -title-rule flag. The first matching rule wins over the
+// built-in parsing.
+type titleRules []titleRule
+
+func (t *titleRules) String() string {
+	var out []string
+	for _, r := range *t {
+		out = append(out, r.re.String()+"="+r.repl)
+	}
+	return strings.Join(out, ",")
+}
+
+// Set parses "<regexp>=<replacement>". The replacement can refer to the
+// submatches as $1 or ${name}.
+func (t *titleRules) Set(v string) error {
+	expr, repl, ok := strings.Cut(v, "=")
+	if !ok || expr == "" || repl == "" {
+		return fmt.Errorf("-title-rule %q must be in the form <regexp>=<replacement>", v)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("-title-rule %q: %w", v, err)
+	}
+	*t = append(*t, titleRule{re, repl})
+	return nil
+}
+
+// apply returns the title of the first rule matching name.
+func (t titleRules) apply(name string) (string, bool) {
+	for _, r := range t {
+		if m := r.re.FindStringSubmatchIndex(name); m != nil {
+			return strings.TrimSpace(string(r.re.ExpandString(nil, r.repl, name, m))), true
+		}
+	}
+	return "", false
+}
+
+// prettyName returns a human readable title for a file name, e.g.
+// "Heat (1995)" for "Heat.1995.1080p.BluRay.x264.mkv" or
+// "front 2024-10-15 14:02:00" for "front/2024-10-15/140200.m3u8".
+func prettyName(name string) string {
+	dir, base := path.Split(name)
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	noExt := dir + stem
+	if m := reTimestamp.FindStringSubmatchIndex(noExt); m != nil && m[1] > len(dir) {
+		if t, ok := parseTimestamp(noExt); ok {
+			prefix := reCameraPrefix.ReplaceAllString(noExt[:m[0]], "")
+			// Drop the milliseconds some phones append.
+			rest := cleanTitle(strings.TrimLeft(noExt[m[1]:], "0123456789"))
+			out := strings.Join(strings.FieldsFunc(prefix, func(r rune) bool { return r == '/' }), " ")
+			out = strings.TrimSpace(out + " " + t.Format("2006-01-02 15:04:05"))
+			if rest != "" {
+				out += " " + rest
+			}
+			return out
+		}
+	}
+	v := parseVideoName(name)
+	if v.Episode != 0 {
+		out := fmt.Sprintf("%s S%02dE%02d", v.Title, v.Season, v.Episode)
+		if m := reEpisode.FindStringIndex(stem); m != nil {
+			if rest := cleanTitle(reJunk.ReplaceAllString(stem[m[1]:], "")); rest != "" {
+				out += " - " + rest
+			}
+		}
+		return strings.TrimSpace(out)
+	}
+	if v.Year != 0 {
+		return fmt.Sprintf("%s (%d)", v.Title, v.Year)
+	}
+	if t := cleanTitle(reJunk.ReplaceAllString(stem, "")); t != "" {
+		return dir + t
+	}
+	return name
+}
+
+// displayTitle returns the title shown for a video: the first matching rule,
+// then the metadata, then the prettified file name.
+func displayTitle(name string, sc *sidecar, rules titleRules) string {
+	if t, ok := rules.apply(name); ok {
+		return t
+	}
+	if sc != nil && sc.Show != "" {
+		out := fmt.Sprintf("%s S%02dE%02d", sc.Show, sc.Season, sc.Episode)
+		if sc.Title != "" {
+			out += " - " + sc.Title
+		}
+		return out
+	}
+	if sc != nil && sc.Title != "" {
+		if sc.Year != 0 {
+			return fmt.Sprintf("%s (%d)", sc.Title, sc.Year)
+		}
+		return sc.Title
+	}
+	return prettyName(name)
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// TestNames checks the parsing of the file names.
+func TestNames(t *testing.T) {
+	for name, want := range map[string]videoName{
+		"Heat (1995).mkv":                        {Title: "Heat", Year: 1995},
+		"2001.A.Space.Odyssey.1968.1080p.mkv":    {Title: "2001 A Space Odyssey", Year: 1968},
+		"The.Office.US.S02E01.720p.HDTV.mkv":     {Title: "The Office US", Season: 2, Episode: 1},
+		"Doctor Who (2005) - 1x02 - The End.mp4": {Title: "Doctor Who", Year: 2005, Season: 1, Episode: 2},
+		"Show/Season 3/s03e10.mkv":               {Title: "Show", Season: 3, Episode: 10},
+		"Movie.1920x1080.mkv":                    {},
+		"cam1/2024-10-15/140200.m3u8":            {},
+	} {
+		if got := parseVideoName(name); got != want {
+			t.Fatalf("%q: got %+v, want %+v", name, got, want)
+		}
+	}
+	var rules titleRules
+	if err := rules.Set(`^cam(\d)/.*/(\d\d)(\d\d)\d\d\.m3u8$=Camera $1 at $2:$3`); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Heat.1995.1080p.BluRay.x264-GROUP.mkv":          "Heat (1995)",
+		"The.Office.US.S02E01.The.Dundies.720p.HDTV.mkv": "The Office US S02E01 - The Dundies",
+		"Show/Season 3/s03e10.mkv":                       "Show S03E10",
+		"home/Birthday.Party.2160p.HEVC.mp4":             "home/Birthday Party",
+		"front/2024-10-15/140200.m3u8":                   "front 2024-10-15 14:02:00",
+		"phone/PXL_20241015_140200123.mp4":               "phone 2024-10-15 14:02:00",
+		"cam2/2024-10-15/140200.m3u8":                    "Camera 2 at 14:02",
+	} {
+		if got := displayTitle(name, nil, rules); got != want {
+			t.Fatalf("%q: got title %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// posterNames and fanartNames are the Kodi artwork file names looked up next
+// to a video, after "<name>-poster.jpg" and "<name>-fanart.jpg" respectively.
+var (
+	posterNames = []string{"poster.jpg", "poster.png"}
+	fanartNames = []string{"fanart.jpg", "fanart.png"}
+)
+
+// isSidecarArt returns true if the image name is artwork of a video or an
+// album rather than a photo.
+func isSidecarArt(name string) bool {
+	base := path.Base(name)
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	if strings.HasSuffix(stem, "-poster") || strings.HasSuffix(stem, "-fanart") || strings.HasSuffix(stem, "-thumb") {
+		return true
+	}
+	for _, l := range [][]string{posterNames, fanartNames, artNames} {
+		for _, n := range l {
+			if strings.EqualFold(base, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findSidecar returns the path relative to root of the first file found next
+// to the file name among "<stem><suffix>" then the names.
+func findSidecar(root *os.Root, name string, suffixes, names []string) string {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	var candidates []string
+	for _, s := range suffixes {
+		candidates = append(candidates, stem+s)
+	}
+	for _, a := range names {
+		candidates = append(candidates, path.Join(path.Dir(name), a))
+	}
+	for _, c := range candidates {
+		if fi, err := root.Stat(filepath.FromSlash(c)); err == nil && fi.Mode().IsRegular() {
+			return c
+		}
+	}
+	return ""
+}
+
+// findPoster returns the path of the poster of a video, falling back to the
+// album art.
+func findPoster(root *os.Root, name string) string {
+	if p := findSidecar(root, name, []string{"-poster.jpg", "-poster.png"}, posterNames); p != "" {
+		return p
+	}
+	return findArt(root, name)
+}
+
+// findFanart returns the path of the background artwork of a video.
+func findFanart(root *os.Root, name string) string {
+	return findSidecar(root, name, []string{"-fanart.jpg", "-fanart.png"}, fanartNames)
+}
+
+// sidecar is the metadata of a video from Kodi sidecar files ("<name>.nfo" or
+// "movie.nfo" and the artwork), TheMovieDB or the file name.
+type sidecar struct {
+	Title string `json:"title,omitempty"`
+	Year  int    `json:"year,omitempty"`
+	Plot  string `json:"plot,omitempty"`
+	// Show, Season and Episode are set for TV episodes.
+	Show    string `json:"show,omitempty"`
+	Season  int    `json:"season,omitempty"`
+	Episode int    `json:"episode,omitempty"`
+	Poster  bool   `json:"poster,omitempty"`
+	Fanart  bool   `json:"fanart,omitempty"`
+}
+
+// nfo is the subset of a Kodi .nfo file that is used. The root element is
+// <movie>, <episodedetails> or <musicvideo>.
+type nfo struct {
+	Title     string `xml:"title"`
+	Year      string `xml:"year"`
+	Plot      string `xml:"plot"`
+	ShowTitle string `xml:"showtitle"`
+	Season    string `xml:"season"`
+	Episode   string `xml:"episode"`
+}
+
+// readSidecar reads the sidecar files of the video name. It returns nil when
+// there is none.
+func readSidecar(root *os.Root, name string) *sidecar {
+	sc := &sidecar{}
+	if p := findSidecar(root, name, []string{".nfo"}, []string{"movie.nfo"}); p != "" {
+		// Kodi allows a URL after the XML, which is ignored.
+		var n nfo
+		if b, err := root.ReadFile(filepath.FromSlash(p)); err == nil {
+			_ = xml.Unmarshal(b, &n)
+		}
+		sc.Title = strings.TrimSpace(n.Title)
+		sc.Year, _ = strconv.Atoi(strings.TrimSpace(n.Year))
+		sc.Plot = strings.TrimSpace(n.Plot)
+		sc.Show = strings.TrimSpace(n.ShowTitle)
+		sc.Season, _ = strconv.Atoi(strings.TrimSpace(n.Season))
+		sc.Episode, _ = strconv.Atoi(strings.TrimSpace(n.Episode))
+	}
+	sc.Poster = findSidecar(root, name, []string{"-poster.jpg", "-poster.png"}, posterNames) != ""
+	sc.Fanart = findFanart(root, name) != ""
+	if *sc == (sidecar{}) {
+		return nil
+	}
+	return sc
+}
+
+// isVideo returns true if the file name is a video, excluding the HLS
+// segments.
+func isVideo(name string) bool {
+	return !isImage(name) && !strings.HasPrefix(mimeType(name), "audio/") && !strings.HasSuffix(name, ".ts")
+}
+
+// sidecars returns the metadata of the videos having some. The Kodi sidecar
+// files have precedence over TheMovieDB, then over the show and episode
+// parsed from the file name. The result is cached until the next change in
+// root.
+func (s *server) sidecars() map[string]*sidecar {
+	s.media.mu.Lock()
+	c := s.media.sidecars
+	s.media.mu.Unlock()
+	if c != nil {
+		return c
+	}
+	c = map[string]*sidecar{}
+	for _, f := range s.getFiles() {
+		if !isVideo(f.Name) {
+			continue
+		}
+		sc := readSidecar(s.rootDir, f.Name)
+		if sc == nil || sc.Title == "" {
+			v := parseVideoName(f.Name)
+			var t *sidecar
+			if s.tmdb != nil {
+				t = s.tmdb.info(v)
+			}
+			if t == nil && v.Episode != 0 {
+				t = &sidecar{Show: v.Title, Season: v.Season, Episode: v.Episode, Year: v.Year}
+			}
+			if t != nil {
+				if sc != nil {
+					// Keep the local artwork.
+					t.Poster = t.Poster || sc.Poster
+					t.Fanart = sc.Fanart
+				}
+				sc = t
+			}
+		}
+		if sc != nil {
+			c[f.Name] = sc
+		}
+	}
+	s.media.mu.Lock()
+	s.media.sidecars = c
+	s.media.mu.Unlock()
+	return c
+}
+
+// titles returns the display titles of the files that differ from their
+// name. The result is cached like sidecars.
+func (s *server) titles() map[string]string {
+	s.media.mu.Lock()
+	c := s.media.titles
+	s.media.mu.Unlock()
+	if c != nil {
+		return c
+	}
+	meta := s.sidecars()
+	c = map[string]string{}
+	for _, f := range s.getFiles() {
+		if !isVideo(f.Name) {
+			continue
+		}
+		if t := displayTitle(f.Name, meta[f.Name], s.opts.titleRules); t != "" && t != f.Name {
+			c[f.Name] = t
+		}
+	}
+	s.media.mu.Lock()
+	s.media.titles = c
+	s.media.mu.Unlock()
+	return c
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsSidecarArt(t *testing.T) {
+	for name, want := range map[string]bool{
+		"movie/heat-poster.jpg": true,
+		"movie/heat-fanart.png": true,
+		"movie/fanart.jpg":      true,
+		"music/cover.jpg":       true,
+		"photos/snap.jpg":       false,
+		"photos/poster-1.jpg":   false,
+	} {
+		if got := isSidecarArt(name); got != want {
+			t.Errorf("%s: got %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	const poster = "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00poster"
+	const fanart = "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00fanart"
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":              testMP4,
+		"movie/heat.mp4":        testMP4,
+		"movie/heat.nfo":        "<?xml version=\"1.0\"?>\n<movie><title>Heat</title><year>1995</year><plot>A heist.</plot></movie>\nhttps://www.themoviedb.org/movie/949\n",
+		"movie/heat-poster.jpg": poster,
+		"movie/fanart.jpg":      fanart,
+	}, options{})
+	testPage(t, ts.URL+"/", "", `"movie/heat.mp4":{"title":"Heat","year":1995,"plot":"A heist.","poster":true,"fanart":true}`)
+	for u, want := range map[string]string{"/art/movie/heat.mp4": poster, "/art/movie/heat.mp4?kind=fanart": fanart} {
+		resp, b := testDo(t, "GET", ts.URL+u, "", "", nil)
+		if resp.StatusCode != http.StatusOK || b != want {
+			t.Fatalf("%s: got status %d: %q", u, resp.StatusCode, b)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+			t.Fatalf("%s: got Content-Type %q", u, ct)
+		}
+	}
+	for _, u := range []string{"/art/clip.mp4", "/art/missing.mp4"} {
+		if status, _ := testGet(t, ts.URL+u, ""); status != http.StatusNotFound {
+			t.Fatalf("%s: got status %d", u, status)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNoteSize is the maximum length of the text of a note.
+const maxNoteSize = 10000
+
+// note is a comment on a file, optionally at a position in the video.
+type note struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	// Time is the position in seconds the note is about, if any.
+	Time    *float64  `json:"time,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// notes are the notes of the files, shared by all the users.
+//
+// They are saved to p when not empty.
+type notes struct {
+	p string
+
+	mu    sync.Mutex
+	files map[string][]note
+	dirty bool
+}
+
+// newNotes loads the notes saved in p, if any.
+func newNotes(p string) (*notes, error) {
+	n := &notes{p: p, files: map[string][]note{}}
+	if err := readJSON(p, &n.files); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// get returns the notes of the file name, oldest first.
+func (n *notes) get(name string) []note {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]note{}, n.files[name]...)
+}
+
+func (n *notes) add(name string, nt note) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.files[name] = append(n.files[name], nt)
+	n.dirty = true
+}
+
+// remove deletes the note id of the file name. Only its author can delete it
+// when -user is used.
+func (n *notes) remove(name, id, user string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v := n.files[name]
+	i := slices.IndexFunc(v, func(nt note) bool { return nt.ID == id && nt.User == user })
+	if i == -1 {
+		return false
+	}
+	if v = slices.Delete(v, i, i+1); len(v) == 0 {
+		delete(n.files, name)
+	} else {
+		n.files[name] = v
+	}
+	n.dirty = true
+	return true
+}
+
+// noteResult is a note found by search.
+type noteResult struct {
+	File string `json:"file"`
+	note
+}
+
+// search returns the notes containing q, case insensitive, most recent first.
+func (n *notes) search(q string) []noteResult {
+	q = strings.ToLower(q)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := []noteResult{}
+	for f, v := range n.files {
+		for _, nt := range v {
+			if strings.Contains(strings.ToLower(nt.Text), q) {
+				out = append(out, noteResult{File: f, note: nt})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// save writes the notes to disk if they changed.
+func (n *notes) save() error {
+	n.mu.Lock()
+	if n.p == "" || !n.dirty {
+		n.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(n.files)
+	n.dirty = false
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(n.p, b)
+}
+
+// serveNotesSearch returns the notes containing ?q=<text> on the files the user
+// can see.
+func (s *server) serveNotesSearch(w http.ResponseWriter, req *http.Request) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	if q == "" {
+		http.Error(w, "Missing q", 400)
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	out := slices.DeleteFunc(s.notes.search(q), func(r noteResult) bool { return !s.canAccess(req, r.File) })
+	_ = json.NewEncoder(w).Encode(map[string]any{"notes": out})
+}
+
+// serveNotes lists the notes of a file with GET, adds one with POST
+// {"text": "...", "time": <seconds>} and deletes one with DELETE ?id=<id>.
+func (s *server) serveNotes(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		var body struct {
+			Text string   `json:"text"`
+			Time *float64 `json:"time"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		body.Text = strings.TrimSpace(body.Text)
+		if body.Text == "" || len(body.Text) > maxNoteSize || (body.Time != nil && *body.Time < 0) {
+			http.Error(w, "Invalid note", 400)
+			return
+		}
+		var id [8]byte
+		_, _ = rand.Read(id[:])
+		nt := note{
+			ID:      hex.EncodeToString(id[:]),
+			Text:    body.Text,
+			Time:    body.Time,
+			User:    userFrom(req),
+			Created: time.Now().UTC().Truncate(time.Second),
+		}
+		s.notes.add(f, nt)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(nt)
+	case http.MethodDelete:
+		if !s.notes.remove(f, req.FormValue("id"), userFrom(req)) {
+			http.Error(w, "Unknown note", 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h := w.Header()
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"notes": s.notes.get(f)})
+	}
+}
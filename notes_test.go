@@ -0,0 +1,58 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestNotes(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"sub dir/clip.mp4": testMP4}, options{})
+	u := ts.URL + "/api/notes/sub%20dir/clip.mp4"
+	for _, body := range []string{`{"text":"  "}`, `{"text":"x","time":-1}`, `{`} {
+		if resp, b := testDo(t, "POST", u, "", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+	}
+	resp, b := testDo(t, "POST", u, "", `{"text":"The clip the Adjuster asked about","time":1.5}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var nt note
+	if err := json.Unmarshal([]byte(b), &nt); err != nil {
+		t.Fatal(err)
+	}
+	testPage(t, u, "", `"text":"The clip the Adjuster asked about","time":1.5,`)
+	testPage(t, ts.URL+"/api/notes?q=adjuster", "", `{"notes":[{"file":"sub dir/clip.mp4","id":"`+nt.ID+`",`)
+	if status, _ := testGet(t, ts.URL+"/api/notes?q=", ""); status != http.StatusBadRequest {
+		t.Fatalf("empty query: got status %d", status)
+	}
+	if resp, _ = testDo(t, "DELETE", u+"?id="+nt.ID, "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/notes?q=adjuster", "", `{"notes":[]}`)
+}
+
+// TestNotesUsers checks that only the author of a note can delete it.
+func TestNotesUsers(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice", "bob"}, "")
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{users: u})
+	resp, b := testDo(t, "POST", ts.URL+"/api/notes/clip.mp4", "alice", `{"text":"hi"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var nt note
+	if err := json.Unmarshal([]byte(b), &nt); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ = testDo(t, "DELETE", ts.URL+"/api/notes/clip.mp4?id="+nt.ID, "bob", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if resp, _ = testDo(t, "DELETE", ts.URL+"/api/notes/clip.mp4?id="+nt.ID, "alice", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// fileEvent is the JSON payload sent to webhooks.
+type fileEvent struct {
+	Event   string    `json:"event"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	URL     string    `json:"url,omitempty"`
+}
+
+// onNewFiles is called by the watcher with the files that appeared.
+func (s *server) onNewFiles(ctx context.Context, added []file) {
+	for _, f := range added {
+		slog.Info("new file", "name", f.Name)
+	}
+	for _, u := range s.opts.webhooks {
+		go s.sendWebhook(ctx, u, added)
+	}
+	if s.opts.ntfy != "" || s.opts.gotify != "" || s.opts.pushover != "" {
+		go s.sendPush(ctx, added)
+	}
+	if s.pregenerate != nil {
+		select {
+		case s.pregenerate <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendPush sends a push notification for each new file in the directories
+// listed in -notify-dir.
+func (s *server) sendPush(ctx context.Context, added []file) {
+	for _, f := range added {
+		dir := path.Dir(f.Name)
+		if !inDirs(dir, s.opts.notifyDirs) {
+			continue
+		}
+		if dir == "." {
+			dir = strings.TrimSuffix(f.Name, path.Ext(f.Name))
+		}
+		msg := "new recording: " + dir + " " + f.ModTime.Format("15:04")
+		link := ""
+		if s.opts.publicURL != "" {
+			link = s.opts.publicURL + watchURL(f.Name)
+		}
+		if s.opts.ntfy != "" {
+			hdr := http.Header{"Title": {"serve-videos"}}
+			if link != "" {
+				hdr.Set("Click", link)
+			}
+			if err := postWithRetry(ctx, s.opts.ntfy, hdr, []byte(msg)); err != nil {
+				slog.Error("ntfy", "name", f.Name, "error", err)
+			}
+		}
+		if s.opts.gotify != "" {
+			m := map[string]any{"title": "serve-videos", "message": msg, "priority": 5}
+			if link != "" {
+				m["extras"] = map[string]any{"client::notification": map[string]any{"click": map[string]string{"url": link}}}
+			}
+			b, _ := json.Marshal(m)
+			if err := postWithRetry(ctx, s.opts.gotify, http.Header{"Content-Type": {"application/json"}}, b); err != nil {
+				slog.Error("gotify", "name", f.Name, "error", err)
+			}
+		}
+		if s.opts.pushover != "" {
+			token, user, _ := strings.Cut(s.opts.pushover, ":")
+			v := url.Values{"token": {token}, "user": {user}, "title": {"serve-videos"}, "message": {msg}}
+			if link != "" {
+				v.Set("url", link)
+			}
+			if err := postWithRetry(ctx, pushoverURL, http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, []byte(v.Encode())); err != nil {
+				slog.Error("pushover", "name", f.Name, "error", err)
+			}
+		}
+	}
+}
+
+const pushoverURL = "https://api.pushover.net/1/messages.json"
+
+// inDirs returns true if dir is one of dirs or a subdirectory of one of them.
+// An empty dirs matches everything.
+func inDirs(dir string, dirs []string) bool {
+	if len(dirs) == 0 {
+		return true
+	}
+	for _, d := range dirs {
+		d = strings.Trim(d, "/")
+		if dir == d || strings.HasPrefix(dir, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sendWebhook POSTs one event per file to the webhook u.
+func (s *server) sendWebhook(ctx context.Context, u string, added []file) {
+	for _, f := range added {
+		e := fileEvent{Event: "file.added", Name: f.Name, Size: f.Size, ModTime: f.ModTime}
+		if s.opts.publicURL != "" {
+			e.URL = s.opts.publicURL + s.linkURL(f.Name)
+		}
+		b, err := json.Marshal(&e)
+		if err != nil {
+			panic(err)
+		}
+		if err = postWithRetry(ctx, u, http.Header{"Content-Type": {"application/json"}}, b); err != nil {
+			slog.Error("webhook", "url", u, "name", f.Name, "error", err)
+		}
+	}
+}
+
+// postWithRetry POSTs body to u, retrying with exponential backoff on network
+// errors and on 429 and 5xx responses.
+func postWithRetry(ctx context.Context, u string, hdr http.Header, body []byte) error {
+	const attempts = 5
+	delay := time.Second
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i != 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		var retry bool
+		if retry, err = post(ctx, u, hdr, body); err == nil || !retry {
+			return err
+		}
+		slog.Warn("post", "url", u, "attempt", i+1, "error", err)
+	}
+	return err
+}
+
+// post POSTs body to u. It returns true if the request should be retried.
+func post(ctx context.Context, u string, hdr http.Header, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("got status %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
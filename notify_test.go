@@ -0,0 +1,45 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchPage(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"sub dir/clip.mp4": testMP4}, options{})
+	testPage(t, ts.URL+watchURL("sub dir/clip.mp4"), "", "const data = ")
+	if status, _ := testGet(t, ts.URL+watchURL("missing.mp4"), ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+// TestPushNtfy checks the ntfy notifications of the new files in the
+// -notify-dir directories.
+func TestPushNtfy(t *testing.T) {
+	type push struct {
+		msg, click string
+	}
+	got := make(chan push, 2)
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		got <- push{string(b), req.Header.Get("Click")}
+	}))
+	defer ntfy.Close()
+	s := &server{opts: options{ntfy: ntfy.URL, publicURL: "https://videos", notifyDirs: []string{"front-door"}}}
+	mod := time.Date(2024, 10, 15, 14, 2, 0, 0, time.Local)
+	s.sendPush(t.Context(), []file{{Name: "back/a.mp4", ModTime: mod}, {Name: "front-door/b c.mp4", ModTime: mod}})
+	want := push{"new recording: front-door 14:02", "https://videos/watch/front-door/b%20c.mp4"}
+	if p := <-got; p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if len(got) != 0 {
+		t.Fatal("notified a file out of -notify-dir")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// partyState is the playback state shared by the members of a watch party.
+type partyState struct {
+	File    string  `json:"file"`
+	Playing bool    `json:"playing"`
+	Time    float64 `json:"time"`
+	Members int     `json:"members"`
+}
+
+// party is a set of players kept in sync.
+type party struct {
+	mu      sync.Mutex
+	state   partyState
+	updated time.Time
+	// seq numbers the broadcasts so a member never gets an older state after
+	// a newer one.
+	seq     uint64
+	members map[*partyMember]bool
+}
+
+// partyMember is a member's connection with the state waiting to be sent.
+type partyMember struct {
+	c    *websocket.Conn
+	wake chan struct{}
+
+	mu   sync.Mutex
+	seq  uint64
+	next *partyState
+}
+
+func newPartyMember(c *websocket.Conn) *partyMember {
+	return &partyMember{c: c, wake: make(chan struct{}, 1)}
+}
+
+// send queues st to be sent by write, replacing the older state not sent
+// yet since only the latest one matters.
+func (m *partyMember) send(st partyState, seq uint64) {
+	m.mu.Lock()
+	if seq > m.seq {
+		m.seq = seq
+		m.next = &st
+	}
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write sends the queued states until done is closed. The connection is
+// closed if the member is too slow to receive one.
+func (m *partyMember) write(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-m.wake:
+		}
+		m.mu.Lock()
+		st := m.next
+		m.next = nil
+		m.mu.Unlock()
+		if st == nil {
+			continue
+		}
+		_ = m.c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Send(m.c, st); err != nil {
+			_ = m.c.Close()
+			return
+		}
+	}
+}
+
+// current returns the state with the position extrapolated to now.
+func (p *party) current() partyState {
+	st := p.state
+	if st.Playing {
+		st.Time += time.Since(p.updated).Seconds()
+	}
+	st.Members = len(p.members)
+	return st
+}
+
+// broadcast queues the state for all the members but skip. The lock is not
+// held while sending, so a slow member doesn't stall the party.
+func (p *party) broadcast(skip *partyMember) {
+	p.mu.Lock()
+	st := p.current()
+	p.seq++
+	seq := p.seq
+	members := make([]*partyMember, 0, len(p.members))
+	for m := range p.members {
+		if m != skip {
+			members = append(members, m)
+		}
+	}
+	p.mu.Unlock()
+	for _, m := range members {
+		m.send(st, seq)
+	}
+}
+
+// parties are the active watch parties by ID. A party is forgotten when its
+// last member leaves.
+type parties struct {
+	mu sync.Mutex
+	m  map[string]*party
+}
+
+var rePartyID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// join returns the party id, creating it to play file if needed.
+func (ps *parties) join(id, file string, m *partyMember) *party {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.m == nil {
+		ps.m = map[string]*party{}
+	}
+	p := ps.m[id]
+	if p == nil {
+		p = &party{state: partyState{File: file}, updated: time.Now(), members: map[*partyMember]bool{}}
+		ps.m[id] = p
+	}
+	p.mu.Lock()
+	p.members[m] = true
+	p.mu.Unlock()
+	return p
+}
+
+func (ps *parties) leave(id string, p *party, m *partyMember) {
+	ps.mu.Lock()
+	p.mu.Lock()
+	delete(p.members, m)
+	left := len(p.members)
+	if left == 0 {
+		delete(ps.m, id)
+	}
+	p.mu.Unlock()
+	ps.mu.Unlock()
+	if left != 0 {
+		p.broadcast(nil)
+	}
+}
+
+// servePartyPage serves the page of a watch party. The video is selected with
+// ?f=<file> when the party starts.
+func (s *server) servePartyPage(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	if !rePartyID.MatchString(id) {
+		http.Error(w, "Invalid party", 404)
+		return
+	}
+	s.serveHTML(w, partyHTML, map[string]any{"id": id, "files": s.libraryNames(userFrom(req))})
+}
+
+// checkSameOrigin rejects WebSocket connections from other sites.
+func checkSameOrigin(cfg *websocket.Config, req *http.Request) error {
+	o, err := url.Parse(req.Header.Get("Origin"))
+	if err != nil || o.Host != req.Host {
+		return errors.New("cross origin WebSocket")
+	}
+	cfg.Origin = o
+	return nil
+}
+
+// servePartyWS keeps the members of a party in sync: a member sends its state
+// when the user plays, pauses, seeks or changes the video and it is
+// broadcast to the others.
+func (s *server) servePartyWS(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	file := req.URL.Query().Get("f")
+	if !rePartyID.MatchString(id) || (file != "" && (!s.inLibrary(file) || !s.canAccess(req, file))) {
+		http.Error(w, "Invalid party", 404)
+		return
+	}
+	websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(c *websocket.Conn) {
+			// Remove the deadline set by the http.Server's ReadTimeout.
+			_ = c.SetReadDeadline(time.Time{})
+			m := newPartyMember(c)
+			done := make(chan struct{})
+			defer close(done)
+			go m.write(done)
+			p := s.parties.join(id, file, m)
+			defer s.parties.leave(id, p, m)
+			p.broadcast(nil)
+			for {
+				var st partyState
+				if err := websocket.JSON.Receive(c, &st); err != nil {
+					return
+				}
+				if st.File != "" && (!s.inLibrary(st.File) || !s.canAccess(req, st.File)) {
+					slog.Warn("party", "id", id, "msg", "unknown file", "f", st.File)
+					continue
+				}
+				p.mu.Lock()
+				p.state = st
+				p.updated = time.Now()
+				p.mu.Unlock()
+				p.broadcast(m)
+			}
+		},
+	}.ServeHTTP(w, req)
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// testPartyJoin joins the party as user, with the password "secret" if not
+// empty.
+func testPartyJoin(t testing.TB, base, user, query string) *websocket.Conn {
+	t.Helper()
+	return testWebSocket(t, base, "/party/p/ws"+query, user)
+}
+
+// TestParty joins a watch party twice and checks that a seek by one member is
+// received by the other.
+func TestParty(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	testPage(t, ts.URL+"/party/p?f=clip.mp4", "", "const data = ")
+	receive := func(c *websocket.Conn) partyState {
+		var st partyState
+		if err := websocket.JSON.Receive(c, &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	a := testPartyJoin(t, ts.URL, "", "?f=clip.mp4")
+	if st := receive(a); st.File != "clip.mp4" || st.Members != 1 {
+		t.Fatalf("unexpected state %+v", st)
+	}
+	b := testPartyJoin(t, ts.URL, "", "?f=clip.mp4")
+	receive(b)
+	// a is told that b joined.
+	if st := receive(a); st.Members != 2 {
+		t.Fatalf("unexpected state %+v", st)
+	}
+	if err := websocket.JSON.Send(a, &partyState{File: "clip.mp4", Time: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if st := receive(b); st.Time != 12 || st.Playing {
+		t.Fatalf("unexpected state %+v", st)
+	}
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/party/p/ws", "", "http://example.com"); err == nil {
+		t.Fatal("cross origin connection was accepted")
+	}
+}
+
+// TestPartyAccess checks that a party member can't play a file denied by
+// -access.
+func TestPartyAccess(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":         testMP4,
+		"private/clip.mp4": testMP4,
+	}, options{users: u, access: a})
+	if status, _ := testGet(t, ts.URL+"/party/p/ws?f=private/clip.mp4", "bob"); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+	alice := testPartyJoin(t, ts.URL, "alice", "?f=clip.mp4")
+	bob := testPartyJoin(t, ts.URL, "bob", "")
+	for _, st := range []partyState{{File: "private/clip.mp4"}, {File: "clip.mp4", Time: 12}} {
+		if err := websocket.JSON.Send(bob, &st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		var st partyState
+		if err := websocket.JSON.Receive(alice, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.File != "clip.mp4" {
+			t.Fatalf("unexpected state %+v", st)
+		}
+		if st.Time == 12 {
+			break
+		}
+	}
+}
+
+// TestPartyBroadcast checks that the latest state is sent to a member once,
+// replacing the states not sent yet.
+func TestPartyBroadcast(t *testing.T) {
+	m := newPartyMember(nil)
+	m.send(partyState{Time: 2}, 2)
+	m.send(partyState{Time: 1}, 1)
+	if m.next == nil || m.next.Time != 2 || len(m.wake) != 1 {
+		t.Fatalf("unexpected state %+v", m.next)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// validPath returns true if name, an unescaped slash separated path requested
+// by a client, is canonical and relative to root.
+//
+// The files are looked up in the list found by the scan so an invalid path
+// should not match anyway; this rejects the traversal attempts before they
+// reach anything else, like a peer or a mirror:
+//   - "." and ".." elements, empty elements and a leading slash;
+//   - backslashes, which are separators on Windows;
+//   - NUL and the control characters;
+//   - an escaped dot, slash, backslash or NUL left after unescaping, i.e. a
+//     traversal escaped twice. The other escapes are valid file names, e.g.
+//     "100%20.mp4";
+//   - invalid UTF-8.
+func validPath(name string) bool {
+	if name == "" || !utf8.ValidString(name) || strings.ContainsRune(name, '\\') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c == 0x7F {
+			return false
+		}
+		if name[i] == '%' && i+2 < len(name) {
+			switch strings.ToLower(name[i+1 : i+3]) {
+			case "00", "2e", "2f", "5c":
+				return false
+			}
+		}
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == "" || e == "." || e == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// mediaPath returns the path of the file name, a slash separated path
+// relative to root, to pass to ffmpeg or ffprobe. As they can't open it
+// through an os.Root, it fails if name or a symlink in it leads outside of
+// root, or for a playlist if one of its segments does.
+func mediaPath(root, name string) (string, error) {
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	rel := filepath.FromSlash(name)
+	if _, err = r.Stat(rel); err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(name, ".m3u8") {
+		if _, err = playlistSegments(r, name); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(root, rel), nil
+}
+
+// open opens the file name, a slash separated path relative to root. It fails
+// if name or a symlink in it leads outside of root, even if a directory was
+// replaced by a symlink since the scan.
+func (s *server) open(name string) (*os.File, error) {
+	return s.rootDir.Open(filepath.FromSlash(name))
+}
+
+// readFile reads the file name relative to root like open.
+func (s *server) readFile(name string) ([]byte, error) {
+	f, err := s.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validPaths are the paths requested by clients and whether they are valid.
+var validPaths = map[string]bool{
+	"clip.mp4":                true,
+	"sub dir/clip.mp4":        true,
+	"100% done.mp4":           true,
+	"percent%20.mp4":          true,
+	"été/clip.mp4":            true,
+	"..":                      false,
+	"../etc/passwd":           false,
+	"sub dir/../clip.mp4":     false,
+	"./clip.mp4":              false,
+	"/etc/passwd":             false,
+	"sub dir//clip.mp4":       false,
+	"sub dir/":                false,
+	"..\\..\\boot.ini":        false,
+	"clip.mp4\x00.txt":        false,
+	"%2e%2e/etc/passwd":       false,
+	"sub dir%2fclip.mp4":      false,
+	"clip\r\n.mp4":            false,
+	"\xc0\xae\xc0\xae/passwd": false,
+	"":                        false,
+}
+
+func TestValidPath(t *testing.T) {
+	for name, want := range validPaths {
+		if got := validPath(name); got != want {
+			t.Errorf("validPath(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+// TestRawPaths checks that the missing files and the traversal attempts
+// through /raw/ are refused.
+func TestRawPaths(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "sub dir/clip.mp4": testMP4}, options{})
+	for _, p := range []string{
+		"missing.mp4",
+		"..%2f..%2fetc%2fpasswd",
+		"%252e%252e/%252e%252e/etc/passwd",
+		"..%5c..%5cwindows%5cwin.ini",
+		"clip.mp4%00.txt",
+		"sub%20dir%2f..%2f..%2fmain.go",
+		"%c0%ae%c0%ae/etc/passwd",
+	} {
+		if status, _ := testGet(t, ts.URL+"/raw/"+p, ""); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d", p, status)
+		}
+	}
+}
+
+// FuzzValidPath checks that the accepted paths stay in root, even once
+// unescaped a second time.
+func FuzzValidPath(f *testing.F) {
+	for name := range validPaths {
+		f.Add(name)
+	}
+	for _, name := range []string{"%252e%252e/etc/passwd", "..%5c..%5cwindows%5cwin.ini", "a/%2E%2e/b", "a%00.mp4"} {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		if !validPath(name) {
+			return
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) || path.Clean(name) != name || strings.ContainsAny(name, "\\\x00") {
+			t.Fatalf("validPath(%q) accepted a path escaping root", name)
+		}
+		u, err := url.PathUnescape(name)
+		if err != nil {
+			return
+		}
+		if !filepath.IsLocal(filepath.FromSlash(u)) || path.Clean(u) != u || strings.ContainsAny(u, "\\\x00") {
+			t.Fatalf("validPath(%q) accepted a path escaping root once unescaped to %q", name, u)
+		}
+	})
+}
+
+// TestMediaPath checks that the files passed to ffmpeg can't be read outside
+// of root through a symlink.
+func TestMediaPath(t *testing.T) {
+	root, out := t.TempDir(), t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a.mp4":        testMP4,
+		"ok.m3u8":      "#EXTM3U\n#EXTINF:2.0,\na.mp4\n",
+		"escape.m3u8":  "#EXTM3U\n#EXTINF:2.0,\nlink.mp4\n",
+		"dotdot.m3u8":  "#EXTM3U\n#EXTINF:2.0,\n../x.mp4\n",
+		"sub/b.mp4":    testMP4,
+		"sub/in.m3u8":  "#EXTM3U\n#EXTINF:2.0,\nb.mp4\n",
+		"sub/up.m3u8":  "#EXTM3U\n#EXTINF:2.0,\n../a.mp4\n",
+		"sub/out.m3u8": "#EXTM3U\n#EXTINF:2.0,\n../../x.mp4\n",
+	})
+	writeTestFiles(t, out, map[string]string{"x.mp4": testMP4})
+	if err := os.Symlink(filepath.Join(out, "x.mp4"), filepath.Join(root, "link.mp4")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(out, filepath.Join(root, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"a.mp4":         true,
+		"ok.m3u8":       true,
+		"sub/in.m3u8":   true,
+		"sub/up.m3u8":   true,
+		"link.mp4":      false,
+		"linkdir/x.mp4": false,
+		"escape.m3u8":   false,
+		"dotdot.m3u8":   false,
+		"sub/out.m3u8":  false,
+	} {
+		p, err := mediaPath(root, name)
+		if (err == nil) != want {
+			t.Errorf("mediaPath(%q) = %q, %v", name, p, err)
+		} else if want && p != filepath.Join(root, filepath.FromSlash(name)) {
+			t.Errorf("mediaPath(%q) = %q", name, p)
+		}
+	}
+}
+
+// TestSymlinks checks that the symlinks inside the root are served and the ones
+// escaping it aren't, as files or as artwork.
+func TestSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	writeTestFiles(t, dir, map[string]string{"root/real.mp4": "inside", "secret.mp4": "outside"})
+	if err := os.Symlink("real.mp4", filepath.Join(root, "inside.mp4")); err != nil {
+		// Creating symlinks requires a privilege on Windows.
+		t.Skip(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "secret.mp4"), filepath.Join(root, "escape.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	// The art of inside.mp4.
+	if err := os.Symlink(filepath.Join("..", "secret.mp4"), filepath.Join(root, "inside.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := newServer(t.Context(), root, defaultExts, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.handler())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.rootDir.Close()
+	})
+	if !srv.hasFile("escape.mp4") {
+		t.Fatal("the symlink was not scanned")
+	}
+	if status, b := testGet(t, ts.URL+"/raw/inside.mp4", ""); status != http.StatusOK || b != "inside" {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+	for _, p := range []string{"/art/inside.mp4", "/raw/escape.mp4"} {
+		if status, b := testGet(t, ts.URL+p, ""); status != http.StatusNotFound {
+			t.Fatalf("%s: got status %d: %q", p, status, b)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peer is another serve-videos instance whose library is merged in this one,
+// under "@<name>/".
+type peer struct {
+	name string
+	url  *url.URL
+
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+// parsePeers parses -peer flags in the form "<name>=<url>".
+func parsePeers(args []string) ([]*peer, error) {
+	var out []*peer
+	seen := map[string]bool{}
+	for _, a := range args {
+		name, u, ok := strings.Cut(a, "=")
+		if !ok || name == "" || strings.ContainsAny(name, "/@") || seen[name] {
+			return nil, fmt.Errorf("-peer %q must be in the form <name>=<url> with a unique name", a)
+		}
+		pu, err := url.Parse(strings.TrimSuffix(u, "/"))
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return nil, fmt.Errorf("-peer %q: invalid URL", a)
+		}
+		seen[name] = true
+		out = append(out, &peer{name: name, url: pu, files: map[string]bool{}})
+	}
+	return out, nil
+}
+
+// prefix is the namespace of the peer's files in the merged library.
+func (p *peer) prefix() string {
+	return "@" + p.name + "/"
+}
+
+// refresh fetches the list of files of the peer.
+func (p *peer) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", p.url.String()+"/api/files", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	var data struct {
+		Files []struct {
+			Name string `json:"name"`
+		} `json:"files"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return err
+	}
+	files := make(map[string]bool, len(data.Files))
+	for _, f := range data.Files {
+		files[f.Name] = true
+	}
+	p.mu.Lock()
+	p.files = files
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *peer) hasFile(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.files[name]
+}
+
+// names returns the peer's files in the merged namespace.
+func (p *peer) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]string, 0, len(p.files))
+	for n := range p.files {
+		out = append(out, p.prefix()+n)
+	}
+	return out
+}
+
+// runPeers refreshes the peers' files every minute until ctx is canceled.
+func (s *server) runPeers(ctx context.Context) {
+	for {
+		for _, p := range s.peers {
+			if err := p.refresh(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("peer", "name", p.name, "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// findPeer returns the peer owning the file name in the merged namespace and
+// the name on the peer.
+func (s *server) findPeer(name string) (*peer, string) {
+	for _, p := range s.peers {
+		if rest, ok := strings.CutPrefix(name, p.prefix()); ok && p.hasFile(rest) {
+			return p, rest
+		}
+	}
+	return nil, ""
+}
+
+// libraryNames returns the local files, the mirrored files not cached yet and
+// the peers' files the user can see.
+func (s *server) libraryNames(user string) []string {
+	// The renditions of the ladders are played through their master playlist.
+	names := slices.DeleteFunc(s.getNames(), isLadderRendition)
+	if s.mirror != nil {
+		var remote []string
+		for _, n := range s.mirror.names() {
+			if !s.hasFile(n) {
+				remote = append(remote, n)
+			}
+		}
+		names = append(names, remote...)
+		sort.Strings(names)
+	}
+	for _, p := range s.peers {
+		n := p.names()
+		sort.Strings(n)
+		names = append(names, n...)
+	}
+	return s.opts.access.filter(user, names)
+}
+
+// inLibrary returns true if the name is a local, mirrored or peer file.
+func (s *server) inLibrary(name string) bool {
+	if s.hasFile(name) || (s.mirror != nil && s.mirror.hasFile(name)) {
+		return true
+	}
+	p, _ := s.findPeer(name)
+	return p != nil
+}
+
+// servePeerFile redirects to the peer owning the file, or proxies the request
+// with -peer-proxy, e.g. when the peer is not reachable by the clients. The
+// credentials of the peer URL are never sent to the clients.
+func (s *server) servePeerFile(w http.ResponseWriter, req *http.Request, p *peer, name string) {
+	if !s.opts.peerProxy {
+		u := *p.url
+		u.User = nil
+		u.Path += "/raw/" + name
+		u.RawPath = p.url.EscapedPath() + rawURL(name)
+		u.RawQuery = req.URL.RawQuery
+		http.Redirect(w, req, u.String(), http.StatusFound)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(p.url)
+			r.Out.URL.Path = p.url.Path + "/raw/" + name
+			r.Out.URL.RawPath = p.url.EscapedPath() + rawURL(name)
+			proxyAuth(r, p.url)
+		},
+	}
+	rp.ServeHTTP(w, req)
+}
+
+// proxyAuth replaces the credentials of the client with the ones of u, if
+// any, in a proxied request.
+func proxyAuth(r *httputil.ProxyRequest, u *url.URL) {
+	r.Out.Header.Del("Authorization")
+	r.Out.Header.Del("Cookie")
+	r.Out.URL.User = nil
+	if u.User != nil {
+		pw, _ := u.User.Password()
+		r.Out.SetBasicAuth(u.User.Username(), pw)
+	}
+}
+
+// fileFilter selects the local files.
+type fileFilter struct {
+	// dir is a directory the files must be in.
+	dir string
+	// query are words that must all be in the name or the title, ignoring
+	// the case.
+	query string
+	// tags must all be set on the files.
+	tags      []string
+	minRating int
+}
+
+// findFiles returns the local files selected by ff, with the tags, the rating
+// of the user and the view counters.
+func (s *server) findFiles(user string, ff fileFilter) []fileInfo {
+	dir := strings.Trim(ff.dir, "/")
+	words := strings.Fields(strings.ToLower(ff.query))
+	var titles map[string]string
+	if len(words) != 0 {
+		titles = s.titles()
+	}
+	all := s.tags.all()
+	counts := s.views.all()
+	ratings := s.profiles.get(user).Ratings
+	out := []fileInfo{}
+	for _, f := range s.getFiles() {
+		t := all[f.Name]
+		if !s.opts.access.allowed(user, f.Name) || !containsAll(t, ff.tags) || ratings[f.Name] < ff.minRating {
+			continue
+		}
+		if dir != "" && !strings.HasPrefix(f.Name, dir+"/") {
+			continue
+		}
+		if len(words) != 0 && !matchesAll(strings.ToLower(f.Name+" "+titles[f.Name]), words) {
+			continue
+		}
+		out = append(out, fileInfo{Name: f.Name, Size: f.Size, ModTime: f.ModTime, Tags: t, Rating: ratings[f.Name], Streams: s.media.cachedProbe(f).mediaStreams(), viewCount: counts[f.Name]})
+	}
+	return out
+}
+
+// matchesAll returns true if s contains all the words.
+func matchesAll(s string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileInfo is a file as listed by /api/files.
+type fileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Tags    []string  `json:"tags,omitempty"`
+	// Rating is the user's rating.
+	Rating int `json:"rating,omitempty"`
+	// Group is the section of the file with ?group=.
+	Group string `json:"group,omitempty"`
+	// Streams are the video, audio and subtitle streams, once the file is
+	// probed.
+	Streams []mediaStream `json:"streams,omitempty"`
+	viewCount
+}
+
+// serveFilesAPI lists the local files. It is used by the peers and the client
+// command. The files can be filtered with ?dir=<dir>, with ?q=<words> where
+// each word must be in the name or the title, with ?tag=<tag>, each one being
+// required, and with ?min_rating=<stars>. ?sort=rating sorts by the user's
+// rating. ?group=<mode>, one of groupModes, sets the section of each file and
+// sorts by section.
+func (s *server) serveFilesAPI(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	group := q.Get("group")
+	if group != "" && !slices.Contains(groupModes, group) {
+		http.Error(w, "group must be one of "+strings.Join(groupModes, ", "), http.StatusBadRequest)
+		return
+	}
+	var meta map[string]*sidecar
+	if group == "show" {
+		meta = s.sidecars()
+	}
+	minRating, _ := strconv.Atoi(q.Get("min_rating"))
+	out := s.findFiles(userFrom(req), fileFilter{dir: q.Get("dir"), query: q.Get("q"), tags: q["tag"], minRating: minRating})
+	if group != "" {
+		for i := range out {
+			out[i].Group = groupOf(group, out[i].Name, out[i].ModTime, meta[out[i].Name])
+		}
+	}
+	if q.Get("sort") == "rating" {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Rating > out[j].Rating })
+	}
+	if group != "" {
+		slices.SortStableFunc(out, func(a, b fileInfo) int { return compareGroups(group, a.Group, b.Group) })
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"files": out})
+}
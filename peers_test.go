@@ -0,0 +1,49 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestPeer lists and serves the files of a peer, by redirecting to it or by
+// proxying it, without leaking its credentials.
+func TestPeer(t *testing.T) {
+	_, src := newTestServer(t, map[string]string{"sub dir/clip.mp4": testMP4}, options{})
+	peers, err := parsePeers([]string{"self=" + strings.Replace(src.URL, "://", "://peer:hunter2@", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peers[0].refresh(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	srv, ts := newTestServer(t, nil, options{peers: peers})
+	testPage(t, ts.URL+"/", "", `"@self/sub dir/clip.mp4"`)
+	testPage(t, ts.URL+watchURL("@self/sub dir/clip.mp4"), "", "const data = ")
+	u := ts.URL + rawURL("@self/sub dir/clip.mp4")
+	req, err := http.NewRequestWithContext(t.Context(), "GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || strings.Contains(loc, "hunter2") {
+		t.Fatalf("unexpected redirect %d %q", resp.StatusCode, loc)
+	}
+	// The client follows the redirect.
+	if status, b := testGet(t, u, ""); status != http.StatusOK || b != testMP4 {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+	srv.opts.peerProxy = true
+	if status, b := testGet(t, u, ""); status != http.StatusOK || b != testMP4 {
+		t.Fatalf("proxied: got status %d: %q", status, b)
+	}
+}
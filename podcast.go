@@ -0,0 +1,110 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	GUID      string       `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+	Duration  string       `xml:"itunes:duration,omitempty"`
+	Image     *rssImage    `xml:"itunes:image"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Image       *rssImage `xml:"itunes:image"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// servePodcast serves a podcast RSS feed of the files directly in a
+// directory, newest first.
+func (s *server) servePodcast(w http.ResponseWriter, req *http.Request) {
+	dir := strings.Trim(req.PathValue("dir"), "/")
+	if dir == "" {
+		dir = "."
+	}
+	var files []file
+	for _, f := range s.visibleFiles(req) {
+		if path.Dir(f.Name) == dir && !isImage(f.Name) {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	files = recentFiles(files, len(files))
+	base := baseURL(req)
+	title := dir
+	if dir == "." {
+		title = "Videos"
+	}
+	feed := rssFeed{
+		Version: "2.0",
+		ITunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        base + "/",
+			Description: "Videos in " + dir,
+		},
+	}
+	for _, f := range files {
+		u := base + rawURL(f.Name)
+		item := rssItem{
+			Title:     path.Base(f.Name),
+			GUID:      u,
+			PubDate:   f.ModTime.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{URL: base + s.linkURL(f.Name), Length: f.Size, Type: mimeType(f.Name)},
+		}
+		if p, err := s.media.probe(req.Context(), s.root, f); err == nil {
+			if d := p.Duration(); d > 0 {
+				item.Duration = fmt.Sprintf("%d", int64(d.Seconds()))
+			}
+		}
+		if s.media.ffmpeg != "" {
+			item.Image = &rssImage{Href: base + s.media.thumbURL(f)}
+			if feed.Channel.Image == nil {
+				feed.Channel.Image = item.Image
+			}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	e := xml.NewEncoder(w)
+	e.Indent("", " ")
+	_ = e.Encode(&feed)
+}
@@ -0,0 +1,29 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+)
+
+func TestPodcast(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"sub dir/clip.mp4": testMP4,
+		"sub dir/snap.jpg": "\xFF\xD8\xFF\xE0",
+		"other.mp4":        testMP4,
+	}, options{})
+	var f rssFeed
+	if err := xml.Unmarshal([]byte(testPage(t, ts.URL+"/podcast/sub%20dir", "", "<enclosure ")), &f); err != nil {
+		t.Fatal(err)
+	}
+	if items := f.Channel.Items; len(items) != 1 || items[0].Title != "clip.mp4" || items[0].Enclosure.Type != "video/mp4" {
+		t.Fatalf("unexpected items %+v", items)
+	}
+	if status, _ := testGet(t, ts.URL+"/podcast/missing", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strconv"
+)
+
+// ffmpegLimits bound the resources used by the ffmpeg and ffprobe processes,
+// so the thumbnails, probes and transcodes never starve the streams on a
+// small box. The RTSP recordings are not limited.
+type ffmpegLimits struct {
+	// max is how many processes run concurrently, unlimited when 0.
+	max int
+	// nice is the niceness of the processes and ionice their I/O scheduling
+	// class, "idle" or "best-effort", unchanged when empty.
+	nice   int
+	ionice string
+	// threads is how many threads each encoder uses, chosen by ffmpeg when 0.
+	threads int
+	// hwaccel is the hardware decoder used, e.g. "vaapi" or "auto".
+	hwaccel string
+}
+
+// setLimits applies l to the processes started afterward.
+func (m *media) setLimits(l ffmpegLimits) {
+	m.limits = l
+	if l.max > 0 {
+		m.slots = make(chan struct{}, l.max)
+	}
+}
+
+// decodeArgs returns the arguments to put before the input of ffmpeg. hwaccel
+// overrides -ffmpeg-hwaccel when not empty.
+func (m *media) decodeArgs(hwaccel string) []string {
+	if hwaccel = cmp.Or(hwaccel, m.limits.hwaccel); hwaccel == "" {
+		return nil
+	}
+	return []string{"-hwaccel", hwaccel}
+}
+
+// encodeArgs returns the arguments to put before the output of ffmpeg when
+// encoding.
+func (m *media) encodeArgs() []string {
+	if m.limits.threads == 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(m.limits.threads)}
+}
+
+// idleKey marks the contexts of the processes run only when the server is
+// idle; see withIdlePriority.
+type idleKey struct{}
+
+// withIdlePriority returns a context whose processes run at the lowest CPU
+// and I/O priority, whatever the limits.
+func withIdlePriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idleKey{}, true)
+}
+
+// run runs cmd once fewer than -ffmpeg-max processes are running, with the
+// niceness and I/O priority of the limits.
+func (m *media) run(ctx context.Context, cmd *exec.Cmd) error {
+	if m.slots != nil {
+		select {
+		case m.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-m.slots }()
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	nice, ionice := m.limits.nice, m.limits.ionice
+	if ctx.Value(idleKey{}) != nil {
+		nice, ionice = 19, "idle"
+	}
+	if nice != 0 || ionice != "" {
+		// The priority is best effort with withIdlePriority on the OSes
+		// where it's not supported.
+		if err := setPriority(cmd.Process.Pid, nice, ionice); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			slog.Warn("ffmpeg", "msg", "failed to lower the priority", "error", err)
+		}
+	}
+	return cmd.Wait()
+}
+
+// output is like cmd.Output() but runs cmd with run.
+func (m *media) output(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := m.run(ctx, cmd)
+	return stdout.Bytes(), err
+}
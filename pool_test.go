@@ -0,0 +1,37 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLimits checks that the processes wait for a slot.
+func TestLimits(t *testing.T) {
+	ctx := t.Context()
+	m := &media{}
+	m.setLimits(ffmpegLimits{max: 1, threads: 2, hwaccel: "auto"})
+	if got := strings.Join(append(m.decodeArgs(""), m.encodeArgs()...), " "); got != "-hwaccel auto -threads 2" {
+		t.Fatalf("got args %q", got)
+	}
+	m.slots <- struct{}{}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := m.run(tctx, exec.Command("serve-videos-missing")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want to wait for the slot", err)
+	}
+	<-m.slots
+	if err := m.run(ctx, exec.Command("serve-videos-missing")); !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("got %v, want %v", err, exec.ErrNotFound)
+	}
+	if len(m.slots) != 0 {
+		t.Fatal("the slot was not released")
+	}
+}
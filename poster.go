@@ -0,0 +1,209 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultThumbTime skips the first second, it's frequently black.
+const defaultThumbTime = time.Second
+
+// thumbTimeRule is the time of the thumbnails of the files matching a glob.
+type thumbTimeRule struct {
+	pattern string
+	at      time.Duration
+}
+
+// thumbTimes is the -thumb-time flag. The first matching glob wins, the rule
+// without a glob is applied last.
+type thumbTimes []thumbTimeRule
+
+func (t *thumbTimes) String() string {
+	var out []string
+	for _, r := range *t {
+		if r.pattern == "" {
+			out = append(out, r.at.String())
+		} else {
+			out = append(out, r.pattern+"="+r.at.String())
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// Set parses "<duration>" or "<glob>=<duration>".
+func (t *thumbTimes) Set(v string) error {
+	pattern, value, ok := strings.Cut(v, "=")
+	if !ok {
+		pattern, value = "", v
+	} else if pattern == "" {
+		return fmt.Errorf("-thumb-time %q must be in the form <duration> or <glob>=<duration>", v)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("-thumb-time %q: %w", v, err)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("-thumb-time %q: invalid duration", v)
+	}
+	*t = append(*t, thumbTimeRule{pattern: pattern, at: d})
+	return nil
+}
+
+// lookup returns the time of the thumbnail of the file name. The glob is
+// matched against the base name, the whole path and its directories.
+func (t thumbTimes) lookup(name string) (time.Duration, bool) {
+	for _, r := range t {
+		if r.pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(r.pattern, path.Base(name)); ok {
+			return r.at, true
+		}
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(strings.Trim(r.pattern, "/"), p); ok {
+				return r.at, true
+			}
+		}
+	}
+	for _, r := range t {
+		if r.pattern == "" {
+			return r.at, true
+		}
+	}
+	return 0, false
+}
+
+// posters are the times of the frames picked from the watch page as the
+// thumbnails of the files, e.g. when the first seconds of a camera's
+// recordings are always black.
+//
+// They are saved to p when not empty.
+type posters struct {
+	p string
+
+	mu sync.Mutex
+	// times are in seconds.
+	times map[string]float64
+	dirty bool
+}
+
+// newPosters loads the posters saved in p, if any.
+func newPosters(p string) (*posters, error) {
+	ps := &posters{p: p, times: map[string]float64{}}
+	if err := readJSON(p, &ps.times); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// get returns the time of the poster of the file, if one was picked.
+func (ps *posters) get(name string) (time.Duration, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	t, ok := ps.times[name]
+	return time.Duration(t * float64(time.Second)), ok
+}
+
+// set picks the frame at t seconds as the poster of the file.
+func (ps *posters) set(name string, t float64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.times[name] = t
+	ps.dirty = true
+}
+
+// remove reverts the file to the thumbnail time of -thumb-time.
+func (ps *posters) remove(name string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.times[name]; !ok {
+		return false
+	}
+	delete(ps.times, name)
+	ps.dirty = true
+	return true
+}
+
+// save writes the posters to disk if they changed.
+func (ps *posters) save() error {
+	ps.mu.Lock()
+	if ps.p == "" || !ps.dirty {
+		ps.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(ps.times)
+	ps.dirty = false
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ps.p, b)
+}
+
+// thumbTime returns the time of the frame used as the thumbnail of the file
+// if set: the poster picked from the watch page, else -thumb-time. Otherwise
+// it is picked by posterTime. The photos have a single frame.
+func (m *media) thumbTime(name string) (time.Duration, bool) {
+	if !hasDuration(name) {
+		return 0, false
+	}
+	if m.posters != nil {
+		if d, ok := m.posters.get(name); ok {
+			return d, true
+		}
+	}
+	return m.thumbTimes.lookup(name)
+}
+
+// thumbVersion identifies the thumbnail of f. It changes when the file or the
+// time of the thumbnail does.
+func (m *media) thumbVersion(f file) string {
+	v := fingerprint(f)
+	if at, ok := m.thumbTime(f.Name); ok {
+		v += "-" + strconv.FormatInt(at.Milliseconds(), 36)
+	}
+	return v
+}
+
+// thumbURL returns the escaped URL path of the thumbnail of a file. It is
+// versioned so it can be cached forever.
+func (m *media) thumbURL(f file) string {
+	return "/thumb/" + escapePath(f.Name) + "?v=" + m.thumbVersion(f)
+}
+
+// servePoster picks the frame at ?t=<seconds> as the thumbnail of a video,
+// or reverts to -thumb-time with DELETE. It returns the new thumbnail URL.
+func (s *server) servePoster(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) || !hasDuration(f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	if req.Method == http.MethodDelete {
+		if !s.media.posters.remove(f.Name) {
+			http.Error(w, "No poster", 404)
+			return
+		}
+	} else {
+		t, err := strconv.ParseFloat(req.FormValue("t"), 64)
+		if err != nil || t < 0 || math.IsInf(t, 0) || math.IsNaN(t) {
+			http.Error(w, "Invalid time", 400)
+			return
+		}
+		// Millisecond precision, as in the thumbnail version.
+		s.media.posters.set(f.Name, math.Round(t*1000)/1000)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"thumbnail": s.media.thumbURL(f)})
+}
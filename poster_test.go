@@ -0,0 +1,79 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestThumbTimes checks the -thumb-time rules.
+func TestThumbTimes(t *testing.T) {
+	var tt thumbTimes
+	for _, v := range []string{"cam1=5s", "3s", "*.mkv=10s"} {
+		if err := tt.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"=1s", "cam1=soon", "-1s", "[=1s"} {
+		if err := tt.Set(v); err == nil {
+			t.Fatalf("%q: expected an error", v)
+		}
+	}
+	for name, want := range map[string]time.Duration{
+		"cam1/2024/a.mp4": 5 * time.Second,
+		"cam1/b.mkv":      5 * time.Second,
+		"cam2/b.mkv":      10 * time.Second,
+		"cam2/c.mp4":      3 * time.Second,
+	} {
+		if got, ok := tt.lookup(name); !ok || got != want {
+			t.Fatalf("%s: got %s, want %s", name, got, want)
+		}
+	}
+	m := newMedia()
+	if got, ok := m.thumbTime("a.mp4"); ok {
+		t.Fatalf("got %s", got)
+	}
+	m.thumbTimes = tt
+	if got, ok := m.thumbTime("photos/a.jpg"); ok {
+		t.Fatalf("photo: got %s", got)
+	}
+}
+
+// TestPosterAPI picks a frame as the thumbnail of a video and reverts it.
+func TestPosterAPI(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{dataDir: t.TempDir()})
+	f, ok := srv.getFile("clip.mp4")
+	if !ok {
+		t.Fatal("clip.mp4 not found")
+	}
+	u := ts.URL + "/api/poster/clip.mp4"
+	testPost(t, u+"?t=-1", "", http.StatusBadRequest)
+	for _, c := range []struct {
+		method, u, want string
+	}{
+		{"POST", u + "?t=2.5", "/thumb/clip.mp4?v=" + fingerprint(f) + "-1xg"},
+		{"DELETE", u, "/thumb/clip.mp4?v=" + fingerprint(f)},
+	} {
+		resp, b := testDo(t, c.method, c.u, "", "", nil)
+		var out struct {
+			Thumbnail string `json:"thumbnail"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", c.method, resp.StatusCode, b)
+		}
+		if err := json.Unmarshal([]byte(b), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Thumbnail != c.want {
+			t.Fatalf("%s: got %q, want %q", c.method, out.Thumbnail, c.want)
+		}
+	}
+	if resp, _ := testDo(t, "DELETE", u, "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// idleWait is how long the pre-generation waits for the server to be idle
+// before checking again.
+const idleWait = 30 * time.Second
+
+// isIdle returns true when no file is streamed and no ffmpeg or ffprobe
+// process runs.
+func (s *server) isIdle() bool {
+	return len(s.streams.list()) == 0 && len(s.media.runningJobs()) == 0
+}
+
+// missingThumbs returns the videos whose thumbnail is not saved yet.
+func (s *server) missingThumbs() []file {
+	var out []file
+	for _, f := range s.getFiles() {
+		if !isVideoFile(f.Name) || isLadderRendition(f.Name) {
+			continue
+		}
+		if _, err := os.Stat(s.media.thumbPath(f)); err != nil {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// runPregenerate generates the missing thumbnails one at a time when the
+// server is idle, at the lowest priority, so the grid shows them at once. It
+// goes through the library at startup, then through the new files, until ctx
+// is canceled.
+func (s *server) runPregenerate(ctx context.Context) {
+	// The files that failed, e.g. corrupted, are not retried until modified.
+	failed := map[file]bool{}
+	for {
+		files := slices.DeleteFunc(s.missingThumbs(), func(f file) bool { return failed[f] })
+		if len(files) != 0 {
+			slog.Info("pregenerate", "missing", len(files))
+		}
+		done := 0
+		for _, f := range files {
+			for !s.isIdle() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(idleWait):
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// The file may have been deleted or modified since.
+			if cur, ok := s.getFile(f.Name); !ok || cur != f {
+				continue
+			}
+			if _, err := s.media.thumbnail(withIdlePriority(ctx), s.root, f); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("pregenerate", "f", f.Name, "error", err)
+				failed[f] = true
+				continue
+			}
+			done++
+		}
+		if done != 0 {
+			slog.Info("pregenerate", "generated", done)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.pregenerate:
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestMissingThumbs checks that only the videos without a saved thumbnail
+// are pregenerated.
+func TestMissingThumbs(t *testing.T) {
+	srv, _ := newTestServer(t, map[string]string{
+		"clip.mp4":        testMP4,
+		"done.mp4":        testMP4,
+		"clip.abr/0.mp4":  testMP4,
+		"music/song.mp3":  "ID3\x04\x00\x00\x00\x00\x00\x00",
+		"photos/snap.jpg": "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00",
+	}, options{dataDir: t.TempDir()})
+	f, ok := srv.getFile("done.mp4")
+	if !ok {
+		t.Fatal("done.mp4 not found")
+	}
+	p := srv.media.thumbPath(f)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("\xFF\xD8\xFF\xD9"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range srv.missingThumbs() {
+		names = append(names, m.Name)
+	}
+	if !slices.Equal(names, []string{"clip.mp4"}) {
+		t.Fatalf("got %q", names)
+	}
+	if !srv.isIdle() {
+		t.Fatal("expected idle")
+	}
+}
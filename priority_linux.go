@@ -0,0 +1,40 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) constants.
+const (
+	ioprioWhoProcess      = 1
+	ioprioClassShift      = 13
+	ioprioClassBestEffort = 2
+	ioprioClassIdle       = 3
+)
+
+// setPriority sets the niceness and the I/O scheduling class of the process
+// pid. The best-effort class uses its lowest priority.
+func setPriority(pid, nice int, ionice string) error {
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, nice); err != nil {
+			return err
+		}
+	}
+	prio := 0
+	switch ionice {
+	case "idle":
+		prio = ioprioClassIdle << ioprioClassShift
+	case "best-effort":
+		prio = ioprioClassBestEffort<<ioprioClassShift | 7
+	default:
+		return nil
+	}
+	if _, _, e := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(pid), uintptr(prio)); e != 0 {
+		return e
+	}
+	return nil
+}
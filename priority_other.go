@@ -0,0 +1,14 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setPriority is only implemented on linux.
+func setPriority(pid, nice int, ionice string) error {
+	return errors.ErrUnsupported
+}
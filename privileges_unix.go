@@ -0,0 +1,59 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges switches to the user and group of spec, "<user>[:<group>]".
+// The group defaults to the primary group of the user. It's done after
+// listening so a port below 1024 can be used.
+func dropPrivileges(spec string) error {
+	name, group, _ := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	// The group must be changed first, while still allowed to.
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return err
+	}
+	if syscall.Setuid(0) == nil {
+		return errors.New("could still switch back to root")
+	}
+	slog.Info("privileges", "user", u.Username, "uid", uid, "gid", gid)
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "errors"
+
+func dropPrivileges(spec string) error {
+	return errors.New("-run-as is not supported on Windows")
+}
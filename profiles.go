@@ -0,0 +1,293 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxHistory is the number of files kept in the history of a profile.
+const maxHistory = 1000
+
+// historyEntry is a file opened by a user.
+type historyEntry struct {
+	File string    `json:"file"`
+	Time time.Time `json:"time"`
+}
+
+// playerPrefs are the player settings chosen by a user. The settings not
+// chosen are nil and use the defaults of the command line.
+type playerPrefs struct {
+	// Volume is from 0 to 1.
+	Volume   *float64 `json:"volume,omitempty"`
+	Muted    *bool    `json:"muted,omitempty"`
+	Speed    *float64 `json:"speed,omitempty"`
+	Autoplay *bool    `json:"autoplay,omitempty"`
+	PiP      *bool    `json:"pip,omitempty"`
+}
+
+// profile is the playback state of a user.
+type profile struct {
+	// Positions are the resume positions in seconds.
+	Positions map[string]float64 `json:"positions"`
+	Watched   map[string]bool    `json:"watched"`
+	Favorites map[string]bool    `json:"favorites"`
+	// Ratings are from 1 to 5 stars.
+	Ratings map[string]int `json:"ratings"`
+	// History is the files opened, most recent first.
+	History []historyEntry `json:"history"`
+	Player  playerPrefs    `json:"player"`
+	// State are the values synced across the user's devices with /api/sync,
+	// e.g. the queue.
+	State map[string]syncEntry `json:"state"`
+	// Bookmarks are the named positions in the files, sorted by time.
+	Bookmarks map[string][]bookmark `json:"bookmarks"`
+}
+
+func newProfile() *profile {
+	pr := &profile{}
+	pr.init()
+	return pr
+}
+
+// init initializes the fields missing, e.g. from a file saved by an older
+// version.
+func (pr *profile) init() {
+	if pr.Positions == nil {
+		pr.Positions = map[string]float64{}
+	}
+	if pr.Watched == nil {
+		pr.Watched = map[string]bool{}
+	}
+	if pr.Favorites == nil {
+		pr.Favorites = map[string]bool{}
+	}
+	if pr.Ratings == nil {
+		pr.Ratings = map[string]int{}
+	}
+	if pr.History == nil {
+		pr.History = []historyEntry{}
+	}
+	if pr.State == nil {
+		pr.State = map[string]syncEntry{}
+	}
+	if pr.Bookmarks == nil {
+		pr.Bookmarks = map[string][]bookmark{}
+	}
+}
+
+// profiles are the users' profiles by user name. The user is "" when -user
+// is not used.
+//
+// They are saved to p when not empty.
+type profiles struct {
+	p string
+
+	mu    sync.Mutex
+	users map[string]*profile
+	dirty bool
+}
+
+// newProfiles loads the profiles saved in p, if any.
+func newProfiles(p string) (*profiles, error) {
+	ps := &profiles{p: p, users: map[string]*profile{}}
+	if err := readJSON(p, &ps.users); err != nil {
+		return nil, err
+	}
+	for _, pr := range ps.users {
+		pr.init()
+	}
+	return ps, nil
+}
+
+// get returns a copy of the profile of the user.
+func (ps *profiles) get(user string) profile {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pr := ps.users[user]
+	if pr == nil {
+		return *newProfile()
+	}
+	// The bookmarks are modified in place.
+	bookmarks := make(map[string][]bookmark, len(pr.Bookmarks))
+	for f, v := range pr.Bookmarks {
+		bookmarks[f] = slices.Clone(v)
+	}
+	return profile{
+		Positions: maps.Clone(pr.Positions),
+		Watched:   maps.Clone(pr.Watched),
+		Favorites: maps.Clone(pr.Favorites),
+		Ratings:   maps.Clone(pr.Ratings),
+		History:   append([]historyEntry{}, pr.History...),
+		Player:    pr.Player,
+		State:     maps.Clone(pr.State),
+		Bookmarks: bookmarks,
+	}
+}
+
+// update modifies the profile of the user.
+func (ps *profiles) update(user string, f func(pr *profile)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pr := ps.users[user]
+	if pr == nil {
+		pr = newProfile()
+		ps.users[user] = pr
+	}
+	f(pr)
+	ps.dirty = true
+}
+
+// save writes the profiles to disk if they changed.
+func (ps *profiles) save() error {
+	ps.mu.Lock()
+	if ps.p == "" || !ps.dirty {
+		ps.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(ps.users)
+	ps.dirty = false
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ps.p, b)
+}
+
+// serveProfileAPI returns the profile of the authenticated user.
+func (s *server) serveProfileAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"user": userFrom(req), "role": s.roleOf(req).String(), "profile": s.profiles.get(userFrom(req))})
+}
+
+// serveProfilePlayer saves the player settings of the authenticated user
+// present in the form: volume, muted, speed, autoplay and pip.
+func (s *server) serveProfilePlayer(w http.ResponseWriter, req *http.Request) {
+	var p playerPrefs
+	if v := req.FormValue("volume"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			http.Error(w, "Invalid volume", 400)
+			return
+		}
+		p.Volume = &f
+	}
+	if v := req.FormValue("speed"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0.5 || f > 4 {
+			http.Error(w, "Invalid speed", 400)
+			return
+		}
+		p.Speed = &f
+	}
+	for k, dst := range map[string]**bool{"muted": &p.Muted, "autoplay": &p.Autoplay, "pip": &p.PiP} {
+		if v := req.FormValue(k); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid "+k, 400)
+				return
+			}
+			*dst = &b
+		}
+	}
+	s.profiles.update(userFrom(req), func(pr *profile) {
+		if p.Volume != nil {
+			pr.Player.Volume = p.Volume
+		}
+		if p.Muted != nil {
+			pr.Player.Muted = p.Muted
+		}
+		if p.Speed != nil {
+			pr.Player.Speed = p.Speed
+		}
+		if p.Autoplay != nil {
+			pr.Player.Autoplay = p.Autoplay
+		}
+		if p.PiP != nil {
+			pr.Player.PiP = p.PiP
+		}
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveProfileUpdate modifies the profile of the authenticated user for a
+// file: POST position?t=<s>, watched, favorite, rating?stars=<1-5> or history
+// and DELETE position, watched, favorite, rating or history.
+func (s *server) serveProfileUpdate(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	del := req.Method == http.MethodDelete
+	var update func(pr *profile)
+	switch kind := req.PathValue("kind"); {
+	case kind == "position" && del:
+		update = func(pr *profile) { delete(pr.Positions, f) }
+	case kind == "position":
+		t, err := strconv.ParseFloat(req.FormValue("t"), 64)
+		if err != nil || t < 0 {
+			http.Error(w, "Invalid t", 400)
+			return
+		}
+		update = func(pr *profile) { pr.Positions[f] = t }
+	case kind == "watched":
+		update = func(pr *profile) {
+			if del {
+				delete(pr.Watched, f)
+			} else {
+				pr.Watched[f] = true
+			}
+		}
+	case kind == "favorite":
+		update = func(pr *profile) {
+			if del {
+				delete(pr.Favorites, f)
+			} else {
+				pr.Favorites[f] = true
+			}
+		}
+	case kind == "rating" && del:
+		update = func(pr *profile) { delete(pr.Ratings, f) }
+	case kind == "rating":
+		stars, err := strconv.Atoi(req.FormValue("stars"))
+		if err != nil || stars < 1 || stars > 5 {
+			http.Error(w, "Invalid stars", 400)
+			return
+		}
+		update = func(pr *profile) { pr.Ratings[f] = stars }
+	case kind == "history" && del:
+		update = func(pr *profile) {
+			pr.History = slices.DeleteFunc(pr.History, func(e historyEntry) bool { return e.File == f })
+		}
+	case kind == "history":
+		update = func(pr *profile) {
+			for i := range pr.History {
+				if pr.History[i].File == f {
+					pr.History = append(pr.History[:i], pr.History[i+1:]...)
+					break
+				}
+			}
+			e := historyEntry{File: f, Time: time.Now().UTC().Truncate(time.Second)}
+			pr.History = append([]historyEntry{e}, pr.History...)
+			if len(pr.History) > maxHistory {
+				pr.History = pr.History[:maxHistory]
+			}
+		}
+	default:
+		http.Error(w, "Unknown profile field", 404)
+		return
+	}
+	s.profiles.update(userFrom(req), update)
+	w.WriteHeader(http.StatusNoContent)
+}
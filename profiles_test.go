@@ -0,0 +1,80 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testPost posts to u as user and fails the test unless the status is want.
+func testPost(t testing.TB, u, user string, want int) {
+	t.Helper()
+	if resp, b := testDo(t, "POST", u, user, "", nil); resp.StatusCode != want {
+		t.Fatalf("%s: got status %d, want %d: %s", u, resp.StatusCode, want, b)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	for _, u := range []string{"position/clip.mp4?t=5", "favorite/clip.mp4", "watched/clip.mp4"} {
+		testPost(t, ts.URL+"/api/profile/"+u, "", http.StatusNoContent)
+	}
+	testPost(t, ts.URL+"/api/profile/favorite/missing.mp4", "", http.StatusNotFound)
+	testPage(t, ts.URL+"/api/profile", "", `{"profile":{"positions":{"clip.mp4":5},"watched":{"clip.mp4":true},"favorites":{"clip.mp4":true},`)
+	if resp, _ := testDo(t, "DELETE", ts.URL+"/api/profile/favorite/clip.mp4", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/profile", "", `"favorites":{}`)
+}
+
+// TestProfileUsers checks that each user has their own profile.
+func TestProfileUsers(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice", "bob"}, "")
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{users: u})
+	if status, _ := testGet(t, ts.URL+"/", ""); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d", status)
+	}
+	if status, _ := testGet(t, strings.Replace(ts.URL, "://", "://alice:wrong@", 1)+"/", ""); status != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got status %d", status)
+	}
+	// alice is not an -admin.
+	if status, _ := testGet(t, ts.URL+"/admin", "alice"); status != http.StatusForbidden {
+		t.Fatalf("admin: got status %d", status)
+	}
+	testPost(t, ts.URL+"/api/profile/position/clip.mp4?t=5", "alice", http.StatusNoContent)
+	testPage(t, ts.URL+"/api/profile", "alice", `"positions":{"clip.mp4":5}`)
+	testPage(t, ts.URL+"/api/profile", "bob", `"positions":{}`)
+	testPage(t, ts.URL+"/api/profile", "bob", `"user":"bob"`)
+}
+
+func TestRatings(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "other.mp4": testMP4}, options{})
+	testPost(t, ts.URL+"/api/profile/rating/clip.mp4?stars=4", "", http.StatusNoContent)
+	testPost(t, ts.URL+"/api/profile/rating/other.mp4?stars=2", "", http.StatusNoContent)
+	for _, q := range []string{"stars=6", "stars=-1", "stars=x"} {
+		testPost(t, ts.URL+"/api/profile/rating/clip.mp4?"+q, "", http.StatusBadRequest)
+	}
+	testPost(t, ts.URL+"/api/profile/rating/missing.mp4?stars=4", "", http.StatusNotFound)
+	testPage(t, ts.URL+"/api/profile", "", `"ratings":{"clip.mp4":4,"other.mp4":2}`)
+	b := testPage(t, ts.URL+"/api/files?min_rating=4", "", `{"files":[{"name":"clip.mp4",`)
+	if strings.Contains(b, "other.mp4") {
+		t.Fatalf("unexpected other.mp4 in %q", b)
+	}
+}
+
+func TestPlayerPrefs(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	testPage(t, ts.URL+"/", "", `"player":{}`)
+	for _, q := range []string{"volume=2", "speed=8", "speed=x", "pip=maybe", "autoplay=1x"} {
+		testPost(t, ts.URL+"/api/profile/player?"+q, "", http.StatusBadRequest)
+	}
+	// The settings not sent are kept.
+	for _, q := range []string{"volume=0.25&muted=false", "speed=1.25&pip=true"} {
+		testPost(t, ts.URL+"/api/profile/player?"+q, "", http.StatusNoContent)
+	}
+	testPage(t, ts.URL+"/", "", `"player":{"volume":0.25,"muted":false,"speed":1.25,"pip":true}`)
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressArgs make ffmpeg write its progress to stdout; see progress.
+var progressArgs = []string{"-progress", "pipe:1", "-nostats"}
+
+// progressWriter parses the output of ffmpeg -progress to update the
+// progress of the running job of kind on name.
+type progressWriter struct {
+	m          *media
+	kind, name string
+	// total is the duration of the media. The job runs ffmpeg parts times,
+	// e.g. once per rung of a ladder, and this is the run part.
+	total       time.Duration
+	part, parts int
+	buf         []byte
+	out         time.Duration
+	speed       float64
+}
+
+// progress returns the writer to use as the stdout of ffmpeg started with
+// progressArgs, for the run part of parts of the job of kind on name. total
+// is the duration of the media, 0 if unknown.
+func (m *media) progress(kind, name string, total time.Duration, part, parts int) io.Writer {
+	return &progressWriter{m: m, kind: kind, name: name, total: total, part: part, parts: max(parts, 1)}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i == -1 {
+			return len(b), nil
+		}
+		k, v, _ := strings.Cut(strings.TrimSpace(string(p.buf[:i])), "=")
+		p.buf = p.buf[i+1:]
+		switch k {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(v, 10, 64); err == nil {
+				p.out = time.Duration(us) * time.Microsecond
+			}
+		case "speed":
+			if x, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "x"), 64); err == nil {
+				p.speed = x
+			}
+		case "progress":
+			// Each block of values ends with progress=continue or end.
+			p.update()
+		}
+	}
+}
+
+// update sets the progress of the job from the last block parsed.
+func (p *progressWriter) update() {
+	p.m.mu.Lock()
+	defer p.m.mu.Unlock()
+	for _, j := range p.m.jobs {
+		if j.Kind != p.kind || j.File != p.name {
+			continue
+		}
+		j.Speed = p.speed
+		if p.total > 0 {
+			done := min(float64(p.out)/float64(p.total), 1)
+			j.Percent = 100 * (float64(p.part) + done) / float64(p.parts)
+			if p.speed > 0 {
+				left := float64(p.parts-p.part) - done
+				j.ETA = left * p.total.Seconds() / p.speed
+			}
+		}
+	}
+}
+
+// jobEvents is sent by the job event streams.
+type jobEvents struct {
+	// Running are the ffmpeg processes running, with their progress.
+	Running []mediaJob `json:"running"`
+	// Queued are the background jobs waiting to run.
+	Queued []job `json:"queued"`
+}
+
+// jobEvents returns the jobs running and queued, only those on name when not
+// empty.
+func (s *server) jobEvents(name string) jobEvents {
+	ev := jobEvents{Running: s.media.runningJobs(), Queued: s.jobs.list()}
+	ev.Queued = slices.DeleteFunc(ev.Queued, func(j job) bool { return j.State != "queued" || (name != "" && j.File != name) })
+	if name != "" {
+		ev.Running = slices.DeleteFunc(ev.Running, func(j mediaJob) bool { return j.File != name })
+	}
+	return ev
+}
+
+// serveJobEvents streams the jobs running and queued, with their progress,
+// as server-sent events.
+func (s *server) serveJobEvents(w http.ResponseWriter, req *http.Request) {
+	s.streamJobEvents(w, req, "")
+}
+
+// serveProgress streams the jobs running and queued on the file, e.g. a
+// transcode, as server-sent events.
+func (s *server) serveProgress(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.hasFile(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	s.streamJobEvents(w, req, f)
+}
+
+// streamJobEvents sends the jobEvents of name every time they change, checking
+// every second, until the client disconnects.
+func (s *server) streamJobEvents(w http.ResponseWriter, req *http.Request, name string) {
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	var last []byte
+	for {
+		b, err := json.Marshal(s.jobEvents(name))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(b, last) {
+			last = b
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			if err = rc.Flush(); err != nil {
+				return
+			}
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProgress parses the output of ffmpeg -progress for the second
+// rung of a ladder.
+func TestProgress(t *testing.T) {
+	m := &media{}
+	defer m.startJob("ladder", "a.mp4")()
+	w := m.progress("ladder", "a.mp4", 10*time.Second, 1, 2)
+	out := "frame=10\nout_time_us=5000000\nspeed=2.5x\nprogr"
+	if _, err := io.WriteString(w, out); err != nil {
+		t.Fatal(err)
+	}
+	if j := m.runningJobs()[0]; j.Percent != 0 {
+		t.Fatalf("got %v%% before the end of the block", j.Percent)
+	}
+	if _, err := io.WriteString(w, "ess=continue\n"); err != nil {
+		t.Fatal(err)
+	}
+	if j := m.runningJobs()[0]; j.Percent != 75 || j.Speed != 2.5 || j.ETA != 2 {
+		t.Fatalf("got %v%% at %vx, %vs left; want 75%% at 2.5x, 2s left", j.Percent, j.Speed, j.ETA)
+	}
+}
+
+// TestProgressEvents checks that the progress of the jobs of a file is
+// streamed as server-sent events.
+func TestProgressEvents(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	if status, _ := testGet(t, ts.URL+"/api/progress/missing.mp4", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+	req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL+"/api/progress/clip.mp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `data: {"running":[],"queued":[]}` + "\n"; line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+	defer srv.media.startJob("ladder", "clip.mp4")()
+	// Skip the blank lines and the events sent before the job started.
+	for !strings.HasPrefix(line, "data: ") || strings.HasPrefix(line, `data: {"running":[],`) {
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := `data: {"running":[{"kind":"ladder","file":"clip.mp4",`; !strings.HasPrefix(line, want) {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The QR codes are encoded in byte mode with the medium error correction
+// level, which recovers from 15% of damage, following ISO/IEC 18004.
+
+// qrECCPerBlock and qrBlocks are the error correction codewords per block and
+// the number of blocks of each version at the medium level.
+var (
+	qrECCPerBlock = [41]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrBlocks      = [41]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// qrRawModules returns the number of modules of a version available for the
+// data and the error correction, i.e. not used by the function patterns.
+func qrRawModules(ver int) int {
+	n := (16*ver+128)*ver + 64
+	if ver >= 2 {
+		align := ver/7 + 2
+		n -= (25*align-10)*align - 55
+		if ver >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords returns the number of data bytes of a version.
+func qrDataCodewords(ver int) int {
+	return qrRawModules(ver)/8 - qrECCPerBlock[ver]*qrBlocks[ver]
+}
+
+// qrAlignment returns the coordinates of the centers of the alignment
+// patterns of a version, on both axes.
+func qrAlignment(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	n := ver/7 + 2
+	step := 26
+	if ver != 32 {
+		// Rounded up.
+		step = (ver*4 + 4 + n*2 - 3) / (n*2 - 2) * 2
+	}
+	out := make([]int, n)
+	out[0] = 6
+	for i, pos := n-1, ver*4+10; i >= 1; i, pos = i-1, pos-step {
+		out[i] = pos
+	}
+	return out
+}
+
+// qrBits is a big-endian bit buffer.
+type qrBits struct {
+	b []byte
+	n int
+}
+
+func (q *qrBits) add(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if q.n%8 == 0 {
+			q.b = append(q.b, 0)
+		}
+		if v>>i&1 != 0 {
+			q.b[q.n/8] |= 0x80 >> (q.n % 8)
+		}
+		q.n++
+	}
+}
+
+// qrMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ z>>7*0x1D
+		z ^= y >> i & 1 * x
+	}
+	return z
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of a degree,
+// without its leading 1 coefficient.
+func qrDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range out {
+			out[j] = qrMul(out[j], root)
+			if j+1 < degree {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = qrMul(root, 2)
+	}
+	return out
+}
+
+// qrRemainder returns the Reed-Solomon error correction codewords of data.
+func qrRemainder(data, divisor []byte) []byte {
+	out := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i, d := range divisor {
+			out[i] ^= qrMul(d, factor)
+		}
+	}
+	return out
+}
+
+// qrCodewords splits the data in blocks, adds their error correction and
+// interleaves them.
+func qrCodewords(ver int, data []byte) []byte {
+	blocks, ecc := qrBlocks[ver], qrECCPerBlock[ver]
+	raw := qrRawModules(ver) / 8
+	short := blocks - raw%blocks
+	shortLen := raw / blocks
+	divisor := qrDivisor(ecc)
+	all := make([][]byte, blocks)
+	for i, k := 0, 0; i < blocks; i++ {
+		n := shortLen - ecc
+		if i >= short {
+			n++
+		}
+		b := append([]byte(nil), data[k:k+n]...)
+		k += n
+		r := qrRemainder(b, divisor)
+		if i < short {
+			// Padding so all the blocks have the same length; skipped below.
+			b = append(b, 0)
+		}
+		all[i] = append(b, r...)
+	}
+	out := make([]byte, 0, raw)
+	for i := range all[0] {
+		for j, b := range all {
+			if i != shortLen-ecc || j >= short {
+				out = append(out, b[i])
+			}
+		}
+	}
+	return out
+}
+
+// qrMatrix is the modules of a QR code being built.
+type qrMatrix struct {
+	size     int
+	dark     [][]bool
+	function [][]bool
+}
+
+func (m *qrMatrix) set(x, y int, dark bool) {
+	m.dark[y][x] = dark
+	m.function[y][x] = true
+}
+
+// drawFunction draws the finder, timing and alignment patterns and the
+// version information.
+func (m *qrMatrix) drawFunction(ver int) {
+	for i := range m.size {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {m.size - 4, 3}, {3, m.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < m.size && y >= 0 && y < m.size {
+					d := max(abs(dx), abs(dy))
+					m.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignment(ver)
+	for i, y := range pos {
+		for j, x := range pos {
+			// Skip the ones overlapping the finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					m.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format information, drawn once the mask is chosen.
+	m.drawFormat(0)
+	if ver >= 7 {
+		rem := ver
+		for range 12 {
+			rem = rem<<1 ^ rem>>11*0x1F25
+		}
+		bits := ver<<12 | rem
+		for i := range 18 {
+			a, b := m.size-11+i%3, i/3
+			m.set(a, b, bits>>i&1 != 0)
+			m.set(b, a, bits>>i&1 != 0)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information: the medium error
+// correction level and the mask.
+func (m *qrMatrix) drawFormat(mask int) {
+	// The medium level is 0.
+	data := mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ rem>>9*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+	for i := range 6 {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+	for i := range 8 {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+	m.set(8, m.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, right to left by
+// pairs of columns, alternately upward and downward.
+func (m *qrMatrix) drawCodewords(data []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern.
+			right = 5
+		}
+		for vert := range m.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = m.size - 1 - vert
+				}
+				if !m.function[y][x] && i < len(data)*8 {
+					m.dark[y][x] = data[i/8]>>(7-i%8)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask. Applying it twice
+// undoes it.
+func (m *qrMatrix) applyMask(mask int) {
+	for y := range m.size {
+		for x := range m.size {
+			var inv bool
+			switch mask {
+			case 0:
+				inv = (x+y)%2 == 0
+			case 1:
+				inv = y%2 == 0
+			case 2:
+				inv = x%3 == 0
+			case 3:
+				inv = (x+y)%3 == 0
+			case 4:
+				inv = (x/3+y/2)%2 == 0
+			case 5:
+				inv = x*y%2+x*y%3 == 0
+			case 6:
+				inv = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				inv = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if inv && !m.function[y][x] {
+				m.dark[y][x] = !m.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read; the mask with the lowest
+// score is used.
+func (m *qrMatrix) penalty() int {
+	score := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return m.dark[x][y]
+		}
+		return m.dark[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, t := range []bool{false, true} {
+		for y := range m.size {
+			run := 1
+			for x := 1; x <= m.size; x++ {
+				if x < m.size && at(x, y, t) == at(x-1, y, t) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			// A finder-like pattern with 4 light modules on either side.
+			for x := 0; x+7 <= m.size; x++ {
+				match := true
+				for k, d := range finder {
+					if at(x+k, y, t) != d {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				light := func(from, to int) bool {
+					for k := from; k < to; k++ {
+						if k >= 0 && k < m.size && at(k, y, t) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					score += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := range m.size {
+		for x := range m.size {
+			if m.dark[y][x] {
+				dark++
+			}
+			if x+1 < m.size && y+1 < m.size && m.dark[y][x] == m.dark[y][x+1] && m.dark[y][x] == m.dark[y+1][x] && m.dark[y][x] == m.dark[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+	return score + abs(dark*100/(m.size*m.size)-50)/5*10
+}
+
+// qrCode returns the modules of the smallest QR code encoding text; true is
+// dark.
+func qrCode(text []byte) ([][]bool, error) {
+	ver, countBits := 1, 8
+	for ; 4+countBits+8*len(text) > 8*qrDataCodewords(ver); ver++ {
+		if ver == 40 {
+			return nil, errors.New("the text is too long for a QR code")
+		}
+		if ver+1 >= 10 {
+			countBits = 16
+		}
+	}
+	capacity := 8 * qrDataCodewords(ver)
+	var b qrBits
+	// Byte mode.
+	b.add(4, 4)
+	b.add(len(text), countBits)
+	for _, c := range text {
+		b.add(int(c), 8)
+	}
+	b.add(0, min(4, capacity-b.n))
+	b.add(0, (8-b.n%8)%8)
+	for pad := 0xEC; b.n < capacity; pad ^= 0xEC ^ 0x11 {
+		b.add(pad, 8)
+	}
+	m := &qrMatrix{size: ver*4 + 17}
+	m.dark = make([][]bool, m.size)
+	m.function = make([][]bool, m.size)
+	for i := range m.size {
+		m.dark[i] = make([]bool, m.size)
+		m.function[i] = make([]bool, m.size)
+	}
+	m.drawFunction(ver)
+	m.drawCodewords(qrCodewords(ver, b.b))
+	best, bestScore := 0, -1
+	for mask := range 8 {
+		m.applyMask(mask)
+		m.drawFormat(mask)
+		if p := m.penalty(); bestScore == -1 || p < bestScore {
+			best, bestScore = mask, p
+		}
+		m.applyMask(mask)
+	}
+	m.applyMask(best)
+	m.drawFormat(best)
+	return m.dark, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// qrSVG renders the modules as an SVG image with the quiet zone around.
+func qrSVG(modules [][]bool) []byte {
+	const quiet = 4
+	n := len(modules) + 2*quiet
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n, n, n)
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
+
+// qrURL returns the URL path of the QR code of a path on this server.
+func qrURL(p string) string {
+	return "/qr?url=" + url.QueryEscape(p)
+}
+
+// serveQR serves the QR code of ?url=, a path on this server or a URL to it,
+// so a phone can open it, e.g. to continue watching a video there. The codes
+// are generated locally.
+func (s *server) serveQR(w http.ResponseWriter, req *http.Request) {
+	u := req.URL.Query().Get("url")
+	if strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+		u = cmp.Or(s.opts.publicURL, baseURL(req)) + u
+	} else if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || (p.Host != req.Host && !strings.HasPrefix(u, s.opts.publicURL+"/")) {
+		// Don't generate codes pointing elsewhere.
+		http.Error(w, "url must be on this server", http.StatusBadRequest)
+		return
+	}
+	modules, err := qrCode([]byte(u))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "image/svg+xml")
+	h.Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(qrSVG(modules))
+}
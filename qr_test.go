@@ -0,0 +1,43 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQRCode(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrRemainder(data, qrDivisor(10)); !bytes.Equal(got, want) {
+		t.Fatalf("got error correction %v, want %v", got, want)
+	}
+	m, err := qrCode([]byte("http://127.0.0.1:12345/watch/clip.mp4#t=12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Version 3.
+	if len(m) != 29 {
+		t.Fatalf("got %d modules", len(m))
+	}
+}
+
+func TestQR(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{publicURL: "https://videos.example"})
+	for _, u := range []string{"/watch/clip.mp4", "https://videos.example/watch/clip.mp4"} {
+		resp, b := testDo(t, "GET", ts.URL+qrURL(u), "", "", nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/svg+xml" || !strings.HasPrefix(b, "<svg ") {
+			t.Fatalf("%s: got status %d, %q", u, resp.StatusCode, b)
+		}
+	}
+	for _, u := range []string{"https://evil.example/", "//evil.example/", "javascript:alert(1)", "https://videos.example.evil/"} {
+		if status, _ := testGet(t, ts.URL+qrURL(u), ""); status != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d", u, status)
+		}
+	}
+}
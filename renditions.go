@@ -0,0 +1,72 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"math"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// rendition is one of the files having the same content in different
+// qualities, e.g. "Heat.1080p.mp4" and "Heat.720p.mp4".
+type rendition struct {
+	Name string `json:"name"`
+	// Label is the quality, e.g. "720p", or "original" for the file without
+	// one in its name.
+	Label  string `json:"label"`
+	height int
+}
+
+// reQuality matches the quality in a file name, e.g. ".1080p".
+var reQuality = regexp.MustCompile(`(?i)[ ._-](\d{3,4})p\b`)
+
+// renditions groups the videos available in several qualities: the files
+// whose names only differ by the quality, including the original without
+// one. It returns the renditions of each group, best first, by the name of
+// the one listed: the original when present, else the best.
+func renditions(names []string) map[string][]rendition {
+	byKey := map[string][]rendition{}
+	for _, n := range names {
+		// HLS has its own renditions.
+		if t := mimeType(n); !strings.HasPrefix(t, "video/") || t == "video/mp2t" {
+			continue
+		}
+		r := rendition{Name: n, Label: "original", height: math.MaxInt}
+		key := strings.TrimSuffix(n, path.Ext(n))
+		if m := reQuality.FindStringSubmatchIndex(key); m != nil {
+			r.height, _ = strconv.Atoi(key[m[2]:m[3]])
+			r.Label = strconv.Itoa(r.height) + "p"
+			key = key[:m[0]] + key[m[1]:]
+		}
+		byKey[key] = append(byKey[key], r)
+	}
+	out := map[string][]rendition{}
+	for _, r := range byKey {
+		if len(r) < 2 || !slices.ContainsFunc(r, func(r rendition) bool { return r.height != math.MaxInt }) {
+			continue
+		}
+		slices.SortFunc(r, func(a, b rendition) int {
+			return cmp.Or(cmp.Compare(b.height, a.height), strings.Compare(a.Name, b.Name))
+		})
+		out[r[0].Name] = r
+	}
+	return out
+}
+
+// listedNames returns names without the renditions not listed.
+func listedNames(names []string, r map[string][]rendition) []string {
+	hidden := map[string]bool{}
+	for _, l := range r {
+		for _, x := range l[1:] {
+			hidden[x.Name] = true
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(names), func(n string) bool { return hidden[n] })
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestRenditions checks the grouping of the files available in several
+// qualities.
+func TestRenditions(t *testing.T) {
+	names := []string{
+		"Heat.1995.1080p.BluRay.mkv", "Heat.1995.720p.BluRay.mkv",
+		"home/party.mp4", "home/party.480p.mp4",
+		"home/other.mp4", "cam/front.m3u8", "cam/front.720p.m3u8",
+	}
+	r := renditions(names)
+	got := map[string]string{}
+	for k, l := range r {
+		var s []string
+		for _, x := range l {
+			s = append(s, x.Label+"="+x.Name)
+		}
+		got[k] = strings.Join(s, " ")
+	}
+	want := map[string]string{
+		"Heat.1995.1080p.BluRay.mkv": "1080p=Heat.1995.1080p.BluRay.mkv 720p=Heat.1995.720p.BluRay.mkv",
+		"home/party.mp4":             "original=home/party.mp4 480p=home/party.480p.mp4",
+	}
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %q", got)
+	}
+	if l := listedNames(names, r); !slices.Equal(l, []string{"Heat.1995.1080p.BluRay.mkv", "home/party.mp4", "home/other.mp4", "cam/front.m3u8", "cam/front.720p.m3u8"}) {
+		t.Fatalf("got %q", l)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// freeSpace is a minimum amount of free space, either in bytes or as a
+// percentage of the volume.
+type freeSpace struct {
+	bytes   uint64
+	percent float64
+}
+
+func (f *freeSpace) String() string {
+	if f.percent != 0 {
+		return strconv.FormatFloat(f.percent, 'f', -1, 64) + "%"
+	}
+	if f.bytes == 0 {
+		return ""
+	}
+	return strconv.FormatUint(f.bytes, 10)
+}
+
+// Set parses "10%", "50GB", "500MB" or a number of bytes.
+func (f *freeSpace) Set(v string) error {
+	if p, ok := strings.CutSuffix(v, "%"); ok {
+		x, err := strconv.ParseFloat(p, 64)
+		if err != nil || x <= 0 || x >= 100 {
+			return fmt.Errorf("invalid percentage %q", v)
+		}
+		f.percent = x
+		return nil
+	}
+	b, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	f.bytes = b
+	return nil
+}
+
+// parseSize parses a size like "50GB", "500MiB" or "1024".
+func parseSize(v string) (uint64, error) {
+	units := []struct {
+		suffix string
+		mul    uint64
+	}{
+		{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+	}
+	mul := uint64(1)
+	s := strings.TrimSpace(v)
+	for _, u := range units {
+		if x, ok := strings.CutSuffix(s, u.suffix); ok {
+			s = strings.TrimSpace(x)
+			mul = u.mul
+			break
+		}
+	}
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil || x < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return uint64(x * float64(mul)), nil
+}
+
+// retention deletes the oldest recordings when the free space on the volume
+// drops below a threshold.
+type retention struct {
+	minFree freeSpace
+	// dirs are the directories holding the recordings; the other files are
+	// never deleted.
+	dirs []string
+	// keep are path.Match patterns of files or directories that are never
+	// deleted.
+	keep []string
+	// dropDir is kept even when empty; see removeEmptyDirs.
+	dropDir string
+
+	mu    sync.Mutex
+	state retentionState
+}
+
+// retentionState is the outcome of the retention checks, for /admin.
+type retentionState struct {
+	Checked time.Time `json:"checked"`
+	Free    uint64    `json:"free"`
+	Total   uint64    `json:"total"`
+	// Need is the number of bytes to free at the last check.
+	Need    uint64 `json:"need"`
+	Deleted int    `json:"deleted"`
+	Freed   uint64 `json:"freed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// status returns the outcome of the last check and the totals since startup.
+func (r *retention) status() retentionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// isKept returns true if the file name is protected from deletion.
+func (r *retention) isKept(name string) bool {
+	if !r.isRecording(name) {
+		return true
+	}
+	for _, k := range r.keep {
+		k = strings.Trim(k, "/")
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(k, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRecording returns true if the file name is in one of the recordings
+// directories.
+func (r *retention) isRecording(name string) bool {
+	for _, d := range r.dirs {
+		if d == "." || strings.HasPrefix(name, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// retentionUnit is a set of files deleted together, e.g. a playlist and its
+// segments.
+type retentionUnit struct {
+	files   []string
+	size    int64
+	modTime time.Time
+}
+
+// units groups the files so HLS playlists are deleted with their segments.
+func (r *retention) units(root *os.Root, files []file) []retentionUnit {
+	byName := make(map[string]file, len(files))
+	for _, f := range files {
+		byName[f.Name] = f
+	}
+	used := map[string]bool{}
+	var out []retentionUnit
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name, ".m3u8") {
+			continue
+		}
+		u := retentionUnit{files: []string{f.Name}, size: f.Size, modTime: f.ModTime}
+		segs, _ := playlistSegments(root, f.Name)
+		for _, s := range segs {
+			rel, err := filepath.Rel(root.Name(), s)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if sf, ok := byName[rel]; ok && !used[rel] {
+				used[rel] = true
+				u.files = append(u.files, rel)
+				u.size += sf.Size
+			}
+		}
+		used[f.Name] = true
+		out = append(out, u)
+	}
+	for _, f := range files {
+		if !used[f.Name] {
+			out = append(out, retentionUnit{files: []string{f.Name}, size: f.Size, modTime: f.ModTime})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].modTime.Before(out[j].modTime) })
+	return out
+}
+
+// needed returns how many bytes must be freed, 0 if none.
+func (r *retention) needed(root string) (uint64, error) {
+	free, total, err := diskSpace(root)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Checked = time.Now().UTC()
+	r.state.Free, r.state.Total, r.state.Need, r.state.Error = free, total, 0, ""
+	if err != nil {
+		r.state.Error = err.Error()
+		return 0, err
+	}
+	want := r.minFree.bytes
+	if r.minFree.percent != 0 {
+		want = uint64(float64(total) * r.minFree.percent / 100)
+	}
+	if free >= want {
+		return 0, nil
+	}
+	r.state.Need = want - free
+	return r.state.Need, nil
+}
+
+// enforce deletes the oldest unprotected files until enough space is free.
+func (r *retention) enforce(root *os.Root, files []file) error {
+	need, err := r.needed(root.Name())
+	if err != nil || need == 0 {
+		return err
+	}
+	slog.Warn("retention", "msg", "free space is low", "need", need)
+	freed := uint64(0)
+	for _, u := range r.units(root, files) {
+		if freed >= need {
+			break
+		}
+		if time.Since(u.modTime) < liveMaxAge {
+			// Never delete what is being recorded.
+			break
+		}
+		kept := false
+		for _, f := range u.files {
+			if r.isKept(f) {
+				kept = true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+		for _, f := range u.files {
+			if err = root.Remove(filepath.FromSlash(f)); err != nil && !os.IsNotExist(err) {
+				slog.Error("retention", "f", f, "error", err)
+				continue
+			}
+			slog.Warn("retention", "deleted", f)
+			removeEmptyDirs(root, path.Dir(f), append(r.dirs, r.dropDir)...)
+		}
+		freed += uint64(u.size)
+		r.mu.Lock()
+		r.state.Deleted += len(u.files)
+		r.state.Freed += uint64(u.size)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents while they are empty, stopping
+// at root or at one of the directories to keep, e.g. -drop.
+func removeEmptyDirs(root *os.Root, dir string, keep ...string) {
+	for ; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if slices.Contains(keep, dir) || root.Remove(filepath.FromSlash(dir)) != nil {
+			return
+		}
+	}
+}
+
+// run checks the free space every minute until ctx is canceled.
+func (r *retention) run(ctx context.Context, s *server) {
+	for {
+		if err := r.enforce(s.rootDir, s.getFiles()); err != nil {
+			slog.Error("retention", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
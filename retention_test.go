@@ -0,0 +1,49 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetentionIsKept(t *testing.T) {
+	r := &retention{dirs: []string{"cameras"}, keep: []string{"*/incidents"}}
+	for name, want := range map[string]bool{
+		"cameras/front/2024-10-15/140200.mp4": false,
+		"cameras/incidents/140200.mp4":        true,
+		"movies/old.mp4":                      true,
+		"cameras.mp4":                         true,
+	} {
+		if got := r.isKept(name); got != want {
+			t.Errorf("isKept(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"incoming/a/b", "cameras/front/2024-10-15"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	removeEmptyDirs(root, "incoming/a/b", "incoming")
+	removeEmptyDirs(root, "cameras/front/2024-10-15", "cameras")
+	for d, want := range map[string]bool{"incoming": true, "incoming/a": false, "cameras": true, "cameras/front": false} {
+		if _, err := os.Stat(filepath.Join(dir, d)); (err == nil) != want {
+			t.Errorf("%s: got %v, want kept %t", d, err, want)
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatal("the root was removed")
+	}
+}
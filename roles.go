@@ -0,0 +1,124 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// role is what a user is allowed to do. Each role can do what the previous
+// ones can.
+type role int
+
+const (
+	// roleViewer can watch and update their own profile.
+	roleViewer role = iota
+	// roleUploader can also upload files into -drop and tag the files.
+	roleUploader
+	// roleAdmin can also delete files, scan for duplicates and use /admin.
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleUploader:
+		return "uploader"
+	case roleAdmin:
+		return "admin"
+	default:
+		return "viewer"
+	}
+}
+
+// roleOf returns the role of the user of the request: the -admin users are
+// admins, the -uploader users uploaders and the others viewers. Without
+// -user, the clients on the same host are admins.
+func (s *server) roleOf(req *http.Request) role {
+	if s.isAdmin(req) {
+		return roleAdmin
+	}
+	if u := userFrom(req); u != "" && slices.Contains(s.opts.uploaders, u) {
+		return roleUploader
+	}
+	return roleViewer
+}
+
+// roleHandler only allows the users with at least the role r.
+func (s *server) roleHandler(r role, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.roleOf(req) < r {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	})
+}
+
+// isUpload returns true for the requests uploading a file.
+func isUpload(req *http.Request) bool {
+	return req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/api/upload/")
+}
+
+// serveUpload saves the body of a PUT /api/upload/<name> in -drop. The file
+// is written under a temporary name first so it is only listed once
+// complete. An existing file is never replaced: the complete file is hard
+// linked to its name, which fails if the name was taken in the meantime.
+func (s *server) serveUpload(w http.ResponseWriter, req *http.Request) {
+	if s.opts.dropDir == "" {
+		http.Error(w, "Uploads are disabled", http.StatusNotFound)
+		return
+	}
+	name := req.PathValue("name")
+	if !validPath(name) || strings.Contains(name, "/") || !slices.ContainsFunc(s.exts, func(ext string) bool { return strings.HasSuffix(name, ext) }) {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	rel := path.Join(s.opts.dropDir, name)
+	// Fail early instead of after receiving the file.
+	if _, err := s.rootDir.Lstat(filepath.FromSlash(rel)); err == nil {
+		http.Error(w, "The file already exists", http.StatusConflict)
+		return
+	}
+	tmp := filepath.FromSlash(rel + ".part")
+	f, err := s.rootDir.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		http.Error(w, "The file is being uploaded", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, req.Body)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.rootDir.Link(tmp, filepath.FromSlash(rel))
+	}
+	_ = s.rootDir.Remove(tmp)
+	if errors.Is(err, fs.ErrExist) {
+		http.Error(w, "The file already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.Error("upload", "file", rel, "error", err)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("upload", "file", rel, "size", n, "user", userFrom(req))
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": rel, "size": n})
+}
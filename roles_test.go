@@ -0,0 +1,93 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRolesServer serves an empty drop directory to alice the admin, bob the
+// uploader and carol the viewer.
+func testRolesServer(t *testing.T) (*server, string) {
+	t.Helper()
+	u, _ := testUsers(t, []string{"alice", "bob", "carol"}, "")
+	srv, ts := newTestServer(t, nil, options{users: u, admins: []string{"alice"}, uploaders: []string{"bob"}, dropDir: "incoming"})
+	if err := os.Mkdir(filepath.Join(srv.rootDir.Name(), "incoming"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return srv, ts.URL
+}
+
+func TestRoles(t *testing.T) {
+	srv, base := testRolesServer(t)
+	for user, want := range map[string]string{"alice": "admin", "bob": "uploader", "carol": "viewer"} {
+		var got struct {
+			Role string `json:"role"`
+		}
+		if err := json.Unmarshal([]byte(testPage(t, base+"/api/profile", user, "")), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Role != want {
+			t.Fatalf("%s: got role %q, want %q", user, got.Role, want)
+		}
+	}
+	for _, c := range []struct {
+		method, user, p, body string
+		want                  int
+	}{
+		{"PUT", "carol", "/api/upload/a.mp4", "video", http.StatusForbidden},
+		{"PUT", "bob", "/api/upload/a.txt", "video", http.StatusBadRequest},
+		{"PUT", "bob", "/api/upload/a.mp4", "video", http.StatusCreated},
+		{"PUT", "alice", "/api/upload/a.mp4", "other", http.StatusConflict},
+		{"POST", "bob", "/api/duplicates/delete", `{"files":["incoming/a.mp4"]}`, http.StatusForbidden},
+		{"GET", "carol", "/api/analytics", "", http.StatusForbidden},
+		{"POST", "carol", "/api/tags", `{"files":["incoming/a.mp4"],"add":["keep"]}`, http.StatusForbidden},
+		// bob passes the role check.
+		{"POST", "bob", "/api/tags", `{"files":["missing.mp4"],"add":["keep"]}`, http.StatusNotFound},
+		{"POST", "bob", "/api/duplicates/scan", "", http.StatusForbidden},
+		{"POST", "carol", "/api/repair/incoming", "", http.StatusForbidden},
+	} {
+		if resp, b := testDo(t, c.method, base+c.p, c.user, c.body, nil); resp.StatusCode != c.want {
+			t.Fatalf("%s %s as %s: got status %d, want %d: %s", c.method, c.p, c.user, resp.StatusCode, c.want, b)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(srv.rootDir.Name(), "incoming", "a.mp4")); err != nil || string(b) != "video" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+// TestRolesSessions checks that only the user and the admins see and control
+// the user's sessions.
+func TestRolesSessions(t *testing.T) {
+	_, base := testRolesServer(t)
+	testWebSocket(t, base, "/api/sessions/ws", "carol")
+	var data struct {
+		Sessions []session `json:"sessions"`
+	}
+	for i := 0; len(data.Sessions) == 0; i++ {
+		if i == 50 {
+			t.Fatal("carol's session is missing")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := json.Unmarshal([]byte(testPage(t, base+"/api/sessions", "carol", "")), &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := data.Sessions[0].ID
+	for user, want := range map[string]int{"alice": 1, "bob": 0} {
+		if err := json.Unmarshal([]byte(testPage(t, base+"/api/sessions", user, "")), &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Sessions) != want || (want != 0 && data.Sessions[0].User != "carol") {
+			t.Fatalf("%s: unexpected sessions %+v", user, data.Sessions)
+		}
+	}
+	testPost(t, base+"/api/sessions/"+id+"/pause", "bob", http.StatusNotFound)
+}
@@ -0,0 +1,38 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxPaths returns the paths the server needs to write to and to read
+// from, for sandbox.
+func sandboxPaths(s *server, logOutput string) (rw, ro []string) {
+	rw = []string{s.root, os.TempDir(), os.DevNull}
+	if s.opts.dataDir != "" {
+		rw = append(rw, s.opts.dataDir)
+	}
+	if s.opts.cacheDir != "" {
+		rw = append(rw, s.opts.cacheDir)
+	}
+	// The log files are rotated in their directory.
+	for _, dest := range []string{logOutput, s.opts.auditLog} {
+		if dest != "" && dest != "stderr" && dest != "journald" && !strings.HasPrefix(dest, "syslog") {
+			rw = append(rw, filepath.Dir(dest))
+		}
+	}
+	// The system directories contain the shared libraries, the TLS
+	// certificates, the time zones and the DNS configuration.
+	ro = []string{"/bin", "/etc", "/lib", "/lib32", "/lib64", "/opt", "/sbin", "/usr", "/dev/urandom"}
+	for _, p := range []string{s.media.ffmpeg, s.media.ffprobe} {
+		if p != "" {
+			ro = append(ro, filepath.Dir(p))
+		}
+	}
+	return rw, ro
+}
@@ -0,0 +1,13 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+func sandbox(rw, ro []string) error {
+	return errors.New("-sandbox is only supported on Linux")
+}
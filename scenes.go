@@ -0,0 +1,213 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// blackLuma and washLuma are the average luma, from 0 to 255, under and
+	// above which a frame is black or washed out, e.g. by the infrared flash
+	// of a camera switching to night mode.
+	blackLuma = 24
+	washLuma  = 230
+	// sceneScore is the minimum scdet score of a keyframe starting a scene.
+	sceneScore = 10
+	// maxScenes is the number of frames of the hover previews.
+	maxScenes = 8
+	// posterWindow is how much of a video is analyzed to pick its poster
+	// when the scenes weren't detected yet.
+	posterWindow = 2 * time.Minute
+)
+
+// scenes are the keyframes of a video worth showing.
+type scenes struct {
+	// Start is the time of the first keyframe neither black nor washed out,
+	// in seconds, or -1 if none.
+	Start float64 `json:"start"`
+	// Times are the keyframes starting the most different scenes from Start
+	// on, in seconds and in order.
+	Times []float64 `json:"times"`
+}
+
+// keyframe is a keyframe as analyzed by ffmpeg.
+type keyframe struct {
+	time  float64
+	luma  float64
+	score float64
+}
+
+// parseKeyframes parses the output of ffmpeg's metadata filter.
+func parseKeyframes(b []byte) []keyframe {
+	var out []keyframe
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		l := s.Text()
+		if strings.HasPrefix(l, "frame:") {
+			kf := keyframe{time: -1, luma: -1}
+			if _, v, ok := strings.Cut(l, "pts_time:"); ok {
+				kf.time, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+			}
+			out = append(out, kf)
+			continue
+		}
+		if len(out) == 0 {
+			continue
+		}
+		k, v, _ := strings.Cut(l, "=")
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		switch k {
+		case "lavfi.signalstats.YAVG":
+			out[len(out)-1].luma = f
+		case "lavfi.scd.score":
+			out[len(out)-1].score = f
+		}
+	}
+	return out
+}
+
+// scenesOf selects the keyframes worth showing.
+func scenesOf(kfs []keyframe) *scenes {
+	out := &scenes{Start: -1, Times: []float64{}}
+	var cands []keyframe
+	for _, kf := range kfs {
+		if kf.time < 0 || kf.luma < blackLuma || kf.luma > washLuma {
+			continue
+		}
+		if out.Start < 0 {
+			out.Start = kf.time
+			// Always show the start.
+			kf.score = math.Inf(1)
+		} else if kf.score < sceneScore {
+			continue
+		}
+		cands = append(cands, kf)
+	}
+	slices.SortStableFunc(cands, func(a, b keyframe) int { return cmp.Compare(b.score, a.score) })
+	for _, kf := range cands[:min(len(cands), maxScenes)] {
+		out.Times = append(out.Times, kf.time)
+	}
+	slices.Sort(out.Times)
+	return out
+}
+
+// detectScenes analyzes the keyframes of f, up to limit when not 0. Only the
+// keyframes are decoded, downscaled, so it is much faster than playing it.
+func (m *media) detectScenes(ctx context.Context, root string, f file, limit time.Duration) (*scenes, error) {
+	if m.ffmpeg == "" {
+		return nil, errNoFFmpeg
+	}
+	src, err := mediaPath(root, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer m.startJob("scenes", f.Name)()
+	args := append(append([]string{"-v", "error", "-skip_frame", "nokey"}, m.decodeArgs("")...), "-i", src)
+	if limit != 0 {
+		args = append(args, "-t", strconv.FormatFloat(limit.Seconds(), 'f', -1, 64))
+	}
+	// format=gray gets 8 bits luma from the 10 bits videos too.
+	args = append(args, "-map", "0:v:0", "-an", "-sn", "-dn",
+		"-vf", "scale=160:-2,format=gray,signalstats,scdet=threshold="+strconv.Itoa(sceneScore)+",metadata=mode=print:file=pipe\\:1",
+		"-f", "null", "-")
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, m.ffmpeg, args...)
+	out, err := m.output(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg %q: %w", f.Name, err)
+	}
+	return scenesOf(parseKeyframes(out)), nil
+}
+
+// scenes returns the scenes of f, detecting them if not done yet.
+func (m *media) scenes(ctx context.Context, root string, f file) (*scenes, error) {
+	m.mu.Lock()
+	sc := m.sceneCache[f]
+	m.mu.Unlock()
+	if sc != nil {
+		return sc, nil
+	}
+	sc, err := m.detectScenes(ctx, root, f, 0)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.sceneCache[f] = sc
+	m.mu.Unlock()
+	return sc, nil
+}
+
+// posterTime returns the time of the thumbnail of f when none was set: the
+// first keyframe neither black nor washed out, at least a second in.
+func (m *media) posterTime(ctx context.Context, root string, f file) time.Duration {
+	if !hasDuration(f.Name) {
+		// The photos have a single frame.
+		return defaultThumbTime
+	}
+	m.mu.Lock()
+	sc := m.sceneCache[f]
+	m.mu.Unlock()
+	if sc == nil {
+		var err error
+		if sc, err = m.detectScenes(ctx, root, f, posterWindow); err != nil {
+			slog.Warn("scenes", "f", f.Name, "error", err)
+			return defaultThumbTime
+		}
+	}
+	return max(defaultThumbTime, time.Duration(sc.Start*float64(time.Second)))
+}
+
+// previewURL returns the escaped URL path of the frame of f at t seconds.
+func previewURL(f file, t float64) string {
+	return "/thumb/" + escapePath(f.Name) + "?t=" + strconv.FormatFloat(t, 'f', -1, 64) + "&v=" + fingerprint(f)
+}
+
+// serveScenes returns the scenes of a video and the URLs of their frames,
+// shown when hovering the video in the grid. They are detected on the first
+// request.
+func (s *server) serveScenes(w http.ResponseWriter, req *http.Request) {
+	f, ok := s.getFile(req.PathValue("path"))
+	if !ok || !s.canAccess(req, f.Name) || !hasDuration(f.Name) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	if s.media.ffmpeg == "" {
+		http.Error(w, errNoFFmpeg.Error(), http.StatusNotImplemented)
+		return
+	}
+	sc, err := s.media.scenes(req.Context(), s.root, f)
+	if err != nil {
+		if req.Context().Err() == nil {
+			slog.Warn("scenes", "f", f.Name, "error", err)
+		}
+		http.Error(w, "Scenes not available", 404)
+		return
+	}
+	previews := make([]string, 0, len(sc.Times))
+	for _, t := range sc.Times {
+		previews = append(previews, previewURL(f, t))
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"start": sc.Start, "times": sc.Times, "previews": previews})
+}
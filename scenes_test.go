@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestScenes selects the scenes from the output of ffmpeg, skipping the
+// black and washed out keyframes.
+func TestScenes(t *testing.T) {
+	var b strings.Builder
+	for i, kf := range []keyframe{
+		{0, 2, 0}, {2, 250, 90}, {4, 120, 80}, {6, 121, 1}, {8, 60, 40}, {10, 10, 50},
+	} {
+		fmt.Fprintf(&b, "frame:%-4d pts:%-7d pts_time:%g\n", i, int(kf.time*1000), kf.time)
+		fmt.Fprintf(&b, "lavfi.signalstats.YMIN=0\nlavfi.signalstats.YAVG=%g\n", kf.luma)
+		fmt.Fprintf(&b, "lavfi.scd.mafd=1.5\nlavfi.scd.score=%g\n", kf.score)
+	}
+	sc := scenesOf(parseKeyframes([]byte(b.String())))
+	if sc.Start != 4 || !slices.Equal(sc.Times, []float64{4, 8}) {
+		t.Fatalf("got %+v", sc)
+	}
+	if sc = scenesOf(nil); sc.Start != -1 || len(sc.Times) != 0 {
+		t.Fatalf("got %+v", sc)
+	}
+}
+
+func TestScenesAPI(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "clip.srt": "1\n"}, options{})
+	if status, b := testGet(t, ts.URL+"/api/scenes/clip.srt", ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d: %s", status, b)
+	}
+	if srv.media.ffmpeg == "" {
+		if status, b := testGet(t, ts.URL+"/api/scenes/clip.mp4", ""); status != http.StatusNotImplemented {
+			t.Fatalf("got status %d: %s", status, b)
+		}
+	}
+	if status, b := testGet(t, ts.URL+"/thumb/clip.mp4?t=-1", ""); status != http.StatusBadRequest {
+		t.Fatalf("got status %d: %s", status, b)
+	}
+}
+
+func TestScenesPreviews(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"testsrc.mp4": testVideo(t)}, options{})
+	testPage(t, ts.URL+"/api/scenes/testsrc.mp4", "", `"previews":["/thumb/testsrc.mp4?t=`)
+}
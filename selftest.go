@@ -0,0 +1,187 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// selfTestFiles is the synthetic library generated by selftest. The content
+// doesn't need to be valid media.
+func selfTestFiles() map[string][]byte {
+	// Smallest valid looking MP4: a single ftyp box.
+	mp4 := []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isommp41")
+	// MPEG-TS packets are 188 bytes starting with the sync byte 0x47.
+	ts := bytes.Repeat(append([]byte{0x47}, bytes.Repeat([]byte{0xFF}, 187)...), 4)
+	m3u8 := []byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:2.0,\nseg0.ts\n#EXTINF:2.0,\nseg1.ts\n#EXT-X-ENDLIST\n")
+	return map[string][]byte{
+		"clip.mp4":         mp4,
+		"with space.mp4":   mp4,
+		"plus+sign.mp4":    mp4,
+		"percent%20.mp4":   mp4,
+		"hash#tag.mp4":     mp4,
+		"vidéo 日本.mp4":     mp4,
+		"sub dir/clip.mp4": mp4,
+		"vod/index.m3u8":   m3u8,
+		"vod/seg0.ts":      ts,
+		"vod/seg1.ts":      ts,
+		"music/song.mp3":   []byte("ID3\x04\x00\x00\x00\x00\x00\x00"),
+		"music/cover.jpg":  []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"),
+		"photos/still.png": []byte("\x89PNG\r\n\x1a\n"),
+		"movie/heat.nfo":   []byte("<movie><title>Heat</title></movie>\n"),
+		"clip.srt":         []byte("1\n00:00:00,000 --> 00:00:01,000\nHello\n"),
+	}
+}
+
+// selftest generates a small library in a temporary directory, serves it on
+// localhost and checks that the pages and the files are served. It is a smoke
+// test of the system it runs on; the features are covered by the go tests.
+func selftest(ctx context.Context) error {
+	root, err := os.MkdirTemp("", "serve-videos-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	files := selfTestFiles()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return err
+		}
+		if err = os.WriteFile(p, content, 0o600); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	srv, err := newServer(ctx, root, defaultExts, options{})
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s := &http.Server{Handler: srv.handler()}
+	go s.Serve(l)
+	defer s.Close()
+	base := "http://" + l.Addr().String()
+	slog.Info("selftest", "root", root, "url", base)
+
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err)
+		} else {
+			fmt.Printf("PASS %s\n", name)
+		}
+	}
+	check("root page", selfTestPage(ctx, base+"/", "const data = "))
+	check("list page", selfTestPage(ctx, base+"/list", "const data = "))
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if !slices.Contains(defaultExts, strings.TrimPrefix(path.Ext(name), ".")) {
+			check("not served "+name, selfTestStatus(ctx, base+rawURL(name), http.StatusNotFound))
+			continue
+		}
+		check("raw "+name, selfTestRaw(ctx, base+rawURL(name), files[name], mimeType(name)))
+		check("range "+name, selfTestRange(ctx, base+rawURL(name), files[name]))
+	}
+	check("unknown file", selfTestStatus(ctx, base+"/raw/missing.mp4", http.StatusNotFound))
+	check("path traversal", selfTestStatus(ctx, base+"/raw/..%2f..%2fetc%2fpasswd", http.StatusNotFound))
+	if failed != 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	fmt.Printf("All checks passed\n")
+	return nil
+}
+
+func selfTestGet(ctx context.Context, u string, hdr http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp, b, err
+}
+
+func selfTestStatus(ctx context.Context, u string, want int) error {
+	resp, _, err := selfTestGet(ctx, u, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, want)
+	}
+	return nil
+}
+
+func selfTestPage(ctx context.Context, u, want string) error {
+	resp, b, err := selfTestGet(ctx, u, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	if !bytes.Contains(b, []byte(want)) {
+		return fmt.Errorf("missing %q", want)
+	}
+	return nil
+}
+
+func selfTestRaw(ctx context.Context, u string, want []byte, wantType string) error {
+	resp, b, err := selfTestGet(ctx, u, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	if !bytes.Equal(b, want) {
+		return errors.New("content mismatch")
+	}
+	if t := resp.Header.Get("Content-Type"); wantType != "" && t != wantType {
+		return fmt.Errorf("got Content-Type %q, want %q", t, wantType)
+	}
+	return nil
+}
+
+func selfTestRange(ctx context.Context, u string, want []byte) error {
+	resp, b, err := selfTestGet(ctx, u, http.Header{"Range": {"bytes=2-5"}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	if !bytes.Equal(b, want[2:6]) {
+		return errors.New("content mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// runningAsService is only set on Windows.
+const runningAsService = false
+
+// runService returns false since services are only supported on Windows.
+func runService(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	return false, nil
+}
+
+func installService(args []string) error {
+	return errors.New("service is only supported on Windows; use systemd or launchd")
+}
+
+func uninstallService() error {
+	return installService(nil)
+}
+
+func openEventLog() (io.Writer, error) {
+	return nil, errors.New("-log-output eventlog is only supported on Windows")
+}
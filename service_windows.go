@@ -0,0 +1,181 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the service and of the event log source.
+const serviceName = "serve-videos"
+
+// runningAsService is set when started by the service control manager.
+var runningAsService bool
+
+// runService runs fn as a Windows service, until it returns or the service is
+// stopped, if the process was started by the service control manager.
+func runService(ctx context.Context, fn func(ctx context.Context) error) (bool, error) {
+	ok, err := svc.IsWindowsService()
+	if err != nil || !ok {
+		return false, err
+	}
+	runningAsService = true
+	h := &serviceHandler{ctx: ctx, fn: fn}
+	if err = svc.Run(serviceName, h); err == nil {
+		err = h.err
+	}
+	if err != nil {
+		// There is no console to print it to.
+		if l, err2 := eventlog.Open(serviceName); err2 == nil {
+			_ = l.Error(1, err.Error())
+			_ = l.Close()
+		}
+	}
+	return true, err
+}
+
+// serviceHandler runs fn and cancels its context when the service is stopped.
+type serviceHandler struct {
+	ctx context.Context
+	fn  func(ctx context.Context) error
+	err error
+}
+
+func (s *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.fn(ctx) }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case s.err = <-done:
+			if s.err != nil {
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// installService registers the service, started automatically with args, and
+// the event log source.
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		_ = s.Close()
+		return fmt.Errorf("service %s already exists; uninstall it first", serviceName)
+	}
+	c := mgr.Config{
+		DisplayName: "serve-videos",
+		Description: "Serves a directory of videos over HTTP.",
+		StartType:   mgr.StartAutomatic,
+	}
+	s, err := m.CreateService(serviceName, exe, c, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// Restart after a crash, waiting a bit more each time.
+	actions := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err = s.SetRecoveryActions(actions, uint32(24*time.Hour/time.Second)); err != nil {
+		return err
+	}
+	if err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return err
+	}
+	slog.Info("service", "installed", serviceName, "args", args)
+	return nil
+}
+
+// uninstallService deletes the service and the event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	if err = eventlog.Remove(serviceName); err != nil {
+		return err
+	}
+	slog.Info("service", "uninstalled", serviceName)
+	return nil
+}
+
+// eventLogWriter writes each line to the event log, with the type of the
+// priority prefix set by journalWriter.
+type eventLogWriter struct {
+	l *eventlog.Log
+}
+
+func openEventLog() (io.Writer, error) {
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("-log-output eventlog requires service install: %w", err)
+	}
+	return &eventLogWriter{l: l}, nil
+}
+
+func (e *eventLogWriter) Write(b []byte) (int, error) {
+	msg := string(b)
+	prio := 6
+	if len(msg) >= 3 && msg[0] == '<' && msg[2] == '>' {
+		prio, _ = strconv.Atoi(msg[1:2])
+		msg = msg[3:]
+	}
+	var err error
+	switch {
+	case prio <= 3:
+		err = e.l.Error(1, msg)
+	case prio == 4:
+		err = e.l.Warning(1, msg)
+	default:
+		err = e.l.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
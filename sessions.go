@@ -0,0 +1,180 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// sessionCommand is a command sent to a player by the remote-control API.
+type sessionCommand struct {
+	Command string  `json:"command"`
+	Time    float64 `json:"time,omitempty"`
+	File    string  `json:"file,omitempty"`
+}
+
+// sessionState is the playback state reported by a player.
+type sessionState struct {
+	File    string  `json:"file"`
+	Playing bool    `json:"playing"`
+	Time    float64 `json:"time"`
+}
+
+// session is a watch page connected to receive commands.
+type session struct {
+	ID string `json:"id"`
+	// User is the user of the watch page. The other users can't see or
+	// control it, except the admins.
+	User      string    `json:"user"`
+	UserAgent string    `json:"user_agent"`
+	Addr      string    `json:"addr"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	sessionState
+
+	conn *websocket.Conn
+}
+
+// sessions are the players that can be remote controlled.
+type sessions struct {
+	mu   sync.Mutex
+	next int
+	m    map[string]*session
+}
+
+func (ss *sessions) add(c *websocket.Conn, req *http.Request) *session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.m == nil {
+		ss.m = map[string]*session{}
+	}
+	ss.next++
+	now := time.Now()
+	se := &session{
+		ID:        strconv.Itoa(ss.next),
+		User:      userFrom(req),
+		UserAgent: req.UserAgent(),
+		Addr:      req.RemoteAddr,
+		Started:   now,
+		Updated:   now,
+		conn:      c,
+	}
+	ss.m[se.ID] = se
+	return se
+}
+
+func (ss *sessions) remove(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.m, id)
+}
+
+func (ss *sessions) update(id string, st sessionState) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if se := ss.m[id]; se != nil {
+		se.sessionState = st
+		se.Updated = time.Now()
+	}
+}
+
+func (ss *sessions) get(id string) *session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.m[id]
+}
+
+// list returns a copy of the sessions, oldest first.
+func (ss *sessions) list() []session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	out := make([]session, 0, len(ss.m))
+	for _, se := range ss.m {
+		out = append(out, *se)
+	}
+	slices.SortFunc(out, func(a, b session) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// serveSessionWS registers a watch page as a session. The page reports its
+// state and receives the commands.
+func (s *server) serveSessionWS(w http.ResponseWriter, req *http.Request) {
+	websocket.Server{
+		Handshake: checkSameOrigin,
+		Handler: func(c *websocket.Conn) {
+			// Remove the deadline set by the http.Server's ReadTimeout.
+			_ = c.SetReadDeadline(time.Time{})
+			se := s.sessions.add(c, req)
+			defer s.sessions.remove(se.ID)
+			for {
+				var st sessionState
+				if err := websocket.JSON.Receive(c, &st); err != nil {
+					return
+				}
+				s.sessions.update(se.ID, st)
+			}
+		},
+	}.ServeHTTP(w, req)
+}
+
+// canControl returns true if the user of the request owns the session or is an
+// admin.
+func (s *server) canControl(req *http.Request, se *session) bool {
+	return se.User == userFrom(req) || s.isAdmin(req)
+}
+
+// serveSessionsAPI lists the active playback sessions of the user, or all of
+// them for the admins.
+func (s *server) serveSessionsAPI(w http.ResponseWriter, req *http.Request) {
+	out := slices.DeleteFunc(s.sessions.list(), func(se session) bool { return !s.canControl(req, &se) })
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"sessions": out})
+}
+
+// serveSessionCommand sends a command to a session: play, pause, seek?t=<s>
+// or load?f=<file>.
+func (s *server) serveSessionCommand(w http.ResponseWriter, req *http.Request) {
+	se := s.sessions.get(req.PathValue("id"))
+	if se == nil || !s.canControl(req, se) {
+		http.Error(w, "Unknown session", 404)
+		return
+	}
+	cmd := sessionCommand{Command: req.PathValue("command")}
+	switch cmd.Command {
+	case "play", "pause":
+	case "seek":
+		t, err := strconv.ParseFloat(req.FormValue("t"), 64)
+		if err != nil || t < 0 {
+			http.Error(w, "Invalid t", 400)
+			return
+		}
+		cmd.Time = t
+	case "load":
+		cmd.File = strings.TrimPrefix(req.FormValue("f"), "/")
+		if !s.inLibrary(cmd.File) || !s.canAccess(req, cmd.File) {
+			http.Error(w, "Unknown file", 404)
+			return
+		}
+	default:
+		http.Error(w, "Unknown command", 404)
+		return
+	}
+	_ = se.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Send(se.conn, &cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestSessions registers a session and remote controls it.
+func TestSessions(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	c := testWebSocket(t, ts.URL, "/api/sessions/ws", "")
+	if err := websocket.JSON.Send(c, &sessionState{File: "clip.mp4", Playing: true, Time: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// The state is processed asynchronously.
+	var data struct {
+		Sessions []session `json:"sessions"`
+	}
+	for i := 0; ; i++ {
+		if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/sessions", "", "")), &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Sessions) == 1 && data.Sessions[0].File == "clip.mp4" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("unexpected sessions %+v", data.Sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cmd := ts.URL + "/api/sessions/" + data.Sessions[0].ID + "/"
+	if resp, _ := testDo(t, "POST", cmd+"seek?t=42", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	var got sessionCommand
+	if err := websocket.JSON.Receive(c, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Command != "seek" || got.Time != 42 {
+		t.Fatalf("unexpected command %+v", got)
+	}
+	for _, u := range []string{cmd + "load?f=missing.mp4", ts.URL + "/api/sessions/0/play"} {
+		if resp, _ := testDo(t, "POST", u, "", "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: got status %d", u, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// share is a link giving access to a file without authentication.
+type share struct {
+	ID   string `json:"id"`
+	File string `json:"file"`
+	// Clip is the ID of the clip of File shared, if any.
+	Clip    string    `json:"clip,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Created time.Time `json:"created"`
+	// Expires is nil for a link that never expires.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Hits counts the downloads; MaxHits limits them when not 0.
+	Hits    int `json:"hits"`
+	MaxHits int `json:"max_hits,omitempty"`
+	// Password is the salt followed by the hash of the password of a
+	// protected link; see sharePassword.
+	Password []byte `json:"password,omitempty"`
+	// Grants are the cookies given to the clients that downloaded a limited
+	// or protected link, so they can seek in the video without counting more
+	// downloads or asking the password again.
+	Grants []shareGrant `json:"tokens,omitempty"`
+	// Protected replaces Password and Grants in the lists.
+	Protected bool `json:"protected,omitempty"`
+
+	// failures counts the wrong passwords in a row; the link refuses the
+	// passwords until retry once it reaches shareMaxFailures.
+	failures int
+	retry    time.Time
+}
+
+// shareGrant is a cookie given to a client by a link.
+type shareGrant struct {
+	// Hash is the SHA-256 of the cookie.
+	Hash    []byte    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+const (
+	// sharePasswordIter is the number of PBKDF2 iterations to hash the
+	// passwords of the links.
+	sharePasswordIter = 600_000
+	// shareSaltSize is the size of the salt prefixing the hash of a password.
+	shareSaltSize = 16
+	// shareMaxFailures is the number of wrong passwords tried in a row
+	// before the link is throttled, starting at a second and doubling on
+	// each failure up to shareMaxRetry.
+	shareMaxFailures = 5
+	shareMaxRetry    = time.Hour
+	// shareMaxHashes is the number of passwords hashed at once, so the
+	// guesses can't saturate the CPUs.
+	shareMaxHashes = 2
+	// shareGrantTTL is how long a client keeps the access to a limited or
+	// protected link, and shareMaxGrants how many clients keep it at once.
+	shareGrantTTL  = 24 * time.Hour
+	shareMaxGrants = 32
+	// shareMaxTTL is the longest a link can be valid for before expiring.
+	shareMaxTTL = 10 * 365 * 24 * time.Hour
+)
+
+// expired returns true if the link cannot be used anymore.
+func (sh *share) expired(now time.Time) bool {
+	return sh.Expires != nil && !now.Before(*sh.Expires)
+}
+
+// sharePassword returns the salt followed by the hash of the password. A
+// new salt is generated if salt is nil.
+func sharePassword(password string, salt []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, shareSaltSize)
+		_, _ = rand.Read(salt)
+	}
+	k, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIter, sha256.Size)
+	if err != nil {
+		panic(err)
+	}
+	return append(salt[:shareSaltSize:shareSaltSize], k...)
+}
+
+// checkPassword returns true if password matches the hash h returned by
+// sharePassword.
+func checkPassword(h []byte, password string) bool {
+	if len(h) != shareSaltSize+sha256.Size {
+		return false
+	}
+	return subtle.ConstantTimeCompare(h, sharePassword(password, h[:shareSaltSize])) == 1
+}
+
+// hasGrant returns true if the cookie token was given by the link and didn't
+// expire.
+func (sh *share) hasGrant(token string, now time.Time) bool {
+	h := sha256.Sum256([]byte(token))
+	for _, g := range sh.Grants {
+		if now.Before(g.Expires) && subtle.ConstantTimeCompare(g.Hash, h[:]) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneGrants drops the expired grants and the oldest ones above
+// shareMaxGrants-1, to make room for a new one.
+func (sh *share) pruneGrants(now time.Time) {
+	sh.Grants = slices.DeleteFunc(sh.Grants, func(g shareGrant) bool {
+		return !now.Before(g.Expires)
+	})
+	if n := len(sh.Grants) - shareMaxGrants + 1; n > 0 {
+		sh.Grants = slices.Delete(sh.Grants, 0, n)
+	}
+}
+
+// errShareThrottled is returned when too many wrong passwords were tried.
+type errShareThrottled struct {
+	retry time.Duration
+}
+
+func (e *errShareThrottled) Error() string {
+	return "too many wrong passwords, retry in " + e.retry.String()
+}
+
+var (
+	errShareInvalid  = errors.New("invalid link")
+	errSharePassword = errors.New("wrong password")
+	errShareLimit    = errors.New("the link reached its download limit")
+)
+
+// shares are the share links by ID.
+//
+// They are saved to p when not empty.
+type shares struct {
+	p string
+	// hashing holds a slot per password being hashed.
+	hashing chan struct{}
+
+	mu    sync.Mutex
+	links map[string]*share
+	dirty bool
+}
+
+// newShares loads the links saved in p, if any.
+func newShares(p string) (*shares, error) {
+	sh := &shares{p: p, hashing: make(chan struct{}, shareMaxHashes), links: map[string]*share{}}
+	if err := readJSON(p, &sh.links); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// create returns a new link to the file, or its clip if not empty, valid for
+// ttl, or forever if 0. It can be downloaded maxHits times if not 0, and
+// requires the password if not empty.
+func (sh *shares) create(user, name, clipID string, ttl time.Duration, maxHits int, password string) share {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	l := &share{ID: base64.RawURLEncoding.EncodeToString(b[:]), File: name, Clip: clipID, User: user, Created: time.Now().UTC().Truncate(time.Second), MaxHits: maxHits}
+	if ttl > 0 {
+		e := l.Created.Add(ttl)
+		l.Expires = &e
+	}
+	if password != "" {
+		l.Password = sharePassword(password, nil)
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.links[l.ID] = l
+	sh.dirty = true
+	return l.public()
+}
+
+// public returns a copy of the link without its secrets.
+func (sh *share) public() share {
+	out := *sh
+	out.Protected = sh.Password != nil
+	out.Password = nil
+	out.Grants = nil
+	return out
+}
+
+// list returns the links that didn't expire, oldest first.
+func (sh *shares) list() []share {
+	now := time.Now()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	out := make([]share, 0, len(sh.links))
+	for _, l := range sh.links {
+		if !l.expired(now) {
+			out = append(out, l.public())
+		}
+	}
+	slices.SortFunc(out, func(a, b share) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return out
+}
+
+// get returns the link if it exists, even if expired.
+func (sh *shares) get(id string) (share, bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	l := sh.links[id]
+	if l == nil {
+		return share{}, false
+	}
+	return l.public(), true
+}
+
+// use returns the link for a client having the cookie token, or the password
+// of a protected link. A download is counted unless the client already has a
+// token; for the limited and protected links, the client gets a new token
+// valid until expires to send back on the next requests.
+//
+// The password is checked without holding the lock, as hashing it is slow;
+// the link is throttled when shareMaxHashes passwords are already being
+// hashed.
+func (sh *shares) use(id, token, password string) (out share, newToken string, expires time.Time, err error) {
+	now := time.Now()
+	sh.mu.Lock()
+	l := sh.links[id]
+	if l == nil || l.expired(now) {
+		sh.mu.Unlock()
+		return share{}, "", expires, errShareInvalid
+	}
+	if l.MaxHits == 0 && l.Password == nil {
+		l.Hits++
+		sh.dirty = true
+		sh.mu.Unlock()
+		return l.public(), "", expires, nil
+	}
+	if token != "" && l.hasGrant(token, now) {
+		sh.mu.Unlock()
+		return l.public(), "", expires, nil
+	}
+	h := l.Password
+	if h != nil {
+		if password == "" {
+			sh.mu.Unlock()
+			return share{}, "", expires, errSharePassword
+		}
+		if now.Before(l.retry) {
+			sh.mu.Unlock()
+			return share{}, "", expires, &errShareThrottled{retry: l.retry.Sub(now).Round(time.Second)}
+		}
+		select {
+		case sh.hashing <- struct{}{}:
+		default:
+			sh.mu.Unlock()
+			return share{}, "", expires, &errShareThrottled{retry: time.Second}
+		}
+		// Count the attempt as a failure before hashing, so the concurrent
+		// guesses are throttled too. It is forgiven if the password matches.
+		if l.failures++; l.failures >= shareMaxFailures {
+			l.retry = now.Add(min(time.Second<<(l.failures-shareMaxFailures), shareMaxRetry))
+		}
+	}
+	sh.mu.Unlock()
+	ok := true
+	if h != nil {
+		ok = checkPassword(h, password)
+		<-sh.hashing
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.links[id] != l {
+		return share{}, "", expires, errShareInvalid
+	}
+	if !ok {
+		return share{}, "", expires, errSharePassword
+	}
+	l.failures = 0
+	l.retry = time.Time{}
+	if l.MaxHits != 0 && l.Hits >= l.MaxHits {
+		return share{}, "", expires, errShareLimit
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	newToken = base64.RawURLEncoding.EncodeToString(b[:])
+	expires = now.Add(shareGrantTTL)
+	if l.Expires != nil && l.Expires.Before(expires) {
+		expires = *l.Expires
+	}
+	t := sha256.Sum256([]byte(newToken))
+	l.pruneGrants(now)
+	l.Grants = append(l.Grants, shareGrant{Hash: t[:], Expires: expires})
+	l.Hits++
+	sh.dirty = true
+	return l.public(), newToken, expires, nil
+}
+
+// revoke deletes the link, returning false if it didn't exist.
+func (sh *shares) revoke(id string) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.links[id] == nil {
+		return false
+	}
+	delete(sh.links, id)
+	sh.dirty = true
+	return true
+}
+
+// save writes the links to disk if they changed. The expired ones are
+// dropped.
+func (sh *shares) save() error {
+	sh.mu.Lock()
+	if sh.p == "" || !sh.dirty {
+		sh.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	for id, l := range sh.links {
+		if l.expired(now) {
+			delete(sh.links, id)
+		} else {
+			l.Grants = slices.DeleteFunc(l.Grants, func(g shareGrant) bool {
+				return !now.Before(g.Expires)
+			})
+		}
+	}
+	b, err := json.Marshal(sh.links)
+	sh.dirty = false
+	sh.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sh.p, b)
+}
+
+// shareURL returns the escaped URL path of a share link.
+func shareURL(id string) string {
+	return "/share/" + id
+}
+
+// shareCookie is the cookie holding the token of a limited or protected link.
+const shareCookie = "share"
+
+// serveShare serves the file of a share link. It doesn't require
+// authentication. A protected link shows a form to enter the password, which
+// is POSTed back.
+func (s *server) serveShare(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	token, password := "", ""
+	if c, err := req.Cookie(shareCookie); err == nil {
+		token = c.Value
+	}
+	if req.Method == http.MethodPost {
+		req.Body = http.MaxBytesReader(w, req.Body, 4096)
+		password = req.PostFormValue("password")
+	}
+	l, newToken, expires, err := s.shares.use(id, token, password)
+	f := l.File
+	var cl clip
+	if err == nil && l.Clip != "" {
+		var ok bool
+		if cl, ok = s.clips.get(l.Clip); !ok || cl.File != f {
+			err = errShareInvalid
+		}
+	}
+	var throttled *errShareThrottled
+	switch {
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(max(throttled.retry, time.Second)/time.Second)))
+		http.Error(w, "Too many wrong passwords, try again later", http.StatusTooManyRequests)
+		return
+	case errors.Is(err, errSharePassword):
+		s.serveHTML(w, shareHTML, map[string]any{"wrong": password != ""})
+		return
+	case errors.Is(err, errShareLimit):
+		http.Error(w, "The link reached its download limit", http.StatusGone)
+		return
+	case err != nil || !s.hasFile(f):
+		http.Error(w, "Invalid link", 404)
+		return
+	}
+	if newToken != "" {
+		http.SetCookie(w, &http.Cookie{Name: shareCookie, Value: newToken, Path: shareURL(id), Expires: expires, HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: req.TLS != nil})
+	}
+	if req.Method == http.MethodPost {
+		http.Redirect(w, req, shareURL(id), http.StatusSeeOther)
+		return
+	}
+	if l.Clip != "" {
+		s.serveClipMedia(w, req, cl)
+		return
+	}
+	if t := mimeType(f); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	s.serveContent(w, req, f)
+}
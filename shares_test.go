@@ -0,0 +1,182 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharePassword(t *testing.T) {
+	a, b := sharePassword("hunter2", nil), sharePassword("hunter2", nil)
+	if bytes.Equal(a, b) {
+		t.Fatal("the passwords are not salted")
+	}
+	if !checkPassword(a, "hunter2") || checkPassword(a, "hunter3") || checkPassword(a[:32], "hunter2") {
+		t.Fatal("checkPassword is wrong")
+	}
+}
+
+func TestShareThrottle(t *testing.T) {
+	sh, _ := newShares("")
+	l := sh.create("", "clip.mp4", "", 0, 0, "hunter2")
+	for i := range shareMaxFailures {
+		if _, _, _, err := sh.use(l.ID, "", "wrong"); !errors.Is(err, errSharePassword) {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	var throttled *errShareThrottled
+	if _, _, _, err := sh.use(l.ID, "", "hunter2"); !errors.As(err, &throttled) || throttled.retry != time.Second {
+		t.Fatalf("the link was not throttled: %v", err)
+	}
+	sh.links[l.ID].retry = time.Time{}
+	if _, token, _, err := sh.use(l.ID, "", "hunter2"); err != nil || token == "" {
+		t.Fatal(err)
+	}
+	if sh.links[l.ID].failures != 0 {
+		t.Fatal("the failures were not reset")
+	}
+}
+
+func TestShareGrants(t *testing.T) {
+	sh, _ := newShares("")
+	l := sh.create("", "clip.mp4", "", time.Hour, 100, "")
+	var tokens []string
+	for range shareMaxGrants + 1 {
+		_, token, expires, err := sh.use(l.ID, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expires.Equal(*l.Expires) {
+			t.Fatalf("the grant outlives the link: %s", expires)
+		}
+		tokens = append(tokens, token)
+	}
+	if got := len(sh.links[l.ID].Grants); got != shareMaxGrants {
+		t.Fatalf("got %d grants", got)
+	}
+	now := time.Now()
+	if sh.links[l.ID].hasGrant(tokens[0], now) || !sh.links[l.ID].hasGrant(tokens[1], now) {
+		t.Fatal("the oldest grant was not pruned")
+	}
+	if sh.links[l.ID].hasGrant(tokens[1], now.Add(2*time.Hour)) {
+		t.Fatal("the grant didn't expire")
+	}
+}
+
+func TestShareThrottleConcurrent(t *testing.T) {
+	sh, _ := newShares("")
+	l := sh.create("", "clip.mp4", "", 0, 0, "hunter2")
+	errs := make(chan error)
+	for range 4 * shareMaxFailures {
+		go func() {
+			_, _, _, err := sh.use(l.ID, "", "wrong")
+			errs <- err
+		}()
+	}
+	hashed := 0
+	for range 4 * shareMaxFailures {
+		err := <-errs
+		var throttled *errShareThrottled
+		if errors.Is(err, errSharePassword) {
+			hashed++
+		} else if !errors.As(err, &throttled) {
+			t.Fatal(err)
+		}
+	}
+	if hashed > shareMaxFailures {
+		t.Fatalf("%d passwords were hashed", hashed)
+	}
+	// A guess is throttled while shareMaxHashes passwords are being hashed.
+	sh.links[l.ID].retry = time.Time{}
+	for range shareMaxHashes {
+		sh.hashing <- struct{}{}
+	}
+	var throttled *errShareThrottled
+	if _, _, _, err := sh.use(l.ID, "", "hunter2"); !errors.As(err, &throttled) {
+		t.Fatalf("the hash was not throttled: %v", err)
+	}
+}
+
+// TestShareLimits checks the password form, the download limit and the
+// throttling of the guesses over HTTP.
+func TestShareLimits(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	resp, b := testDo(t, "POST", ts.URL+"/api/v1/shares", "", `{"file":"clip.mp4","max_hits":1,"password":"hunter2"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	var created struct {
+		Data v1Share `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(b), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !created.Data.Protected || created.Data.Password != nil {
+		t.Fatal("the password was leaked")
+	}
+	u := ts.URL + created.Data.URL
+	testPage(t, u, "", `<form method=post>`)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Jar: jar}
+	post := func(c *http.Client, password string) (*http.Response, string) {
+		req, err2 := http.NewRequestWithContext(t.Context(), "POST", u, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r, err2 := c.Do(req)
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		defer r.Body.Close()
+		body, err2 := io.ReadAll(r.Body)
+		if err2 != nil {
+			t.Fatal(err2)
+		}
+		return r, string(body)
+	}
+	if _, b = post(c, "wrong"); !strings.Contains(b, `"wrong":true`) {
+		t.Fatalf("the wrong password was accepted: %q", b)
+	}
+	if _, b = post(c, "hunter2"); b != testMP4 {
+		t.Fatalf("got %q", b)
+	}
+	// Seeking doesn't count another download.
+	req, err := http.NewRequestWithContext(t.Context(), "GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=1-")
+	if resp, err = c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if resp, _ = post(http.DefaultClient, "hunter2"); resp.StatusCode != http.StatusGone {
+		t.Fatalf("a second download was allowed: %d", resp.StatusCode)
+	}
+	// Guessing the password is throttled.
+	for range shareMaxFailures {
+		post(http.DefaultClient, "wrong")
+	}
+	if resp, _ = post(http.DefaultClient, "hunter2"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("the password guesses were not throttled: %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/v1/shares", "", `"hits":1,"max_hits":1,"protected":true`)
+}
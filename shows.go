@@ -0,0 +1,91 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// episodeEntry is an episode as listed on the shows page.
+type episodeEntry struct {
+	File    string `json:"file"`
+	Episode int    `json:"episode"`
+	Title   string `json:"title,omitempty"`
+}
+
+type seasonEntry struct {
+	Season   int            `json:"season"`
+	Episodes []episodeEntry `json:"episodes"`
+}
+
+// showEntry is a show with its episodes grouped by season.
+type showEntry struct {
+	Name string `json:"name"`
+	Year int    `json:"year,omitempty"`
+	// Poster is the file whose artwork is the show's poster, if any.
+	Poster  string        `json:"poster,omitempty"`
+	Seasons []seasonEntry `json:"seasons"`
+}
+
+// movieEntry is a movie as listed on the shows page.
+type movieEntry struct {
+	File   string `json:"file"`
+	Title  string `json:"title"`
+	Year   int    `json:"year,omitempty"`
+	Poster bool   `json:"poster,omitempty"`
+}
+
+// shows groups the videos with metadata the user of the request can see into
+// shows and movies, sorted by name.
+func (s *server) shows(req *http.Request) ([]showEntry, []movieEntry) {
+	byName := map[string]*showEntry{}
+	movies := []movieEntry{}
+	for f, sc := range visibleKeys(s.opts.access, userFrom(req), s.sidecars()) {
+		if sc.Show == "" {
+			if sc.Title != "" {
+				movies = append(movies, movieEntry{File: f, Title: sc.Title, Year: sc.Year, Poster: sc.Poster})
+			}
+			continue
+		}
+		key := strings.ToLower(sc.Show)
+		sh := byName[key]
+		if sh == nil {
+			sh = &showEntry{Name: sc.Show, Year: sc.Year}
+			byName[key] = sh
+		}
+		if sh.Poster == "" && sc.Poster {
+			sh.Poster = f
+		}
+		i := slices.IndexFunc(sh.Seasons, func(se seasonEntry) bool { return se.Season == sc.Season })
+		if i == -1 {
+			sh.Seasons = append(sh.Seasons, seasonEntry{Season: sc.Season})
+			i = len(sh.Seasons) - 1
+		}
+		sh.Seasons[i].Episodes = append(sh.Seasons[i].Episodes, episodeEntry{File: f, Episode: sc.Episode, Title: sc.Title})
+	}
+	shows := make([]showEntry, 0, len(byName))
+	for _, sh := range byName {
+		slices.SortFunc(sh.Seasons, func(a, b seasonEntry) int { return cmp.Compare(a.Season, b.Season) })
+		for _, se := range sh.Seasons {
+			slices.SortFunc(se.Episodes, func(a, b episodeEntry) int {
+				return cmp.Or(cmp.Compare(a.Episode, b.Episode), strings.Compare(a.File, b.File))
+			})
+		}
+		shows = append(shows, *sh)
+	}
+	slices.SortFunc(shows, func(a, b showEntry) int { return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) })
+	slices.SortFunc(movies, func(a, b movieEntry) int {
+		return cmp.Or(strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title)), cmp.Compare(a.Year, b.Year), strings.Compare(a.File, b.File))
+	})
+	return shows, movies
+}
+
+func (s *server) serveShows(w http.ResponseWriter, req *http.Request) {
+	shows, movies := s.shows(req)
+	s.serveHTML(w, showsHTML, map[string]any{"shows": shows, "movies": movies})
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShows(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "shows/Private alice\n")
+	_, ts := newTestServer(t, map[string]string{
+		"movie/heat.mp4":                       testMP4,
+		"movie/heat.nfo":                       "<movie><title>Heat</title><year>1995</year></movie>\n",
+		"shows/The Office/Season 2/S02E02.mkv": testMP4,
+		"shows/The Office/Season 2/S02E01.mkv": testMP4,
+		"shows/The Office/Season 1/S01E01.mkv": testMP4,
+		"shows/Private/Season 1/S01E01.mkv":    testMP4,
+	}, options{users: u, access: a})
+	b := testPage(t, ts.URL+"/shows", "bob", `"shows":[{"name":"The Office","seasons":[`+
+		`{"season":1,"episodes":[{"file":"shows/The Office/Season 1/S01E01.mkv","episode":1}]},`+
+		`{"season":2,"episodes":[{"file":"shows/The Office/Season 2/S02E01.mkv","episode":1},{"file":"shows/The Office/Season 2/S02E02.mkv","episode":2}]}]}]`)
+	testPage(t, ts.URL+"/shows", "bob", `"movies":[{"file":"movie/heat.mp4","title":"Heat","year":1995}]`)
+	testPage(t, ts.URL+"/shows", "alice", `{"name":"Private","seasons":[`)
+	if strings.Contains(b, "Private") {
+		t.Fatalf("bob can see a denied show: %q", b)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// connKey is the context key of the connection of a request.
+type connKey struct{}
+
+// connContext records the connection in the context of its requests, so the
+// streams can be cut at shutdown. It is used as http.Server.ConnContext.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// drainHandler rejects the requests received while shutting down, asking the
+// client to retry once the server is back.
+func (s *server) drainHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.draining.Load() {
+			h.ServeHTTP(w, req)
+			return
+		}
+		hdr := w.Header()
+		if req.ProtoMajor == 1 {
+			// HTTP/2 doesn't allow it; the server sends GOAWAY instead.
+			hdr.Set("Connection", "close")
+		}
+		hdr.Set("Retry-After", strconv.Itoa(int(s.opts.shutdownGrace/time.Second)+1))
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+	})
+}
+
+// shutdown stops accepting connections then waits up to the grace period for
+// the requests in flight to complete. The files being streamed are cut
+// immediately unless drainStreams is set; players resume them anyway. root is
+// closed last.
+func (s *server) shutdown(hs *http.Server) error {
+	s.draining.Store(true)
+	if !s.opts.drainStreams {
+		if n := s.streams.cut(); n != 0 {
+			slog.Info("shutdown", "streams_cut", n)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.shutdownGrace)
+	defer cancel()
+	err := hs.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("shutdown", "msg", "grace period expired, closing the connections", "streams", len(s.streams.list()))
+		err = hs.Close()
+	}
+	return errors.Join(err, s.rootDir.Close())
+}
@@ -0,0 +1,23 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDraining(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{shutdownGrace: 10 * time.Second})
+	if status, _ := testGet(t, ts.URL+"/", ""); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	srv.draining.Store(true)
+	resp, _ := testDo(t, "GET", ts.URL+"/", "", "", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "11" || !resp.Close {
+		t.Fatalf("got status %d, Retry-After %q, close %t", resp.StatusCode, resp.Header.Get("Retry-After"), resp.Close)
+	}
+}
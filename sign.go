@@ -0,0 +1,152 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5" // #nosec G501; required for nginx compatibility.
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signer signs and verifies /raw/ URLs with a shared secret.
+//
+// The scheme is the one of nginx's secure_link module configured with:
+//
+//	secure_link $arg_md5,$arg_expires;
+//	secure_link_md5 "$secure_link_expires$uri <secret>";
+//
+// so a CDN or nginx in front can verify the URLs while serve-videos stays the
+// origin.
+type signer struct {
+	secret string
+	// ttl is the validity of the URLs generated.
+	ttl time.Duration
+	// required rejects unsigned requests to /raw/.
+	required bool
+}
+
+var (
+	errSignatureRequired = errors.New("signature required")
+	errSignatureInvalid  = errors.New("invalid signature")
+	errSignatureExpired  = errors.New("signature expired")
+)
+
+// hash returns the signature of the unescaped URL path p.
+func (s *signer) hash(p string, expires int64) string {
+	// #nosec G401
+	h := md5.Sum([]byte(strconv.FormatInt(expires, 10) + p + " " + s.secret))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// query returns the query arguments signing the unescaped URL path p.
+func (s *signer) query(p string, expires int64) string {
+	return "md5=" + s.hash(p, expires) + "&expires=" + strconv.FormatInt(expires, 10)
+}
+
+// rawURL returns the signed escaped URL path to fetch a file.
+func (s *signer) rawURL(name string) string {
+	return rawURL(name) + "?" + s.query("/raw/"+name, time.Now().Add(s.ttl).Unix())
+}
+
+// verify checks the signature of the request, if any.
+func (s *signer) verify(req *http.Request) error {
+	q := req.URL.Query()
+	if !q.Has("md5") {
+		if s.required {
+			return errSignatureRequired
+		}
+		return nil
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(q.Get("md5")), []byte(s.hash(req.URL.Path, expires))) != 1 {
+		return errSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+// signPlaylist signs the relative URIs in a playlist served at the unescaped
+// URL path p with the same expiration, so the segments can be fetched through
+// the CDN.
+//
+// Only the URIs in the directory of the playlist or below, whose unescaped
+// URL path is allowed by ok, are signed.
+func (s *signer) signPlaylist(b []byte, p string, expires int64, ok func(p string) bool) []byte {
+	dir := path.Dir(p)
+	sign := func(u string) string {
+		if strings.Contains(u, "://") || strings.HasPrefix(u, "/") || strings.Contains(u, "?") {
+			return u
+		}
+		v, err := url.PathUnescape(u)
+		if err != nil {
+			return u
+		}
+		if j := path.Join(dir, v); strings.HasPrefix(j, dir+"/") && ok(j) {
+			return u + "?" + s.query(j, expires)
+		}
+		return u
+	}
+	out := bytes.Buffer{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		l := sc.Text()
+		switch t := strings.TrimSpace(l); {
+		case t == "":
+		case !strings.HasPrefix(t, "#"):
+			l = sign(t)
+		default:
+			// e.g. #EXT-X-PART, #EXT-X-PRELOAD-HINT and #EXT-X-MAP.
+			if i := strings.Index(l, `URI="`); i != -1 {
+				if j := strings.IndexByte(l[i+5:], '"'); j != -1 {
+					l = l[:i+5] + sign(l[i+5:i+5+j]) + l[i+5+j:]
+				}
+			}
+		}
+		out.WriteString(l)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// serveSignedPlaylist serves a playlist requested with a signed URL, with its
+// segments signed too when the client can access them.
+func (s *server) serveSignedPlaylist(w http.ResponseWriter, req *http.Request, name string) {
+	b, err := s.readFile(name)
+	if err != nil {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	expires, _ := strconv.ParseInt(req.URL.Query().Get("expires"), 10, 64)
+	b = s.signer.signPlaylist(b, req.URL.Path, expires, func(p string) bool {
+		name, ok := strings.CutPrefix(p, "/raw/")
+		return ok && validPath(name) && s.canAccess(req, name)
+	})
+	w.Header().Set("Content-Type", mimeType(name))
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	_, _ = w.Write(b)
+}
+
+// linkURL returns the escaped URL path to fetch a file from outside the web
+// UI, e.g. in feeds and notifications. It is signed when -sign-secret is set.
+func (s *server) linkURL(name string) string {
+	if s.signer != nil {
+		return s.signer.rawURL(name)
+	}
+	return rawURL(name)
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigned(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{
+		"clip.mp4":       testMP4,
+		"vod/index.m3u8": "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n#EXT-X-ENDLIST\n",
+		"vod/seg0.ts":    "ts",
+	}, options{signSecret: "secret", signTTL: time.Hour})
+	if status, b := testGet(t, ts.URL+srv.signer.rawURL("clip.mp4"), ""); status != http.StatusOK || b != testMP4 {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+	testPage(t, ts.URL+srv.signer.rawURL("vod/index.m3u8"), "", "\nseg0.ts?md5=")
+	if status, _ := testGet(t, ts.URL+srv.signer.rawURL("clip.mp4")+"0", ""); status != http.StatusForbidden {
+		t.Fatalf("tampered: got status %d", status)
+	}
+	expired := &signer{secret: "secret", ttl: -time.Minute}
+	if status, _ := testGet(t, ts.URL+expired.rawURL("clip.mp4"), ""); status != http.StatusForbidden {
+		t.Fatalf("expired: got status %d", status)
+	}
+}
+
+// TestSignedAccess checks that a signed URL doesn't grant access to the files
+// denied by -access, directly or through a playlist.
+func TestSignedAccess(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	pl := "#EXTM3U\n#EXT-X-MAP:URI=\"../private/x.mp4\"\n#EXTINF:2.0,\nseg0.ts\n#EXTINF:2.0,\n../private/x.mp4\n#EXTINF:2.0,\nsub/../../private/x.mp4\n#EXT-X-ENDLIST\n"
+	srv, ts := newTestServer(t, map[string]string{
+		"incoming/index.m3u8": pl,
+		"incoming/seg0.ts":    "ts",
+		"private/x.mp4":       testMP4,
+	}, options{users: u, access: a, signSecret: "secret", signTTL: time.Hour})
+	status, b := testGet(t, ts.URL+srv.signer.rawURL("incoming/index.m3u8"), "bob")
+	if status != http.StatusOK || !strings.Contains(b, "\nseg0.ts?md5=") {
+		t.Fatalf("got %d %q", status, b)
+	}
+	if strings.Contains(b, "x.mp4?") {
+		t.Fatalf("signed a file out of the playlist's directory: %q", b)
+	}
+	for _, user := range []string{"bob", ""} {
+		if status, _ = testGet(t, ts.URL+srv.signer.rawURL("private/x.mp4"), user); status != http.StatusNotFound {
+			t.Fatalf("%q: got status %d", user, status)
+		}
+	}
+	if status, _ = testGet(t, ts.URL+srv.signer.rawURL("private/x.mp4"), "alice"); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+}
+
+func TestSignPlaylist(t *testing.T) {
+	s := &signer{secret: "secret"}
+	b := string(s.signPlaylist([]byte("a.ts\nsub/b.ts\n../c.ts\nsub/../../c.ts\n/raw/d.ts\nhttp://x/e.ts\n"), "/raw/dir/index.m3u8", 1, func(p string) bool {
+		return p != "/raw/dir/sub/b.ts"
+	}))
+	want := "a.ts?" + s.query("/raw/dir/a.ts", 1) + "\nsub/b.ts\n../c.ts\nsub/../../c.ts\n/raw/d.ts\nhttp://x/e.ts\n"
+	if b != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+}
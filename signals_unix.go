@@ -0,0 +1,16 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignals shut down the server gracefully. SIGTERM is sent by systemd and
+// docker.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
@@ -0,0 +1,11 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// stopSignals shut down the server gracefully. The service is stopped by the
+// service manager instead.
+var stopSignals = []os.Signal{os.Interrupt}
@@ -0,0 +1,178 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slugAlphabet excludes the characters easily confused with each other, like
+// 0 and o or 1 and l, so the short URLs can be read aloud or typed.
+const slugAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// slugMaxMisses is the number of unknown slugs a client can request per
+// minute, so the short URLs can't be enumerated.
+const slugMaxMisses = 10
+
+var (
+	errSlugUnknown   = errors.New("unknown short URL")
+	errSlugThrottled = errors.New("too many unknown short URLs")
+)
+
+// slugs are the short URLs /s/<slug> redirecting to the watch pages, as the
+// full escaped paths are unreadable and get mangled when pasted in an SMS. A
+// target always keeps the same slug. They are only created when asked for.
+//
+// The share links are not shortened: a slug is short enough to be guessed.
+//
+// They are saved to p when not empty.
+type slugs struct {
+	p string
+
+	mu sync.Mutex
+	// targets maps the slugs to the escaped URL paths; byTarget is the
+	// reverse.
+	targets  map[string]string
+	byTarget map[string]string
+	dirty    bool
+	// misses counts the unknown slugs requested by each client address
+	// since missesReset.
+	misses      map[string]int
+	missesReset time.Time
+}
+
+// newSlugs loads the slugs saved in p, if any.
+func newSlugs(p string) (*slugs, error) {
+	sl := &slugs{p: p, targets: map[string]string{}, byTarget: map[string]string{}, misses: map[string]int{}}
+	if err := readJSON(p, &sl.targets); err != nil {
+		return nil, err
+	}
+	for slug, t := range sl.targets {
+		if strings.HasPrefix(t, "/share/") {
+			// Saved by a previous version.
+			delete(sl.targets, slug)
+			sl.dirty = true
+			continue
+		}
+		sl.byTarget[t] = slug
+	}
+	return sl, nil
+}
+
+// get returns the slug of the target URL path, creating it if needed.
+func (sl *slugs) get(target string) string {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if slug, ok := sl.byTarget[target]; ok {
+		return slug
+	}
+	for {
+		var b [5]byte
+		for i := range b {
+			// Reject the bytes above the largest multiple of the alphabet's
+			// size, so every character is as likely.
+			for {
+				var c [1]byte
+				_, _ = rand.Read(c[:])
+				if int(c[0]) < 256-256%len(slugAlphabet) {
+					b[i] = slugAlphabet[int(c[0])%len(slugAlphabet)]
+					break
+				}
+			}
+		}
+		slug := string(b[:])
+		if _, ok := sl.targets[slug]; !ok {
+			sl.targets[slug] = target
+			sl.byTarget[target] = slug
+			sl.dirty = true
+			return slug
+		}
+	}
+}
+
+// lookup returns the slug of the target URL path, or "" if it has none.
+func (sl *slugs) lookup(target string) string {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.byTarget[target]
+}
+
+// resolve returns the URL path of the slug requested by the client addr. A
+// client is refused once it requested slugMaxMisses unknown slugs in the
+// minute.
+func (sl *slugs) resolve(addr, slug string) (string, error) {
+	now := time.Now()
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if now.Sub(sl.missesReset) >= time.Minute {
+		clear(sl.misses)
+		sl.missesReset = now
+	}
+	if sl.misses[addr] >= slugMaxMisses {
+		return "", errSlugThrottled
+	}
+	t, ok := sl.targets[slug]
+	if !ok {
+		sl.misses[addr]++
+		return "", errSlugUnknown
+	}
+	return t, nil
+}
+
+// save writes the slugs to disk if they changed.
+func (sl *slugs) save() error {
+	sl.mu.Lock()
+	if sl.p == "" || !sl.dirty {
+		sl.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(sl.targets)
+	sl.dirty = false
+	sl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sl.p, b)
+}
+
+// slugURL returns the short URL path of the target URL path, creating it if
+// needed.
+func (s *server) slugURL(target string) string {
+	return "/s/" + s.slugs.get(target)
+}
+
+// serveSlug redirects a short URL to its target. The browsers keep the
+// fragment, e.g. #t=<seconds>, across the redirect.
+func (s *server) serveSlug(w http.ResponseWriter, req *http.Request) {
+	t, err := s.slugs.resolve(clientAddr(req), req.PathValue("slug"))
+	switch {
+	case errors.Is(err, errSlugThrottled):
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many invalid links, try again later", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, "Invalid link", 404)
+		return
+	}
+	http.Redirect(w, req, t, http.StatusFound)
+}
+
+// serveSlugCreate returns the short URL of the watch page of a file,
+// creating it if needed.
+func (s *server) serveSlugCreate(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"short": s.slugURL(watchURL(f))})
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSlugs(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "slugs.json")
+	if err := os.WriteFile(p, []byte(`{"abcde":"/watch/a.mp4","fghjk":"/share/id"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sl, err := newSlugs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sl.resolve("x", "fghjk"); !errors.Is(err, errSlugUnknown) {
+		t.Fatalf("the share link was kept: %v", err)
+	}
+	if got, err2 := sl.resolve("a", "abcde"); err2 != nil || got != "/watch/a.mp4" {
+		t.Fatalf("got %q, %v", got, err2)
+	}
+	slug := sl.get("/watch/b.mp4")
+	if len(slug) != 5 || strings.Trim(slug, slugAlphabet) != "" || sl.get("/watch/b.mp4") != slug || sl.lookup("/watch/b.mp4") != slug {
+		t.Fatalf("unexpected slug %q", slug)
+	}
+	if sl.lookup("/watch/c.mp4") != "" {
+		t.Fatal("lookup created a slug")
+	}
+	for range slugMaxMisses {
+		if _, err = sl.resolve("a", "zzzzz"); !errors.Is(err, errSlugUnknown) {
+			t.Fatal(err)
+		}
+	}
+	if _, err = sl.resolve("a", slug); !errors.Is(err, errSlugThrottled) {
+		t.Fatalf("the client was not throttled: %v", err)
+	}
+	if _, err = sl.resolve("b", slug); err != nil {
+		t.Fatalf("another client was throttled: %v", err)
+	}
+}
+
+// TestSlugsHTTP checks that the short URLs are only created on demand and
+// require a login.
+func TestSlugsHTTP(t *testing.T) {
+	u, _ := testUsers(t, []string{"alice"}, "")
+	srv, ts := newTestServer(t, map[string]string{"sub dir/clip.mp4": testMP4}, options{users: u})
+	if status, _ := testGet(t, ts.URL+watchURL("sub dir/clip.mp4"), "alice"); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if srv.slugs.lookup(watchURL("sub dir/clip.mp4")) != "" {
+		t.Fatal("the watch page created a short URL")
+	}
+	resp, b := testDo(t, "POST", ts.URL+"/api/short/sub%20dir/clip.mp4", "alice", "", nil)
+	var got struct {
+		Short string `json:"short"`
+	}
+	if err := json.Unmarshal([]byte(b), &got); resp.StatusCode != http.StatusOK || err != nil || !strings.HasPrefix(got.Short, "/s/") {
+		t.Fatalf("got %d %q", resp.StatusCode, b)
+	}
+	if resp, _ = testDo(t, "POST", ts.URL+"/api/short/missing.mp4", "alice", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL+got.Short, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	if resp, err = c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if l := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || l != "/watch/sub%20dir/clip.mp4" {
+		t.Fatalf("got status %d to %q", resp.StatusCode, l)
+	}
+	if status, _ := testGet(t, ts.URL+got.Short, ""); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d", status)
+	}
+	if status, _ := testGet(t, ts.URL+"/s/zzzzz", "alice"); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
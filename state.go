@@ -0,0 +1,62 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// writeFileAtomic writes the file so it is never seen partially written.
+func writeFileAtomic(p string, b []byte) error {
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// saveState writes the state that changed to -data.
+func (s *server) saveState() error {
+	err := errors.Join(s.coverage.save(), s.profiles.save(), s.tags.save(), s.notes.save(), s.clips.save(), s.views.save(), s.shares.save(), s.slugs.save(), s.jobs.save(), s.media.posters.save(), s.media.loudness.save())
+	if s.tmdb != nil {
+		err = errors.Join(err, s.tmdb.save())
+	}
+	return err
+}
+
+// runSaveState saves the state every minute until ctx is canceled.
+func (s *server) runSaveState(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+			if err := s.saveState(); err != nil {
+				slog.Error("state", "error", err)
+			}
+		}
+	}
+}
+
+// readJSON loads the state saved in p into v. It is a no-op when p is empty
+// or doesn't exist yet.
+func readJSON(p string, v any) error {
+	if p == "" {
+		return nil
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// statsBucket sums the files of an extension, a directory or a month.
+type statsBucket struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+	// Duration is in seconds, for the files probed so far.
+	Duration float64 `json:"duration"`
+}
+
+func (b *statsBucket) add(f file, d time.Duration) {
+	b.Files++
+	b.Size += f.Size
+	b.Duration += d.Seconds()
+}
+
+// libraryStats summarizes the library.
+type libraryStats struct {
+	statsBucket
+	// Probed is the number of media files whose duration is known out of
+	// Media. The others are probed in the background.
+	Probed  int           `json:"probed"`
+	Media   int           `json:"media"`
+	ByExt   []statsBucket `json:"by_ext"`
+	ByDir   []statsBucket `json:"by_dir"`
+	ByMonth []statsBucket `json:"by_month"`
+}
+
+// hasDuration returns true if the file is a playable media. HLS segments are
+// covered by their playlist.
+func hasDuration(name string) bool {
+	t := mimeType(name)
+	if strings.HasSuffix(name, ".m3u8") {
+		return true
+	}
+	return (strings.HasPrefix(t, "video/") || strings.HasPrefix(t, "audio/")) && t != "video/mp2t" && t != "video/iso.segment"
+}
+
+// stats sums the files the user of the request can see by extension,
+// top-level directory and month of modification. The months without a file
+// are included, so gaps show up.
+func (s *server) stats(req *http.Request) libraryStats {
+	files := s.visibleFiles(req)
+	var st libraryStats
+	st.Name = "total"
+	byExt := map[string]*statsBucket{}
+	byDir := map[string]*statsBucket{}
+	byMonth := map[string]*statsBucket{}
+	bucket := func(m map[string]*statsBucket, name string) *statsBucket {
+		b := m[name]
+		if b == nil {
+			b = &statsBucket{Name: name}
+			m[name] = b
+		}
+		return b
+	}
+	var first, last time.Time
+	for _, f := range files {
+		var d time.Duration
+		if hasDuration(f.Name) {
+			st.Media++
+			if p := s.media.cachedProbe(f); p != nil {
+				d = p.Duration()
+				st.Probed++
+			}
+		}
+		st.add(f, d)
+		bucket(byExt, strings.ToLower(path.Ext(f.Name))).add(f, d)
+		dir := "/"
+		if i := strings.IndexByte(f.Name, '/'); i != -1 {
+			dir = f.Name[:i]
+		}
+		bucket(byDir, dir).add(f, d)
+		t := f.ModTime.Local()
+		bucket(byMonth, t.Format("2006-01")).add(f, d)
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	if !first.IsZero() {
+		for m := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.Local); !m.After(last); m = m.AddDate(0, 1, 0) {
+			bucket(byMonth, m.Format("2006-01"))
+		}
+	}
+	sorted := func(m map[string]*statsBucket, cmpFn func(a, b statsBucket) int) []statsBucket {
+		out := make([]statsBucket, 0, len(m))
+		for _, b := range m {
+			out = append(out, *b)
+		}
+		slices.SortFunc(out, cmpFn)
+		return out
+	}
+	bySize := func(a, b statsBucket) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), strings.Compare(a.Name, b.Name))
+	}
+	st.ByExt = sorted(byExt, bySize)
+	st.ByDir = sorted(byDir, bySize)
+	st.ByMonth = sorted(byMonth, func(a, b statsBucket) int { return strings.Compare(a.Name, b.Name) })
+	if st.Probed != st.Media {
+		s.probeMissing(files)
+	}
+	return st
+}
+
+// probeMissing probes the durations not known yet in the background, one file
+// at a time.
+func (s *server) probeMissing(files []file) {
+	if s.media.ffprobe == "" {
+		return
+	}
+	s.media.mu.Lock()
+	running := s.media.probing
+	s.media.probing = true
+	s.media.mu.Unlock()
+	if running {
+		return
+	}
+	go func() {
+		defer func() {
+			s.media.mu.Lock()
+			s.media.probing = false
+			s.media.mu.Unlock()
+		}()
+		ctx := context.Background()
+		for _, f := range files {
+			if hasDuration(f.Name) && s.media.cachedProbe(f) == nil {
+				_, _ = s.media.probe(ctx, s.root, f)
+			}
+		}
+	}()
+}
+
+func (s *server) serveStats(w http.ResponseWriter, req *http.Request) {
+	s.serveHTML(w, statsHTML, map[string]any{"stats": s.stats(req)})
+}
+
+func (s *server) serveStatsAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.stats(req))
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	u, a := testUsers(t, []string{"alice", "bob"}, "private alice\n")
+	_, ts := newTestServer(t, map[string]string{
+		"clip.mp4":       testMP4,
+		"sub/clip.mp4":   testMP4,
+		"sub/clip.srt":   "1\n",
+		"private/x.mp4":  testMP4,
+		"vod/seg0.ts":    "ts",
+		"vod/index.m3u8": "#EXTM3U\n",
+	}, options{users: u, access: a})
+	testPage(t, ts.URL+"/stats", "bob", `{"name":".mp4","files":2,"size":48,`)
+	testPage(t, ts.URL+"/stats", "alice", `{"name":".mp4","files":3,"size":72,`)
+	testPage(t, ts.URL+"/stats", "bob", `"probed":0,"media":3,`)
+}
+
+func TestStatsMonths(t *testing.T) {
+	root := t.TempDir()
+	for name, mt := range map[string]time.Time{
+		"a.mp4": time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local),
+		"b.mp4": time.Date(2024, 3, 15, 0, 0, 0, 0, time.Local),
+	} {
+		p := filepath.Join(root, name)
+		if err := os.WriteFile(p, []byte("data"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv, err := newServer(t.Context(), root, defaultExts, options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.rootDir.Close() })
+	st := srv.stats(&http.Request{})
+	var got []string
+	for _, b := range st.ByMonth {
+		got = append(got, fmt.Sprintf("%s:%d", b.Name, b.Files))
+	}
+	if want := []string{"2024-01:1", "2024-02:0", "2024-03:1"}; !slices.Equal(got, want) || st.Size != 8 {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	// maxSyncKeys is the number of values synced per user.
+	maxSyncKeys = 100
+	// maxSyncValue is the size of a value synced.
+	maxSyncValue = 64 << 10
+)
+
+// reSyncKey matches the keys of the synced values.
+var reSyncKey = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func validSyncKey(k string) bool {
+	return reSyncKey.MatchString(k)
+}
+
+// syncEntry is a JSON value synced across the devices of a user, e.g. what
+// the pages would otherwise keep in localStorage.
+type syncEntry struct {
+	Value   json.RawMessage `json:"value"`
+	Updated time.Time       `json:"updated"`
+}
+
+// syncValues returns the values synced, for the pages.
+func (pr *profile) syncValues() map[string]json.RawMessage {
+	out := make(map[string]json.RawMessage, len(pr.State))
+	for k, e := range pr.State {
+		out[k] = e.Value
+	}
+	return out
+}
+
+// serveSyncList returns the values synced of the authenticated user, or only
+// the ones updated after ?since=<RFC 3339 time>, to poll for the changes made
+// on the other devices. The resume positions, watched markers and player
+// settings are in /api/profile.
+func (s *server) serveSyncList(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if v := req.FormValue("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "Invalid since", 400)
+			return
+		}
+	}
+	out := map[string]syncEntry{}
+	for k, e := range s.profiles.get(userFrom(req)).State {
+		if e.Updated.After(since) {
+			out[k] = e
+		}
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"values": out, "now": time.Now().UTC()})
+}
+
+// serveSync gets, sets with PUT or deletes a value synced of the
+// authenticated user. The value is any JSON up to maxSyncValue.
+func (s *server) serveSync(w http.ResponseWriter, req *http.Request) {
+	k := req.PathValue("key")
+	if !validSyncKey(k) {
+		http.Error(w, "Invalid key", 400)
+		return
+	}
+	user := userFrom(req)
+	switch req.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxSyncValue))
+		if err != nil {
+			http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !json.Valid(b) {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		e := syncEntry{Value: b, Updated: time.Now().UTC()}
+		full := false
+		s.profiles.update(user, func(pr *profile) {
+			if _, ok := pr.State[k]; !ok && len(pr.State) >= maxSyncKeys {
+				full = true
+				return
+			}
+			pr.State[k] = e
+		})
+		if full {
+			http.Error(w, "Too many keys", http.StatusInsufficientStorage)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(e)
+	case http.MethodDelete:
+		s.profiles.update(user, func(pr *profile) { delete(pr.State, k) })
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		e, ok := s.profiles.get(user).State[k]
+		if !ok {
+			http.Error(w, "Unknown key", 404)
+			return
+		}
+		h := w.Header()
+		h.Set("Cache-Control", "no-store")
+		h.Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(e)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestSync sets, lists and deletes a value synced across devices.
+func TestSync(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	u := ts.URL + "/api/sync/queue"
+	for _, c := range []struct {
+		method, u, body string
+		want            int
+	}{
+		{"PUT", u, `["clip.mp4",`, http.StatusBadRequest},
+		{"PUT", ts.URL + "/api/sync/a%20b", `1`, http.StatusBadRequest},
+		{"PUT", u, `["clip.mp4"]`, http.StatusOK},
+	} {
+		if resp, b := testDo(t, c.method, c.u, "", c.body, nil); resp.StatusCode != c.want {
+			t.Fatalf("%s %s: got status %d, want %d: %s", c.method, c.body, resp.StatusCode, c.want, b)
+		}
+	}
+	testPage(t, u, "", `{"value":["clip.mp4"],"updated":"`)
+	testPage(t, ts.URL+"/api/sync?since=2020-01-01T00:00:00Z", "", `"values":{"queue":{"value":["clip.mp4"],`)
+	testPage(t, ts.URL+watchURL("clip.mp4"), "", `"sync":{"queue":["clip.mp4"]}`)
+	if resp, b := testDo(t, "DELETE", u, "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", resp.StatusCode, b)
+	}
+	if status, _ := testGet(t, u, ""); status != http.StatusNotFound {
+		t.Fatalf("got status %d", status)
+	}
+}
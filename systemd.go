@@ -0,0 +1,97 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state to systemd, as sd_notify(3). It does nothing when not
+// started by systemd with Type=notify.
+func sdNotify(state string) error {
+	p := os.Getenv("NOTIFY_SOCKET")
+	if p == "" {
+		return nil
+	}
+	if p[0] == '@' {
+		// Abstract socket.
+		p = "\x00" + p[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: p, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval at which systemd expects WATCHDOG=1
+// with WatchdogSec, or 0.
+func watchdogInterval() time.Duration {
+	us, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || us <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// sdStatus returns the status shown by systemctl status.
+func (s *server) sdStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var size int64
+	for i := range s.files {
+		size += s.files[i].Size
+	}
+	return fmt.Sprintf("STATUS=Serving %d files, %.1f GB", len(s.files), float64(size)/1e9)
+}
+
+// runSystemd tells systemd the server is ready then sends the status and the
+// watchdog heartbeats until ctx is canceled.
+func (s *server) runSystemd(ctx context.Context) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if err := sdNotify("READY=1\n" + s.sdStatus()); err != nil {
+		slog.Error("systemd", "error", err)
+		return
+	}
+	wd := watchdogInterval()
+	// Send the heartbeats twice per interval as recommended, and update the
+	// status every minute otherwise.
+	every := time.Minute
+	if wd != 0 {
+		every = wd / 2
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = sdNotify("STOPPING=1")
+			return
+		case <-t.C:
+			// sdStatus takes the lock guarding the files, so a deadlock stops
+			// the heartbeats and systemd restarts the service.
+			state := s.sdStatus()
+			if wd != 0 {
+				state = "WATCHDOG=1\n" + state
+			}
+			if err := sdNotify(state); err != nil {
+				slog.Error("systemd", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// tags are the tags of the files, shared by all the users.
+//
+// They are saved to p when not empty.
+type tags struct {
+	p string
+
+	mu    sync.Mutex
+	files map[string][]string
+	dirty bool
+}
+
+// newTags loads the tags saved in p, if any.
+func newTags(p string) (*tags, error) {
+	t := &tags{p: p, files: map[string][]string{}}
+	if err := readJSON(p, &t.files); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validTag returns an error if the tag can't be used, e.g. in a comma
+// separated list.
+func validTag(tag string) error {
+	if tag == "" || len(tag) > 64 || strings.ContainsFunc(tag, func(r rune) bool { return r == ',' || unicode.IsControl(r) }) || strings.TrimSpace(tag) != tag {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
+
+// get returns the tags of the file name.
+func (t *tags) get(name string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.files[name]...)
+}
+
+// all returns a copy of the tags of all the files.
+func (t *tags) all() map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string][]string, len(t.files))
+	for n, v := range t.files {
+		out[n] = slices.Clone(v)
+	}
+	return out
+}
+
+// counts returns the number of files for each tag, only counting the files
+// for which visible returns true.
+func (t *tags) counts(visible func(name string) bool) map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := map[string]int{}
+	for n, v := range t.files {
+		if !visible(n) {
+			continue
+		}
+		for _, tag := range v {
+			out[tag]++
+		}
+	}
+	return out
+}
+
+// edit adds and removes tags to the files.
+func (t *tags) edit(files, add, remove []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range files {
+		v := t.files[f]
+		for _, tag := range add {
+			if !slices.Contains(v, tag) {
+				v = append(v, tag)
+			}
+		}
+		v = slices.DeleteFunc(v, func(tag string) bool { return slices.Contains(remove, tag) })
+		if len(v) == 0 {
+			delete(t.files, f)
+		} else {
+			slices.Sort(v)
+			t.files[f] = v
+		}
+	}
+	t.dirty = true
+}
+
+// save writes the tags to disk if they changed.
+func (t *tags) save() error {
+	t.mu.Lock()
+	if t.p == "" || !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(t.files)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.p, b)
+}
+
+// containsAll returns true if all the items of want are in v.
+func containsAll(v, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// serveTagsAPI returns the tags in use with their number of files the user can
+// see.
+func (s *server) serveTagsAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"tags": s.tags.counts(func(n string) bool { return s.canAccess(req, n) })})
+}
+
+// serveFileTagsAPI returns the tags of a file.
+func (s *server) serveFileTagsAPI(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"tags": s.tags.get(f)})
+}
+
+// serveTagsEdit adds and removes tags to a selection of files, sent as
+// {"files": [...], "add": [...], "remove": [...]}.
+func (s *server) serveTagsEdit(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Files  []string `json:"files"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	for _, tag := range append(body.Add, body.Remove...) {
+		if err := validTag(tag); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	for _, f := range body.Files {
+		if !s.inLibrary(f) || !s.canAccess(req, f) {
+			http.Error(w, fmt.Sprintf("unknown file %q", f), 404)
+			return
+		}
+	}
+	s.tags.edit(body.Files, body.Add, body.Remove)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4, "vod/index.m3u8": "#EXTM3U\n"}, options{})
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"files":["clip.mp4","vod/index.m3u8"],"add":["incident","keep"]}`, http.StatusNoContent},
+		{`{"files":["vod/index.m3u8"],"remove":["keep"]}`, http.StatusNoContent},
+		{`{"files":["clip.mp4"],"add":["a,b"]}`, http.StatusBadRequest},
+		{`{"files":["missing.mp4"],"add":["keep"]}`, http.StatusNotFound},
+	} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/tags", "", c.body, nil); resp.StatusCode != c.want {
+			t.Fatalf("%s: got status %d, want %d: %s", c.body, resp.StatusCode, c.want, b)
+		}
+	}
+	testPage(t, ts.URL+"/api/tags", "", `{"tags":{"incident":2,"keep":1}}`)
+	testPage(t, ts.URL+"/api/tags/vod/index.m3u8", "", `{"tags":["incident"]}`)
+	var data struct {
+		Files []fileInfo `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/files?tag=incident&tag=keep", "", "")), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Files) != 1 || data.Files[0].Name != "clip.mp4" {
+		t.Fatalf("unexpected files %+v", data.Files)
+	}
+}
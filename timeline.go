@@ -0,0 +1,138 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reTimestamp matches a date and time in a path, e.g.
+// "front/2024-10-15/140200.m3u8", "20241015_140200.mp4" or
+// "2024-10-15T14-02-00.mkv".
+var reTimestamp = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})[T_ /.-]?(\d{2})[-:.h]?(\d{2})[-:.m]?(\d{2})`)
+
+// recording is a file placed in time.
+type recording struct {
+	Name string `json:"name"`
+	// Start is when the recording started, as parsed from the file name. It is
+	// the modification time when the name has no timestamp.
+	Start int64 `json:"start"`
+	// End is the last modification time.
+	End int64 `json:"end"`
+
+	// dated is true if Start was parsed from the name.
+	dated bool
+}
+
+// parseTimestamp returns the date and time found in name, in local time.
+func parseTimestamp(name string) (time.Time, bool) {
+	m := reTimestamp.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("20060102150405", strings.Join(m[1:], ""), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// recordings returns the files the user of the request can see placed in
+// time, sorted by start time. HLS segments are skipped since they are covered
+// by their playlist, and photos since they are not footage.
+func (s *server) recordings(req *http.Request) []recording {
+	out := []recording{}
+	for _, f := range s.visibleFiles(req) {
+		if strings.HasSuffix(f.Name, ".ts") || isImage(f.Name) {
+			continue
+		}
+		end := f.ModTime
+		start, ok := parseTimestamp(f.Name)
+		if !ok || start.After(end) {
+			start = end
+		}
+		out = append(out, recording{Name: f.Name, Start: start.Unix(), End: end.Unix(), dated: ok})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+// recordingGroup returns the source of a recording, which is its top level
+// directory, e.g. the camera name.
+func recordingGroup(name string) string {
+	if i := strings.IndexByte(name, '/'); i != -1 {
+		return name[:i]
+	}
+	return "."
+}
+
+// gap is a period without any recording.
+type gap struct {
+	Group string `json:"group"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	// Open is true when the gap is ongoing; End is then the current time.
+	Open bool `json:"open"`
+}
+
+// findGaps returns the periods longer than threshold between consecutive
+// recordings of each group. Only the recordings with a timestamp in their name
+// are considered. recordings must be sorted by start time.
+//
+// A group that had a recording in the last day but none since threshold has
+// an open gap, e.g. when a camera stopped recording.
+func findGaps(recordings []recording, threshold time.Duration, now time.Time) []gap {
+	out := []gap{}
+	th := int64(threshold / time.Second)
+	ends := map[string]int64{}
+	var groups []string
+	for _, r := range recordings {
+		if !r.dated {
+			continue
+		}
+		g := recordingGroup(r.Name)
+		end, ok := ends[g]
+		if !ok {
+			groups = append(groups, g)
+		} else if r.Start-end > th {
+			out = append(out, gap{Group: g, Start: end, End: r.Start})
+		}
+		if r.End > end {
+			ends[g] = r.End
+		}
+	}
+	n := now.Unix()
+	for _, g := range groups {
+		if end := ends[g]; n-end > th && n-end < 86400 {
+			out = append(out, gap{Group: g, Start: end, End: n, Open: true})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out
+}
+
+func (s *server) serveTimelineAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"recordings": s.recordings(req)})
+}
+
+func (s *server) serveGapsAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"gaps": findGaps(s.recordings(req), s.opts.gapThreshold, time.Now())})
+}
+
+func (s *server) serveTimeline(w http.ResponseWriter, req *http.Request) {
+	recs := s.recordings(req)
+	s.serveHTML(w, timelineHTML, map[string]any{"recordings": recs, "gaps": findGaps(recs, s.opts.gapThreshold, time.Now())})
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 10, 15, 14, 2, 0, 0, time.Local)
+	for _, name := range []string{"front/2024-10-15/140200.m3u8", "20241015_140200.mp4", "2024-10-15T14-02-00.mkv"} {
+		if got, ok := parseTimestamp(name); !ok || !got.Equal(want) {
+			t.Errorf("%s: got %s, %t", name, got, ok)
+		}
+	}
+	if _, ok := parseTimestamp("clip.mp4"); ok {
+		t.Error("clip.mp4 has no timestamp")
+	}
+}
+
+// TestTimeline checks that the recordings are sorted by the time in their
+// name, skipping the segments and the photos.
+func TestTimeline(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{
+		"front/2024-10-15/140200.m3u8": "#EXTM3U\n",
+		"front/2024-10-15/seg0.ts":     "ts",
+		"back/20241015_130000.mp4":     testMP4,
+		"photos/snap.jpg":              "\xFF\xD8\xFF\xE0",
+	}, options{})
+	testPage(t, ts.URL+"/timeline", "", "const data = ")
+	var data struct {
+		Recordings []recording `json:"recordings"`
+	}
+	if err := json.Unmarshal([]byte(testPage(t, ts.URL+"/api/timeline", "", `"recordings":[`)), &data); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"back/20241015_130000.mp4", "front/2024-10-15/140200.m3u8"}
+	if len(data.Recordings) != len(want) {
+		t.Fatalf("got %+v", data.Recordings)
+	}
+	for i, r := range data.Recordings {
+		if r.Name != want[i] {
+			t.Fatalf("got %+v", data.Recordings)
+		}
+	}
+	if start := time.Unix(data.Recordings[0].Start, 0); !start.Equal(time.Date(2024, 10, 15, 13, 0, 0, 0, time.Local)) {
+		t.Fatalf("got start %s", start)
+	}
+}
+
+func TestFindGaps(t *testing.T) {
+	now := time.Unix(100_000, 0)
+	recs := []recording{
+		{Name: "front/a.mp4", Start: 1000, End: 1060, dated: true},
+		{Name: "back/a.mp4", Start: 1000, End: 1060, dated: true},
+		{Name: "front/b.mp4", Start: 1100, End: 1160, dated: true},
+		{Name: "undated.mp4", Start: 1200, End: 1200},
+		{Name: "front/c.mp4", Start: 2000, End: 99_000, dated: true},
+	}
+	got := findGaps(recs, 2*time.Minute, now)
+	// back's last recording is more than a day old, it is not an open gap.
+	want := []gap{
+		{Group: "front", Start: 1160, End: 2000},
+		{Group: "front", Start: 99_000, End: 100_000, Open: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestGapsAPI(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"front/20241015_140200.mp4": testMP4}, options{gapThreshold: 2 * time.Minute})
+	testPage(t, ts.URL+"/api/gaps", "", `{"gaps":[`)
+}
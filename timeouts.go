@@ -0,0 +1,151 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// streamPrefixes are the routes sending the media, whose responses last as
+// long as the video is watched.
+var streamPrefixes = []string{"/raw/", "/share/", "/export/", "/remux/", "/audio/", "/clips/"}
+
+// isStream returns true if the request is for a media stream.
+func isStream(req *http.Request) bool {
+	for _, p := range streamPrefixes {
+		if strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// reIdleRoute matches the WebSocket and server-sent events routes. They are
+// matched by path since the request headers are chosen by the client.
+var reIdleRoute = regexp.MustCompile(`^/(api/jobs/events|api/progress/.+|api/sessions/ws|party/[^/]+/ws)$`)
+
+// timeoutHandler sets the read and write deadlines of each request according
+// to its route: the pages and the API get -read-timeout and -write-timeout,
+// the media streams, the uploads and gRPC -stream-timeout and the WebSockets
+// and the server-sent events none, as they are idle most of the time. The
+// media streams and gRPC are also aborted when the client stops reading them
+// for -stall-timeout; see stallWriter.
+//
+// The deadlines are set on every request since with HTTP/1 they are on the
+// connection and would otherwise carry over to the next request.
+func (s *server) timeoutHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		rc := http.NewResponseController(w)
+		var read, write time.Time
+		switch {
+		case reIdleRoute.MatchString(req.URL.Path):
+		case isUpload(req):
+			// The response is only sent once the upload is received.
+			read = deadline(now, s.opts.streamTimeout)
+			write = read
+		case isGRPC(req) || isStream(req):
+			// No read deadline: with HTTP/1 it would cancel the context of the
+			// request once expired.
+			write = deadline(now, s.opts.streamTimeout)
+			if s.opts.stallTimeout != 0 {
+				w = &stallWriter{ResponseWriter: w, rc: rc, stall: s.opts.stallTimeout, end: write, m: s.metrics, req: req}
+			}
+		default:
+			read = deadline(now, s.opts.readTimeout)
+			write = deadline(now, s.opts.writeTimeout)
+		}
+		_ = rc.SetReadDeadline(read)
+		_ = rc.SetWriteDeadline(write)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// deadline returns now+d, or no deadline when d is 0.
+func deadline(now time.Time, d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return now.Add(d)
+}
+
+// stallChunk is the most sent to a stream at once, so the client has to read
+// this much within the stall timeout.
+const stallChunk = 1 << 20
+
+// stallWriter aborts a stream whose client hasn't read anything for stall,
+// e.g. a phone that went to sleep in the middle of a video, instead of
+// holding its file and its stream slot until the stream deadline. It moves
+// the write deadline forward before each chunk sent.
+type stallWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	stall time.Duration
+	// end is the stream deadline, zero for none.
+	end     time.Time
+	m       *metrics
+	req     *http.Request
+	stalled bool
+}
+
+func (sw *stallWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) != 0 {
+		c := min(len(b), stallChunk)
+		sw.extend()
+		w, err := sw.ResponseWriter.Write(b[:c])
+		n += w
+		if err != nil {
+			return n, sw.check(err)
+		}
+		b = b[c:]
+	}
+	return n, nil
+}
+
+// ReadFrom sends r in chunks, each one still using sendfile when possible.
+func (sw *stallWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	for {
+		sw.extend()
+		c, err := io.Copy(sw.ResponseWriter, io.LimitReader(r, stallChunk))
+		n += c
+		if err != nil {
+			return n, sw.check(err)
+		}
+		if c < stallChunk {
+			return n, nil
+		}
+	}
+}
+
+func (sw *stallWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *stallWriter) extend() {
+	d := time.Now().Add(sw.stall)
+	if !sw.end.IsZero() && sw.end.Before(d) {
+		d = sw.end
+	}
+	_ = sw.rc.SetWriteDeadline(d)
+}
+
+// check records the streams aborted because the client stalled.
+func (sw *stallWriter) check(err error) error {
+	if !sw.stalled && errors.Is(err, os.ErrDeadlineExceeded) && (sw.end.IsZero() || time.Now().Before(sw.end)) {
+		sw.stalled = true
+		sw.m.stall()
+		slog.Info("stream", "msg", "client stalled", "path", sw.req.URL.Path, "addr", clientAddr(sw.req))
+	}
+	return err
+}
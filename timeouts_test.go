@@ -0,0 +1,122 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTimeouts checks that the API responses are cut at -write-timeout while
+// the files use -stream-timeout.
+func TestTimeouts(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": "clip"}, options{writeTimeout: time.Nanosecond, streamTimeout: time.Minute})
+	req, err := http.NewRequestWithContext(t.Context(), "GET", ts.URL+"/api/files", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err2 := http.DefaultClient.Do(req); err2 == nil {
+		_ = resp.Body.Close()
+		t.Fatalf("the API response was sent past its deadline with status %d", resp.StatusCode)
+	}
+	if status, b := testGet(t, ts.URL+"/raw/clip.mp4", ""); status != http.StatusOK || b != "clip" {
+		t.Fatalf("got status %d: %q", status, b)
+	}
+}
+
+// TestStall checks that a stream is aborted when the client stops reading.
+func TestStall(t *testing.T) {
+	// Larger than what the socket buffers can hold.
+	const size = 64 << 20
+	srv, ts := newTestServer(t, nil, options{stallTimeout: 200 * time.Millisecond})
+	f, err := os.Create(filepath.Join(srv.rootDir.Name(), "big.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(size)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.requestRescan()
+	for start := time.Now(); !srv.hasFile("big.mp4"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the scan")
+		}
+	}
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = io.WriteString(c, "GET /raw/big.mp4 HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if n, _ := io.Copy(io.Discard, c); n >= size {
+		t.Fatalf("the stream wasn't aborted, got %d bytes", n)
+	}
+	srv.metrics.mu.Lock()
+	defer srv.metrics.mu.Unlock()
+	if srv.metrics.stalls != 1 {
+		t.Fatalf("got %d stalls", srv.metrics.stalls)
+	}
+}
+
+// TestTimeoutIdleRoutes checks that only the WebSocket and server-sent events
+// routes have no deadline, whatever the request headers.
+func TestTimeoutIdleRoutes(t *testing.T) {
+	s := &server{opts: options{readTimeout: time.Minute, writeTimeout: time.Minute}}
+	h := s.timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for p, idle := range map[string]bool{
+		"/api/jobs/events":       true,
+		"/api/progress/clip.mp4": true,
+		"/api/sessions/ws":       true,
+		"/party/p/ws":            true,
+		"/api/jobs":              false,
+		"/api/progress/":         false,
+		"/party/p":               false,
+		"/party/p/x/ws":          false,
+		"/api/v1/files":          false,
+	} {
+		if got := reIdleRoute.MatchString(p); got != idle {
+			t.Errorf("%s: got %t", p, got)
+		}
+	}
+	// The headers don't remove the deadlines of the other routes.
+	req := httptest.NewRequest("GET", "/api/v1/files", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Upgrade", "websocket")
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, req)
+	if w.read.IsZero() || w.write.IsZero() {
+		t.Fatalf("the deadlines were removed: %s %s", w.read, w.write)
+	}
+}
+
+// deadlineRecorder records the deadlines set by the handler.
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	read, write time.Time
+}
+
+func (d *deadlineRecorder) SetReadDeadline(t time.Time) error {
+	d.read = t
+	return nil
+}
+
+func (d *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	d.write = t
+	return nil
+}
@@ -0,0 +1,358 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmdbResult is a movie, show or episode found on TheMovieDB.
+type tmdbResult struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+	Plot  string `json:"plot,omitempty"`
+	// Poster is the file name of the poster, or of the still of an episode, in
+	// the cache directory.
+	Poster string `json:"poster,omitempty"`
+}
+
+// tmdb matches the videos against TheMovieDB and caches the results in dir,
+// so each title is looked up once.
+type tmdb struct {
+	key string
+	dir string
+	// api and images are TheMovieDB's endpoints.
+	api    string
+	images string
+
+	mu sync.Mutex
+	// results are by lookup key; nil when not found.
+	results map[string]*tmdbResult
+	dirty   bool
+}
+
+func newTMDB(key, dir string) (*tmdb, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	t := &tmdb{
+		key:     key,
+		dir:     dir,
+		api:     "https://api.themoviedb.org/3",
+		images:  "https://image.tmdb.org/t/p/w342",
+		results: map[string]*tmdbResult{},
+	}
+	if err := readJSON(filepath.Join(dir, "tmdb.json"), &t.results); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Lookup keys.
+func tmdbMovieKey(v videoName) string {
+	return fmt.Sprintf("movie/%s/%d", strings.ToLower(v.Title), v.Year)
+}
+func tmdbShowKey(v videoName) string { return "tv/" + strings.ToLower(v.Title) }
+func tmdbEpisodeKey(id int, v videoName) string {
+	return fmt.Sprintf("tv/%d/%d/%d", id, v.Season, v.Episode)
+}
+
+var errTMDBNotFound = errors.New("not found on TheMovieDB")
+
+var reDigits = regexp.MustCompile(`^[\d ]+$`)
+
+// scrapable returns true if the name looks like a movie or an episode. Names
+// without a year or an episode number, like the ones of cameras, are skipped.
+func scrapable(v videoName) bool {
+	return v.Title != "" && !reDigits.MatchString(v.Title) && (v.Year != 0 || v.Episode != 0)
+}
+
+// lookup returns the cached result for a key and whether it was looked up.
+func (t *tmdb) lookup(key string) (*tmdbResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.results[key]
+	return r, ok
+}
+
+// info returns the metadata of a video, if found.
+func (t *tmdb) info(v videoName) *sidecar {
+	if !scrapable(v) {
+		return nil
+	}
+	if v.Episode == 0 {
+		m, _ := t.lookup(tmdbMovieKey(v))
+		if m == nil {
+			return nil
+		}
+		return &sidecar{Title: m.Title, Year: m.Year, Plot: m.Plot, Poster: m.Poster != ""}
+	}
+	show, _ := t.lookup(tmdbShowKey(v))
+	if show == nil {
+		return nil
+	}
+	sc := &sidecar{Show: show.Title, Season: v.Season, Episode: v.Episode, Year: show.Year, Plot: show.Plot, Poster: show.Poster != ""}
+	if ep, _ := t.lookup(tmdbEpisodeKey(show.ID, v)); ep != nil {
+		sc.Title = ep.Title
+		if ep.Plot != "" {
+			sc.Plot = ep.Plot
+		}
+	}
+	return sc
+}
+
+// poster returns the path of the cached poster of a video, if any.
+func (t *tmdb) poster(v videoName) string {
+	if !scrapable(v) {
+		return ""
+	}
+	key := tmdbShowKey(v)
+	if v.Episode == 0 {
+		key = tmdbMovieKey(v)
+	}
+	if r, _ := t.lookup(key); r != nil && r.Poster != "" {
+		return filepath.Join(t.dir, r.Poster)
+	}
+	return ""
+}
+
+// get calls the API at p with the query parameters and decodes the response.
+func (t *tmdb) get(ctx context.Context, p string, q url.Values, out any) error {
+	if q == nil {
+		q = url.Values{}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", t.api+p, nil)
+	if err != nil {
+		return err
+	}
+	// A v4 read access token is a JWT, a v3 API key is a hex string.
+	if strings.Contains(t.key, ".") {
+		req.Header.Set("Authorization", "Bearer "+t.key)
+	} else {
+		q.Set("api_key", t.key)
+	}
+	req.URL.RawQuery = q.Encode()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errTMDBNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: got status %d", p, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fetchPoster downloads the image at p, e.g. "/abc.jpg", in the cache
+// directory and returns its file name.
+func (t *tmdb) fetchPoster(ctx context.Context, p string) string {
+	if p == "" {
+		return ""
+	}
+	name := path.Base(p)
+	dst := filepath.Join(t.dir, name)
+	if _, err := os.Stat(dst); err == nil {
+		return name
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", t.images+p, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("tmdb", "poster", p, "error", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		slog.Warn("tmdb", "poster", p, "status", resp.StatusCode, "error", err)
+		return ""
+	}
+	if err = writeFileAtomic(dst, b); err != nil {
+		slog.Warn("tmdb", "poster", p, "error", err)
+		return ""
+	}
+	return name
+}
+
+// yearOf returns the year of a "2006-01-02" date.
+func yearOf(date string) int {
+	y, _ := strconv.Atoi(strings.SplitN(date, "-", 2)[0])
+	return y
+}
+
+// fetchMovie searches the movie and keeps the best match.
+func (t *tmdb) fetchMovie(ctx context.Context, v videoName) (*tmdbResult, error) {
+	q := url.Values{"query": {v.Title}, "year": {strconv.Itoa(v.Year)}}
+	var data struct {
+		Results []struct {
+			ID          int    `json:"id"`
+			Title       string `json:"title"`
+			ReleaseDate string `json:"release_date"`
+			Overview    string `json:"overview"`
+			PosterPath  string `json:"poster_path"`
+		} `json:"results"`
+	}
+	if err := t.get(ctx, "/search/movie", q, &data); err != nil || len(data.Results) == 0 {
+		return nil, err
+	}
+	m := data.Results[0]
+	return &tmdbResult{ID: m.ID, Title: m.Title, Year: yearOf(m.ReleaseDate), Plot: m.Overview, Poster: t.fetchPoster(ctx, m.PosterPath)}, nil
+}
+
+// fetchShow searches the show and keeps the best match.
+func (t *tmdb) fetchShow(ctx context.Context, v videoName) (*tmdbResult, error) {
+	q := url.Values{"query": {v.Title}}
+	if v.Year != 0 {
+		q.Set("first_air_date_year", strconv.Itoa(v.Year))
+	}
+	var data struct {
+		Results []struct {
+			ID           int    `json:"id"`
+			Name         string `json:"name"`
+			FirstAirDate string `json:"first_air_date"`
+			Overview     string `json:"overview"`
+			PosterPath   string `json:"poster_path"`
+		} `json:"results"`
+	}
+	if err := t.get(ctx, "/search/tv", q, &data); err != nil || len(data.Results) == 0 {
+		return nil, err
+	}
+	s := data.Results[0]
+	return &tmdbResult{ID: s.ID, Title: s.Name, Year: yearOf(s.FirstAirDate), Plot: s.Overview, Poster: t.fetchPoster(ctx, s.PosterPath)}, nil
+}
+
+// fetchEpisode fetches the episode of a show.
+func (t *tmdb) fetchEpisode(ctx context.Context, id int, v videoName) (*tmdbResult, error) {
+	var e struct {
+		ID        int    `json:"id"`
+		Name      string `json:"name"`
+		AirDate   string `json:"air_date"`
+		Overview  string `json:"overview"`
+		StillPath string `json:"still_path"`
+	}
+	if err := t.get(ctx, fmt.Sprintf("/tv/%d/season/%d/episode/%d", id, v.Season, v.Episode), nil, &e); err != nil {
+		if errors.Is(err, errTMDBNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &tmdbResult{ID: e.ID, Title: e.Name, Year: yearOf(e.AirDate), Plot: e.Overview, Poster: t.fetchPoster(ctx, e.StillPath)}, nil
+}
+
+// fetch looks up the key if it wasn't yet. It returns true if a request was
+// made.
+func (t *tmdb) fetch(ctx context.Context, key string, f func() (*tmdbResult, error)) (*tmdbResult, bool) {
+	if r, ok := t.lookup(key); ok {
+		return r, false
+	}
+	r, err := f()
+	if err != nil {
+		// Try again on the next scrape.
+		slog.Warn("tmdb", "key", key, "error", err)
+		return nil, true
+	}
+	slog.Info("tmdb", "key", key, "found", r != nil)
+	t.mu.Lock()
+	t.results[key] = r
+	t.dirty = true
+	t.mu.Unlock()
+	return r, true
+}
+
+// scrape looks up the videos not looked up yet. It returns true if new
+// results were found.
+func (t *tmdb) scrape(ctx context.Context, names []string) bool {
+	found := false
+	wait := func(requested bool) {
+		if requested {
+			// Stay well below the rate limit.
+			select {
+			case <-ctx.Done():
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+	}
+	for _, n := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		v := parseVideoName(n)
+		if !scrapable(v) {
+			continue
+		}
+		if v.Episode == 0 {
+			r, req := t.fetch(ctx, tmdbMovieKey(v), func() (*tmdbResult, error) { return t.fetchMovie(ctx, v) })
+			found = found || (req && r != nil)
+			wait(req)
+			continue
+		}
+		show, req := t.fetch(ctx, tmdbShowKey(v), func() (*tmdbResult, error) { return t.fetchShow(ctx, v) })
+		found = found || (req && show != nil)
+		wait(req)
+		if show != nil {
+			ep, req := t.fetch(ctx, tmdbEpisodeKey(show.ID, v), func() (*tmdbResult, error) { return t.fetchEpisode(ctx, show.ID, v) })
+			found = found || (req && ep != nil)
+			wait(req)
+		}
+	}
+	return found
+}
+
+// save writes the results to disk if they changed.
+func (t *tmdb) save() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(t.results)
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(t.dir, "tmdb.json"), b)
+}
+
+// runTMDB scrapes the new videos every 5 minutes until ctx is canceled.
+func (s *server) runTMDB(ctx context.Context) {
+	for {
+		var names []string
+		for _, f := range s.getFiles() {
+			if isVideo(f.Name) {
+				names = append(names, f.Name)
+			}
+		}
+		if s.tmdb.scrape(ctx, names) {
+			s.media.resetMetadata()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestTMDB scrapes from a fake TheMovieDB.
+func TestTMDB(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	m := http.NewServeMux()
+	m.HandleFunc("GET /search/movie", func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("query") != "Heat" || req.FormValue("year") != "1995" || req.FormValue("api_key") != "key" {
+			http.Error(w, "bad query", 400)
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"id":949,"title":"Heat","release_date":"1995-12-15","overview":"A heist.","poster_path":"/heat.jpg"}]}`))
+	})
+	m.HandleFunc("GET /search/tv", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"results":[{"id":2316,"name":"The Office","first_air_date":"2005-03-24","overview":"Paper."}]}`))
+	})
+	m.HandleFunc("GET /tv/2316/season/2/episode/1", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"id":1,"name":"The Dundies","air_date":"2005-09-20","overview":"Awards."}`))
+	})
+	m.HandleFunc("GET /img/heat.jpg", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("poster"))
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+	tm, err := newTMDB("key", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.api = s.URL
+	tm.images = tm.api + "/img"
+	if !tm.scrape(ctx, []string{"Heat.1995.1080p.mkv", "The.Office.S02E01.mkv", "cam1/140200.mp4"}) {
+		t.Fatal("nothing found")
+	}
+	if got := tm.info(parseVideoName("Heat.1995.1080p.mkv")); got == nil || *got != (sidecar{Title: "Heat", Year: 1995, Plot: "A heist.", Poster: true}) {
+		t.Fatalf("unexpected movie %+v", got)
+	}
+	want := sidecar{Title: "The Dundies", Year: 2005, Plot: "Awards.", Show: "The Office", Season: 2, Episode: 1}
+	if got := tm.info(parseVideoName("The.Office.S02E01.mkv")); got == nil || *got != want {
+		t.Fatalf("unexpected episode %+v", got)
+	}
+	if b, err := os.ReadFile(tm.poster(parseVideoName("Heat.1995.1080p.mkv"))); err != nil || string(b) != "poster" {
+		t.Fatalf("unexpected poster %q: %v", b, err)
+	}
+}
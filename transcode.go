@@ -0,0 +1,195 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// transcodeProfile are the ffmpeg settings of a transcode. The streams
+// already in the codec of the encoder and within the limits are copied.
+type transcodeProfile struct {
+	Name string `json:"name"`
+	// Video is the ffmpeg video encoder, e.g. "libx264", "libx265" or
+	// "h264_nvenc". Preset, CRF and Bitrate, e.g. "2M", are its settings;
+	// the ones empty are not passed.
+	Video   string `json:"video"`
+	Preset  string `json:"preset,omitempty"`
+	CRF     int    `json:"crf,omitempty"`
+	Bitrate string `json:"bitrate,omitempty"`
+	// Height scales down the taller videos.
+	Height int `json:"height,omitempty"`
+	// Audio is the ffmpeg audio encoder, e.g. "aac" or "libopus", with its
+	// settings.
+	Audio        string `json:"audio"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	Channels     int    `json:"channels,omitempty"`
+	// HWAccel overrides -ffmpeg-hwaccel.
+	HWAccel string `json:"hwaccel,omitempty"`
+	// ToneMap is the algorithm converting the HDR videos to SDR, one of
+	// toneMapAlgorithms, or "off" to keep them HDR.
+	ToneMap string `json:"tonemap"`
+	// Loudnorm is the EBU R128 integrated loudness the audio is normalized to,
+	// in LUFS, e.g. -23 for broadcast or -16 for the streaming services; 0
+	// keeps the loudness as is.
+	Loudnorm float64 `json:"loudnorm,omitempty"`
+}
+
+// defaultProfile writes H.264 and AAC, which all browsers play. The profiles
+// defined with -transcode-profile start from it.
+var defaultProfile = transcodeProfile{Name: "default", Video: "libx264", Preset: "medium", CRF: 23, Audio: "aac", AudioBitrate: "160k", ToneMap: "hable"}
+
+// toneMapAlgorithms are the algorithms of ffmpeg's tonemap filter.
+var toneMapAlgorithms = []string{"clip", "linear", "gamma", "reinhard", "hable", "mobius"}
+
+// toneMapFilter returns the ffmpeg filters converting a PQ or HLG video to
+// SDR BT.709 with the algorithm, so it doesn't look washed out on the SDR
+// screens. It requires an ffmpeg built with zimg.
+func toneMapFilter(algorithm string) string {
+	return "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=" + algorithm +
+		":desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+}
+
+// toneMapArgs tag the output of toneMapFilter as BT.709.
+var toneMapArgs = []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709"}
+
+// reProfileName matches the profile names, used in the names of the files
+// written.
+var reProfileName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// transcodeProfiles are the profiles defined with -transcode-profile.
+type transcodeProfiles []transcodeProfile
+
+func (t *transcodeProfiles) String() string {
+	var out []string
+	for _, p := range *t {
+		out = append(out, p.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+// Set parses "<name>=<key>=<value>,...". The keys are video, preset, crf,
+// bitrate, height, audio, audio_bitrate, channels, hwaccel, tonemap and
+// loudnorm.
+func (t *transcodeProfiles) Set(v string) error {
+	name, settings, ok := strings.Cut(v, "=")
+	if !ok || !reProfileName.MatchString(name) {
+		return fmt.Errorf("-transcode-profile %q must be in the form <name>=<key>=<value>,... where the name is lowercase letters, digits and dashes", v)
+	}
+	p := defaultProfile
+	p.Name = name
+	for kv := range strings.SplitSeq(settings, ",") {
+		if kv == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(kv, "=")
+		if !ok || val == "" {
+			return fmt.Errorf("-transcode-profile %q: invalid setting %q", v, kv)
+		}
+		var err error
+		switch k {
+		case "video":
+			p.Video = val
+		case "preset":
+			p.Preset = val
+		case "crf":
+			p.CRF, err = strconv.Atoi(val)
+		case "bitrate":
+			p.Bitrate = val
+			// A bitrate replaces the constant quality of the default.
+			p.CRF = 0
+		case "height":
+			p.Height, err = strconv.Atoi(val)
+		case "audio":
+			p.Audio = val
+		case "audio_bitrate":
+			p.AudioBitrate = val
+		case "channels":
+			p.Channels, err = strconv.Atoi(val)
+		case "hwaccel":
+			p.HWAccel = val
+		case "tonemap":
+			if val != "off" && !slices.Contains(toneMapAlgorithms, val) {
+				return fmt.Errorf("-transcode-profile %q: tonemap must be off or one of %s", v, strings.Join(toneMapAlgorithms, ", "))
+			}
+			p.ToneMap = val
+		case "loudnorm":
+			if p.Loudnorm, err = strconv.ParseFloat(val, 64); err == nil && (p.Loudnorm < -70 || p.Loudnorm > -5) {
+				return fmt.Errorf("-transcode-profile %q: loudnorm must be between -70 and -5 LUFS", v)
+			}
+		default:
+			return fmt.Errorf("-transcode-profile %q: unknown setting %q", v, k)
+		}
+		if err != nil || p.CRF < 0 || p.Height < 0 || p.Channels < 0 {
+			return fmt.Errorf("-transcode-profile %q: invalid %s", v, k)
+		}
+	}
+	for i := range *t {
+		if (*t)[i].Name == name {
+			(*t)[i] = p
+			return nil
+		}
+	}
+	*t = append(*t, p)
+	return nil
+}
+
+// lookup returns the profile name, "" being the default.
+func (t transcodeProfiles) lookup(name string) (transcodeProfile, bool) {
+	if name == "" {
+		name = defaultProfile.Name
+	}
+	for _, p := range t {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return defaultProfile, name == defaultProfile.Name
+}
+
+// list returns the profiles, the default first.
+func (t transcodeProfiles) list() []transcodeProfile {
+	out := []transcodeProfile{defaultProfile}
+	for _, p := range t {
+		if p.Name == defaultProfile.Name {
+			out[0] = p
+		} else {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// codecOf returns the codec written by the ffmpeg encoder, as named by
+// ffprobe.
+func codecOf(encoder string) string {
+	switch {
+	case encoder == "libx264" || strings.HasPrefix(encoder, "h264_"):
+		return "h264"
+	case encoder == "libx265" || strings.HasPrefix(encoder, "hevc_"):
+		return "hevc"
+	case encoder == "libvpx-vp9" || strings.HasPrefix(encoder, "vp9_"):
+		return "vp9"
+	case encoder == "libsvtav1" || encoder == "libaom-av1" || strings.HasPrefix(encoder, "av1_"):
+		return "av1"
+	case encoder == "libopus":
+		return "opus"
+	case encoder == "libmp3lame":
+		return "mp3"
+	}
+	return encoder
+}
+
+// serveTranscodeProfiles lists the transcode profiles.
+func (s *server) serveTranscodeProfiles(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"profiles": s.media.profiles.list()})
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestTranscodeProfiles parses the transcode profiles.
+func TestTranscodeProfiles(t *testing.T) {
+	var tp transcodeProfiles
+	if err := tp.Set("small=video=libx265,bitrate=1M,height=720,audio=libopus,channels=2,tonemap=off"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"Small=crf=20", "small", "small=crf=x", "small=size=1", "small=tonemap=fast"} {
+		if err := tp.Set(v); err == nil {
+			t.Fatalf("%q should be rejected", v)
+		}
+	}
+	p, ok := tp.lookup("small")
+	want := transcodeProfile{Name: "small", Video: "libx265", Preset: "medium", Bitrate: "1M", Height: 720, Audio: "libopus", AudioBitrate: "160k", Channels: 2, ToneMap: "off"}
+	if !ok || p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if p, ok = tp.lookup(""); !ok || p != defaultProfile {
+		t.Fatalf("got %+v, want the default", p)
+	}
+	if _, ok = tp.lookup("missing"); ok {
+		t.Fatal("missing should not be found")
+	}
+	if c := codecOf(p.Video) + " " + codecOf("libx265") + " " + codecOf("aac"); c != "h264 hevc aac" {
+		t.Fatalf("got codecs %q", c)
+	}
+}
+
+func TestTranscodeProfilesAPI(t *testing.T) {
+	var tp transcodeProfiles
+	if err := tp.Set("small=height=720"); err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{profiles: tp})
+	testPage(t, ts.URL+"/api/transcode/profiles", "", `{"profiles":[{"name":"default","video":"libx264","preset":"medium","crf":23,`)
+	testPage(t, ts.URL+"/api/transcode/profiles", "", `{"name":"small","video":"libx264","preset":"medium","crf":23,"height":720,`)
+	for _, body := range []string{
+		`{"kind":"transcode","files":["clip.mp4"],"profile":"missing"}`,
+		// Only the transcodes use a profile.
+		`{"kind":"hash","files":["clip.mp4"],"profile":"small"}`,
+	} {
+		if resp, b := testDo(t, "POST", ts.URL+"/api/jobs", "", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d: %s", body, resp.StatusCode, b)
+		}
+	}
+}
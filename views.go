@@ -0,0 +1,93 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+)
+
+// viewCount is how many times a file was watched to the end or downloaded
+// whole.
+type viewCount struct {
+	Plays     int `json:"plays,omitempty"`
+	Downloads int `json:"downloads,omitempty"`
+}
+
+// views counts the plays and downloads of the files, for all the users.
+//
+// They are saved to p when not empty.
+type views struct {
+	p string
+
+	mu    sync.Mutex
+	files map[string]viewCount
+	dirty bool
+}
+
+// newViews loads the counters saved in p, if any.
+func newViews(p string) (*views, error) {
+	v := &views{p: p, files: map[string]viewCount{}}
+	if err := readJSON(p, &v.files); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// all returns a copy of the counters of all the files.
+func (v *views) all() map[string]viewCount {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return maps.Clone(v.files)
+}
+
+// add increments the counters of the file name.
+func (v *views) add(name string, plays, downloads int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := v.files[name]
+	c.Plays += plays
+	c.Downloads += downloads
+	v.files[name] = c
+	v.dirty = true
+}
+
+// save writes the counters to disk if they changed.
+func (v *views) save() error {
+	v.mu.Lock()
+	if v.p == "" || !v.dirty {
+		v.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(v.files)
+	v.dirty = false
+	v.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(v.p, b)
+}
+
+// serveViewsAPI returns the counters of the files the user can see.
+func (s *server) serveViewsAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"views": visibleKeys(s.opts.access, userFrom(req), s.views.all())})
+}
+
+// servePlayed counts a play of a file to its end, reported by the player.
+func (s *server) servePlayed(w http.ResponseWriter, req *http.Request) {
+	f := req.PathValue("path")
+	if !s.inLibrary(f) || !s.canAccess(req, f) {
+		http.Error(w, "Invalid path", 404)
+		return
+	}
+	s.views.add(f, 1, 0)
+	s.analytics.record(req, "play", f, 0, 0, 0)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,25 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestViews(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"clip.mp4": testMP4}, options{})
+	testPost(t, ts.URL+"/api/views/clip.mp4", "", http.StatusNoContent)
+	testPost(t, ts.URL+"/api/views/missing.mp4", "", http.StatusNotFound)
+	// A whole download is counted, a range isn't.
+	if status, _ := testGet(t, ts.URL+rawURL("clip.mp4"), ""); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if resp, _ := testDo(t, "GET", ts.URL+rawURL("clip.mp4"), "", "", http.Header{"Range": {"bytes=0-3"}}); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	testPage(t, ts.URL+"/api/views", "", `"clip.mp4":{"plays":1,"downloads":1}`)
+	testPage(t, ts.URL+"/api/files", "", `"plays":1,"downloads":1`)
+}